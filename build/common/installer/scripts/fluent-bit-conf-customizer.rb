@@ -138,6 +138,7 @@ def substituteFluentBitPlaceHolders
     storageMaxChunksUp = ENV["FBIT_STORAGE_MAX_CHUNKS_UP"]
     storageType = ENV["FBIT_STORAGE_TYPE"]
     enableFbitThreading = ENV["ENABLE_FBIT_THREADING"]
+    hostLogsSyslogEnabled = ENV["AZMON_HOST_LOGS_SYSLOG_ENABLED"]
 
 
     serviceInterval = @default_service_interval
@@ -193,6 +194,10 @@ def substituteFluentBitPlaceHolders
       new_contents = new_contents.gsub("#${AnnotationBasedLogFilteringEnabled}", "")
     end
 
+    if !hostLogsSyslogEnabled.nil? && hostLogsSyslogEnabled.to_s.downcase == "true"
+      new_contents = new_contents.gsub("#${HostLogsSyslogEnabled}", "")
+    end
+
     new_contents = substituteMultiline(multilineLogging, stacktraceLanguages, new_contents)
 
     # Valid resource optimization scenarios
@@ -21,6 +21,7 @@ require_relative "ConfigParseErrorLogger"
 @logExclusionRegexPattern = "(^((?!stdout|stderr).)*$)"
 @excludePath = "*.csv2" #some invalid path
 @enrichContainerLogs = false
+@verboseCollectionOverrideEnabled = false
 @containerLogSchemaVersion = ""
 @collectAllKubeEvents = false
 @containerLogsRoute = "v2" # default for linux
@@ -28,7 +29,13 @@ require_relative "ConfigParseErrorLogger"
 @stacktraceLanguages = "go,java,python" #supported languages for multiline logs. java is also used for dotnet stacktraces
 @logEnableKubernetesMetadata = false
 @logKubernetesMetadataIncludeFields = "podlabels,podannotations,poduid,image,imageid,imagerepo,imagetag"
+@logKubernetesMetadataOptionalFields = "namespacelabels,namespaceannotations,nodename,nodelabels,ownerreferences"
+@logKubernetesMetadataLabelKeys = ""
+@logKubernetesMetadataAnnotationKeys = ""
+@logKubernetesMetadataNodeLabelKeys = ""
 @annotationBasedLogFiltering = false
+@traceContextExtractionEnabled = false
+@hostLogsSyslogEnabled = false
 @allowed_system_namespaces = ['kube-system', 'gatekeeper-system', 'calico-system', 'azure-arc', 'kube-public', 'kube-node-lease']
 @isAzMonMultiTenancyLogCollectionEnabled = false
 @isAzMonMultiTenancyLogCollectionAdvancedMode = false
@@ -352,6 +359,21 @@ def populateSettingValuesFromConfigMap(parsedConfig)
       ConfigParseErrorLogger.logError("Exception while reading config map settings for cluster level container log enrichment - #{errorStr}, using defaults, please check config map for errors")
     end
 
+    #Get verbose collection override setting
+    begin
+      if !parsedConfig[:log_collection_settings][:verbose_collection_override].nil? && !parsedConfig[:log_collection_settings][:verbose_collection_override][:enabled].nil?
+        @verboseCollectionOverrideEnabled = parsedConfig[:log_collection_settings][:verbose_collection_override][:enabled]
+        puts "config::Using config map setting for verbose collection override"
+        if @verboseCollectionOverrideEnabled
+          # excluded namespaces need to be tailed so that annotated pods can be collected, the output plugin drops the rest
+          @excludePath = "*.csv2" #some invalid path
+          puts "config::verbose collection override enabled, excluded namespaces are filtered by the output plugin instead of tail"
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("Exception while reading config map settings for verbose collection override - #{errorStr}, using defaults, please check config map for errors")
+    end
+
     #Get container log schema version setting
     begin
       if !parsedConfig[:log_collection_settings][:schema].nil? && !parsedConfig[:log_collection_settings][:schema][:containerlog_schema_version].nil?
@@ -436,7 +458,7 @@ def populateSettingValuesFromConfigMap(parsedConfig)
             @logEnableKubernetesMetadata = false
           elsif include_fields.kind_of?(Array)
             include_fields.map!(&:downcase)
-            predefined_fields = @logKubernetesMetadataIncludeFields.downcase.split(',')
+            predefined_fields = @logKubernetesMetadataIncludeFields.downcase.split(',') + @logKubernetesMetadataOptionalFields.split(',')
             any_field_match = include_fields.any? { |field| predefined_fields.include?(field) }
             if any_field_match
               @logKubernetesMetadataIncludeFields = include_fields.join(",")
@@ -451,6 +473,47 @@ def populateSettingValuesFromConfigMap(parsedConfig)
       ConfigParseErrorLogger.logError("config::error: Exception while reading config map settings for kubernetes metadata - #{errorStr}, please check config map for errors")
     end
 
+    #Get Kubernetes Metadata label and annotation key allowlists
+    begin
+      metadataCollection = parsedConfig[:log_collection_settings][:metadata_collection]
+      if !metadataCollection.nil?
+        if metadataCollection[:label_keys].kind_of?(Array)
+          @logKubernetesMetadataLabelKeys = metadataCollection[:label_keys].map(&:strip).join(",")
+          puts "config::INFO: Using config map setting for kubernetes metadata label keys: #{@logKubernetesMetadataLabelKeys}"
+        end
+        if metadataCollection[:annotation_keys].kind_of?(Array)
+          @logKubernetesMetadataAnnotationKeys = metadataCollection[:annotation_keys].map(&:strip).join(",")
+          puts "config::INFO: Using config map setting for kubernetes metadata annotation keys: #{@logKubernetesMetadataAnnotationKeys}"
+        end
+        if metadataCollection[:node_label_keys].kind_of?(Array)
+          @logKubernetesMetadataNodeLabelKeys = metadataCollection[:node_label_keys].map(&:strip).join(",")
+          puts "config::INFO: Using config map setting for kubernetes metadata node label keys: #{@logKubernetesMetadataNodeLabelKeys}"
+        end
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("config::error: Exception while reading config map settings for kubernetes metadata key allowlists - #{errorStr}, please check config map for errors")
+    end
+
+    #Get trace context extraction setting
+    begin
+      if !parsedConfig[:log_collection_settings][:trace_context].nil? && !parsedConfig[:log_collection_settings][:trace_context][:enabled].nil?
+        puts "config::INFO: Using config map setting for trace context extraction"
+        @traceContextExtractionEnabled = parsedConfig[:log_collection_settings][:trace_context][:enabled]
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("config::error: Exception while reading config map settings for trace context extraction - #{errorStr}, please check config map for errors")
+    end
+
+    #Get host log collection setting
+    begin
+      if !parsedConfig[:log_collection_settings][:host_logs].nil? && !parsedConfig[:log_collection_settings][:host_logs][:syslog_enabled].nil?
+        puts "config::INFO: Using config map setting for host syslog collection"
+        @hostLogsSyslogEnabled = parsedConfig[:log_collection_settings][:host_logs][:syslog_enabled]
+      end
+    rescue => errorStr
+      ConfigParseErrorLogger.logError("config::error: Exception while reading config map settings for host log collection - #{errorStr}, please check config map for errors")
+    end
+
     #Get annotation based log filtering setting
     begin
       if !parsedConfig[:log_collection_settings][:filter_using_annotations].nil? && !parsedConfig[:log_collection_settings][:filter_using_annotations][:enabled].nil?
@@ -600,6 +663,7 @@ if !file.nil?
   file.write("export AZMON_CLUSTER_COLLECT_ENV_VAR=#{@collectClusterEnvVariables}\n")
   file.write("export AZMON_CLUSTER_LOG_TAIL_EXCLUDE_PATH=#{@excludePath}\n")
   file.write("export AZMON_CLUSTER_CONTAINER_LOG_ENRICH=#{@enrichContainerLogs}\n")
+  file.write("export AZMON_VERBOSE_COLLECTION_OVERRIDE_ENABLED=#{@verboseCollectionOverrideEnabled}\n")
   file.write("export AZMON_CLUSTER_COLLECT_ALL_KUBE_EVENTS=#{@collectAllKubeEvents}\n")
   file.write("export AZMON_CONTAINER_LOGS_ROUTE=#{@containerLogsRoute}\n")
   file.write("export AZMON_CONTAINER_LOG_SCHEMA_VERSION=#{@containerLogSchemaVersion}\n")
@@ -607,7 +671,12 @@ if !file.nil?
   file.write("export AZMON_MULTILINE_LANGUAGES=#{@stacktraceLanguages}\n")
   file.write("export AZMON_KUBERNETES_METADATA_ENABLED=#{@logEnableKubernetesMetadata}\n")
   file.write("export AZMON_KUBERNETES_METADATA_INCLUDES_FIELDS=#{@logKubernetesMetadataIncludeFields}\n")
+  file.write("export AZMON_KUBERNETES_METADATA_LABEL_KEYS=#{@logKubernetesMetadataLabelKeys}\n")
+  file.write("export AZMON_KUBERNETES_METADATA_ANNOTATION_KEYS=#{@logKubernetesMetadataAnnotationKeys}\n")
+  file.write("export AZMON_KUBERNETES_METADATA_NODE_LABEL_KEYS=#{@logKubernetesMetadataNodeLabelKeys}\n")
   file.write("export AZMON_ANNOTATION_BASED_LOG_FILTERING=#{@annotationBasedLogFiltering}\n")
+  file.write("export AZMON_TRACE_CONTEXT_EXTRACTION_ENABLED=#{@traceContextExtractionEnabled}\n")
+  file.write("export AZMON_HOST_LOGS_SYSLOG_ENABLED=#{@hostLogsSyslogEnabled}\n")
   if @isAzMonMultiTenancyLogCollectionEnabled
     file.write("export AZMON_MULTI_TENANCY_LOG_COLLECTION=#{@isAzMonMultiTenancyLogCollectionEnabled}\n")
     file.write("export AZMON_MULTI_TENANCY_LOG_COLLECTION_ADVANCED_MODE=#{@isAzMonMultiTenancyLogCollectionAdvancedMode}\n")
@@ -676,6 +745,8 @@ if !@os_type.nil? && !@os_type.empty? && @os_type.strip.casecmp("windows") == 0
     file.write(commands)
     commands = get_command_windows("AZMON_CLUSTER_CONTAINER_LOG_ENRICH", @enrichContainerLogs)
     file.write(commands)
+    commands = get_command_windows("AZMON_VERBOSE_COLLECTION_OVERRIDE_ENABLED", @verboseCollectionOverrideEnabled)
+    file.write(commands)
     commands = get_command_windows("AZMON_CLUSTER_COLLECT_ALL_KUBE_EVENTS", @collectAllKubeEvents)
     file.write(commands)
     commands = get_command_windows("AZMON_CONTAINER_LOGS_ROUTE", @containerLogsRoute)
@@ -690,8 +761,16 @@ if !@os_type.nil? && !@os_type.empty? && @os_type.strip.casecmp("windows") == 0
     file.write(commands)
     commands = get_command_windows("AZMON_KUBERNETES_METADATA_INCLUDES_FIELDS", @logKubernetesMetadataIncludeFields)
     file.write(commands)
+    commands = get_command_windows("AZMON_KUBERNETES_METADATA_LABEL_KEYS", @logKubernetesMetadataLabelKeys)
+    file.write(commands)
+    commands = get_command_windows("AZMON_KUBERNETES_METADATA_ANNOTATION_KEYS", @logKubernetesMetadataAnnotationKeys)
+    file.write(commands)
+    commands = get_command_windows("AZMON_KUBERNETES_METADATA_NODE_LABEL_KEYS", @logKubernetesMetadataNodeLabelKeys)
+    file.write(commands)
     commands = get_command_windows("AZMON_ANNOTATION_BASED_LOG_FILTERING", @annotationBasedLogFiltering)
     file.write(commands)
+    commands = get_command_windows("AZMON_TRACE_CONTEXT_EXTRACTION_ENABLED", @traceContextExtractionEnabled)
+    file.write(commands)
     if @isAzMonMultiTenancyLogCollectionEnabled
       commands = get_command_windows("AZMON_MULTI_TENANCY_LOG_COLLECTION", @isAzMonMultiTenancyLogCollectionEnabled)
       file.write(commands)
@@ -3,13 +3,12 @@ package lib
 import (
 	"encoding/base64"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
 
-	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"Docker-Provider/source/plugins/go/src/paths"
+	"Docker-Provider/source/plugins/go/src/telemetry"
 )
 
 const (
@@ -28,11 +27,17 @@ const (
 	envAddonResizer = "RS_ADDON-RESIZER_VPA_ENABLED"
 )
 
+// local files of the file telemetry backend
+const (
+	telemetryFilePath        = "/var/opt/microsoft/docker-cimprov/log/input_plugins_telemetry.json"
+	windowsTelemetryFilePath = "/etc/amalogswindows/input_plugins_telemetry.json"
+)
+
 var (
 	isWindows        bool
 	hostName         string
 	customProperties map[string]string
-	telemetryClient  appinsights.TelemetryClient
+	telemetryClient  telemetry.Client = telemetry.NewNoopClient()
 	proxyEndpoint    string
 	aiLogger         *log.Logger
 )
@@ -97,16 +102,13 @@ func init() {
 	appInsightsEndpoint := os.Getenv(envAppEndpoint)
 	customProperties["WSCloud"] = getWorkspaceCloud()
 	customProperties["cri"] = os.Getenv(envContainerRT)
-	isProxyConfigured := false
 	if proxyEndpoint != "" {
 		customProperties["Proxy"] = "true"
-		isProxyConfigured = true
 		if IsProxyCACertConfigured() {
 			customProperties["IsProxyCACertConfigured"] = "true"
 		}
 	} else {
 		customProperties["Proxy"] = "false"
-		isProxyConfigured = false
 		if IsIgnoreProxySettings() {
 			customProperties["IsProxyConfigurationIgnored"] = "true"
 		}
@@ -124,63 +126,59 @@ func init() {
 		customProperties["addonResizerVPAEnabled"] = "true"
 	}
 
-	if encodedAppInsightsKey != "" {
-		decodedAppInsightsKey, err := base64.StdEncoding.DecodeString(encodedAppInsightsKey)
-		if err != nil {
-			aiLogger.Printf("Error decoding Application Insights key: %s", err.Error())
-		}
-
-		telemetryClientConfig := appinsights.NewTelemetryConfiguration(string(decodedAppInsightsKey))
-
-		if appInsightsEndpoint != "" {
-			aiLogger.Printf("Setting Application Insights endpoint to %s", appInsightsEndpoint)
-			telemetryClientConfig.EndpointUrl = appInsightsEndpoint
+	telemetryConfig := telemetry.Config{
+		Backend:      strings.ToLower(strings.TrimSpace(os.Getenv(telemetry.BackendEnv))),
+		Disabled:     strings.EqualFold(os.Getenv("DISABLE_TELEMETRY"), "true"),
+		ServiceName:  "input-plugins",
+		ProxyURL:     proxyEndpoint,
+		OTLPEndpoint: os.Getenv(telemetry.OTLPEndpointEnv),
+		OTLPHeaders:  telemetry.ParseHeaders(os.Getenv(telemetry.OTLPHeadersEnv)),
+		FilePath:     os.Getenv(telemetry.FilePathEnv),
+		Logger:       aiLogger,
+	}
+	if telemetryConfig.FilePath == "" {
+		if isWindows {
+			telemetryConfig.FilePath = windowsTelemetryFilePath
+		} else {
+			telemetryConfig.FilePath = telemetryFilePath
 		}
-
-		if isProxyConfigured {
-			proxyEndpointUrl, err := url.Parse(proxyEndpoint)
+	}
+	telemetryConfig.FilePath = paths.Resolve(telemetryConfig.FilePath)
+	if telemetryConfig.Backend == "" || telemetryConfig.Backend == telemetry.BackendAppInsights {
+		if encodedAppInsightsKey == "" {
+			// no instrumentation key, the telemetry is dropped
+			telemetryConfig.Backend = telemetry.BackendNoop
+		} else {
+			decodedAppInsightsKey, err := base64.StdEncoding.DecodeString(encodedAppInsightsKey)
 			if err != nil {
-				aiLogger.Printf("Error parsing proxy endpoint: %s", err.Error())
-				telemetryClient = nil
-				return
+				aiLogger.Printf("Error decoding Application Insights key: %s", err.Error())
 			}
-
-			transport := &http.Transport{
-				Proxy: http.ProxyURL(proxyEndpointUrl),
-			}
-			httpClient := &http.Client{
-				Transport: transport,
-			}
-			telemetryClientConfig.Client = httpClient
+			telemetryConfig.AppInsightsKey = string(decodedAppInsightsKey)
+		}
+		if appInsightsEndpoint != "" {
+			aiLogger.Printf("Setting Application Insights endpoint to %s", appInsightsEndpoint)
+			telemetryConfig.AppInsightsEndpoint = appInsightsEndpoint
 		}
-		telemetryClient = appinsights.NewTelemetryClientFromConfig(telemetryClientConfig)
 	}
 
-	telemetryOffStr := os.Getenv("DISABLE_TELEMETRY")
-	if strings.EqualFold(telemetryOffStr, "true") {
-		telemetryClient.SetIsEnabled(false)
+	client, err := telemetry.New(telemetryConfig)
+	if err != nil {
+		aiLogger.Printf("Error creating the telemetry client: %s", err.Error())
+		return
 	}
-
+	telemetryClient = client
 }
 
 func sendHeartBeatEvent(pluginName string) {
 	eventName := pluginName + heartBeat
-	if telemetryClient != nil {
-		event := appinsights.NewEventTelemetry(eventName)
-		event.Properties = customProperties
-		telemetryClient.Track(event)
-		aiLogger.Printf("AppInsights Heartbeat Telemetry put successfully into the queue")
-	}
+	telemetryClient.Track(telemetry.Event(eventName, customProperties))
+	aiLogger.Printf("AppInsights Heartbeat Telemetry put successfully into the queue")
 }
 
 func sendLastProcessedContainerInventoryCountMetric(pluginName string, properties map[string]string) {
-	if telemetryClient != nil {
-		containerCount, _ := strconv.ParseFloat(properties["ContainerCount"], 64)
-		metric := appinsights.NewMetricTelemetry("LastProcessedContainerInventoryCount", containerCount)
-		metric.Properties = customProperties
-		telemetryClient.Track(metric)
-		aiLogger.Printf("AppInsights Container Count Telemetry put successfully into the queue")
-	}
+	containerCount, _ := strconv.ParseFloat(properties["ContainerCount"], 64)
+	telemetryClient.Track(telemetry.Metric("LastProcessedContainerInventoryCount", containerCount, customProperties))
+	aiLogger.Printf("AppInsights Container Count Telemetry put successfully into the queue")
 }
 
 func SendCustomEvent(eventName string, properties map[string]string) {
@@ -196,12 +194,8 @@ func SendCustomEvent(eventName string, properties map[string]string) {
 		telemetryProps[k] = v
 	}
 
-	if telemetryClient != nil {
-		event := appinsights.NewEventTelemetry(eventName)
-		event.Properties = telemetryProps
-		telemetryClient.Track(event)
-		aiLogger.Printf("AppInsights Custom Event %s sent successfully\n", eventName)
-	}
+	telemetryClient.Track(telemetry.Event(eventName, telemetryProps))
+	aiLogger.Printf("AppInsights Custom Event %s sent successfully\n", eventName)
 }
 
 func SendExceptionTelemetry(errorStr string, properties map[string]string) {
@@ -217,12 +211,8 @@ func SendExceptionTelemetry(errorStr string, properties map[string]string) {
 		telemetryProps[k] = v
 	}
 
-	if telemetryClient != nil {
-		exception := appinsights.NewExceptionTelemetry(errorStr)
-		exception.Properties = telemetryProps
-		telemetryClient.Track(exception)
-		aiLogger.Printf("AppInsights Exception Telemetry put successfully into the queue")
-	}
+	telemetryClient.Track(telemetry.Exception(errorStr, telemetryProps))
+	aiLogger.Printf("AppInsights Exception Telemetry put successfully into the queue")
 }
 
 func SendTelemetry(pluginName string, properties map[string]string) {
@@ -253,18 +243,12 @@ func SendMetricTelemetry(metricName string, metricValue float64, properties map[
 		telemetryProps[k] = v
 	}
 
-	if telemetryClient != nil {
-		metric := appinsights.NewMetricTelemetry(metricName, metricValue)
-		metric.Properties = telemetryProps
-		telemetryClient.Track(metric)
-		aiLogger.Printf("AppInsights metric Telemetry %s put successfully into the queue\n", metricName)
-	}
+	telemetryClient.Track(telemetry.Metric(metricName, metricValue, telemetryProps))
+	aiLogger.Printf("AppInsights metric Telemetry %s put successfully into the queue\n", metricName)
 }
 
 func SendException(err interface{}) {
-	if telemetryClient != nil {
-		telemetryClient.TrackException(err)
-	}
+	telemetryClient.Track(telemetry.Exception(err, nil))
 }
 
 func getWorkspaceCloud() string {
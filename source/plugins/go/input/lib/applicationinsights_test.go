@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"testing"
+
+	"Docker-Provider/source/plugins/go/src/telemetry"
+)
+
+func useMemoryTelemetryClient(t *testing.T) *telemetry.MemoryClient {
+	client := telemetry.NewMemoryClient()
+	origClient := telemetryClient
+	telemetryClient = client
+	t.Cleanup(func() { telemetryClient = origClient })
+	return client
+}
+
+func TestSendCustomEventMergesCustomProperties(t *testing.T) {
+	client := useMemoryTelemetryClient(t)
+
+	SendCustomEvent("ContainerInventoryEvent", map[string]string{"WSID": "override", "PodCount": "3"})
+
+	events := client.Find(telemetry.KindEvent, "ContainerInventoryEvent")
+	if len(events) != 1 {
+		t.Fatalf("expected a single event, got %+v", client.Items())
+	}
+	properties := events[0].Properties
+	if properties["WSID"] != "override" || properties["PodCount"] != "3" || properties["Controller"] != customProperties["Controller"] {
+		t.Errorf("unexpected event properties %v", properties)
+	}
+}
+
+func TestSendTelemetry(t *testing.T) {
+	client := useMemoryTelemetryClient(t)
+
+	SendTelemetry("containerinventory", map[string]string{"Computer": "node", "ContainerCount": "12"})
+
+	if events := client.Find(telemetry.KindEvent, "containerinventory"+heartBeat); len(events) != 1 || events[0].Properties["Computer"] != "node" {
+		t.Errorf("expected a heartbeat event, got %+v", client.Items())
+	}
+	if metrics := client.Find(telemetry.KindMetric, "LastProcessedContainerInventoryCount"); len(metrics) != 1 || metrics[0].Value != 12 {
+		t.Errorf("expected the container count metric, got %+v", client.Items())
+	}
+}
+
+func TestSendMetricTelemetryWithoutName(t *testing.T) {
+	client := useMemoryTelemetryClient(t)
+
+	SendMetricTelemetry("", 1, nil)
+	SendExceptionTelemetry("failed", nil)
+
+	if items := client.Items(); len(items) != 1 || items[0].Kind != telemetry.KindException {
+		t.Errorf("expected only the exception, got %+v", items)
+	}
+}
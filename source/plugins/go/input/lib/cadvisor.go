@@ -16,7 +16,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"Docker-Provider/source/plugins/go/src/logging"
+	"Docker-Provider/source/plugins/go/src/paths"
 )
 
 const (
@@ -72,13 +73,11 @@ var (
 	winContainerCpuUsageNanoSecondsLast     = make(map[string]float64)
 	winContainerCpuUsageNanoSecondsTimeLast = make(map[string]time.Time)
 	winContainerPrevMetricRate              = make(map[string]float64)
-	Log                                     *logrus.Logger
+	Log                                     *logging.Logger
 	osType                                  string
 )
 
 func init() {
-	Log = logrus.New()
-
 	osType = os.Getenv("OS_TYPE")
 	if osType != "" && osType == "windows" {
 		LogPath = WindowsLogPath + "kubernetes_perf_log.txt"
@@ -91,14 +90,7 @@ func init() {
 		LogPath = "./kubernetes_perf_log.txt"
 	}
 
-	// Open file
-	file, err := os.OpenFile(LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		Log.Fatalf("Failed to open log file: %v", err)
-	}
-
-	Log.SetOutput(file)
-	Log.SetLevel(logrus.InfoLevel)
+	Log = logging.NewFile(paths.Resolve(LogPath), logging.ConfigFromEnv(os.Getenv)).WithComponent("cadvisor")
 }
 
 type metricDataItem map[string]interface{}
@@ -114,6 +106,9 @@ func GetPodsFromCAdvisor(winNode map[string]string) (*http.Response, error) {
 }
 
 func getBaseCAdvisorUrl(winNode map[string]string) string {
+	if paths.LocalMode() {
+		return paths.KubeletURL()
+	}
 	cAdvisorSecurePort := isCAdvisorOnSecurePort()
 
 	var defaultHost string
@@ -166,7 +161,7 @@ func isCAdvisorOnSecurePort() bool {
 func getResponse(winNode map[string]string, relativeUri string) (*http.Response, error) {
 	var response *http.Response
 	Log.Infof("Getting CAdvisor Uri Response")
-	bearerToken, _ := ioutil.ReadFile(BEARER_TOKEN_FILE)
+	bearerToken, _ := ioutil.ReadFile(paths.Resolve(BEARER_TOKEN_FILE))
 
 	cAdvisorUri := getCAdvisorUri(winNode, relativeUri)
 	Log.Infof("CAdvisor Uri: %s", cAdvisorUri)
@@ -180,7 +175,7 @@ func getResponse(winNode map[string]string, relativeUri string) (*http.Response,
 
 		var httpClient *http.Client
 		if isCAdvisorOnSecurePort() {
-			caCert, err := ioutil.ReadFile(CA_CERT_PATH)
+			caCert, err := ioutil.ReadFile(paths.Resolve(CA_CERT_PATH))
 			if err != nil {
 				Log.Errorf("Failed to read CA cert: %s", err)
 				return nil, err
@@ -600,7 +595,7 @@ func getContainerCpuMetricItemRate(metricInfo map[string]interface{}, hostName,
 						telemetryProps["Computer"] = hostName
 						telemetryProps["CAdvisorIsSecure"] = os.Getenv("IS_SECURE_CADVISOR_PORT")
 
-						_, err := os.Stat(configMapMountPath)
+						_, err := os.Stat(paths.Resolve(configMapMountPath))
 						if err == nil {
 							telemetryProps["clustercustomsettings"] = "true"
 							telemetryProps["clusterenvvars"] = os.Getenv("AZMON_CLUSTER_COLLECT_ENV_VAR")
@@ -616,7 +611,7 @@ func getContainerCpuMetricItemRate(metricInfo map[string]interface{}, hostName,
 							telemetryProps["clusterCLEnrich"] = os.Getenv("AZMON_CLUSTER_CONTAINER_LOG_ENRICH")
 						}
 						// telemetry about prometheus metric collections settings for daemonset
-						_, err = os.Stat(promConfigMountPath)
+						_, err = os.Stat(paths.Resolve(promConfigMountPath))
 						if err == nil {
 							telemetryProps["dsPromInt"] = os.Getenv("TELEMETRY_DS_PROM_INTERVAL")
 							telemetryProps["dsPromFPC"] = os.Getenv("TELEMETRY_DS_PROM_FIELDPASS_LENGTH")
@@ -834,7 +829,7 @@ func getNodeLastRebootTimeMetric(metricInfo map[string]interface{}, hostName, me
 	var epochTime int64
 	if osType != "" && strings.EqualFold(osType, "windows") && IsAADMSIAuthMode() {
 		//Stat the modification time from "C:\\etc\\kubernetes\\host\\windowsnodereset.log"
-		fileStat, err := os.Stat("C:\\etc\\kubernetes\\host\\windowsnodereset.log")
+		fileStat, err := os.Stat(paths.Resolve("C:\\etc\\kubernetes\\host\\windowsnodereset.log"))
 		if err != nil {
 			Log.Warnf("Error stating C:\\etc\\kubernetes\\host\\windowsnodereset.log: %s", err)
 			return nodeMetricItem
@@ -843,7 +838,7 @@ func getNodeLastRebootTimeMetric(metricInfo map[string]interface{}, hostName, me
 		epochTime = modificationTime.Unix()
 	} else {
 		// Read the first value from /proc/uptime and convert it to a float64
-		uptimeStr, err := ioutil.ReadFile("/proc/uptime")
+		uptimeStr, err := ioutil.ReadFile(paths.Resolve("/proc/uptime"))
 		if err != nil {
 			Log.Warnf("Error reading /proc/uptime: %s", err)
 			return nodeMetricItem
@@ -1028,7 +1023,7 @@ func getContainerCpuMetricItems(metricInfo map[string]interface{}, hostName, met
 						telemetryProps["Computer"] = hostName
 						telemetryProps["CAdvisorIsSecure"] = os.Getenv("IS_SECURE_CADVISOR_PORT")
 
-						_, err := os.Stat(configMapMountPath)
+						_, err := os.Stat(paths.Resolve(configMapMountPath))
 						if err == nil {
 							telemetryProps["clustercustomsettings"] = "true"
 							telemetryProps["clusterenvvars"] = os.Getenv("AZMON_CLUSTER_COLLECT_ENV_VAR")
@@ -1044,7 +1039,7 @@ func getContainerCpuMetricItems(metricInfo map[string]interface{}, hostName, met
 							telemetryProps["clusterCLEnrich"] = os.Getenv("AZMON_CLUSTER_CONTAINER_LOG_ENRICH")
 						}
 						// telemetry about prometheus metric collections settings for daemonset
-						_, err = os.Stat(promConfigMountPath)
+						_, err = os.Stat(paths.Resolve(promConfigMountPath))
 						if err == nil {
 							telemetryProps["dsPromInt"] = os.Getenv("TELEMETRY_DS_PROM_INTERVAL")
 							telemetryProps["dsPromFPC"] = os.Getenv("TELEMETRY_DS_PROM_FIELDPASS_LENGTH")
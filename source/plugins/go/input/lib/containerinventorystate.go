@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+
+	"Docker-Provider/source/plugins/go/src/paths"
 )
 
 type Container map[string]interface{}
@@ -16,9 +18,9 @@ func getInventoryDirectory() string {
 		return os.Getenv("TESTDIR")
 	}
 	if osType == "windows" {
-		return "/opt/amalogswindows/state/ContainerInventory/"
+		return paths.Resolve("/opt/amalogswindows/state/ContainerInventory/")
 	} else {
-		return "/var/opt/microsoft/docker-cimprov/state/ContainerInventory/"
+		return paths.Resolve("/var/opt/microsoft/docker-cimprov/state/ContainerInventory/")
 	}
 }
 
@@ -16,6 +16,8 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+
+	"Docker-Provider/source/plugins/go/src/paths"
 )
 
 const (
@@ -62,11 +64,7 @@ func init() {
 	TokenExpiry = time.Now().Unix()
 
 	// Define logger
-	file, err := os.OpenFile(LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalln("Failed to open log file :", err)
-	}
-	logger = log.New(file, "", log.LstdFlags)
+	logger = CreateLogger(LogPath)
 }
 
 func getKubeResourceInfo(resource string, api_group *string) (*http.Response, error) {
@@ -78,24 +76,28 @@ func getKubeResourceInfo(resource string, api_group *string) (*http.Response, er
 		return nil, err
 	}
 
-	// Load CA cert
-	caCert, err := ioutil.ReadFile(CaFile)
-	if err != nil {
-		logger.Println("Failed to read ca.crt: ", err)
-		return nil, err
-	}
+	// the local API server endpoint of the local mode has no cluster CA
+	client := &http.Client{Timeout: time.Second * 40}
+	if !paths.LocalMode() {
+		// Load CA cert
+		caCert, err := ioutil.ReadFile(paths.Resolve(CaFile))
+		if err != nil {
+			logger.Println("Failed to read ca.crt: ", err)
+			return nil, err
+		}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
 
-	tlsConfig := &tls.Config{
-		RootCAs: caCertPool,
-	}
+		tlsConfig := &tls.Config{
+			RootCAs: caCertPool,
+		}
 
-	// Setup HTTPS client
-	tlsConfig.BuildNameToCertificate()
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
-	client := &http.Client{Transport: transport, Timeout: time.Second * 40}
+		// Setup HTTPS client
+		tlsConfig.BuildNameToCertificate()
+		transport := &http.Transport{TLSClientConfig: tlsConfig}
+		client = &http.Client{Transport: transport, Timeout: time.Second * 40}
+	}
 
 	req, _ := http.NewRequest("GET", resourceUri, nil)
 	req.Header.Add("Authorization", "Bearer "+GetTokenStr())
@@ -114,15 +116,19 @@ func getKubeResourceInfo(resource string, api_group *string) (*http.Response, er
 func getResourceUri(resource string, api_group *string) (string, error) {
 	serviceHost, serviceHostExist := os.LookupEnv("KUBERNETES_SERVICE_HOST")
 	servicePort, servicePortExist := os.LookupEnv("KUBERNETES_PORT_443_TCP_PORT")
+	baseUri := "https://" + serviceHost + ":" + servicePort
+	if paths.LocalMode() {
+		baseUri, serviceHostExist, servicePortExist = paths.APIServerURL(), true, true
+	}
 
 	if serviceHostExist && servicePortExist {
 		switch {
 		case api_group == nil:
-			return "https://" + serviceHost + ":" + servicePort + "/api/" + ApiVersion + "/" + resource, nil
+			return baseUri + "/api/" + ApiVersion + "/" + resource, nil
 		case *api_group == ApiGroupApps:
-			return "https://" + serviceHost + ":" + servicePort + "/apis/apps/" + ApiVersionApps + "/" + resource, nil
+			return baseUri + "/apis/apps/" + ApiVersionApps + "/" + resource, nil
 		case *api_group == ApiGroupHPA:
-			return "https://" + serviceHost + ":" + servicePort + "/apis/" + ApiGroupHPA + "/" + ApiVersionHPA + "/" + resource, nil
+			return baseUri + "/apis/" + ApiGroupHPA + "/" + ApiVersionHPA + "/" + resource, nil
 		default:
 			return "", fmt.Errorf("unsupported API group: %s", *api_group)
 		}
@@ -134,8 +140,8 @@ func getResourceUri(resource string, api_group *string) (string, error) {
 
 func GetTokenStr() string {
 	if TokenStr == "" || math.Abs(float64(TokenExpiry-time.Now().Unix())) <= float64(SERVICE_ACCOUNT_TOKEN_REFRESH_INTERVAL_SECONDS) { // refresh token from token file if its near expiry
-		if _, err := os.Stat(TokenFileName); err == nil {
-			data, readErr := ioutil.ReadFile(TokenFileName)
+		if _, err := os.Stat(paths.Resolve(TokenFileName)); err == nil {
+			data, readErr := ioutil.ReadFile(paths.Resolve(TokenFileName))
 			if readErr == nil {
 				TokenStr = string(data)
 				if token, _ := jwt.Parse(TokenStr, nil); token != nil {
@@ -143,12 +149,12 @@ func GetTokenStr() string {
 						if claims["exp"] != nil {
 							TokenExpiry = int64(claims["exp"].(float64))
 						} else {
-							fmt.Println("exp not present in JWT")
+							FLBLogger.Println("Warn::KubernetesAPIClient::exp not present in JWT")
 							TokenExpiry = time.Now().Unix() + int64(LEGACY_SERVICE_ACCOUNT_TOKEN_EXPIRY_SECONDS)
 						}
 					}
 				} else {
-					fmt.Println("The token is not a JSON Web Token (JWT).")
+					FLBLogger.Println("Warn::KubernetesAPIClient::The token is not a JSON Web Token (JWT).")
 					TokenExpiry = time.Now().Unix() + int64(LEGACY_SERVICE_ACCOUNT_TOKEN_EXPIRY_SECONDS)
 				}
 
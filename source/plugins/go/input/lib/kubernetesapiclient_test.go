@@ -3,6 +3,8 @@ package lib
 import (
 	"os"
 	"testing"
+
+	"Docker-Provider/source/plugins/go/src/paths"
 )
 
 func TestGetResourceUri(t *testing.T) {
@@ -70,3 +72,21 @@ func TestGetResourceUri(t *testing.T) {
 		t.Errorf("Expected error: %s, but got: %v", expectedErr, err)
 	}
 }
+
+func TestGetResourceUriLocalMode(t *testing.T) {
+	original := paths.Current()
+	defer paths.Configure(original)
+	settings, _ := paths.Load(func(name string) string {
+		return map[string]string{paths.LocalModeEnv: "true", paths.APIServerURLEnv: "http://127.0.0.1:18001/"}[name]
+	})
+	paths.Configure(settings)
+
+	apiGroupApps := ApiGroupApps
+	uri, err := getResourceUri("deployments", &apiGroupApps)
+	if expected := "http://127.0.0.1:18001/apis/apps/" + ApiVersionApps + "/deployments"; err != nil || uri != expected {
+		t.Errorf("Expected URI to be %s, but got %s %v", expected, uri, err)
+	}
+	if baseUrl := getBaseCAdvisorUrl(nil); baseUrl != paths.DefaultKubeletURL {
+		t.Errorf("Expected the kubelet URL of the local mode, but got %s", baseUrl)
+	}
+}
@@ -12,8 +12,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+
+	"Docker-Provider/source/plugins/go/src/paths"
 )
 
+// hostProcDir is the proc filesystem of the node mounted in the container
+const hostProcDir = "/hostfs/proc"
+
 var (
 	containerCGroupCache      = map[string]string{}
 	addonTokenAdapterImageTag = ""
@@ -290,19 +295,19 @@ func obtainContainerEnvironmentVars(containerID string) string {
 		isCGroupPidFetchRequired = true
 	} else {
 		cGroupPid := containerCGroupCache[containerID]
-		if cGroupPid == "" || !fileExists(fmt.Sprintf("/hostfs/proc/%s/environ", cGroupPid)) {
+		if cGroupPid == "" || !fileExists(filepath.Join(paths.Resolve(hostProcDir), cGroupPid, "environ")) {
 			isCGroupPidFetchRequired = true
 			delete(containerCGroupCache, containerID)
 		}
 	}
 
 	if isCGroupPidFetchRequired {
-		cGroupPids, err := filepath.Glob("/hostfs/proc/*/cgroup")
+		cGroupPids, err := filepath.Glob(filepath.Join(paths.Resolve(hostProcDir), "*", "cgroup"))
 		if err != nil {
 			FLBLogger.Printf("KubernetesContainerInventory::obtainContainerEnvironmentVars: Failed to read cgroup files: %v", err)
 		} else {
 			for _, filename := range cGroupPids {
-				cGroupPid := strings.Split(filename, "/")[3]
+				cGroupPid := filepath.Base(filepath.Dir(filename))
 				pattern := regexp.MustCompile(regexp.QuoteMeta(containerID))
 				if fileExists(filename) && fileContains(filename, pattern) {
 					if isNumber(cGroupPid) {
@@ -323,7 +328,7 @@ func obtainContainerEnvironmentVars(containerID string) string {
 
 	cGroupPid, exists := containerCGroupCache[containerID]
 	if exists && cGroupPid != "" {
-		environFilePath := fmt.Sprintf("/hostfs/proc/%s/environ", cGroupPid)
+		environFilePath := filepath.Join(paths.Resolve(hostProcDir), cGroupPid, "environ")
 		if fileExists(environFilePath) {
 			pattern := regexp.MustCompile(`(?i)` + regexp.QuoteMeta("AZMON_COLLECT_ENV=FALSE"))
 			if fileContains(environFilePath, pattern) {
@@ -470,7 +475,7 @@ func obtainContainerEnvironmentVarsFromPodsResponse(pod map[string]interface{},
 		// Check to see if the environment variable collection is disabled for this container.
 		if strings.Contains(envValueString, "AZMON_COLLECT_ENV=FALSE") {
 			envValueString = `["AZMON_COLLECT_ENV=FALSE"]`
-			fmt.Printf("Environment Variable collection for container: %s skipped because AZMON_COLLECT_ENV is set to false\n", containerName)
+			FLBLogger.Printf("KubernetesContainerInventory::Environment Variable collection for container: %s skipped because AZMON_COLLECT_ENV is set to false", containerName)
 		} else if len(envValueString) > 200000 { // Restricting the ENV string value to 200kb since the size of this string can go very high
 			envValueStringTruncated := envValueString[:200000]
 			lastIndex := strings.LastIndex(envValueStringTruncated, `",`)
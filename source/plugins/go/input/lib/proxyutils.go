@@ -4,13 +4,15 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+
+	"Docker-Provider/source/plugins/go/src/paths"
 )
 
 var proxyCertPath = "/etc/ama-logs-secret/PROXYCERT.crt"
 
 func GetProxyEndpoint() (string, error) {
 	amaLogsProxySecretPath := "/etc/ama-logs-secret/PROXY"
-	proxyConfig, err := ioutil.ReadFile(amaLogsProxySecretPath)
+	proxyConfig, err := ioutil.ReadFile(paths.Resolve(amaLogsProxySecretPath))
 	if err != nil {
 		return "", err
 	}
@@ -18,7 +20,7 @@ func GetProxyEndpoint() (string, error) {
 }
 
 func IsProxyCACertConfigured() bool {
-	_, err := os.Stat(proxyCertPath)
+	_, err := os.Stat(paths.Resolve(proxyCertPath))
 	return err == nil
 }
 
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// env variables to tune the circuit breakers of the mdsd socket and ama named pipe connections
+const CircuitBreakerFailureThresholdEnv = "AZMON_MDSD_CIRCUIT_BREAKER_FAILURE_THRESHOLD"
+const CircuitBreakerBaseBackoffSecondsEnv = "AZMON_MDSD_CIRCUIT_BREAKER_BASE_BACKOFF_SECONDS"
+const CircuitBreakerMaxBackoffSecondsEnv = "AZMON_MDSD_CIRCUIT_BREAKER_MAX_BACKOFF_SECONDS"
+
+const defaultCircuitBreakerFailureThreshold = 3
+const defaultCircuitBreakerBaseBackoff = 1 * time.Second
+const defaultCircuitBreakerMaxBackoff = 5 * time.Minute
+
+// a half-open probe whose result was never recorded (e.g. the write was rejected by a full priority lane) is given up after this
+const circuitBreakerProbeTimeout = 1 * time.Minute
+
+const CircuitBreakerStateChangedEvent = "MdsdCircuitBreakerStateChanged"
+
+const ConnectionErrorEventCategory = "container.azm.ms/mdsdconnection"
+
+// CircuitState of a circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed connects and writes are attempted
+	CircuitClosed CircuitState = iota
+	// CircuitOpen connects are skipped until the backoff expires
+	CircuitOpen
+	// CircuitHalfOpen a single probe connect is attempted, its result closes or re-opens the circuit
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "Closed"
+	case CircuitOpen:
+		return "Open"
+	case CircuitHalfOpen:
+		return "HalfOpen"
+	}
+	return "Unknown"
+}
+
+func (dataType DataType) String() string {
+	switch dataType {
+	case ContainerLogV2:
+		return "ContainerLogV2"
+	case KubeMonAgentEvents:
+		return "KubeMonAgentEvents"
+	case InsightsMetrics:
+		return "InsightsMetrics"
+	case InputPluginRecords:
+		return "InputPluginRecords"
+	case HostLogs:
+		return "HostLogs"
+	case ConfigSnapshot:
+		return "ConfigSnapshot"
+	}
+	return "Unknown"
+}
+
+// CircuitBreaker guards the connection to a single mdsd socket or ama named pipe destination. After FailureThreshold
+// consecutive failures the circuit opens and connects are skipped for an exponentially growing, jittered backoff
+type CircuitBreaker struct {
+	Destination      string
+	FailureThreshold int
+	BaseBackoff      time.Duration
+	MaxBackoff       time.Duration
+	// OnStateChange is called outside of the breaker lock for every state transition
+	OnStateChange func(destination string, from CircuitState, to CircuitState, failures int, backoff time.Duration)
+
+	mutex               sync.Mutex
+	state               CircuitState
+	consecutiveFailures int
+	openCount           int
+	backoff             time.Duration
+	nextAttempt         time.Time
+	probeInFlight       bool
+	probeStartedAt      time.Time
+	now                 func() time.Time
+	jitter              func(time.Duration) time.Duration
+}
+
+var (
+	// CircuitBreakers per destination (mdsd:<datatype> or ama:<datatype>)
+	CircuitBreakers = make(map[string]*CircuitBreaker)
+	// CircuitBreakersMutex read and write mutex access to CircuitBreakers
+	CircuitBreakersMutex = &sync.Mutex{}
+	// ConnectionErrorEvent hash of circuit breaker transitions sent as KubeMonAgentEvents
+	ConnectionErrorEvent           = make(map[string]KubeMonAgentEventTags)
+	circuitBreakerFailureThreshold = defaultCircuitBreakerFailureThreshold
+	circuitBreakerBaseBackoff      = defaultCircuitBreakerBaseBackoff
+	circuitBreakerMaxBackoff       = defaultCircuitBreakerMaxBackoff
+)
+
+// NewCircuitBreaker creates a closed circuit breaker for the destination
+func NewCircuitBreaker(destination string, failureThreshold int, baseBackoff time.Duration, maxBackoff time.Duration) *CircuitBreaker {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	if maxBackoff < baseBackoff {
+		maxBackoff = baseBackoff
+	}
+	return &CircuitBreaker{
+		Destination:      destination,
+		FailureThreshold: failureThreshold,
+		BaseBackoff:      baseBackoff,
+		MaxBackoff:       maxBackoff,
+		now:              time.Now,
+		jitter:           fullJitter,
+	}
+}
+
+// fullJitter returns a random duration in [backoff/2, backoff) so that agents on many nodes don't reconnect in lockstep
+func fullJitter(backoff time.Duration) time.Duration {
+	if backoff <= 1 {
+		return backoff
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)))
+}
+
+// State returns the current state of the breaker
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state
+}
+
+// Allow returns true if a connect should be attempted. An open circuit turns half-open once its backoff expired and
+// allows a single probe until its result is recorded
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mutex.Lock()
+	var transition func()
+	allowed := true
+	switch cb.state {
+	case CircuitOpen:
+		if cb.now().Before(cb.nextAttempt) {
+			allowed = false
+		} else {
+			transition = cb.setState(CircuitHalfOpen)
+			cb.probeInFlight = true
+			cb.probeStartedAt = cb.now()
+		}
+	case CircuitHalfOpen:
+		if cb.probeInFlight && cb.now().Before(cb.probeStartedAt.Add(circuitBreakerProbeTimeout)) {
+			allowed = false
+		} else {
+			cb.probeInFlight = true
+			cb.probeStartedAt = cb.now()
+		}
+	}
+	cb.mutex.Unlock()
+	if transition != nil {
+		transition()
+	}
+	return allowed
+}
+
+// RecordSuccess closes the circuit and resets the backoff
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mutex.Lock()
+	var transition func()
+	cb.consecutiveFailures = 0
+	cb.probeInFlight = false
+	if cb.state != CircuitClosed {
+		cb.openCount = 0
+		cb.backoff = 0
+		transition = cb.setState(CircuitClosed)
+	}
+	cb.mutex.Unlock()
+	if transition != nil {
+		transition()
+	}
+}
+
+// RecordFailure opens the circuit once the failure threshold is reached. A failed probe re-opens it with a doubled backoff
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.mutex.Lock()
+	var transition func()
+	cb.consecutiveFailures++
+	cb.probeInFlight = false
+	if cb.state == CircuitHalfOpen || (cb.state == CircuitClosed && cb.consecutiveFailures >= cb.FailureThreshold) {
+		backoff := cb.BaseBackoff << uint(cb.openCount)
+		if backoff > cb.MaxBackoff || backoff <= 0 {
+			backoff = cb.MaxBackoff
+		} else {
+			cb.openCount++
+		}
+		cb.backoff = cb.jitter(backoff)
+		cb.nextAttempt = cb.now().Add(cb.backoff)
+		transition = cb.setState(CircuitOpen)
+	}
+	cb.mutex.Unlock()
+	if transition != nil {
+		transition()
+	}
+}
+
+// setState must be called with the lock held, the returned func notifies OnStateChange and must be called after unlocking
+func (cb *CircuitBreaker) setState(state CircuitState) func() {
+	from := cb.state
+	cb.state = state
+	if from == state || cb.OnStateChange == nil {
+		return nil
+	}
+	destination, failures, backoff, onStateChange := cb.Destination, cb.consecutiveFailures, cb.backoff, cb.OnStateChange
+	return func() {
+		onStateChange(destination, from, state, failures, backoff)
+	}
+}
+
+func populateCircuitBreakerSettings(config *PluginConfig) {
+	circuitBreakerFailureThreshold = config.CircuitBreakerFailureThreshold
+	circuitBreakerBaseBackoff = time.Duration(config.CircuitBreakerBaseBackoffSeconds) * time.Second
+	circuitBreakerMaxBackoff = time.Duration(config.CircuitBreakerMaxBackoffSeconds) * time.Second
+	Log("Circuit breaker failure threshold: %d, base backoff: %s, max backoff: %s", circuitBreakerFailureThreshold, circuitBreakerBaseBackoff, circuitBreakerMaxBackoff)
+}
+
+// getCircuitBreaker returns the breaker of the destination, creating it on first use
+func getCircuitBreaker(destination string) *CircuitBreaker {
+	CircuitBreakersMutex.Lock()
+	defer CircuitBreakersMutex.Unlock()
+	cb, ok := CircuitBreakers[destination]
+	if !ok {
+		cb = NewCircuitBreaker(destination, circuitBreakerFailureThreshold, circuitBreakerBaseBackoff, circuitBreakerMaxBackoff)
+		cb.OnStateChange = onCircuitBreakerStateChange
+		CircuitBreakers[destination] = cb
+	}
+	return cb
+}
+
+// getMdsdCircuitBreaker returns the breaker of the mdsd socket connection for the data type, with priority lanes the
+// breaker is shared by all data types of the lane
+func getMdsdCircuitBreaker(dataType DataType) *CircuitBreaker {
+	if PriorityLanesEnabled {
+		return getCircuitBreaker(getLaneDestination(getLanePriority(dataType)))
+	}
+	return getCircuitBreaker("mdsd:" + dataType.String())
+}
+
+// getAMACircuitBreaker returns the breaker of the ama named pipe connection for the data type
+func getAMACircuitBreaker(datatype string) *CircuitBreaker {
+	return getCircuitBreaker("ama:" + datatype)
+}
+
+// recordConnectionResult records the result of a connect or write to an mdsd socket or ama named pipe on its breaker.
+// Payloads rejected by a full priority lane are backpressure and not connection failures
+func recordConnectionResult(cb *CircuitBreaker, err error) {
+	if err == ErrLaneQueueFull || err == ErrLaneTimeout {
+		return
+	}
+	if err != nil {
+		cb.RecordFailure()
+	} else {
+		cb.RecordSuccess()
+	}
+}
+
+// logConnectionError logs a missing or failed connection of a flush. While the circuit of the destination is open no
+// connect is attempted and the message is rate limited instead of logged on every flush
+func logConnectionError(cb *CircuitBreaker, format string, v ...interface{}) {
+	if cb.State() == CircuitOpen {
+		LogRateLimited(cb.Destination+":"+format, format, v...)
+		return
+	}
+	Log(format, v...)
+}
+
+func onCircuitBreakerStateChange(destination string, from CircuitState, to CircuitState, failures int, backoff time.Duration) {
+	message := fmt.Sprintf("Circuit breaker for %s changed from %s to %s after %d consecutive failures", destination, from, to, failures)
+	if to == CircuitOpen {
+		message = fmt.Sprintf("%s. Next connect attempt in %s", message, backoff)
+	}
+	Log("Info::circuitBreaker::%s", message)
+
+	ContainerLogTelemetryMutex.Lock()
+	if to == CircuitOpen {
+		CircuitBreakerOpenCount += 1
+	}
+	ContainerLogTelemetryMutex.Unlock()
+
+	SendEvent(CircuitBreakerStateChangedEvent, map[string]string{
+		"Destination": destination,
+		"FromState":   from.String(),
+		"ToState":     to.String(),
+		"Failures":    strconv.Itoa(failures),
+		"BackoffMs":   strconv.FormatInt(backoff.Milliseconds(), 10),
+	})
+
+	// half-open is transient, only opened and recovered connections are reported as KubeMonAgentEvents
+	if to == CircuitHalfOpen {
+		return
+	}
+	eventTimeStamp := time.Now().Format(time.RFC3339)
+	key := fmt.Sprintf("Connection to %s is %s", destination, strings.ToLower(to.String()))
+	EventHashUpdateMutex.Lock()
+	if val, ok := ConnectionErrorEvent[key]; ok {
+		ConnectionErrorEvent[key] = KubeMonAgentEventTags{
+			FirstOccurrence: val.FirstOccurrence,
+			LastOccurrence:  eventTimeStamp,
+			Count:           val.Count + 1,
+		}
+	} else {
+		ConnectionErrorEvent[key] = KubeMonAgentEventTags{
+			FirstOccurrence: eventTimeStamp,
+			LastOccurrence:  eventTimeStamp,
+			Count:           1,
+		}
+	}
+	EventHashUpdateMutex.Unlock()
+}
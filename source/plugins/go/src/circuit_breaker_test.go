@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/logging"
+	"Docker-Provider/source/plugins/go/src/telemetry"
+)
+
+type circuitTransition struct {
+	from CircuitState
+	to   CircuitState
+}
+
+func newTestCircuitBreaker(clock *time.Time, transitions *[]circuitTransition) *CircuitBreaker {
+	cb := NewCircuitBreaker("mdsd:test", 2, time.Second, 4*time.Second)
+	cb.now = func() time.Time { return *clock }
+	cb.jitter = func(backoff time.Duration) time.Duration { return backoff }
+	cb.OnStateChange = func(destination string, from CircuitState, to CircuitState, failures int, backoff time.Duration) {
+		*transitions = append(*transitions, circuitTransition{from, to})
+	}
+	return cb
+}
+
+func TestCircuitBreakerStateTransitions(t *testing.T) {
+	clock := time.Now()
+	var transitions []circuitTransition
+	cb := newTestCircuitBreaker(&clock, &transitions)
+
+	cb.RecordFailure()
+	if cb.State() != CircuitClosed || !cb.Allow() {
+		t.Fatalf("expected circuit to stay closed below the failure threshold")
+	}
+	cb.RecordFailure()
+	if cb.State() != CircuitOpen || cb.Allow() {
+		t.Fatalf("expected circuit to open at the failure threshold")
+	}
+
+	clock = clock.Add(time.Second)
+	if !cb.Allow() || cb.State() != CircuitHalfOpen {
+		t.Fatalf("expected a single probe once the backoff expired")
+	}
+	if cb.Allow() {
+		t.Fatalf("expected only one probe while half-open")
+	}
+
+	// failed probe doubles the backoff
+	cb.RecordFailure()
+	clock = clock.Add(time.Second)
+	if cb.Allow() {
+		t.Fatalf("expected doubled backoff after a failed probe")
+	}
+	clock = clock.Add(time.Second)
+	if !cb.Allow() {
+		t.Fatalf("expected probe after the doubled backoff")
+	}
+	cb.RecordSuccess()
+	if cb.State() != CircuitClosed || !cb.Allow() {
+		t.Fatalf("expected circuit to close after a successful probe")
+	}
+
+	expected := []circuitTransition{
+		{CircuitClosed, CircuitOpen},
+		{CircuitOpen, CircuitHalfOpen},
+		{CircuitHalfOpen, CircuitOpen},
+		{CircuitOpen, CircuitHalfOpen},
+		{CircuitHalfOpen, CircuitClosed},
+	}
+	if len(transitions) != len(expected) {
+		t.Fatalf("expected transitions %v, got %v", expected, transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Errorf("transition %d: expected %v, got %v", i, expected[i], transitions[i])
+		}
+	}
+}
+
+func TestCircuitBreakerStateChangeTelemetry(t *testing.T) {
+	client := telemetry.NewMemoryClient()
+	origClient := TelemetryClient
+	TelemetryClient = client
+	defer func() { TelemetryClient = origClient }()
+
+	onCircuitBreakerStateChange("mdsd:test", CircuitOpen, CircuitHalfOpen, 3, 2*time.Second)
+
+	events := client.Find(telemetry.KindEvent, CircuitBreakerStateChangedEvent)
+	if len(events) != 1 {
+		t.Fatalf("expected a single state change event, got %+v", client.Items())
+	}
+	if properties := events[0].Properties; properties["Destination"] != "mdsd:test" || properties["ToState"] != CircuitHalfOpen.String() || properties["BackoffMs"] != "2000" {
+		t.Errorf("unexpected event properties %v", properties)
+	}
+}
+
+func TestCircuitBreakerBackoffIsCapped(t *testing.T) {
+	clock := time.Now()
+	var transitions []circuitTransition
+	cb := newTestCircuitBreaker(&clock, &transitions)
+	cb.RecordFailure()
+	cb.RecordFailure()
+	for i := 0; i < 10; i++ {
+		clock = clock.Add(cb.MaxBackoff)
+		if !cb.Allow() {
+			t.Fatalf("expected probe after the max backoff on attempt %d", i)
+		}
+		cb.RecordFailure()
+	}
+	if cb.backoff != cb.MaxBackoff {
+		t.Errorf("expected backoff to be capped at %s, got %s", cb.MaxBackoff, cb.backoff)
+	}
+}
+
+func TestFullJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if jittered := fullJitter(10 * time.Second); jittered < 5*time.Second || jittered >= 10*time.Second {
+			t.Fatalf("expected jittered backoff in [5s, 10s), got %s", jittered)
+		}
+	}
+}
+
+func TestLogConnectionErrorIsRateLimitedWhileOpen(t *testing.T) {
+	origLimiter := LogRateLimiter
+	LogRateLimiter = logging.NewRateLimiter(time.Minute)
+	defer func() { LogRateLimiter = origLimiter }()
+	clock := time.Now()
+	var transitions []circuitTransition
+	cb := newTestCircuitBreaker(&clock, &transitions)
+	const message = "Error::mdsd::mdsd connection does not exist. re-connecting ..."
+
+	// a closed circuit logs every message
+	logConnectionError(cb, message)
+	cb.RecordFailure()
+	cb.RecordFailure()
+	for i := 0; i < 3; i++ {
+		logConnectionError(cb, message)
+	}
+	// the first flush of the open circuit logged the message and the next 2 were suppressed
+	if allowed, suppressed := LogRateLimiter.Allow(cb.Destination+":"+message, time.Now().Add(time.Minute)); !allowed || suppressed != 2 {
+		t.Errorf("expected the messages of the open circuit to be rate limited, got %v with %d suppressed", allowed, suppressed)
+	}
+}
+
+// TestCreateMDSDClientCircuitBreaker dials a fake mdsd unix socket server that goes down and comes back
+func TestCreateMDSDClientCircuitBreaker(t *testing.T) {
+	socketDir := t.TempDir()
+	socketPath := filepath.Join(socketDir, "default_fluent.socket")
+	origBreakers, origThreshold, origBase := CircuitBreakers, circuitBreakerFailureThreshold, circuitBreakerBaseBackoff
+	CircuitBreakers = make(map[string]*CircuitBreaker)
+	circuitBreakerFailureThreshold, circuitBreakerBaseBackoff = 2, 50*time.Millisecond
+	defer func() {
+		CircuitBreakers, circuitBreakerFailureThreshold, circuitBreakerBaseBackoff = origBreakers, origThreshold, origBase
+		for k := range ConnectionErrorEvent {
+			delete(ConnectionErrorEvent, k)
+		}
+	}()
+
+	cb := getMdsdCircuitBreaker(HostLogs)
+	dial := func() net.Conn {
+		if !cb.Allow() {
+			return nil
+		}
+		conn, _ := dialMdsdSocket(cb, socketPath)
+		return conn
+	}
+
+	// mdsd down: the circuit opens after the failure threshold and dials are skipped
+	for i := 0; i < 2; i++ {
+		if conn := dial(); conn != nil {
+			t.Fatalf("expected dial to fail without a server")
+		}
+	}
+	if cb.State() != CircuitOpen {
+		t.Fatalf("expected circuit to be open, got %s", cb.State())
+	}
+	if dial() != nil || cb.State() != CircuitOpen {
+		t.Fatalf("expected dial to be skipped while the circuit is open")
+	}
+	if _, ok := ConnectionErrorEvent["Connection to mdsd:HostLogs is open"]; !ok {
+		t.Errorf("expected a connection error KubeMonAgentEvent, got %v", ConnectionErrorEvent)
+	}
+
+	// mdsd back: the half-open probe succeeds and closes the circuit
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %s", err.Error())
+	}
+	defer listener.Close()
+	defer os.Remove(socketPath)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	var conn net.Conn
+	for conn == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		conn = dial()
+	}
+	if conn == nil {
+		t.Fatalf("expected dial to succeed once the server is back")
+	}
+	conn.Close()
+	if cb.State() != CircuitClosed {
+		t.Errorf("expected circuit to close after a successful probe, got %s", cb.State())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"Docker-Provider/source/plugins/go/src/paths"
+)
+
+const cliUsage = `usage: out_oms <command> [arguments]
+
+commands:
+  dlq list [-dir <dir>]              list the entries of the dead-letter store
+  dlq inspect [-dir <dir>] <id>      print an entry of the dead-letter store
+  dlq redrive [-dir <dir>] <id|all>  re-send entries to their destination and remove them on success
+  dlq purge [-dir <dir>] <id|all>    remove entries from the dead-letter store
+  lint [-conf <path>] [-configmap <dir>] [-json]
+                                     print the effective configuration and its invalid or conflicting settings
+  replay [-conf <path>] [-out <dir>] [-json] <tag>=<file> ...
+                                     flush fluent-bit chunk, msgpack or NDJSON files through the plugin into a local
+                                     capture sink and print the filtered, enriched, routed and dropped records
+`
+
+// runCommand runs the out_oms subcommands when the plugin is built as an executable and returns the exit code
+func runCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "lint" {
+		return lintCommand(args[1:], stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "replay" {
+		return replayCommand(args[1:], stdout, stderr)
+	}
+	if len(args) == 0 || args[0] != "dlq" || len(args) < 2 {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("dlq "+args[1], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", getDeadLetterDir(), "directory of the dead-letter store")
+	if err := flags.Parse(args[2:]); err != nil {
+		return 2
+	}
+
+	var err error
+	switch args[1] {
+	case "list":
+		err = listDeadLettersCommand(*dir, stdout)
+	case "inspect", "redrive", "purge":
+		if flags.NArg() != 1 {
+			fmt.Fprint(stderr, cliUsage)
+			return 2
+		}
+		err = deadLetterEntryCommand(args[1], *dir, flags.Arg(0), stdout)
+	default:
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+func listDeadLettersCommand(dir string, stdout io.Writer) error {
+	entries, err := ListDeadLetters(dir)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tTIMESTAMP\tDATATYPE\tREASON\tRECORDS\tBYTES\tDESTINATION")
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", entry.ID, entry.Timestamp, entry.DataType, entry.Reason, entry.RecordCount, len(entry.Payload), entry.Destination)
+	}
+	return writer.Flush()
+}
+
+func deadLetterEntryCommand(command string, dir string, id string, stdout io.Writer) error {
+	ids := []string{id}
+	if id == "all" && command != "inspect" {
+		entries, err := ListDeadLetters(dir)
+		if err != nil {
+			return err
+		}
+		ids = nil
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+	}
+
+	var odsClient *ODSRedriveClient
+	if command == "redrive" {
+		// the ODS auth of the agent, loaded like the plugin loads it
+		odsClient = NewODSRedriveClient(LoadPluginConfig(getPluginConfFilePath(os.Getenv("OS_TYPE"), os.Getenv("CONTROLLER_TYPE")), os.Getenv, paths.Resolve(ConfigMapMountPath)))
+	}
+	failed := 0
+	for _, id := range ids {
+		var err error
+		switch command {
+		case "inspect":
+			var entry DeadLetterEntry
+			if entry, err = GetDeadLetter(dir, id); err == nil {
+				encoder := json.NewEncoder(stdout)
+				encoder.SetIndent("", "  ")
+				err = encoder.Encode(struct {
+					DeadLetterEntry
+					Payload string `json:"payload"`
+				}{entry, string(entry.Payload)})
+			}
+		case "redrive":
+			if err = RedriveDeadLetter(dir, id, odsClient); err == nil {
+				fmt.Fprintf(stdout, "re-driven %s\n", id)
+			}
+		case "purge":
+			if err = DeleteDeadLetter(dir, id); err == nil {
+				fmt.Fprintf(stdout, "purged %s\n", id)
+			}
+		}
+		if err != nil {
+			if len(ids) == 1 {
+				return err
+			}
+			fmt.Fprintf(stdout, "failed %s: %s\n", id, err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d entries failed", failed, len(ids))
+	}
+	return nil
+}
+
+// lintCommand loads the configuration like the plugin does, prints it and returns 1 if it has errors
+func lintCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	confPath := flags.String("conf", getPluginConfFilePath(os.Getenv("OS_TYPE"), os.Getenv("CONTROLLER_TYPE")), "out_oms.conf file of the plugin")
+	configMapPath := flags.String("configmap", paths.Resolve(ConfigMapMountPath), "mount directory of the agent configmap")
+	asJSON := flags.Bool("json", false, "print the configuration as JSON")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return 2
+	}
+
+	config := LoadPluginConfig(*confPath, os.Getenv, *configMapPath)
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(struct {
+			ConfFile             string          `json:"confFile"`
+			ContainerLogsRouteV2 bool            `json:"containerLogsRouteV2"`
+			ContainerLogSchemaV2 bool            `json:"containerLogSchemaV2"`
+			Settings             []ConfigSetting `json:"settings"`
+			Issues               []ConfigIssue   `json:"issues"`
+		}{config.ConfFilePath, config.ContainerLogsRouteV2(), config.ContainerLogSchemaV2(), config.Settings, config.Issues})
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %s\n", err.Error())
+			return 1
+		}
+	} else {
+		writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "SETTING\tVALUE\tSOURCE")
+		for _, setting := range config.Settings {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", setting.Name, setting.Value, setting.Source)
+		}
+		writer.Flush()
+		fmt.Fprintf(stdout, "\nconf file: %s\ncontainer logs route v2: %v\ncontainer log schema v2: %v\n", config.ConfFilePath, config.ContainerLogsRouteV2(), config.ContainerLogSchemaV2())
+		if len(config.Issues) > 0 {
+			fmt.Fprintln(stdout)
+		}
+		for _, issue := range config.Issues {
+			fmt.Fprintf(stdout, "%s: %s: %s\n", issue.Severity, issue.Setting, issue.Message)
+		}
+	}
+	if config.HasErrors() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"Docker-Provider/source/plugins/go/src/logging"
+	"Docker-Provider/source/plugins/go/src/paths"
+	"Docker-Provider/source/plugins/go/src/telemetry"
+)
+
+// ConfigMapMountPath is where the container-azm-ms-agentconfig configmap is mounted
+const ConfigMapMountPath = "/etc/config/settings"
+
+// configmap schema version supported by the agent
+const supportedConfigMapSchemaVersion = "v1"
+
+// ConfigIssueSeverity of an invalid or conflicting setting
+type ConfigIssueSeverity string
+
+const (
+	// ConfigIssueError settings the plugin can't run with or that are ignored in a way that changes the collected data
+	ConfigIssueError ConfigIssueSeverity = "error"
+	// ConfigIssueWarning settings that fall back to their default or have no effect
+	ConfigIssueWarning ConfigIssueSeverity = "warning"
+)
+
+// Sources of a setting value
+const (
+	ConfigSourceEnv       = "env"
+	ConfigSourceConfFile  = "conf"
+	ConfigSourceConfigMap = "configmap"
+	ConfigSourceDefault   = "default"
+)
+
+// ConfigIssue is an invalid or conflicting setting found while loading the configuration
+type ConfigIssue struct {
+	Severity ConfigIssueSeverity `json:"severity"`
+	Setting  string              `json:"setting"`
+	Message  string              `json:"message"`
+}
+
+// ConfigSetting is a loaded setting with the source of its value
+type ConfigSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// PluginConfig is the typed configuration of the plugin, loaded from the env, the out_oms.conf file and the configmap mount
+type PluginConfig struct {
+	// out_oms.conf
+	ConfFilePath                             string
+	ConfProperties                           map[string]string
+	ContainerHostFilePath                    string
+	ProxySecretPath                          string
+	ContainerInventoryRefreshIntervalSeconds int
+
+	// configmap mount
+	ConfigMapSchemaVersion string
+	ConfigMapConfigVersion string
+
+	// deployment
+	OSType               string
+	ControllerType       string
+	ContainerType        string
+	ContainerRuntime     string
+	Hostname             string
+	WorkspaceID          string
+	WorkspaceDomain      string
+	ResourceID           string
+	ResourceName         string
+	AADMSIAuthMode       bool
+	IgnoreProxySettings  bool
+	Proxy                string
+	DockerCimprovVersion string
+
+	// container logs
+	ContainerLogsRoute                    string
+	ContainerLogSchemaVersion             string
+	GenevaLogsIntegration                 bool
+	GenevaLogsIntegrationServiceMode      bool
+	MultiTenancyLogCollection             bool
+	MultiTenancyLogCollectionAdvancedMode bool
+	MultiTenancyLogsServiceMode           bool
+	ContainerLogEnrichment                bool
+	CollectStdoutLogs                     bool
+	CollectStderrLogs                     bool
+	StdoutExcludedNamespaces              []string
+	StderrExcludedNamespaces              []string
+	StdoutIncludedSystemPods              []string
+	StderrIncludedSystemPods              []string
+	HostLogSourceName                     string
+	TailExcludePath                       []string
+
+	// kubernetes metadata
+	KubernetesMetadataEnabled        bool
+	KubernetesMetadataIncludeFields  []string
+	KubernetesMetadataLabelKeys      []string
+	KubernetesMetadataAnnotationKeys []string
+	KubernetesMetadataNodeLabelKeys  []string
+
+	// features
+	TraceContextExtractionEnabled    bool
+	TraceContextPatterns             []string
+	VerboseCollectionOverrideEnabled bool
+	DeadLetterEnabled                bool
+	DeadLetterDir                    string
+	DeadLetterMaxSizeMB              int
+	DeadLetterMaxRetries             int
+	CircuitBreakerFailureThreshold   int
+	CircuitBreakerBaseBackoffSeconds int
+	CircuitBreakerMaxBackoffSeconds  int
+	PriorityLanesEnabled             bool
+	PriorityLaneQueueSizes           map[LanePriority]int
+	DroppedRecordLogSampleRate       int
+	DeliveryLatencyMetricsEnabled    bool
+	ConfigHotReloadEnabled           bool
+	DiagnosticsServerEnabled         bool
+	DiagnosticsServerPort            int
+	HealthServerEnabled              bool
+	HealthServerPort                 int
+	HealthStatusFile                 string
+	PrometheusMetricsEnabled         bool
+	PrometheusMetricsPort            int
+	PrometheusMetricsListenAddress   string
+	ShutdownTimeoutSeconds           int
+	LogLevel                         string
+	LogComponentLevels               string
+	LogFormat                        string
+	LogRateLimitSeconds              int
+	RootDir                          string
+	PathOverrides                    string
+	LocalMode                        bool
+	LocalAPIServerURL                string
+	DebugTeeEnabled                  bool
+	DebugTeePath                     string
+	DebugTeeMaxSizeMB                int
+	DebugTeeSampleRate               int
+	DebugTeeNamespaces               []string
+	DebugTeeDurationMinutes          int
+	ConfigSnapshotEnabled            bool
+	ConfigSnapshotIntervalHours      int
+	SchemaValidationEnabled          bool
+	SchemaValidationLogSampleRate    int
+	ThrottlingEnabled                bool
+	ThrottlingMemoryPercent          int
+	ThrottlingCPUPercent             int
+	ThrottlingSampleRate             int
+	ThrottlingBatchSize              int
+	ThrottlingLowPriorityNamespaces  []string
+	ThrottlingIntervalSeconds        int
+
+	// telemetry
+	TelemetryDisabled     bool
+	TelemetryBackend      string
+	TelemetryOTLPEndpoint string
+	TelemetryOTLPHeaders  string
+	TelemetryFilePath     string
+
+	// input plugin, the input lib reads these from the env itself. They are loaded here so that lint reports them
+	NodeIP                     string
+	KubernetesServiceHost      string
+	KubernetesServicePort      string
+	SecureCAdvisorPort         bool
+	PVCollectKubeSystemMetrics bool
+
+	// health check staleness thresholds
+	HealthFlushStalenessSeconds           int
+	HealthTokenStalenessSeconds           int
+	HealthExtensionConfigStalenessSeconds int
+	HealthInputPluginStalenessSeconds     int
+
+	// Settings in load order with the source of their value
+	Settings []ConfigSetting
+	// Issues found while loading the configuration
+	Issues []ConfigIssue
+}
+
+var (
+	// PluginSettings is the configuration InitializePlugin was loaded with, updated by configmap reloads
+	PluginSettings *PluginConfig
+	// PluginSettingsMutex read and write mutex access to PluginSettings
+	PluginSettingsMutex = &sync.RWMutex{}
+)
+
+func setPluginSettings(config *PluginConfig) {
+	PluginSettingsMutex.Lock()
+	defer PluginSettingsMutex.Unlock()
+	PluginSettings = config
+}
+
+// getPluginSettings returns the current configuration, nil before InitializePlugin
+func getPluginSettings() *PluginConfig {
+	PluginSettingsMutex.RLock()
+	defer PluginSettingsMutex.RUnlock()
+	return PluginSettings
+}
+
+// configLoader reads the settings of a PluginConfig and records their source and issues
+type configLoader struct {
+	getenv        func(string) string
+	conf          map[string]string
+	configMapPath string
+	config        *PluginConfig
+}
+
+func (l *configLoader) issue(severity ConfigIssueSeverity, setting string, format string, args ...interface{}) {
+	l.config.Issues = append(l.config.Issues, ConfigIssue{Severity: severity, Setting: setting, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *configLoader) record(name string, value string, source string) {
+	l.config.Settings = append(l.config.Settings, ConfigSetting{Name: name, Value: value, Source: source})
+}
+
+// override replaces the recorded value of a setting, a setting that wasn't recorded yet is added
+func (l *configLoader) override(name string, value string, source string) {
+	for i := range l.config.Settings {
+		if l.config.Settings[i].Name == name {
+			l.config.Settings[i].Value, l.config.Settings[i].Source = value, source
+			return
+		}
+	}
+	l.record(name, value, source)
+}
+
+// envString returns the trimmed value of the env variable or the default
+func (l *configLoader) envString(name string, defaultValue string) string {
+	if value := strings.TrimSpace(l.getenv(name)); value != "" {
+		l.record(name, value, ConfigSourceEnv)
+		return value
+	}
+	l.record(name, defaultValue, ConfigSourceDefault)
+	return defaultValue
+}
+
+// envSecret is envString for values that must not be printed, the setting records a hash of the value
+func (l *configLoader) envSecret(name string) string {
+	value := strings.TrimSpace(l.getenv(name))
+	if value == "" {
+		l.record(name, "", ConfigSourceDefault)
+		return ""
+	}
+	l.record(name, redactSecret(value), ConfigSourceEnv)
+	return value
+}
+
+// envURL is envString for URLs that may have credentials, the setting records a hash of the user info
+func (l *configLoader) envURL(name string, defaultValue string) string {
+	value := strings.TrimSpace(l.getenv(name))
+	if value == "" {
+		l.record(name, defaultValue, ConfigSourceDefault)
+		return defaultValue
+	}
+	l.record(name, redactURLCredentials(value), ConfigSourceEnv)
+	return value
+}
+
+// redactURLCredentials returns the url with its user info replaced by a hash, a url that can't be parsed is hashed
+// as a whole
+func redactURLCredentials(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return redactSecret(value)
+	}
+	if u.User == nil {
+		return value
+	}
+	userInfo := u.User.String()
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//"+redactSecret(userInfo)+"@", 1)
+}
+
+// redactSecret returns a short hash of the secret, enough to tell that it changed without revealing it
+func redactSecret(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "<redacted sha256:" + hex.EncodeToString(sum[:])[:12] + ">"
+}
+
+// envBool accepts true or false in any case, other values fall back to the default with a warning
+func (l *configLoader) envBool(name string, defaultValue bool) bool {
+	value := strings.TrimSpace(l.getenv(name))
+	if value == "" {
+		l.record(name, strconv.FormatBool(defaultValue), ConfigSourceDefault)
+		return defaultValue
+	}
+	switch strings.ToLower(value) {
+	case "true":
+		l.record(name, "true", ConfigSourceEnv)
+		return true
+	case "false":
+		l.record(name, "false", ConfigSourceEnv)
+		return false
+	}
+	l.issue(ConfigIssueWarning, name, "invalid boolean %q, using %v", value, defaultValue)
+	l.record(name, strconv.FormatBool(defaultValue), ConfigSourceDefault)
+	return defaultValue
+}
+
+// inputEnvBool is envBool for the settings of the input plugin, which only matches the lower case values as is
+func (l *configLoader) inputEnvBool(name string, defaultValue bool) bool {
+	value := l.envBool(name, defaultValue)
+	if raw := l.getenv(name); raw != "true" && raw != "false" && strings.EqualFold(strings.TrimSpace(raw), strconv.FormatBool(value)) {
+		l.issue(ConfigIssueWarning, name, "the input plugin only accepts %q, %q is ignored by it", strconv.FormatBool(value), raw)
+	}
+	return value
+}
+
+// envInt accepts integers of at least minValue, other values fall back to the default with a warning
+func (l *configLoader) envInt(name string, defaultValue int, minValue int) int {
+	return l.parseInt(name, strings.TrimSpace(l.getenv(name)), ConfigSourceEnv, defaultValue, minValue)
+}
+
+func (l *configLoader) parseInt(name string, value string, source string, defaultValue int, minValue int) int {
+	if value == "" {
+		l.record(name, strconv.Itoa(defaultValue), ConfigSourceDefault)
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < minValue {
+		l.issue(ConfigIssueWarning, name, "invalid value %q, expected an integer of at least %d. Using %d", value, minValue, defaultValue)
+		l.record(name, strconv.Itoa(defaultValue), ConfigSourceDefault)
+		return defaultValue
+	}
+	l.record(name, value, source)
+	return parsed
+}
+
+// envList splits the env variable on sep and drops empty items
+func (l *configLoader) envList(name string, sep string, defaultValue string) []string {
+	source := ConfigSourceEnv
+	value := l.getenv(name)
+	if strings.TrimSpace(value) == "" {
+		source, value = ConfigSourceDefault, defaultValue
+	}
+	var items []string
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	l.record(name, strings.Join(items, sep), source)
+	return items
+}
+
+// envChoice returns the lower case value of the env variable if it is one of choices, otherwise the default with a warning
+func (l *configLoader) envChoice(name string, defaultValue string, choices ...string) string {
+	value := strings.ToLower(strings.TrimSpace(l.getenv(name)))
+	if value == "" {
+		l.record(name, defaultValue, ConfigSourceDefault)
+		return defaultValue
+	}
+	for _, choice := range choices {
+		if value == choice {
+			l.record(name, value, ConfigSourceEnv)
+			return value
+		}
+	}
+	l.issue(ConfigIssueWarning, name, "unknown value %q, expected one of %s. Using %q", value, strings.Join(choices, ", "), defaultValue)
+	l.record(name, defaultValue, ConfigSourceDefault)
+	return defaultValue
+}
+
+func (l *configLoader) confString(key string) string {
+	value, ok := l.conf[key]
+	if !ok {
+		l.record(key, "", ConfigSourceDefault)
+		return ""
+	}
+	l.record(key, value, ConfigSourceConfFile)
+	return value
+}
+
+func (l *configLoader) confInt(key string, defaultValue int, minValue int) int {
+	return l.parseInt(key, strings.TrimSpace(l.conf[key]), ConfigSourceConfFile, defaultValue, minValue)
+}
+
+// configMapString returns the content of a file of the configmap mount, empty if the configmap isn't mounted
+func (l *configLoader) configMapString(file string) string {
+	if l.configMapPath == "" {
+		return ""
+	}
+	content, err := os.ReadFile(filepath.Join(l.configMapPath, file))
+	if err != nil {
+		return ""
+	}
+	value := strings.TrimSpace(string(content))
+	l.record("configmap/"+file, value, ConfigSourceConfigMap)
+	return value
+}
+
+// LoadPluginConfig loads the configuration from the conf file at confPath, the env and the configmap mount
+func LoadPluginConfig(confPath string, getenv func(string) string, configMapPath string) *PluginConfig {
+	conf, err := readConfigurationFile(confPath)
+	config := NewPluginConfig(conf, getenv, configMapPath)
+	config.ConfFilePath = confPath
+	if err != nil {
+		config.Issues = append([]ConfigIssue{{Severity: ConfigIssueError, Setting: confPath, Message: err.Error()}}, config.Issues...)
+	}
+	return config
+}
+
+// NewPluginConfig loads the configuration from the properties of the conf file, the env and the configmap mount
+func NewPluginConfig(conf map[string]string, getenv func(string) string, configMapPath string) *PluginConfig {
+	config := &PluginConfig{ConfProperties: conf}
+	l := &configLoader{getenv: getenv, conf: conf, configMapPath: configMapPath, config: config}
+
+	config.ContainerHostFilePath = l.confString("container_host_file_path")
+	config.ProxySecretPath = l.confString("amalogsproxy_secret_path")
+	config.ContainerInventoryRefreshIntervalSeconds = l.confInt("container_inventory_refresh_interval", defaultContainerInventoryRefreshInterval, 1)
+
+	config.ConfigMapSchemaVersion = l.configMapString("schema-version")
+	config.ConfigMapConfigVersion = l.configMapString("config-version")
+
+	config.OSType = strings.ToLower(l.envString("OS_TYPE", "linux"))
+	config.ControllerType = strings.ToLower(l.envString("CONTROLLER_TYPE", ""))
+	config.ContainerType = l.envString(ContainerTypeEnv, "")
+	config.ContainerRuntime = l.envString(ContainerRuntimeEnv, "")
+	config.Hostname = l.envString("HOSTNAME", "")
+	config.WorkspaceID = l.envString("WSID", "")
+	config.WorkspaceDomain = l.envString("DOMAIN", "")
+	config.ResourceID = l.envString(envAKSResourceID, "")
+	config.ResourceName = l.envString(ResourceNameEnv, "")
+	config.AADMSIAuthMode = l.envBool(AADMSIAuthMode, false)
+	config.IgnoreProxySettings = l.envBool("IGNORE_PROXY_SETTINGS", false)
+	config.Proxy = l.envSecret("PROXY")
+	config.DockerCimprovVersion = l.envString("DOCKER_CIMPROV_VERSION", "")
+
+	config.ContainerLogsRoute = l.envChoice("AZMON_CONTAINER_LOGS_ROUTE", "", ContainerLogsV2Route, "v1", ContainerLogsADXRoute)
+	config.ContainerLogSchemaVersion = l.envChoice("AZMON_CONTAINER_LOG_SCHEMA_VERSION", "", "v1", ContainerLogV2SchemaVersion)
+	config.GenevaLogsIntegration = l.envBool("GENEVA_LOGS_INTEGRATION", false)
+	config.GenevaLogsIntegrationServiceMode = l.envBool("GENEVA_LOGS_INTEGRATION_SERVICE_MODE", false)
+	config.MultiTenancyLogCollection = l.envBool("AZMON_MULTI_TENANCY_LOG_COLLECTION", false)
+	config.MultiTenancyLogCollectionAdvancedMode = l.envBool("AZMON_MULTI_TENANCY_LOG_COLLECTION_ADVANCED_MODE", false)
+	config.MultiTenancyLogsServiceMode = l.envBool("AZMON_MULTI_TENANCY_LOGS_SERVICE_MODE", false)
+	config.ContainerLogEnrichment = l.envBool("AZMON_CLUSTER_CONTAINER_LOG_ENRICH", false)
+	// both streams are collected without the configmap, like tomlparser.rb
+	config.CollectStdoutLogs = l.envBool("AZMON_COLLECT_STDOUT_LOGS", true)
+	config.CollectStderrLogs = l.envBool("AZMON_COLLECT_STDERR_LOGS", true)
+	config.StdoutExcludedNamespaces = l.envList("AZMON_STDOUT_EXCLUDED_NAMESPACES", ",", "")
+	config.StderrExcludedNamespaces = l.envList("AZMON_STDERR_EXCLUDED_NAMESPACES", ",", "")
+	config.StdoutIncludedSystemPods = l.envList("AZMON_STDOUT_INCLUDED_SYSTEM_PODS", ",", "")
+	config.StderrIncludedSystemPods = l.envList("AZMON_STDERR_INCLUDED_SYSTEM_PODS", ",", "")
+	config.HostLogSourceName = l.envString(HostLogSourceNameEnv, "")
+	// Exclude_Path of the container log tail, set by tomlparser.rb from the namespaces excluded for both streams
+	config.TailExcludePath = l.envList("AZMON_CLUSTER_LOG_TAIL_EXCLUDE_PATH", ",", "")
+
+	config.KubernetesMetadataEnabled = l.envBool("AZMON_KUBERNETES_METADATA_ENABLED", false)
+	config.KubernetesMetadataIncludeFields = l.envList("AZMON_KUBERNETES_METADATA_INCLUDES_FIELDS", ",", "")
+	for i, field := range config.KubernetesMetadataIncludeFields {
+		config.KubernetesMetadataIncludeFields[i] = strings.ToLower(field)
+	}
+	config.KubernetesMetadataLabelKeys = l.envList(KubernetesMetadataLabelKeysEnv, ",", "")
+	config.KubernetesMetadataAnnotationKeys = l.envList(KubernetesMetadataAnnotationKeysEnv, ",", "")
+	config.KubernetesMetadataNodeLabelKeys = l.envList(KubernetesMetadataNodeLabelKeysEnv, ",", defaultKubernetesMetadataNodeLabelKeys)
+	// the configmap is the source of the log collection settings tomlparser.rb exports to the env at startup
+	if err := l.configMapLogCollectionSettings(); err != nil {
+		l.issue(ConfigIssueError, "configmap/"+LogDataCollectionSettingsFile, "%s, using the log collection settings of the env", err.Error())
+	}
+
+	config.TraceContextExtractionEnabled = l.envBool(TraceContextExtractionEnabledEnv, false)
+	config.TraceContextPatterns = l.envList(TraceContextPatternsEnv, traceContextPatternSeparator, "")
+	config.VerboseCollectionOverrideEnabled = l.envBool(VerboseCollectionOverrideEnabledEnv, false)
+	config.DeadLetterEnabled = l.envBool(DeadLetterEnabledEnv, false)
+	defaultDir := defaultDeadLetterDir
+	if config.OSType == "windows" {
+		defaultDir = defaultWindowsDeadLetterDir
+	}
+	config.DeadLetterDir = l.envString(DeadLetterDirEnv, defaultDir)
+	config.DeadLetterMaxSizeMB = l.envInt(DeadLetterMaxSizeMBEnv, defaultDeadLetterMaxSizeMB, 1)
+	config.DeadLetterMaxRetries = l.envInt(DeadLetterMaxRetriesEnv, defaultDeadLetterMaxRetries, 0)
+	config.CircuitBreakerFailureThreshold = l.envInt(CircuitBreakerFailureThresholdEnv, defaultCircuitBreakerFailureThreshold, 1)
+	config.CircuitBreakerBaseBackoffSeconds = l.envInt(CircuitBreakerBaseBackoffSecondsEnv, int(defaultCircuitBreakerBaseBackoff.Seconds()), 1)
+	config.CircuitBreakerMaxBackoffSeconds = l.envInt(CircuitBreakerMaxBackoffSecondsEnv, int(defaultCircuitBreakerMaxBackoff.Seconds()), 1)
+	config.PriorityLanesEnabled = l.envBool(PriorityLanesEnabledEnv, false)
+	config.PriorityLaneQueueSizes = make(map[LanePriority]int)
+	for _, priority := range []LanePriority{LaneHigh, LaneMedium, LaneLow} {
+		name := fmt.Sprintf(priorityLaneQueueSizeEnvFormat, strings.ToUpper(priority.String()))
+		config.PriorityLaneQueueSizes[priority] = l.envInt(name, defaultLaneSettings[priority].queueSize, 1)
+	}
+	config.DroppedRecordLogSampleRate = l.envInt(DroppedRecordLogSampleRateEnv, 0, 0)
+	config.DeliveryLatencyMetricsEnabled = l.envBool(DeliveryLatencyMetricsEnabledEnv, true)
+	config.ConfigHotReloadEnabled = l.envBool(ConfigHotReloadEnabledEnv, true)
+	config.DiagnosticsServerEnabled = l.envBool(DiagnosticsServerEnabledEnv, false)
+	config.DiagnosticsServerPort = l.envInt(DiagnosticsServerPortEnv, defaultDiagnosticsServerPort, 1)
+	config.HealthServerEnabled = l.envBool(HealthServerEnabledEnv, false)
+	config.HealthServerPort = l.envInt(HealthServerPortEnv, defaultHealthServerPort, 1)
+	config.HealthStatusFile = l.envString(HealthStatusFileEnv, "")
+	config.PrometheusMetricsEnabled = l.envBool(PrometheusMetricsEnabledEnv, false)
+	config.PrometheusMetricsPort = l.envInt(PrometheusMetricsPortEnv, defaultPrometheusMetricsPort, 1)
+	config.PrometheusMetricsListenAddress = l.envString(PrometheusMetricsListenAddressEnv, defaultPrometheusMetricsListenAddress)
+	config.ShutdownTimeoutSeconds = l.envInt(ShutdownTimeoutSecondsEnv, defaultShutdownTimeoutSeconds, 1)
+	config.LogLevel = l.envChoice(logging.LevelEnv, "info", "debug", "info", "warn", "warning", "error")
+	config.LogComponentLevels = l.envString(logging.ComponentLevelsEnv, "")
+	config.LogFormat = l.envChoice(logging.FormatEnv, logging.FormatText, logging.FormatText, logging.FormatJSON)
+	config.LogRateLimitSeconds = l.envInt(LogRateLimitSecondsEnv, defaultLogRateLimitSeconds, 0)
+	config.RootDir = l.envString(paths.RootDirEnv, "")
+	config.PathOverrides = l.envString(paths.OverridesEnv, "")
+	config.LocalMode = l.envBool(paths.LocalModeEnv, false)
+	config.LocalAPIServerURL = l.envURL(paths.APIServerURLEnv, paths.DefaultAPIServerURL)
+	config.DebugTeeEnabled = l.envBool(DebugTeeEnabledEnv, false)
+	defaultTeePath := defaultDebugTeePath
+	if config.OSType == "windows" {
+		defaultTeePath = defaultWindowsDebugTeePath
+	}
+	config.DebugTeePath = l.envString(DebugTeePathEnv, defaultTeePath)
+	config.DebugTeeMaxSizeMB = l.envInt(DebugTeeMaxSizeMBEnv, defaultDebugTeeMaxSizeMB, 1)
+	config.DebugTeeSampleRate = l.envInt(DebugTeeSampleRateEnv, 1, 1)
+	config.DebugTeeNamespaces = l.envList(DebugTeeNamespacesEnv, ",", "")
+	config.DebugTeeDurationMinutes = l.envInt(DebugTeeDurationMinutesEnv, defaultDebugTeeDurationMinutes, 1)
+	config.ConfigSnapshotEnabled = l.envBool(ConfigSnapshotEnabledEnv, false)
+	config.ConfigSnapshotIntervalHours = l.envInt(ConfigSnapshotIntervalHoursEnv, defaultConfigSnapshotIntervalHours, 1)
+	config.SchemaValidationEnabled = l.envBool(SchemaValidationEnabledEnv, false)
+	config.SchemaValidationLogSampleRate = l.envInt(SchemaValidationLogSampleRateEnv, defaultSchemaValidationLogSampleRate, 0)
+	config.ThrottlingEnabled = l.envBool(ResourceThrottlingEnabledEnv, false)
+	config.ThrottlingMemoryPercent = l.envInt(ResourceThrottlingMemoryPercentEnv, defaultResourceThrottlingMemoryPercent, 1)
+	config.ThrottlingCPUPercent = l.envInt(ResourceThrottlingCPUPercentEnv, defaultResourceThrottlingCPUPercent, 1)
+	config.ThrottlingSampleRate = l.envInt(ResourceThrottlingSampleRateEnv, defaultResourceThrottlingSampleRate, 1)
+	config.ThrottlingBatchSize = l.envInt(ResourceThrottlingBatchSizeEnv, defaultResourceThrottlingBatchSize, 1)
+	config.ThrottlingLowPriorityNamespaces = l.envList(ResourceThrottlingLowPriorityNamespacesEnv, ",", "")
+	config.ThrottlingIntervalSeconds = l.envInt(ResourceThrottlingIntervalSecondsEnv, defaultResourceThrottlingIntervalSeconds, 1)
+	config.TelemetryDisabled = l.envBool("DISABLE_TELEMETRY", false)
+	config.TelemetryBackend = l.envChoice(telemetry.BackendEnv, telemetry.BackendAppInsights, telemetry.BackendAppInsights, telemetry.BackendOTLP, telemetry.BackendFile, telemetry.BackendNoop)
+	config.TelemetryOTLPEndpoint = l.envURL(telemetry.OTLPEndpointEnv, telemetry.DefaultOTLPEndpoint)
+	config.TelemetryOTLPHeaders = l.envSecret(telemetry.OTLPHeadersEnv)
+	defaultTelemetryFile := defaultTelemetryFilePath
+	if config.OSType == "windows" {
+		defaultTelemetryFile = defaultWindowsTelemetryFilePath
+	}
+	config.TelemetryFilePath = l.envString(telemetry.FilePathEnv, defaultTelemetryFile)
+	config.HealthFlushStalenessSeconds = l.envInt(HealthFlushStalenessSecondsEnv, defaultHealthFlushStalenessSeconds, 1)
+	config.HealthTokenStalenessSeconds = l.envInt(HealthTokenStalenessSecondsEnv, defaultHealthTokenStalenessSeconds, 1)
+	config.HealthExtensionConfigStalenessSeconds = l.envInt(HealthExtensionConfigStalenessSecondsEnv, defaultHealthExtensionConfigStalenessSeconds, 1)
+	config.HealthInputPluginStalenessSeconds = l.envInt(HealthInputPluginStalenessSecondsEnv, defaultHealthInputPluginStalenessSeconds, 1)
+	config.NodeIP = l.envString("NODE_IP", "")
+	config.KubernetesServiceHost = l.envString("KUBERNETES_SERVICE_HOST", "")
+	config.KubernetesServicePort = l.envString("KUBERNETES_PORT_443_TCP_PORT", "")
+	config.SecureCAdvisorPort = l.inputEnvBool("IS_SECURE_CADVISOR_PORT", false)
+	config.PVCollectKubeSystemMetrics = l.inputEnvBool("AZMON_PV_COLLECT_KUBE_SYSTEM_METRICS", true)
+
+	config.validate(l)
+	return config
+}
+
+// IsWindows returns true for the windows agent
+func (config *PluginConfig) IsWindows() bool {
+	return config.OSType == "windows" && !config.GenevaLogsIntegrationServiceMode
+}
+
+// ContainerLogsRouteV2 returns true if container logs are sent through mdsd/ama instead of ODS direct
+func (config *PluginConfig) ContainerLogsRouteV2() bool {
+	if config.GenevaLogsIntegration {
+		return true
+	}
+	return config.ContainerLogsRoute != ContainerLogsADXRoute && (!config.IsWindows() || config.AADMSIAuthMode)
+}
+
+// ContainerLogSchemaV2 returns true if the configmap selects the ContainerLogV2 schema
+func (config *PluginConfig) ContainerLogSchemaV2() bool {
+	return config.ContainerLogSchemaVersion == ContainerLogV2SchemaVersion
+}
+
+// HasErrors returns true if an issue has the error severity
+func (config *PluginConfig) HasErrors() bool {
+	for _, issue := range config.Issues {
+		if issue.Severity == ConfigIssueError {
+			return true
+		}
+	}
+	return false
+}
+
+// validate flags required settings that are missing and settings that conflict or have no effect
+func (config *PluginConfig) validate(l *configLoader) {
+	if !config.GenevaLogsIntegrationServiceMode {
+		if config.WorkspaceID == "" && !config.IsWindows() {
+			l.issue(ConfigIssueError, "WSID", "workspace id is required")
+		}
+		if config.WorkspaceDomain == "" && !config.IsWindows() {
+			l.issue(ConfigIssueError, "DOMAIN", "workspace domain is required")
+		}
+	}
+
+	switch config.ContainerLogsRoute {
+	case ContainerLogsADXRoute:
+		l.issue(ConfigIssueError, "AZMON_CONTAINER_LOGS_ROUTE", "ADX route has been deprecated")
+		if config.GenevaLogsIntegration {
+			l.issue(ConfigIssueError, "AZMON_CONTAINER_LOGS_ROUTE", "ADX route conflicts with GENEVA_LOGS_INTEGRATION, container logs are routed through v2")
+		} else if config.ContainerLogSchemaV2() {
+			l.issue(ConfigIssueError, "AZMON_CONTAINER_LOG_SCHEMA_VERSION", "ADX route conflicts with the v2 schema, which requires route v2")
+		}
+	case "v1":
+		if config.ContainerLogsRouteV2() {
+			l.issue(ConfigIssueWarning, "AZMON_CONTAINER_LOGS_ROUTE", "route v1 is ignored on linux, in AAD MSI auth mode and with geneva logs integration, container logs are routed through v2")
+		}
+	}
+
+	if config.MultiTenancyLogCollectionAdvancedMode && !config.MultiTenancyLogCollection {
+		l.issue(ConfigIssueWarning, "AZMON_MULTI_TENANCY_LOG_COLLECTION_ADVANCED_MODE", "has no effect without AZMON_MULTI_TENANCY_LOG_COLLECTION")
+	}
+	if (config.MultiTenancyLogCollection || config.MultiTenancyLogsServiceMode) && !config.AADMSIAuthMode {
+		l.issue(ConfigIssueWarning, "AZMON_MULTI_TENANCY_LOG_COLLECTION", "multi-tenancy log collection requires AAD MSI auth mode")
+	}
+	if config.MultiTenancyLogCollection && config.ContainerLogSchemaVersion == "v1" {
+		l.issue(ConfigIssueWarning, "AZMON_MULTI_TENANCY_LOG_COLLECTION", "multi-tenancy only applies to the ContainerLogV2 schema")
+	}
+
+	if !config.KubernetesMetadataEnabled {
+		for name, values := range map[string][]string{
+			"AZMON_KUBERNETES_METADATA_INCLUDES_FIELDS": config.KubernetesMetadataIncludeFields,
+			KubernetesMetadataLabelKeysEnv:              config.KubernetesMetadataLabelKeys,
+			KubernetesMetadataAnnotationKeysEnv:         config.KubernetesMetadataAnnotationKeys,
+		} {
+			if len(values) > 0 {
+				l.issue(ConfigIssueWarning, name, "has no effect without AZMON_KUBERNETES_METADATA_ENABLED")
+			}
+		}
+	}
+
+	for _, stream := range []struct {
+		collect  bool
+		name     string
+		excluded []string
+		included []string
+	}{
+		{config.CollectStdoutLogs, "STDOUT", config.StdoutExcludedNamespaces, config.StdoutIncludedSystemPods},
+		{config.CollectStderrLogs, "STDERR", config.StderrExcludedNamespaces, config.StderrIncludedSystemPods},
+	} {
+		if !stream.collect && (len(stream.excluded) > 0 || len(stream.included) > 0) {
+			l.issue(ConfigIssueWarning, "AZMON_COLLECT_"+stream.name+"_LOGS", "excluded namespaces and included system pods have no effect while %s collection is disabled", strings.ToLower(stream.name))
+		}
+		for _, pod := range stream.included {
+			if !strings.Contains(pod, ":") {
+				l.issue(ConfigIssueWarning, "AZMON_"+stream.name+"_INCLUDED_SYSTEM_PODS", "ignoring %q, expected namespace:controller", pod)
+			}
+		}
+	}
+
+	if config.TraceContextExtractionEnabled {
+		for _, pattern := range config.TraceContextPatterns {
+			if compiled, err := regexp.Compile(pattern); err != nil {
+				l.issue(ConfigIssueWarning, TraceContextPatternsEnv, "ignoring invalid pattern %s: %s", pattern, err.Error())
+			} else if compiled.SubexpIndex("trace_id") == -1 {
+				l.issue(ConfigIssueWarning, TraceContextPatternsEnv, "ignoring pattern %s without trace_id named group", pattern)
+			}
+		}
+	} else if len(config.TraceContextPatterns) > 0 {
+		l.issue(ConfigIssueWarning, TraceContextPatternsEnv, "has no effect without %s", TraceContextExtractionEnabledEnv)
+	}
+
+	if config.CircuitBreakerBaseBackoffSeconds > config.CircuitBreakerMaxBackoffSeconds {
+		l.issue(ConfigIssueWarning, CircuitBreakerBaseBackoffSecondsEnv, "base backoff %ds is above the max backoff %ds", config.CircuitBreakerBaseBackoffSeconds, config.CircuitBreakerMaxBackoffSeconds)
+	}
+	if config.ThrottlingMemoryPercent >= 100 {
+		l.issue(ConfigIssueWarning, ResourceThrottlingMemoryPercentEnv, "memory threshold %d%% is not below the limit, using %d%%", config.ThrottlingMemoryPercent, defaultResourceThrottlingMemoryPercent)
+		config.ThrottlingMemoryPercent = defaultResourceThrottlingMemoryPercent
+	}
+	if config.ThrottlingCPUPercent >= 100 {
+		l.issue(ConfigIssueWarning, ResourceThrottlingCPUPercentEnv, "cpu threshold %d%% is not below the limit, using %d%%", config.ThrottlingCPUPercent, defaultResourceThrottlingCPUPercent)
+		config.ThrottlingCPUPercent = defaultResourceThrottlingCPUPercent
+	}
+	if config.DiagnosticsServerPort > 65535 {
+		l.issue(ConfigIssueWarning, DiagnosticsServerPortEnv, "invalid port %d, using %d", config.DiagnosticsServerPort, defaultDiagnosticsServerPort)
+		config.DiagnosticsServerPort = defaultDiagnosticsServerPort
+	}
+	if config.HealthServerPort > 65535 {
+		l.issue(ConfigIssueWarning, HealthServerPortEnv, "invalid port %d, using %d", config.HealthServerPort, defaultHealthServerPort)
+		config.HealthServerPort = defaultHealthServerPort
+	}
+	if config.HealthServerEnabled && config.DiagnosticsServerEnabled && config.HealthServerPort == config.DiagnosticsServerPort {
+		l.issue(ConfigIssueError, HealthServerPortEnv, "port %d is also used by the diagnostics server", config.HealthServerPort)
+	}
+	if config.PrometheusMetricsPort > 65535 {
+		l.issue(ConfigIssueWarning, PrometheusMetricsPortEnv, "invalid port %d, using %d", config.PrometheusMetricsPort, defaultPrometheusMetricsPort)
+		config.PrometheusMetricsPort = defaultPrometheusMetricsPort
+	}
+	if net.ParseIP(config.PrometheusMetricsListenAddress) == nil {
+		l.issue(ConfigIssueWarning, PrometheusMetricsListenAddressEnv, "invalid listen address %s, using %s", config.PrometheusMetricsListenAddress, defaultPrometheusMetricsListenAddress)
+		config.PrometheusMetricsListenAddress = defaultPrometheusMetricsListenAddress
+	}
+	if config.PrometheusMetricsEnabled && ((config.DiagnosticsServerEnabled && config.PrometheusMetricsPort == config.DiagnosticsServerPort) || (config.HealthServerEnabled && config.PrometheusMetricsPort == config.HealthServerPort)) {
+		l.issue(ConfigIssueError, PrometheusMetricsPortEnv, "port %d is also used by the diagnostics or health server", config.PrometheusMetricsPort)
+	}
+	if config.HealthStatusFile != "" && !filepath.IsAbs(config.HealthStatusFile) {
+		l.issue(ConfigIssueWarning, HealthStatusFileEnv, "health status file %s is not an absolute path", config.HealthStatusFile)
+	}
+	if config.TelemetryBackend == telemetry.BackendOTLP && !isValidUrl(config.TelemetryOTLPEndpoint) {
+		l.issue(ConfigIssueWarning, telemetry.OTLPEndpointEnv, "invalid OTLP endpoint %s", config.TelemetryOTLPEndpoint)
+	}
+	if config.TelemetryBackend == telemetry.BackendFile && !filepath.IsAbs(config.TelemetryFilePath) {
+		l.issue(ConfigIssueWarning, telemetry.FilePathEnv, "telemetry file %s is not an absolute path", config.TelemetryFilePath)
+	}
+	if _, err := logging.ParseComponentLevels(config.LogComponentLevels); err != nil {
+		l.issue(ConfigIssueWarning, logging.ComponentLevelsEnv, "%s, skipping them", err.Error())
+	}
+	if config.RootDir != "" && !filepath.IsAbs(config.RootDir) {
+		l.issue(ConfigIssueWarning, paths.RootDirEnv, "root dir %s is not an absolute path", config.RootDir)
+	}
+	if _, err := paths.ParseOverrides(config.PathOverrides); err != nil {
+		l.issue(ConfigIssueWarning, paths.OverridesEnv, "%s, skipping them", err.Error())
+	}
+	if config.LocalMode && !isValidUrl(config.LocalAPIServerURL) {
+		l.issue(ConfigIssueError, paths.APIServerURLEnv, "invalid API server URL %s", config.LocalAPIServerURL)
+	}
+	if config.DeadLetterEnabled && !filepath.IsAbs(config.DeadLetterDir) {
+		l.issue(ConfigIssueWarning, DeadLetterDirEnv, "dead-letter dir %s is not an absolute path", config.DeadLetterDir)
+	}
+	if config.DebugTeePath != DebugTeeStdout && !filepath.IsAbs(config.DebugTeePath) {
+		l.issue(ConfigIssueWarning, DebugTeePathEnv, "debug tee path %s is neither - nor an absolute path", config.DebugTeePath)
+	}
+	if config.ConfigMapSchemaVersion != "" && !strings.EqualFold(config.ConfigMapSchemaVersion, supportedConfigMapSchemaVersion) {
+		l.issue(ConfigIssueWarning, "configmap/schema-version", "unsupported configmap schema version %s, expected %s", config.ConfigMapSchemaVersion, supportedConfigMapSchemaVersion)
+	}
+}
+
+// logConfigIssues logs the issues of the configuration
+func logConfigIssues(config *PluginConfig) {
+	for _, issue := range config.Issues {
+		if issue.Severity == ConfigIssueError {
+			Log("Error::config::%s: %s", issue.Setting, issue.Message)
+		} else {
+			Log("Warn::config::%s: %s", issue.Setting, issue.Message)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+)
+
+// env variable to disable the reload of the log-data-collection-settings configmap while the plugin is running
+const ConfigHotReloadEnabledEnv = "AZMON_CONFIG_HOT_RELOAD_ENABLED"
+
+// configmap file with the log collection settings, parsed by tomlparser.rb at startup
+const LogDataCollectionSettingsFile = "log-data-collection-settings"
+
+// kubelet updates a configmap mount by swapping symlinks, which takes a few events
+const configReloadDebounce = 2 * time.Second
+
+// defaults of tomlparser.rb for a configmap without the stream and metadata collection settings
+const defaultExcludedNamespaces = "kube-system,gatekeeper-system"
+const defaultKubernetesMetadataIncludeFields = "podlabels,podannotations,poduid,image,imageid,imagerepo,imagetag"
+
+// include fields tomlparser.rb accepts in addition to the default ones
+const optionalKubernetesMetadataIncludeFields = "namespacelabels,namespaceannotations,nodename,nodelabels,ownerreferences"
+
+// system namespaces tomlparser.rb accepts in collect_system_pod_logs
+var allowedSystemNamespaces = map[string]bool{"kube-system": true, "gatekeeper-system": true, "calico-system": true, "azure-arc": true, "kube-public": true, "kube-node-lease": true}
+
+// logDataCollectionSettings are the log_collection_settings of the configmap that are reloaded without a restart
+type logDataCollectionSettings struct {
+	LogCollectionSettings struct {
+		Stdout             logStreamSettings          `toml:"stdout"`
+		Stderr             logStreamSettings          `toml:"stderr"`
+		MetadataCollection metadataCollectionSettings `toml:"metadata_collection"`
+	} `toml:"log_collection_settings"`
+}
+
+type metadataCollectionSettings struct {
+	Enabled        *bool     `toml:"enabled"`
+	IncludeFields  *[]string `toml:"include_fields"`
+	LabelKeys      *[]string `toml:"label_keys"`
+	AnnotationKeys *[]string `toml:"annotation_keys"`
+	NodeLabelKeys  *[]string `toml:"node_label_keys"`
+}
+
+type logStreamSettings struct {
+	Enabled              *bool    `toml:"enabled"`
+	ExcludeNamespaces    []string `toml:"exclude_namespaces"`
+	CollectSystemPodLogs []string `toml:"collect_system_pod_logs"`
+}
+
+// configReloader applies changes of the configmap mount to the log collection filters
+type configReloader struct {
+	configMapPath string
+	// startup configuration, fluent-bit only tails the streams enabled at startup
+	startup *PluginConfig
+	// content of the configmap files last reloaded, to skip events that didn't change them
+	lastContent string
+}
+
+var (
+	// ConfigReloadWatcher watches the configmap mount, nil when hot reload is disabled
+	ConfigReloadWatcher *fsnotify.Watcher
+)
+
+// startConfigReloadWatcher watches the configmap mount and reloads the log collection filters when it changes
+func startConfigReloadWatcher(config *PluginConfig, configMapPath string) {
+	if !config.ConfigHotReloadEnabled {
+		Log("Config hot reload disabled")
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		Log("Error::configReload::Unable to create the configmap watcher %s", err.Error())
+		return
+	}
+	if err := watcher.Add(configMapPath); err != nil {
+		Log("Error::configReload::Unable to watch %s %s", configMapPath, err.Error())
+		watcher.Close()
+		return
+	}
+	ConfigReloadWatcher = watcher
+	reloader := &configReloader{configMapPath: configMapPath, startup: config, lastContent: readConfigMapContent(configMapPath)}
+	Log("Watching %s for log collection settings changes", configMapPath)
+	goBackground(func() { reloader.watch(watcher) })
+}
+
+func (r *configReloader) watch(watcher *fsnotify.Watcher) {
+	debounce := time.NewTimer(configReloadDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case _, ok := <-watcher.Events:
+			if !ok {
+				debounce.Stop()
+				return
+			}
+			debounce.Reset(configReloadDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				debounce.Stop()
+				return
+			}
+			Log("Error::configReload::Configmap watcher error %s", err.Error())
+		case <-debounce.C:
+			r.reload()
+		}
+	}
+}
+
+// reload applies the configmap if it changed since the last reload. Invalid settings keep the last-known-good ones
+func (r *configReloader) reload() {
+	content := readConfigMapContent(r.configMapPath)
+	if content == r.lastContent {
+		return
+	}
+	r.lastContent = content
+
+	current := getPluginSettings()
+	next, err := loadLogCollectionSettings(r.configMapPath, current)
+	if err != nil {
+		message := fmt.Sprintf("config::error::Invalid %s configmap settings, keeping the current settings: %s", LogDataCollectionSettingsFile, err.Error())
+		Log("Error::configReload::%s", message)
+		recordConfigErrorEvent(message, current.Hostname, time.Now())
+		return
+	}
+
+	// the fluent-bit kubernetes filter and the metadata cache refresh only run if the metadata was enabled at startup
+	restartRequired := restartRequiredChanges(r.startup, next)
+	next.KubernetesMetadataEnabled = current.KubernetesMetadataEnabled
+	for _, setting := range current.Settings {
+		if setting.Name == "AZMON_KUBERNETES_METADATA_ENABLED" {
+			(&configLoader{config: next}).override(setting.Name, setting.Value, setting.Source)
+		}
+	}
+
+	changes := diffLogCollectionSettings(current, next)
+	if len(changes) == 0 && len(restartRequired) == 0 {
+		Log("Info::configReload::Configmap changed without log collection settings changes")
+		return
+	}
+	for _, change := range changes {
+		Log("Info::configReload::%s", change)
+	}
+	for _, message := range restartRequired {
+		Log("Warn::configReload::%s", message)
+		recordConfigErrorEvent(message, current.Hostname, time.Now())
+	}
+	setLogCollectionFilters(newLogCollectionFilters(next))
+	setKubernetesMetadataIncludes(next)
+	setPluginSettings(next)
+	requestConfigSnapshot()
+}
+
+// restartRequiredChanges describes the changes of the configmap that fluent-bit only applies after a restart, the
+// streams and Exclude_Path of the container log tail are set at startup
+func restartRequiredChanges(startup *PluginConfig, next *PluginConfig) []string {
+	var messages []string
+	if next.CollectStdoutLogs && !startup.CollectStdoutLogs {
+		messages = append(messages, "config::warn::stdout collection was disabled at startup, fluent-bit only tails stdout after a restart")
+	}
+	if next.CollectStderrLogs && !startup.CollectStderrLogs {
+		messages = append(messages, "config::warn::stderr collection was disabled at startup, fluent-bit only tails stderr after a restart")
+	}
+	if next.KubernetesMetadataEnabled != startup.KubernetesMetadataEnabled {
+		messages = append(messages, fmt.Sprintf("config::warn::kubernetes metadata collection changed from %v to %v, it only takes effect after a restart", startup.KubernetesMetadataEnabled, next.KubernetesMetadataEnabled))
+	}
+	collected := make(map[string]bool)
+	for _, pod := range append(append([]string{}, next.StdoutIncludedSystemPods...), next.StderrIncludedSystemPods...) {
+		namespace, _, _ := strings.Cut(pod, ":")
+		collected[namespace] = true
+	}
+	var namespaces []string
+	for namespace := range tailExcludedNamespaces(startup.TailExcludePath) {
+		stdout := next.CollectStdoutLogs && !slices.Contains(next.StdoutExcludedNamespaces, namespace)
+		stderr := next.CollectStderrLogs && !slices.Contains(next.StderrExcludedNamespaces, namespace)
+		if stdout || stderr || collected[namespace] {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		messages = append(messages, fmt.Sprintf("config::warn::namespace %s was excluded from the container log tail at startup, its logs are only collected after a restart", namespace))
+	}
+	return messages
+}
+
+// tailExcludedNamespaces returns the namespaces of the *_<namespace>_*.log patterns of the tail Exclude_Path
+func tailExcludedNamespaces(excludePath []string) map[string]bool {
+	namespaces := make(map[string]bool)
+	for _, pattern := range excludePath {
+		if strings.HasPrefix(pattern, "*_") && strings.HasSuffix(pattern, "_*.log") && len(pattern) > len("*__*.log") {
+			namespaces[strings.TrimSuffix(strings.TrimPrefix(pattern, "*_"), "_*.log")] = true
+		}
+	}
+	return namespaces
+}
+
+// readConfigMapContent returns the content of the configmap files the reload depends on
+func readConfigMapContent(configMapPath string) string {
+	var content strings.Builder
+	for _, file := range []string{"schema-version", LogDataCollectionSettingsFile} {
+		data, _ := os.ReadFile(filepath.Join(configMapPath, file))
+		content.WriteString(file + "\x00" + string(data) + "\x00")
+	}
+	return content.String()
+}
+
+// loadLogCollectionSettings returns a copy of current with the log collection settings of the configmap. The
+// settings of a configmap without the log collection settings file are the defaults of tomlparser.rb
+func loadLogCollectionSettings(configMapPath string, current *PluginConfig) (*PluginConfig, error) {
+	next := *current
+	next.Issues = nil
+	next.Settings = append([]ConfigSetting(nil), current.Settings...)
+	l := &configLoader{configMapPath: configMapPath, config: &next}
+	if _, err := os.Stat(filepath.Join(configMapPath, LogDataCollectionSettingsFile)); errors.Is(err, os.ErrNotExist) {
+		setDefaultLogCollectionSettings(&next)
+		l.recordLogCollectionSettings(ConfigSourceDefault)
+		return &next, nil
+	}
+	if err := l.configMapLogCollectionSettings(); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// configMapLogCollectionSettings applies the log_collection_settings of the configmap mount like tomlparser.rb. The
+// settings are kept if the configmap isn't mounted or has no log collection settings file
+func (l *configLoader) configMapLogCollectionSettings() error {
+	if l.configMapPath == "" {
+		return nil
+	}
+	content, err := os.ReadFile(filepath.Join(l.configMapPath, LogDataCollectionSettingsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	schemaVersion, _ := os.ReadFile(filepath.Join(l.configMapPath, "schema-version"))
+	version := strings.TrimSpace(string(schemaVersion))
+	if !strings.EqualFold(version, supportedConfigMapSchemaVersion) {
+		return fmt.Errorf("unsupported configmap schema version '%s'", version)
+	}
+	var settings logDataCollectionSettings
+	if _, err := toml.Decode(string(content), &settings); err != nil {
+		return err
+	}
+
+	config := l.config
+	setDefaultLogCollectionSettings(config)
+	config.CollectStdoutLogs, config.StdoutExcludedNamespaces, config.StdoutIncludedSystemPods = applyLogStreamSettings("stdout", settings.LogCollectionSettings.Stdout, config.StdoutExcludedNamespaces)
+	config.CollectStderrLogs, config.StderrExcludedNamespaces, config.StderrIncludedSystemPods = applyLogStreamSettings("stderr", settings.LogCollectionSettings.Stderr, config.StderrExcludedNamespaces)
+	applyMetadataCollectionSettings(settings.LogCollectionSettings.MetadataCollection, config)
+	config.ConfigMapSchemaVersion = version
+	l.override("configmap/schema-version", version, ConfigSourceConfigMap)
+	l.recordLogCollectionSettings(ConfigSourceConfigMap)
+	return nil
+}
+
+// setDefaultLogCollectionSettings sets the log collection settings tomlparser.rb uses without a configmap
+func setDefaultLogCollectionSettings(config *PluginConfig) {
+	config.CollectStdoutLogs, config.StdoutExcludedNamespaces, config.StdoutIncludedSystemPods = true, strings.Split(defaultExcludedNamespaces, ","), nil
+	config.CollectStderrLogs, config.StderrExcludedNamespaces, config.StderrIncludedSystemPods = true, strings.Split(defaultExcludedNamespaces, ","), nil
+	config.KubernetesMetadataEnabled, config.KubernetesMetadataIncludeFields = false, strings.Split(defaultKubernetesMetadataIncludeFields, ",")
+	config.KubernetesMetadataLabelKeys, config.KubernetesMetadataAnnotationKeys = nil, nil
+	config.KubernetesMetadataNodeLabelKeys = strings.Split(defaultKubernetesMetadataNodeLabelKeys, ",")
+}
+
+// recordLogCollectionSettings replaces the recorded values of the log collection settings with the ones of the config
+func (l *configLoader) recordLogCollectionSettings(source string) {
+	config := l.config
+	for _, setting := range []ConfigSetting{
+		{Name: "AZMON_COLLECT_STDOUT_LOGS", Value: strconv.FormatBool(config.CollectStdoutLogs)},
+		{Name: "AZMON_STDOUT_EXCLUDED_NAMESPACES", Value: strings.Join(config.StdoutExcludedNamespaces, ",")},
+		{Name: "AZMON_STDOUT_INCLUDED_SYSTEM_PODS", Value: strings.Join(config.StdoutIncludedSystemPods, ",")},
+		{Name: "AZMON_COLLECT_STDERR_LOGS", Value: strconv.FormatBool(config.CollectStderrLogs)},
+		{Name: "AZMON_STDERR_EXCLUDED_NAMESPACES", Value: strings.Join(config.StderrExcludedNamespaces, ",")},
+		{Name: "AZMON_STDERR_INCLUDED_SYSTEM_PODS", Value: strings.Join(config.StderrIncludedSystemPods, ",")},
+		{Name: "AZMON_KUBERNETES_METADATA_ENABLED", Value: strconv.FormatBool(config.KubernetesMetadataEnabled)},
+		{Name: "AZMON_KUBERNETES_METADATA_INCLUDES_FIELDS", Value: strings.Join(config.KubernetesMetadataIncludeFields, ",")},
+		{Name: KubernetesMetadataLabelKeysEnv, Value: strings.Join(config.KubernetesMetadataLabelKeys, ",")},
+		{Name: KubernetesMetadataAnnotationKeysEnv, Value: strings.Join(config.KubernetesMetadataAnnotationKeys, ",")},
+		{Name: KubernetesMetadataNodeLabelKeysEnv, Value: strings.Join(config.KubernetesMetadataNodeLabelKeys, ",")},
+	} {
+		l.override(setting.Name, setting.Value, source)
+	}
+}
+
+// applyLogStreamSettings returns the collection toggle, excluded namespaces and included system pods of a stream like
+// tomlparser.rb, invalid system pods are skipped
+func applyLogStreamSettings(stream string, settings logStreamSettings, defaultExcluded []string) (bool, []string, []string) {
+	if settings.Enabled == nil {
+		return true, defaultExcluded, nil
+	}
+	collect := *settings.Enabled
+	if !collect {
+		return false, nil, nil
+	}
+	var excluded, included []string
+	excludedSet := make(map[string]bool)
+	for _, namespace := range settings.ExcludeNamespaces {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			excluded = append(excluded, namespace)
+			excludedSet[namespace] = true
+		}
+	}
+	for _, pod := range settings.CollectSystemPodLogs {
+		namespace, controller, _ := strings.Cut(strings.TrimSpace(pod), ":")
+		if !allowedSystemNamespaces[namespace] || excludedSet[namespace] || controller == "" {
+			Log("Warn::configReload::Skipping invalid %s collect_system_pod_logs entry %s, expected namespace:controller of a system namespace that isn't excluded", stream, pod)
+			continue
+		}
+		included = append(included, namespace+":"+controller)
+	}
+	return true, excluded, included
+}
+
+// applyMetadataCollectionSettings sets the kubernetes metadata toggle, include fields and key allowlists like
+// tomlparser.rb, include fields that don't match any known field disable the metadata
+func applyMetadataCollectionSettings(settings metadataCollectionSettings, next *PluginConfig) {
+	if settings.Enabled != nil {
+		next.KubernetesMetadataEnabled = *settings.Enabled
+		if settings.IncludeFields != nil {
+			known := make(map[string]bool)
+			for _, field := range strings.Split(defaultKubernetesMetadataIncludeFields+","+optionalKubernetesMetadataIncludeFields, ",") {
+				known[field] = true
+			}
+			var fields []string
+			match := false
+			for _, field := range *settings.IncludeFields {
+				field = strings.ToLower(field)
+				fields = append(fields, field)
+				match = match || known[field]
+			}
+			if match {
+				next.KubernetesMetadataIncludeFields = fields
+			} else {
+				Log("Warn::configReload::metadata_collection include_fields %v don't match any known field, disabling kubernetes metadata", *settings.IncludeFields)
+				next.KubernetesMetadataEnabled = false
+			}
+		}
+	}
+	trimmed := func(keys []string) []string {
+		var result []string
+		for _, key := range keys {
+			if key = strings.TrimSpace(key); key != "" {
+				result = append(result, key)
+			}
+		}
+		return result
+	}
+	if settings.LabelKeys != nil {
+		next.KubernetesMetadataLabelKeys = trimmed(*settings.LabelKeys)
+	}
+	if settings.AnnotationKeys != nil {
+		next.KubernetesMetadataAnnotationKeys = trimmed(*settings.AnnotationKeys)
+	}
+	if settings.NodeLabelKeys != nil {
+		if keys := trimmed(*settings.NodeLabelKeys); len(keys) > 0 {
+			next.KubernetesMetadataNodeLabelKeys = keys
+		}
+	}
+}
+
+// diffLogCollectionSettings describes the reloadable settings that differ between the configurations
+func diffLogCollectionSettings(current *PluginConfig, next *PluginConfig) []string {
+	var changes []string
+	diffBool := func(name string, from bool, to bool) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, from, to))
+		}
+	}
+	diffList := func(name string, from []string, to []string) {
+		if added, removed := diffStringLists(from, to); len(added) > 0 || len(removed) > 0 {
+			changes = append(changes, fmt.Sprintf("%s: added %v, removed %v", name, added, removed))
+		}
+	}
+	diffBool("stdout collection", current.CollectStdoutLogs, next.CollectStdoutLogs)
+	diffList("stdout excluded namespaces", current.StdoutExcludedNamespaces, next.StdoutExcludedNamespaces)
+	diffList("stdout included system pods", current.StdoutIncludedSystemPods, next.StdoutIncludedSystemPods)
+	diffBool("stderr collection", current.CollectStderrLogs, next.CollectStderrLogs)
+	diffList("stderr excluded namespaces", current.StderrExcludedNamespaces, next.StderrExcludedNamespaces)
+	diffList("stderr included system pods", current.StderrIncludedSystemPods, next.StderrIncludedSystemPods)
+	diffList("kubernetes metadata include fields", current.KubernetesMetadataIncludeFields, next.KubernetesMetadataIncludeFields)
+	diffList("kubernetes metadata label keys", current.KubernetesMetadataLabelKeys, next.KubernetesMetadataLabelKeys)
+	diffList("kubernetes metadata annotation keys", current.KubernetesMetadataAnnotationKeys, next.KubernetesMetadataAnnotationKeys)
+	diffList("kubernetes metadata node label keys", current.KubernetesMetadataNodeLabelKeys, next.KubernetesMetadataNodeLabelKeys)
+	return changes
+}
+
+// diffStringLists returns the sorted items only in to and only in from
+func diffStringLists(from []string, to []string) (added []string, removed []string) {
+	fromSet := make(map[string]bool)
+	for _, item := range from {
+		fromSet[item] = true
+	}
+	toSet := make(map[string]bool)
+	for _, item := range to {
+		toSet[item] = true
+		if !fromSet[item] {
+			added = append(added, item)
+		}
+	}
+	for item := range fromSet {
+		if !toSet[item] {
+			removed = append(removed, item)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// recordConfigErrorEvent adds a config error to the KubeMonAgentEvents sent by flushKubeMonAgentEventRecords
+func recordConfigErrorEvent(message string, podName string, now time.Time) {
+	timestamp := now.Format(time.RFC3339)
+	EventHashUpdateMutex.Lock()
+	defer EventHashUpdateMutex.Unlock()
+	if ConfigErrorEvent == nil {
+		ConfigErrorEvent = make(map[string]KubeMonAgentEventTags)
+	}
+	event, ok := ConfigErrorEvent[message]
+	if !ok {
+		event = KubeMonAgentEventTags{PodName: podName, FirstOccurrence: timestamp}
+	}
+	event.LastOccurrence = timestamp
+	event.Count++
+	ConfigErrorEvent[message] = event
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testLogDataCollectionSettings = `
+[log_collection_settings]
+  [log_collection_settings.stdout]
+    enabled = true
+    exclude_namespaces = ["kube-system", "dev"]
+    collect_system_pod_logs = ["kube-system:coredns", "default:app", "calico-system:calico-node"]
+  [log_collection_settings.stderr]
+    enabled = false
+`
+
+func writeConfigMap(t *testing.T, dir string, schemaVersion string, settings string) {
+	if err := os.WriteFile(filepath.Join(dir, "schema-version"), []byte(schemaVersion), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, LogDataCollectionSettingsFile), []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadLogCollectionSettings(t *testing.T) {
+	dir := t.TempDir()
+	current := &PluginConfig{CollectStdoutLogs: true, CollectStderrLogs: true, Hostname: "ama-logs-xyz"}
+
+	next, err := loadLogCollectionSettings(dir, current)
+	if err != nil || !next.CollectStdoutLogs || strings.Join(next.StderrExcludedNamespaces, ",") != defaultExcludedNamespaces {
+		t.Fatalf("expected the defaults without a configmap, got %+v %v", next, err)
+	}
+
+	writeConfigMap(t, dir, "v1", testLogDataCollectionSettings)
+	next, err = loadLogCollectionSettings(dir, current)
+	if err != nil {
+		t.Fatalf("loadLogCollectionSettings failed: %v", err)
+	}
+	if strings.Join(next.StdoutExcludedNamespaces, ",") != "kube-system,dev" {
+		t.Errorf("unexpected stdout excluded namespaces %v", next.StdoutExcludedNamespaces)
+	}
+	// kube-system is excluded and default isn't a system namespace
+	if strings.Join(next.StdoutIncludedSystemPods, ",") != "calico-system:calico-node" {
+		t.Errorf("unexpected stdout included system pods %v", next.StdoutIncludedSystemPods)
+	}
+	if next.CollectStderrLogs || len(next.StderrExcludedNamespaces) != 0 {
+		t.Errorf("expected stderr collection to be disabled, got %+v", next)
+	}
+	if next.Hostname != current.Hostname || !current.CollectStderrLogs {
+		t.Errorf("expected a copy of the current configuration")
+	}
+
+	writeConfigMap(t, dir, "v2", testLogDataCollectionSettings)
+	if _, err := loadLogCollectionSettings(dir, current); err == nil {
+		t.Errorf("expected an error for an unsupported schema version")
+	}
+	writeConfigMap(t, dir, "v1", "[log_collection_settings.stdout]\nenabled = \"yes\"\n")
+	if _, err := loadLogCollectionSettings(dir, current); err == nil {
+		t.Errorf("expected an error for an invalid enabled value")
+	}
+}
+
+func TestConfigReloaderKeepsLastKnownGoodSettings(t *testing.T) {
+	origSettings, origFilters, origEvents := getPluginSettings(), getLogCollectionFilters(), ConfigErrorEvent
+	defer func() {
+		setPluginSettings(origSettings)
+		setLogCollectionFilters(origFilters)
+		ConfigErrorEvent = origEvents
+	}()
+	ConfigErrorEvent = make(map[string]KubeMonAgentEventTags)
+
+	startup := &PluginConfig{CollectStdoutLogs: true, CollectStderrLogs: true, StdoutExcludedNamespaces: []string{"kube-system"}, StderrExcludedNamespaces: []string{"kube-system"},
+		KubernetesMetadataIncludeFields: strings.Split(defaultKubernetesMetadataIncludeFields, ","), KubernetesMetadataNodeLabelKeys: strings.Split(defaultKubernetesMetadataNodeLabelKeys, ",")}
+	setPluginSettings(startup)
+	setLogCollectionFilters(newLogCollectionFilters(startup))
+
+	dir := t.TempDir()
+	reloader := &configReloader{configMapPath: dir, startup: startup, lastContent: readConfigMapContent(dir)}
+	writeConfigMap(t, dir, "v1", testLogDataCollectionSettings)
+	reloader.reload()
+
+	filters := getLogCollectionFilters()
+	if !filters.StdoutIgnoreNsSet["dev"] || !filters.StdoutIncludeSystemResourceSet["calico-system:calico-node"] || filters.CollectStderrLogs {
+		t.Errorf("expected the reloaded filters, got %+v", filters)
+	}
+	if settings := getPluginSettings(); settings.CollectStderrLogs {
+		t.Errorf("expected the reloaded settings")
+	}
+	if changes := diffLogCollectionSettings(startup, getPluginSettings()); len(changes) != 4 {
+		t.Errorf("expected 4 changes, got %v", changes)
+	}
+
+	writeConfigMap(t, dir, "v1", "[log_collection_settings\n")
+	reloader.reload()
+	if filters := getLogCollectionFilters(); !filters.StdoutIgnoreNsSet["dev"] || filters.CollectStderrLogs {
+		t.Errorf("expected an invalid configmap to keep the last-known-good filters, got %+v", filters)
+	}
+	if len(ConfigErrorEvent) != 1 {
+		t.Errorf("expected a config error event, got %v", ConfigErrorEvent)
+	}
+
+	// the same invalid content is only reported once
+	reloader.reload()
+	for _, event := range ConfigErrorEvent {
+		if event.Count != 1 {
+			t.Errorf("expected the config error to be recorded once, got %d", event.Count)
+		}
+	}
+}
+
+func TestConfigReloaderAppliesKubernetesMetadataIncludes(t *testing.T) {
+	origSettings, origFilters, origIncludes, origEvents := getPluginSettings(), getLogCollectionFilters(), getKubernetesMetadataIncludes(), ConfigErrorEvent
+	defer func() {
+		setPluginSettings(origSettings)
+		setLogCollectionFilters(origFilters)
+		KubernetesMetadataIncludeList, KubernetesMetadataLabelKeyFilter = origIncludes.Fields, origIncludes.LabelKeys
+		KubernetesMetadataAnnotationKeyFilter, KubernetesMetadataNodeLabelKeys = origIncludes.AnnotationKeys, origIncludes.NodeLabelKeys
+		ConfigErrorEvent = origEvents
+	}()
+	ConfigErrorEvent = make(map[string]KubeMonAgentEventTags)
+
+	startup := &PluginConfig{CollectStdoutLogs: true, CollectStderrLogs: true, StdoutExcludedNamespaces: []string{"kube-system", "dev"}, StderrExcludedNamespaces: []string{"kube-system", "dev"},
+		TailExcludePath: []string{"*_kube-system_*.log", "*_dev_*.log"}, KubernetesMetadataEnabled: true, KubernetesMetadataIncludeFields: []string{"podlabels"}}
+	setPluginSettings(startup)
+	setLogCollectionFilters(newLogCollectionFilters(startup))
+	setKubernetesMetadataIncludes(startup)
+
+	dir := t.TempDir()
+	reloader := &configReloader{configMapPath: dir, startup: startup, lastContent: readConfigMapContent(dir)}
+	writeConfigMap(t, dir, "v1", `
+[log_collection_settings]
+  [log_collection_settings.stdout]
+    enabled = true
+    exclude_namespaces = ["kube-system"]
+  [log_collection_settings.stderr]
+    enabled = true
+    exclude_namespaces = ["kube-system"]
+  [log_collection_settings.metadata_collection]
+    enabled = true
+    include_fields = ["podLabels","nodeLabels"]
+    label_keys = ["app"]
+    node_label_keys = ["topology.kubernetes.io/zone"]
+`)
+	reloader.reload()
+
+	includes := getKubernetesMetadataIncludes()
+	if strings.Join(includes.Fields, ",") != "podlabels,nodelabels" || strings.Join(includes.LabelKeys, ",") != "app" || strings.Join(includes.NodeLabelKeys, ",") != "topology.kubernetes.io/zone" {
+		t.Errorf("expected the reloaded include settings, got %+v", includes)
+	}
+	// dev is no longer excluded but stays out of the tail until a restart
+	if len(ConfigErrorEvent) != 1 {
+		t.Fatalf("expected a restart required event, got %v", ConfigErrorEvent)
+	}
+	for message := range ConfigErrorEvent {
+		if !strings.Contains(message, "namespace dev") {
+			t.Errorf("expected the event to name the dev namespace, got %s", message)
+		}
+	}
+
+	// disabling the metadata requires a restart and keeps it enabled
+	writeConfigMap(t, dir, "v1", "[log_collection_settings.metadata_collection]\nenabled = false\n")
+	reloader.reload()
+	if settings := getPluginSettings(); !settings.KubernetesMetadataEnabled || len(getKubernetesMetadataIncludes().Fields) == 0 {
+		t.Errorf("expected the kubernetes metadata to stay enabled until a restart")
+	}
+	for _, setting := range getPluginSettings().Settings {
+		if setting.Name == "AZMON_KUBERNETES_METADATA_ENABLED" && setting.Value != "true" {
+			t.Errorf("expected the reported setting to stay enabled, got %+v", setting)
+		}
+	}
+}
+
+func TestRestartRequiredChanges(t *testing.T) {
+	startup := &PluginConfig{CollectStdoutLogs: true, CollectStderrLogs: false, StdoutExcludedNamespaces: []string{"kube-system", "dev"}, TailExcludePath: []string{"*_kube-system_*.log", "*.csv2"}}
+	next := &PluginConfig{CollectStdoutLogs: true, CollectStderrLogs: false, StdoutExcludedNamespaces: []string{"dev"}}
+	if messages := restartRequiredChanges(startup, next); len(messages) != 1 || !strings.Contains(messages[0], "namespace kube-system") {
+		t.Errorf("expected kube-system to require a restart, got %v", messages)
+	}
+	next.StdoutExcludedNamespaces = []string{"kube-system"}
+	next.StdoutIncludedSystemPods = []string{"kube-system:coredns"}
+	if messages := restartRequiredChanges(startup, next); len(messages) != 1 {
+		t.Errorf("expected the included kube-system pods to require a restart, got %v", messages)
+	}
+	next.StdoutIncludedSystemPods = nil
+	next.CollectStderrLogs = true
+	next.StderrExcludedNamespaces = []string{"kube-system"}
+	if messages := restartRequiredChanges(startup, next); len(messages) != 1 || !strings.Contains(messages[0], "stderr") {
+		t.Errorf("expected only the stderr stream to require a restart, got %v", messages)
+	}
+}
+
+func TestPostDataHelperDropsDisabledStream(t *testing.T) {
+	origFilters := getLogCollectionFilters()
+	defer setLogCollectionFilters(origFilters)
+	setLogCollectionFilters(newLogCollectionFilters(&PluginConfig{CollectStdoutLogs: true, CollectStderrLogs: false}))
+	resetDroppedRecordCounts(t)
+
+	(&PluginInstance{}).PostDataHelper([]map[interface{}]interface{}{
+		{"filepath": []byte("/var/log/containers/app-5d4f_app_app-0123456789abcdef.log"), "stream": []byte("stderr"), "log": []byte("error")},
+	})
+	if counts := takeDroppedRecordCounts(); counts[dropKey{Reason: DropReasonStreamDisabled, Namespace: "app"}] != 1 {
+		t.Errorf("expected the stderr record to be dropped, got %v", counts)
+	}
+}
+
+func TestPostDataHelperSendsStreamsWithoutCollectionSettings(t *testing.T) {
+	origFilters := getLogCollectionFilters()
+	defer setLogCollectionFilters(origFilters)
+	resetDroppedRecordCounts(t)
+	records := []map[interface{}]interface{}{
+		{"filepath": []byte("/var/log/containers/app-5d4f_app_app-0123456789abcdef.log"), "stream": []byte("stdout"), "log": []byte("stdout line")},
+		{"filepath": []byte("/var/log/containers/app-5d4f_app_app-0123456789abcdef.log"), "stream": []byte("stderr"), "log": []byte("stderr line")},
+	}
+	assertSent := func(name string) {
+		t.Helper()
+		conn := newFakeMdsdConn(true)
+		if ret := (&PluginInstance{ContainerLogsRouteV2: true, MdsdMsgpUnixSocketClient: conn}).PostDataHelper(records); ret != 1 || len(conn.written) != 1 {
+			t.Fatalf("%s: expected the records to be sent, got %d with %d writes", name, ret, len(conn.written))
+		}
+		if !bytes.Contains(conn.written[0], []byte("stdout line")) || !bytes.Contains(conn.written[0], []byte("stderr line")) {
+			t.Errorf("%s: expected the stdout and stderr records to be sent", name)
+		}
+		if counts := takeDroppedRecordCounts(); len(counts) != 0 {
+			t.Errorf("%s: expected no drops, got %v", name, counts)
+		}
+	}
+
+	// without AZMON_COLLECT_STDOUT_LOGS and AZMON_COLLECT_STDERR_LOGS
+	config := NewPluginConfig(map[string]string{}, mapGetenv(map[string]string{}), "")
+	setLogCollectionFilters(newLogCollectionFilters(config))
+	assertSent("unset env")
+
+	// a reloaded configmap without the stream sections or their enabled setting
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", "[log_collection_settings]\n  [log_collection_settings.stdout]\n    exclude_namespaces = [\"dev\"]\n")
+	next, err := loadLogCollectionSettings(dir, &PluginConfig{})
+	if err != nil || !next.CollectStdoutLogs || !next.CollectStderrLogs {
+		t.Fatalf("expected the absent sections to enable the streams, got %+v %v", next, err)
+	}
+	setLogCollectionFilters(newLogCollectionFilters(next))
+	assertSent("reloaded configmap")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/extension"
+)
+
+// env variable to enable the effective configuration snapshots (disabled when unset). The snapshot stream isn't
+// registered with mdsd or the DCR yet, so the snapshots are opt-in until it's ingested
+const ConfigSnapshotEnabledEnv = "AZMON_CONFIG_SNAPSHOT_ENABLED"
+
+// env variable with the hours after which an unchanged configuration is sent again
+const ConfigSnapshotIntervalHoursEnv = "AZMON_CONFIG_SNAPSHOT_INTERVAL_HOURS"
+
+// DataType of the effective configuration snapshots
+const ConfigSnapshotDataType = "CONTAINERINSIGHTS_AGENTCONFIGSNAPSHOT"
+
+// Eventsource name in mdsd for the effective configuration snapshots
+const MdsdConfigSnapshotSourceName = "AgentConfigSnapshotSource"
+
+const defaultConfigSnapshotIntervalHours = 24
+
+// the configuration is checked for changes, e.g. of the extension settings, at this interval. Configmap reloads are
+// checked right away
+const configSnapshotCheckInterval = 5 * time.Minute
+
+// Triggers of a snapshot
+const (
+	ConfigSnapshotTriggerStartup  = "startup"
+	ConfigSnapshotTriggerChange   = "change"
+	ConfigSnapshotTriggerPeriodic = "periodic"
+)
+
+// configSnapshotter decides when the snapshots are sent
+type configSnapshotter struct {
+	interval time.Duration
+	lastHash string
+	lastSent time.Time
+	send     func(record map[string]string) error
+}
+
+var (
+	// ConfigSnapshotEnabled sends the effective configuration snapshots
+	ConfigSnapshotEnabled bool
+	// ConfigSnapshotInterval after which an unchanged configuration is sent again
+	ConfigSnapshotInterval time.Duration
+	// ConfigSnapshotTicker checks the configuration for changes
+	ConfigSnapshotTicker *time.Ticker
+	// configSnapshotRequests asks the snapshot loop to check the configuration before the next tick
+	configSnapshotRequests = make(chan struct{}, 1)
+	// MdsdConfigSnapshotMsgpUnixSocketClient for the config snapshots
+	MdsdConfigSnapshotMsgpUnixSocketClient net.Conn
+	// ConfigSnapshotNamedPipe named pipe connection to send the config snapshots for AMA
+	ConfigSnapshotNamedPipe net.Conn
+	// MdsdConfigSnapshotTagName is the mdsd source name or the output stream id of the config snapshots
+	MdsdConfigSnapshotTagName string
+	// MdsdConfigSnapshotTagRefreshTracker tracks the refresh of the output stream id
+	MdsdConfigSnapshotTagRefreshTracker time.Time
+)
+
+func populateConfigSnapshotSettings(config *PluginConfig) {
+	ConfigSnapshotEnabled = config.ConfigSnapshotEnabled
+	ConfigSnapshotInterval = time.Duration(config.ConfigSnapshotIntervalHours) * time.Hour
+	if ConfigSnapshotEnabled && IsWindows && !IsAADMSIAuthMode {
+		Log("Warn::configSnapshot::config snapshots are only supported through mdsd/ama route, disabling them")
+		ConfigSnapshotEnabled = false
+	}
+	MdsdConfigSnapshotTagName = MdsdConfigSnapshotSourceName
+	MdsdConfigSnapshotTagRefreshTracker = time.Now()
+	Log("ConfigSnapshotEnabled: %v", ConfigSnapshotEnabled)
+}
+
+// requestConfigSnapshot checks the configuration for changes without waiting for the next tick
+func requestConfigSnapshot() {
+	select {
+	case configSnapshotRequests <- struct{}{}:
+	default:
+	}
+}
+
+// buildConfigSnapshot returns the snapshot record of the configuration and its hash. Secrets are hashed by the config
+// loader, the snapshot only has the settings, the effective routes and the settings cached from the extension
+func buildConfigSnapshot(config *PluginConfig) (map[string]string, string) {
+	streamIds, dataCollectionSettings := extension.GetInstance(FLBLogger, ContainerType).GetCachedSettings()
+	namespaceStreamIdsMap, _ := getContainerLogV2ExtensionMaps()
+	sections := []struct {
+		name  string
+		value interface{}
+	}{
+		{"Settings", config.Settings},
+		{"Routes", map[string]interface{}{
+			"ContainerLogsRoute":                    config.ContainerLogsRoute,
+			"ContainerLogsRouteV2":                  ContainerLogsRouteV2,
+			"ContainerLogSchemaV2":                  ContainerLogSchemaV2,
+			"AADMSIAuthMode":                        IsAADMSIAuthMode,
+			"GenevaLogsIntegration":                 IsGenevaLogsIntegrationEnabled,
+			"MultiTenancyLogCollection":             IsAzMonMultiTenancyLogCollectionEnabled,
+			"MultiTenancyLogCollectionAdvancedMode": IsAzMonMultiTenancyLogCollectionAdvancedModeEnabled,
+			"MultiTenancyLogsServiceMode":           IsAzMonMultitenancyLogsServiceMode,
+			"PriorityLanes":                         PriorityLanesEnabled,
+		}},
+		{"Extension", map[string]interface{}{
+			"OutputStreamIds":        streamIds,
+			"DataCollectionSettings": dataCollectionSettings,
+			"NamespaceStreamIds":     namespaceStreamIdsMap,
+		}},
+		{"Issues", config.Issues},
+	}
+	record := map[string]string{
+		"Computer":       Computer,
+		"AgentVersion":   dockerCimprovVersion,
+		"ControllerType": config.ControllerType,
+	}
+	// maps are marshalled with sorted keys and the settings in load order, so an unchanged configuration hashes the same
+	hash := sha256.New()
+	for _, section := range sections {
+		// without HTML escaping, the redacted secrets stay readable in the workspace
+		var value bytes.Buffer
+		encoder := json.NewEncoder(&value)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(section.value)
+		record[section.name] = strings.TrimSpace(value.String())
+		hash.Write(value.Bytes())
+	}
+	record["ConfigHash"] = hex.EncodeToString(hash.Sum(nil))
+	return record, record["ConfigHash"]
+}
+
+// trigger returns the trigger of a snapshot with the hash, empty if none is due
+func (s *configSnapshotter) trigger(hash string, now time.Time) string {
+	switch {
+	case s.lastSent.IsZero():
+		return ConfigSnapshotTriggerStartup
+	case hash != s.lastHash:
+		return ConfigSnapshotTriggerChange
+	case now.Sub(s.lastSent) >= s.interval:
+		return ConfigSnapshotTriggerPeriodic
+	}
+	return ""
+}
+
+// check sends a snapshot of the configuration if one is due. A failed send is retried on the next check
+func (s *configSnapshotter) check(config *PluginConfig, now time.Time) {
+	if config == nil {
+		return
+	}
+	record, hash := buildConfigSnapshot(config)
+	trigger := s.trigger(hash, now)
+	if trigger == "" {
+		return
+	}
+	record["Trigger"] = trigger
+	record["TimeGenerated"] = now.UTC().Format(time.RFC3339)
+	if err := s.send(record); err != nil {
+		LogRateLimited("configsnapshot", "Error::configSnapshot::Failed to send the %s config snapshot. Will retry ... error : %s", trigger, err.Error())
+		return
+	}
+	s.lastHash, s.lastSent = hash, now
+	Log("Info::configSnapshot::Sent the %s config snapshot %s", trigger, hash)
+}
+
+// sendConfigSnapshots sends a snapshot at startup, when the configuration changes and after the snapshot interval
+func sendConfigSnapshots() {
+	snapshotter := &configSnapshotter{interval: ConfigSnapshotInterval, send: sendConfigSnapshot}
+	for {
+		if IsAADMSIAuthMode {
+			// also refreshes the output stream ids of the extension the snapshot has
+			MdsdConfigSnapshotTagName = getOutputStreamIdTag(ConfigSnapshotDataType, MdsdConfigSnapshotTagName, &MdsdConfigSnapshotTagRefreshTracker)
+		}
+		snapshotter.check(getPluginSettings(), time.Now())
+		select {
+		case <-ShutdownContext.Done():
+			return
+		case <-ConfigSnapshotTicker.C:
+		case <-configSnapshotRequests:
+		}
+	}
+}
+
+// sendConfigSnapshot writes the snapshot record to its stream in mdsd/ama, the stream is opted out without an output
+// stream id in AAD MSI auth mode
+func sendConfigSnapshot(record map[string]string) error {
+	if MdsdConfigSnapshotTagName == "" {
+		Log("Warn::mdsd::skipping config snapshot stream since its opted out")
+		recordDrop(DropReasonStreamOptedOut, "", 1, ConfigSnapshotDataType)
+		return nil
+	}
+	msgPackEntries := []MsgPackEntry{{Record: record}}
+	RecordTee.Write(ConfigSnapshot.String(), MdsdConfigSnapshotTagName, msgPackEntries)
+	msgpBytes := convertMsgPackEntriesToMsgpBytes(MdsdConfigSnapshotTagName, msgPackEntries)
+	var er error
+	deadline := 10 * time.Second
+	if !IsWindows {
+		if MdsdConfigSnapshotMsgpUnixSocketClient == nil {
+			CreateMDSDClient(&MdsdConfigSnapshotMsgpUnixSocketClient, ConfigSnapshot, ContainerType)
+			if MdsdConfigSnapshotMsgpUnixSocketClient == nil {
+				ContainerLogTelemetryMutex.Lock()
+				ConfigSnapshotClientCreateErrors += 1
+				ContainerLogTelemetryMutex.Unlock()
+				return errors.New("unable to create the mdsd client for config snapshots")
+			}
+		}
+		MdsdConfigSnapshotMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+		_, er = MdsdConfigSnapshotMsgpUnixSocketClient.Write(msgpBytes)
+		recordConnectionResult(getMdsdCircuitBreaker(ConfigSnapshot), er)
+	} else {
+		if !EnsureGenevaOr3PNamedPipeExists(&ConfigSnapshotNamedPipe, ConfigSnapshotDataType, &ConfigSnapshotClientCreateErrors, false, &MdsdConfigSnapshotTagRefreshTracker) {
+			return errors.New("unable to create the ama named pipe for config snapshots")
+		}
+		ConfigSnapshotNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+		_, er = ConfigSnapshotNamedPipe.Write(msgpBytes)
+		recordConnectionResult(getAMACircuitBreaker(ConfigSnapshotDataType), er)
+	}
+	if er != nil {
+		closeConnection(&MdsdConfigSnapshotMsgpUnixSocketClient)
+		closeConnection(&ConfigSnapshotNamedPipe)
+		ContainerLogTelemetryMutex.Lock()
+		ConfigSnapshotSendErrors += 1
+		ContainerLogTelemetryMutex.Unlock()
+		return er
+	}
+	return nil
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"Docker-Provider/source/plugins/go/src/paths"
+)
+
+// env variables for the dead-letter store of records rejected with non-retriable errors
+const DeadLetterEnabledEnv = "AZMON_DEAD_LETTER_ENABLED"
+const DeadLetterDirEnv = "AZMON_DEAD_LETTER_DIR"
+const DeadLetterMaxSizeMBEnv = "AZMON_DEAD_LETTER_MAX_SIZE_MB"
+
+// env variable with the retries of an ODS payload before it goes to the dead-letter store, 0 leaves the retries to
+// fluent-bit
+const DeadLetterMaxRetriesEnv = "AZMON_DEAD_LETTER_MAX_RETRIES"
+
+const defaultDeadLetterDir = "/var/opt/microsoft/docker-cimprov/state/deadletter"
+const defaultWindowsDeadLetterDir = "/etc/amalogswindows/deadletter"
+const defaultDeadLetterMaxSizeMB = 50
+const defaultDeadLetterMaxRetries = 10
+
+// failed payloads tracked for the retry limit, the one that failed first is forgotten first
+const maxDeadLetterRetryPayloads = 1000
+
+const deadLetterFileExtension = ".json"
+
+// Dead-letter reasons
+const (
+	DeadLetterReasonMarshalError       = "MarshalError"
+	DeadLetterReasonNonRetriableStatus = "NonRetriableStatus"
+	DeadLetterReasonProcessingPanic    = "ProcessingPanic"
+	DeadLetterReasonRetriesExhausted   = "RetriesExhausted"
+)
+
+// DeadLetterEntry is a rejected payload persisted to disk for inspection and re-drive
+type DeadLetterEntry struct {
+	ID          string            `json:"id"`
+	Timestamp   string            `json:"timestamp"`
+	Reason      string            `json:"reason"`
+	Detail      string            `json:"detail"`
+	DataType    string            `json:"dataType"`
+	Destination string            `json:"destination"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	RecordCount int               `json:"recordCount"`
+	Payload     []byte            `json:"payload"`
+}
+
+var (
+	// DeadLetterEnabled enables persisting rejected records to the dead-letter store
+	DeadLetterEnabled bool
+	// DeadLetterDir directory of the dead-letter store
+	DeadLetterDir string
+	// DeadLetterMaxSizeBytes bounds the total size of the dead-letter store, oldest entries are evicted first
+	DeadLetterMaxSizeBytes int64
+	// DeadLetterMutex serializes writes and evictions of the dead-letter store
+	DeadLetterMutex = &sync.Mutex{}
+	// DeadLetterMaxRetries of an ODS payload before it goes to the dead-letter store, 0 leaves the retries to fluent-bit
+	DeadLetterMaxRetries int
+	// deadLetterRetries are the failed sends of the payloads being retried, by their retry key
+	deadLetterRetries = make(map[deadLetterRetryKey]*deadLetterRetry)
+	// deadLetterRetriesMutex guards deadLetterRetries
+	deadLetterRetriesMutex = &sync.Mutex{}
+)
+
+// deadLetterRetryKey identifies the records of a payload across the flushes that retry it
+type deadLetterRetryKey [sha256.Size]byte
+
+// deadLetterRetry counts the failed sends of a payload
+type deadLetterRetry struct {
+	count int
+	first time.Time
+}
+
+func populateDeadLetterSettings(config *PluginConfig) {
+	DeadLetterEnabled = config.DeadLetterEnabled
+	DeadLetterDir = paths.Resolve(config.DeadLetterDir)
+	DeadLetterMaxSizeBytes = int64(config.DeadLetterMaxSizeMB) * 1024 * 1024
+	DeadLetterMaxRetries = config.DeadLetterMaxRetries
+	Log("DeadLetterEnabled: %v, DeadLetterDir: %s, DeadLetterMaxSizeBytes: %d, DeadLetterMaxRetries: %d", DeadLetterEnabled, DeadLetterDir, DeadLetterMaxSizeBytes, DeadLetterMaxRetries)
+}
+
+// getDeadLetterDir returns the dead-letter dir of the plugin config, the CLI reads the store the plugin writes to
+func getDeadLetterDir() string {
+	return paths.Resolve(NewPluginConfig(map[string]string{}, os.Getenv, "").DeadLetterDir)
+}
+
+// payloadRetryKey returns the retry key of a payload without per-flush fields
+func payloadRetryKey(payload []byte) deadLetterRetryKey {
+	return sha256.Sum256(payload)
+}
+
+// containerLogRetryKey returns the retry key of ContainerLog records, their TimeOfCommand is the time of the flush
+// and differs between the retries of a chunk
+func containerLogRetryKey(dataItems []DataItemLAv1) deadLetterRetryKey {
+	hash := sha256.New()
+	for _, dataItem := range dataItems {
+		dataItem.LogEntryTimeOfCommand = ""
+		itemBytes, _ := json.Marshal(dataItem)
+		hash.Write(itemBytes)
+	}
+	var key deadLetterRetryKey
+	copy(key[:], hash.Sum(nil))
+	return key
+}
+
+// WriteDeadLetter persists a rejected payload. It never fails the caller, errors are only logged
+func WriteDeadLetter(dataType string, destination string, reason string, detail string, headers map[string]string, recordCount int, payload []byte) {
+	if !DeadLetterEnabled {
+		return
+	}
+	entry := DeadLetterEntry{
+		ID:          uuid.New().String(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Reason:      reason,
+		Detail:      detail,
+		DataType:    dataType,
+		Destination: destination,
+		Headers:     headers,
+		RecordCount: recordCount,
+		Payload:     payload,
+	}
+	if err := writeDeadLetterEntry(DeadLetterDir, DeadLetterMaxSizeBytes, entry); err != nil {
+		Log("Error::deadLetter::Failed to write dead-letter entry for %s: %s", dataType, err.Error())
+		return
+	}
+	ContainerLogTelemetryMutex.Lock()
+	DeadLetterRecordCount += float64(recordCount)
+	ContainerLogTelemetryMutex.Unlock()
+	Log("Warn::deadLetter::Stored %d %s records rejected with %s as dead-letter entry %s", recordCount, dataType, reason, entry.ID)
+}
+
+// retryOrDeadLetter counts a retriable failure to send the payload of the retry key. Once the payload failed more than
+// DeadLetterMaxRetries times it's persisted to the dead-letter store and true is returned, the caller stops retrying it
+func retryOrDeadLetter(key deadLetterRetryKey, dataType string, destination string, detail string, headers map[string]string, recordCount int, payload []byte) bool {
+	if !DeadLetterEnabled || DeadLetterMaxRetries <= 0 {
+		return false
+	}
+	deadLetterRetriesMutex.Lock()
+	retry, ok := deadLetterRetries[key]
+	if !ok {
+		if len(deadLetterRetries) >= maxDeadLetterRetryPayloads {
+			var oldest deadLetterRetryKey
+			var oldestRetry *deadLetterRetry
+			for other, otherRetry := range deadLetterRetries {
+				if oldestRetry == nil || otherRetry.first.Before(oldestRetry.first) {
+					oldest, oldestRetry = other, otherRetry
+				}
+			}
+			delete(deadLetterRetries, oldest)
+		}
+		retry = &deadLetterRetry{first: time.Now()}
+		deadLetterRetries[key] = retry
+	}
+	retry.count++
+	retries := retry.count - 1
+	if retries < DeadLetterMaxRetries {
+		deadLetterRetriesMutex.Unlock()
+		return false
+	}
+	delete(deadLetterRetries, key)
+	deadLetterRetriesMutex.Unlock()
+
+	WriteDeadLetter(dataType, destination, DeadLetterReasonRetriesExhausted, fmt.Sprintf("%s after %d retries since %s", detail, retries, retry.first.UTC().Format(time.RFC3339)), headers, recordCount, payload)
+	return true
+}
+
+// clearDeadLetterRetries forgets the failed sends of a payload that was sent
+func clearDeadLetterRetries(key deadLetterRetryKey) {
+	deadLetterRetriesMutex.Lock()
+	defer deadLetterRetriesMutex.Unlock()
+	if len(deadLetterRetries) > 0 {
+		delete(deadLetterRetries, key)
+	}
+}
+
+// odsDeadLetterPayload returns the JSON payload ODS receives for the items of a data type. Items that can't be
+// marshalled are left out, their number is returned with the payload
+func odsDeadLetterPayload[T any](dataType string, items []T) ([]byte, int) {
+	blob := struct {
+		DataType  string            `json:"DataType"`
+		IPName    string            `json:"IPName"`
+		DataItems []json.RawMessage `json:"DataItems"`
+	}{DataType: dataType, IPName: IPName}
+	skipped := 0
+	for _, item := range items {
+		itemBytes, err := json.Marshal(item)
+		if err != nil {
+			skipped++
+			continue
+		}
+		blob.DataItems = append(blob.DataItems, itemBytes)
+	}
+	payload, _ := json.Marshal(blob)
+	return payload, skipped
+}
+
+// msgpDeadLetterPayload returns the msgpack forward payload mdsd/ama receive for the records of a stream. Records that
+// can't be marshalled are left out, their number is returned with the payload
+func msgpDeadLetterPayload[T any](tag string, records []T) ([]byte, int) {
+	var msgPackEntries []MsgPackEntry
+	skipped := 0
+	for _, record := range records {
+		var interfaceMap map[string]interface{}
+		jsonBytes, err := json.Marshal(record)
+		if err == nil {
+			err = json.Unmarshal(jsonBytes, &interfaceMap)
+		}
+		if err != nil {
+			skipped++
+			continue
+		}
+		stringMap := make(map[string]string)
+		for key, value := range interfaceMap {
+			stringMap[key] = fmt.Sprintf("%v", value)
+		}
+		msgPackEntries = append(msgPackEntries, MsgPackEntry{Record: stringMap})
+	}
+	return convertMsgPackEntriesToMsgpBytes(tag, msgPackEntries), skipped
+}
+
+// writeInputPluginDeadLetters persists input plugin records in the msgpack forward payload of their tag, one entry per
+// record. Records that can't be converted are left out
+func writeInputPluginDeadLetters(records []map[interface{}]interface{}, detail string) {
+	if !DeadLetterEnabled {
+		return
+	}
+	skipped := 0
+	for _, record := range records {
+		tag, msgPackEntries, ok := inputPluginDeadLetterEntries(record)
+		if !ok {
+			skipped++
+			continue
+		}
+		if len(msgPackEntries) > 0 {
+			WriteDeadLetter(InputPluginRecords.String(), getMdsdDeadLetterDestination(InputPluginRecords), DeadLetterReasonProcessingPanic, detail, nil, len(msgPackEntries), convertMsgPackEntriesToMsgpBytes(tag, msgPackEntries))
+		}
+	}
+	if skipped > 0 {
+		Log("Warn::deadLetter::%d input plugin records can't be converted and are not stored", skipped)
+	}
+}
+
+// inputPluginDeadLetterEntries returns the tag and the msgpack entries of an input plugin record, false if the record
+// can't be converted
+func inputPluginDeadLetterEntries(record map[interface{}]interface{}) (tag string, msgPackEntries []MsgPackEntry, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+		}
+	}()
+	val := toStringMap(record)
+	tag = val["tag"].(string)
+	for _, message := range val["messages"].([]map[string]interface{}) {
+		msgPackEntries = append(msgPackEntries, MsgPackEntry{Record: convertMap(message)})
+	}
+	return tag, msgPackEntries, true
+}
+
+// deadLetterMarshalDetail describes a marshal error and the records left out of the dead-letter payload
+func deadLetterMarshalDetail(err error, skipped int) string {
+	return fmt.Sprintf("%s, %d records that can't be marshalled are not in the payload", err.Error(), skipped)
+}
+
+func deadLetterFileName(entry DeadLetterEntry) string {
+	// names sort in write order, so eviction and listing can use the file name only
+	return fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), entry.ID, deadLetterFileExtension)
+}
+
+func writeDeadLetterEntry(dir string, maxSizeBytes int64, entry DeadLetterEntry) error {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if maxSizeBytes > 0 && int64(len(content)) > maxSizeBytes {
+		return fmt.Errorf("entry of %d bytes exceeds the dead-letter store size limit of %d bytes", len(content), maxSizeBytes)
+	}
+
+	DeadLetterMutex.Lock()
+	defer DeadLetterMutex.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := evictDeadLetterEntries(dir, maxSizeBytes-int64(len(content))); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, deadLetterFileName(entry))
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// evictDeadLetterEntries deletes the oldest entries until the store is within maxSizeBytes
+func evictDeadLetterEntries(dir string, maxSizeBytes int64) error {
+	files, err := listDeadLetterFiles(dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, file := range files {
+		info, err := os.Stat(filepath.Join(dir, file))
+		if err != nil {
+			continue
+		}
+		sizes[i] = info.Size()
+		total += sizes[i]
+	}
+	for i := 0; i < len(files) && total > maxSizeBytes; i++ {
+		if err := os.Remove(filepath.Join(dir, files[i])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
+
+func listDeadLetterFiles(dir string) ([]string, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []string
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() && strings.HasSuffix(dirEntry.Name(), deadLetterFileExtension) {
+			files = append(files, dirEntry.Name())
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ListDeadLetters returns the entries of the dead-letter store, oldest first
+func ListDeadLetters(dir string) ([]DeadLetterEntry, error) {
+	files, err := listDeadLetterFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []DeadLetterEntry
+	for _, file := range files {
+		entry, err := readDeadLetterFile(filepath.Join(dir, file))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func readDeadLetterFile(path string) (DeadLetterEntry, error) {
+	var entry DeadLetterEntry
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(content, &entry)
+	return entry, err
+}
+
+func findDeadLetterFile(dir string, id string) (string, error) {
+	files, err := listDeadLetterFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "-"+id+deadLetterFileExtension) {
+			return filepath.Join(dir, file), nil
+		}
+	}
+	return "", fmt.Errorf("dead-letter entry %s not found in %s", id, dir)
+}
+
+// GetDeadLetter returns a single entry of the dead-letter store
+func GetDeadLetter(dir string, id string) (DeadLetterEntry, error) {
+	path, err := findDeadLetterFile(dir, id)
+	if err != nil {
+		return DeadLetterEntry{}, err
+	}
+	return readDeadLetterFile(path)
+}
+
+// DeleteDeadLetter removes an entry from the dead-letter store
+func DeleteDeadLetter(dir string, id string) error {
+	path, err := findDeadLetterFile(dir, id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// ODSRedriveClient sends re-driven ODS payloads with the current auth of the agent, the dead-letter entries don't
+// persist credentials. The client is created on its first request
+type ODSRedriveClient struct {
+	config     *PluginConfig
+	once       sync.Once
+	err        error
+	httpClient *http.Client
+	// token is the ingestion auth token of the AAD MSI auth mode, empty in the cert auth mode
+	token string
+}
+
+// NewODSRedriveClient returns a client with the auth of the configuration
+func NewODSRedriveClient(config *PluginConfig) *ODSRedriveClient {
+	return &ODSRedriveClient{config: config}
+}
+
+func (c *ODSRedriveClient) init() {
+	if c.httpClient != nil {
+		return
+	}
+	config := c.config
+	proxyEndpoint := config.Proxy
+	if !config.IsWindows() && !config.IgnoreProxySettings {
+		if proxyConfig, err := os.ReadFile(paths.Resolve(config.ProxySecretPath)); err == nil {
+			proxyEndpoint = strings.TrimSpace(string(proxyConfig))
+		}
+	}
+	certFilePath, keyFilePath := getODSCertFilePaths(config.ConfProperties, config.WorkspaceID, config.IsWindows())
+	transport, err := newODSTransport(config.AADMSIAuthMode, certFilePath, keyFilePath, proxyEndpoint)
+	if err != nil {
+		c.err = err
+		return
+	}
+	if config.AADMSIAuthMode {
+		if c.token, err = fetchIngestionAuthToken(); err != nil {
+			c.err = fmt.Errorf("unable to get the ingestion auth token: %s", err.Error())
+			return
+		}
+	}
+	c.httpClient = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+}
+
+// Do sends the request with the auth of the agent
+func (c *ODSRedriveClient) Do(req *http.Request) (*http.Response, error) {
+	c.once.Do(c.init)
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.httpClient.Do(req)
+}
+
+// RedriveDeadLetter re-sends the payload of an entry to its destination and removes the entry on success.
+// unix:// destinations are mdsd/ama fluent sockets (msgpack forward payload), http(s) destinations are ODS (json payload)
+func RedriveDeadLetter(dir string, id string, odsClient *ODSRedriveClient) error {
+	entry, err := GetDeadLetter(dir, id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(entry.Destination, "unix://"):
+		conn, err := net.DialTimeout("unix", strings.TrimPrefix(entry.Destination, "unix://"), 10*time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(entry.Payload); err != nil {
+			return err
+		}
+	case strings.HasPrefix(entry.Destination, "http://") || strings.HasPrefix(entry.Destination, "https://"):
+		req, err := http.NewRequest("POST", entry.Destination, bytes.NewBuffer(entry.Payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range entry.Headers {
+			req.Header.Set(key, value)
+		}
+		req.Header.Set("x-ms-date", time.Now().Format(time.RFC3339))
+		req.Header.Set("X-Request-ID", uuid.New().String())
+		resp, err := odsClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if !IsSuccessStatusCode(resp.StatusCode) {
+			return fmt.Errorf("re-drive of %s failed with status %s", id, resp.Status)
+		}
+	default:
+		return fmt.Errorf("dead-letter entry %s has unsupported destination %q", id, entry.Destination)
+	}
+	return DeleteDeadLetter(dir, id)
+}
+
+// getODSDeadLetterHeaders returns the request headers needed to re-drive an ODS payload. Auth headers are not persisted
+func getODSDeadLetterHeaders() map[string]string {
+	headers := map[string]string{"User-Agent": userAgent}
+	if ResourceCentric {
+		headers["x-ms-AzureResourceId"] = ResourceID
+	}
+	return headers
+}
+
+// getMdsdDeadLetterDestination returns the mdsd fluent socket of the data type as a dead-letter destination
+func getMdsdDeadLetterDestination(dataType DataType) string {
+	return "unix://" + getMdsdSocketPath(dataType, ContainerType)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func resetDeadLetter(t *testing.T) string {
+	origEnabled, origDir, origMaxSize, origMaxRetries := DeadLetterEnabled, DeadLetterDir, DeadLetterMaxSizeBytes, DeadLetterMaxRetries
+	t.Cleanup(func() {
+		DeadLetterEnabled, DeadLetterDir, DeadLetterMaxSizeBytes, DeadLetterMaxRetries = origEnabled, origDir, origMaxSize, origMaxRetries
+		deadLetterRetriesMutex.Lock()
+		deadLetterRetries = make(map[deadLetterRetryKey]*deadLetterRetry)
+		deadLetterRetriesMutex.Unlock()
+	})
+	DeadLetterEnabled, DeadLetterDir, DeadLetterMaxSizeBytes = true, t.TempDir(), 1024*1024
+	return DeadLetterDir
+}
+
+func TestWriteAndListDeadLetters(t *testing.T) {
+	dir := t.TempDir()
+	for _, reason := range []string{DeadLetterReasonMarshalError, DeadLetterReasonNonRetriableStatus} {
+		entry := DeadLetterEntry{ID: reason, Reason: reason, DataType: ContainerLogDataType, RecordCount: 2, Payload: []byte(`[{"LogEntry":"a"}]`)}
+		if err := writeDeadLetterEntry(dir, 1024*1024, entry); err != nil {
+			t.Fatalf("writeDeadLetterEntry failed: %s", err.Error())
+		}
+	}
+
+	entries, err := ListDeadLetters(dir)
+	if err != nil {
+		t.Fatalf("ListDeadLetters failed: %s", err.Error())
+	}
+	if len(entries) != 2 || entries[0].Reason != DeadLetterReasonMarshalError || entries[1].Reason != DeadLetterReasonNonRetriableStatus {
+		t.Fatalf("expected entries in write order, got %+v", entries)
+	}
+	if string(entries[0].Payload) != `[{"LogEntry":"a"}]` {
+		t.Errorf("payload not preserved, got %s", string(entries[0].Payload))
+	}
+
+	if err := DeleteDeadLetter(dir, DeadLetterReasonMarshalError); err != nil {
+		t.Fatalf("DeleteDeadLetter failed: %s", err.Error())
+	}
+	if _, err := GetDeadLetter(dir, DeadLetterReasonMarshalError); err == nil {
+		t.Errorf("expected deleted entry to be gone")
+	}
+}
+
+func TestDeadLetterEvictsOldestEntries(t *testing.T) {
+	dir := t.TempDir()
+	payload := bytes.Repeat([]byte("x"), 300)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		if err := writeDeadLetterEntry(dir, 1200, DeadLetterEntry{ID: id, Payload: payload}); err != nil {
+			t.Fatalf("writeDeadLetterEntry failed: %s", err.Error())
+		}
+	}
+
+	entries, _ := ListDeadLetters(dir)
+	if len(entries) == 0 || len(entries) == 4 {
+		t.Fatalf("expected the oldest entries to be evicted, got %d entries", len(entries))
+	}
+	if entries[len(entries)-1].ID != "4" || entries[0].ID == "1" {
+		t.Errorf("expected oldest entries to be evicted first, got %+v", entries)
+	}
+	if err := writeDeadLetterEntry(dir, 100, DeadLetterEntry{ID: "big", Payload: payload}); err == nil {
+		t.Errorf("expected an entry larger than the store to be rejected")
+	}
+}
+
+func TestWriteDeadLetterDisabled(t *testing.T) {
+	dir := t.TempDir()
+	DeadLetterEnabled, DeadLetterDir, DeadLetterMaxSizeBytes = false, dir, 1024*1024
+	WriteDeadLetter(ContainerLogDataType, OMSEndpoint, DeadLetterReasonMarshalError, "", nil, 1, []byte("x"))
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected no entries when the dead-letter store is disabled, got %d", len(files))
+	}
+
+	DeadLetterEnabled = true
+	defer func() { DeadLetterEnabled = false }()
+	WriteDeadLetter(ContainerLogDataType, OMSEndpoint, DeadLetterReasonMarshalError, "", nil, 1, []byte("x"))
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected one entry when the dead-letter store is enabled, got %d", len(files))
+	}
+}
+
+func TestRedriveDeadLetterToUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(t.TempDir(), "fluent.socket")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %s", err.Error())
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+
+	payload := []byte("msgpack-forward-payload")
+	writeDeadLetterEntry(dir, 1024*1024, DeadLetterEntry{ID: "sock", Destination: "unix://" + socketPath, Payload: payload})
+	if err := RedriveDeadLetter(dir, "sock", nil); err != nil {
+		t.Fatalf("RedriveDeadLetter failed: %s", err.Error())
+	}
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, payload) {
+			t.Errorf("expected payload %s, got %s", payload, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("payload was not received")
+	}
+	if _, err := GetDeadLetter(dir, "sock"); err == nil {
+		t.Errorf("expected re-driven entry to be removed")
+	}
+}
+
+func TestRedriveDeadLetterToHTTP(t *testing.T) {
+	status := http.StatusBadRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-ms-AzureResourceId") != "/subscriptions/sub" {
+			t.Errorf("expected stored headers to be sent")
+		}
+		if r.Header.Get("Authorization") != "Bearer ingestion-token" {
+			t.Errorf("expected the current ingestion auth token, got %q", r.Header.Get("Authorization"))
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	writeDeadLetterEntry(dir, 1024*1024, DeadLetterEntry{ID: "ods", Destination: server.URL, Headers: map[string]string{"x-ms-AzureResourceId": "/subscriptions/sub"}, Payload: []byte("{}")})
+	odsClient := &ODSRedriveClient{httpClient: server.Client(), token: "ingestion-token"}
+	if err := RedriveDeadLetter(dir, "ods", odsClient); err == nil {
+		t.Fatalf("expected re-drive to fail with a non-success status")
+	}
+	if _, err := GetDeadLetter(dir, "ods"); err != nil {
+		t.Fatalf("expected entry to be kept after a failed re-drive")
+	}
+
+	status = http.StatusOK
+	if err := RedriveDeadLetter(dir, "ods", odsClient); err != nil {
+		t.Fatalf("RedriveDeadLetter failed: %s", err.Error())
+	}
+
+	// the cert auth mode needs the workspace cert of the agent
+	writeDeadLetterEntry(dir, 1024*1024, DeadLetterEntry{ID: "cert", Destination: server.URL, Payload: []byte("{}")})
+	config := &PluginConfig{WorkspaceID: "ws", ConfProperties: map[string]string{"cert_file_path": filepath.Join(dir, "%s.crt"), "key_file_path": filepath.Join(dir, "%s.key")}}
+	if err := RedriveDeadLetter(dir, "cert", NewODSRedriveClient(config)); err == nil || !strings.Contains(err.Error(), "ws.crt") {
+		t.Errorf("expected the missing workspace cert to fail the re-drive, got %v", err)
+	}
+}
+
+func TestDeadLetterPayloadsAreWireFormat(t *testing.T) {
+	metrics := []laTelegrafMetric{{Name: "used", Value: 1.5, Computer: "node-1"}, {Name: "broken", Value: math.NaN()}}
+	payload, skipped := odsDeadLetterPayload(InsightsMetricsDataType, metrics)
+	var blob InsightsMetricsBlob
+	if err := json.Unmarshal(payload, &blob); err != nil || skipped != 1 {
+		t.Fatalf("expected an ODS payload without the record that can't be marshalled, got %s %d %v", payload, skipped, err)
+	}
+	if blob.DataType != InsightsMetricsDataType || len(blob.DataItems) != 1 || blob.DataItems[0].Name != "used" {
+		t.Errorf("unexpected ODS payload %+v", blob)
+	}
+
+	payload, skipped = msgpDeadLetterPayload(MdsdInsightsMetricsSourceName, metrics)
+	tag, records := decodeMsgpForward(t, payload)
+	if skipped != 1 || tag != MdsdInsightsMetricsSourceName || len(records) != 1 || records[0]["Name"] != "used" {
+		t.Errorf("unexpected msgpack payload %s %+v", tag, records)
+	}
+}
+
+// decodeMsgpForward returns the tag and the records of a msgpack forward payload
+func decodeMsgpForward(t *testing.T, payload []byte) (string, []map[string]string) {
+	t.Helper()
+	_, payload, err := msgp.ReadArrayHeaderBytes(payload)
+	var tag string
+	if err == nil {
+		tag, payload, err = msgp.ReadStringBytes(payload)
+	}
+	var count uint32
+	if err == nil {
+		count, payload, err = msgp.ReadArrayHeaderBytes(payload)
+	}
+	var records []map[string]string
+	for i := uint32(0); err == nil && i < count; i++ {
+		var record map[string]interface{}
+		if _, payload, err = msgp.ReadArrayHeaderBytes(payload); err == nil {
+			if _, payload, err = msgp.ReadInt64Bytes(payload); err == nil {
+				record, payload, err = msgp.ReadMapStrIntfBytes(payload, nil)
+			}
+		}
+		stringRecord := make(map[string]string)
+		for key, value := range record {
+			stringRecord[key] = value.(string)
+		}
+		records = append(records, stringRecord)
+	}
+	if err != nil {
+		t.Fatalf("invalid msgpack forward payload: %v", err)
+	}
+	return tag, records
+}
+
+func TestWriteInputPluginDeadLetters(t *testing.T) {
+	dir := resetDeadLetter(t)
+	writeInputPluginDeadLetters([]map[interface{}]interface{}{
+		{"tag": []byte("oneagent.containerInsights.CONTAINER_INVENTORY_BLOB"), "messages": []interface{}{map[interface{}]interface{}{"InstanceID": []byte("id")}}},
+		{"tag": "not bytes"},
+	}, "panic")
+
+	entries, _ := ListDeadLetters(dir)
+	if len(entries) != 1 || entries[0].RecordCount != 1 || !strings.HasPrefix(entries[0].Destination, "unix://") {
+		t.Fatalf("expected one entry for the record that can be converted, got %+v", entries)
+	}
+	if tag, records := decodeMsgpForward(t, entries[0].Payload); tag != "oneagent.containerInsights.CONTAINER_INVENTORY_BLOB" || records[0]["InstanceID"] != "id" {
+		t.Errorf("expected the msgpack forward payload of the record tag, got %s %+v", tag, records)
+	}
+}
+
+func TestRetryOrDeadLetter(t *testing.T) {
+	dir := resetDeadLetter(t)
+	DeadLetterMaxRetries = 2
+	payload := []byte(`{"DataType":"CONTAINER_LOG_BLOB"}`)
+	key := payloadRetryKey(payload)
+
+	for i := 0; i < 2; i++ {
+		if retryOrDeadLetter(key, ContainerLogDataType, OMSEndpoint, "503", nil, 1, payload) {
+			t.Fatalf("expected retry %d to be left to fluent-bit", i)
+		}
+	}
+	// a sent payload starts over
+	clearDeadLetterRetries(key)
+	for i := 0; i < 2; i++ {
+		retryOrDeadLetter(key, ContainerLogDataType, OMSEndpoint, "503", nil, 1, payload)
+	}
+	if !retryOrDeadLetter(key, ContainerLogDataType, OMSEndpoint, "503", nil, 1, payload) {
+		t.Fatalf("expected the payload to go to the dead-letter store after 2 retries")
+	}
+	entries, _ := ListDeadLetters(dir)
+	if len(entries) != 1 || entries[0].Reason != DeadLetterReasonRetriesExhausted || !bytes.Equal(entries[0].Payload, payload) {
+		t.Errorf("expected the payload with the retries exhausted, got %+v", entries)
+	}
+
+	DeadLetterMaxRetries = 0
+	for i := 0; i < 5; i++ {
+		if retryOrDeadLetter(key, ContainerLogDataType, OMSEndpoint, "503", nil, 1, payload) {
+			t.Fatalf("expected no retry limit with 0 retries")
+		}
+	}
+}
+
+func TestContainerLogRetriesAreCountedAcrossFlushes(t *testing.T) {
+	dir := resetDeadLetter(t)
+	DeadLetterMaxRetries = 2
+	origFilters, origEndpoint, origClient := getLogCollectionFilters(), OMSEndpoint, HTTPClient
+	defer func() { setLogCollectionFilters(origFilters); OMSEndpoint, HTTPClient = origEndpoint, origClient }()
+	setLogCollectionFilters(newLogCollectionFilters(&PluginConfig{CollectStdoutLogs: true, CollectStderrLogs: true}))
+	resetDroppedRecordCounts(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	OMSEndpoint, HTTPClient = server.URL, *server.Client()
+
+	records := []map[interface{}]interface{}{
+		{"filepath": []byte("/var/log/containers/app-5d4f_app_app-0123456789abcdef.log"), "stream": []byte("stdout"), "log": []byte("hello"), "time": []byte("2024-05-01T12:00:00Z")},
+	}
+	// the flushes are a second apart so that their TimeOfCommand differs
+	for i := 0; i < 2; i++ {
+		if ret := (&PluginInstance{}).PostDataHelper(records); ret != output.FLB_RETRY {
+			t.Fatalf("expected flush %d to be retried, got %d", i, ret)
+		}
+		time.Sleep(time.Second)
+	}
+	if ret := (&PluginInstance{}).PostDataHelper(records); ret != output.FLB_OK {
+		t.Fatalf("expected the chunk to go to the dead-letter store after 2 retries, got %d", ret)
+	}
+	if entries, _ := ListDeadLetters(dir); len(entries) != 1 || entries[0].Reason != DeadLetterReasonRetriesExhausted {
+		t.Errorf("expected the ContainerLog records with the retries exhausted, got %+v", entries)
+	}
+}
+
+func TestDeadLetterCommand(t *testing.T) {
+	dir := t.TempDir()
+	writeDeadLetterEntry(dir, 1024*1024, DeadLetterEntry{ID: "cli", Reason: DeadLetterReasonProcessingPanic, DataType: InsightsMetricsDataType, Payload: []byte("payload")})
+
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"dlq", "list", "-dir", dir}, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), "cli") {
+		t.Errorf("dlq list returned %d, output %s %s", code, stdout.String(), stderr.String())
+	}
+	stdout.Reset()
+	if code := runCommand([]string{"dlq", "inspect", "-dir", dir, "cli"}, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), `"payload": "payload"`) {
+		t.Errorf("dlq inspect returned %d, output %s", code, stdout.String())
+	}
+	if code := runCommand([]string{"dlq", "purge", "-dir", dir, "all"}, &stdout, &stderr); code != 0 {
+		t.Errorf("dlq purge returned %d", code)
+	}
+	if entries, _ := ListDeadLetters(dir); len(entries) != 0 {
+		t.Errorf("expected purge to remove all entries, got %d", len(entries))
+	}
+	if code := runCommand([]string{"dlq"}, &stdout, &stderr); code != 2 {
+		t.Errorf("expected usage exit code 2, got %d", code)
+	}
+}
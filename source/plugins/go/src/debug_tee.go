@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"Docker-Provider/source/plugins/go/src/paths"
+)
+
+// env variable to tee the records sent to mdsd and AMA as NDJSON from the start (opt-in, disabled when unset). The
+// diagnostics server enables and disables the tee at runtime on /debug/tee
+const DebugTeeEnabledEnv = "AZMON_DEBUG_TEE_ENABLED"
+
+// env variable with the NDJSON file of the tee, - writes to stdout
+const DebugTeePathEnv = "AZMON_DEBUG_TEE_PATH"
+
+// env variable with the size at which the tee file is rotated
+const DebugTeeMaxSizeMBEnv = "AZMON_DEBUG_TEE_MAX_SIZE_MB"
+
+// env variable to tee one in every N records
+const DebugTeeSampleRateEnv = "AZMON_DEBUG_TEE_SAMPLE_RATE"
+
+// env variable with the comma separated namespaces to tee. Records without a PodNamespace or Namespace field, e.g.
+// metrics and v1 container logs, are only teed without a namespace filter
+const DebugTeeNamespacesEnv = "AZMON_DEBUG_TEE_NAMESPACES"
+
+// env variable with the minutes after which the tee disables itself
+const DebugTeeDurationMinutesEnv = "AZMON_DEBUG_TEE_DURATION_MINUTES"
+
+// DebugTeeStdout is the tee path of stdout
+const DebugTeeStdout = "-"
+
+const (
+	defaultDebugTeePath            = "/var/opt/microsoft/docker-cimprov/log/fluent-bit-out-oms-tee.ndjson"
+	defaultWindowsDebugTeePath     = "/etc/amalogswindows/fluent-bit-out-oms-tee.ndjson"
+	defaultDebugTeeMaxSizeMB       = 10
+	defaultDebugTeeDurationMinutes = 30
+)
+
+// DebugTeeSettings of the tee, they apply when it's enabled
+type DebugTeeSettings struct {
+	Path       string
+	MaxSizeMB  int
+	SampleRate int
+	Namespaces []string
+	Duration   time.Duration
+}
+
+// DebugTeeStatus is the state of the tee served on /debug/tee
+type DebugTeeStatus struct {
+	Enabled    bool
+	Path       string
+	SampleRate int
+	Namespaces []string
+	Until      string
+	Seen       int64
+	Written    int64
+}
+
+// DebugTee writes the outgoing records, with their data type and stream tag, as NDJSON lines
+type DebugTee struct {
+	// active is checked without the mutex so the flushes only pay for the tee while it's enabled
+	active int32
+
+	mutex sync.Mutex
+	// settings apply when the tee is enabled, current are the ones it was enabled with
+	settings   DebugTeeSettings
+	current    DebugTeeSettings
+	namespaces map[string]bool
+	out        io.Writer
+	until      time.Time
+	seen       int64
+	written    int64
+	now        func() time.Time
+}
+
+// debugTeeRecord is a line of the tee
+type debugTeeRecord struct {
+	Time     string            `json:"time"`
+	DataType string            `json:"dataType"`
+	Stream   string            `json:"stream"`
+	Record   map[string]string `json:"record"`
+}
+
+var (
+	// RecordTee tees the records written to the mdsd sockets and AMA named pipes
+	RecordTee = &DebugTee{now: time.Now, settings: DebugTeeSettings{
+		Path:       defaultDebugTeePath,
+		MaxSizeMB:  defaultDebugTeeMaxSizeMB,
+		SampleRate: 1,
+		Duration:   defaultDebugTeeDurationMinutes * time.Minute,
+	}}
+)
+
+func populateDebugTeeSettings(config *PluginConfig) {
+	settings := DebugTeeSettings{
+		Path:       config.DebugTeePath,
+		MaxSizeMB:  config.DebugTeeMaxSizeMB,
+		SampleRate: config.DebugTeeSampleRate,
+		Namespaces: config.DebugTeeNamespaces,
+		Duration:   time.Duration(config.DebugTeeDurationMinutes) * time.Minute,
+	}
+	RecordTee.Configure(settings)
+	if !config.DebugTeeEnabled {
+		return
+	}
+	if err := RecordTee.Enable(settings); err != nil {
+		Log("Error::tee::Unable to enable the debug tee %s", err.Error())
+	}
+}
+
+// Configure replaces the configured settings, an enabled tee keeps the ones it was enabled with
+func (tee *DebugTee) Configure(settings DebugTeeSettings) {
+	tee.mutex.Lock()
+	defer tee.mutex.Unlock()
+	tee.settings = settings
+}
+
+// Settings returns the configured settings
+func (tee *DebugTee) Settings() DebugTeeSettings {
+	tee.mutex.Lock()
+	defer tee.mutex.Unlock()
+	return tee.settings
+}
+
+// Enable opens the output and tees the records until the duration of the settings passed
+func (tee *DebugTee) Enable(settings DebugTeeSettings) error {
+	if settings.Duration <= 0 {
+		return fmt.Errorf("invalid duration %s", settings.Duration)
+	}
+	var out io.Writer = os.Stdout
+	if settings.Path != DebugTeeStdout {
+		path := paths.Resolve(settings.Path)
+		// lumberjack creates the file on the first write, open it now so a bad path fails the enable
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+		out = &lumberjack.Logger{Filename: path, MaxSize: settings.MaxSizeMB, MaxBackups: 1}
+	}
+	tee.mutex.Lock()
+	defer tee.mutex.Unlock()
+	tee.closeOutput()
+	tee.out = out
+	tee.current = settings
+	tee.namespaces = make(map[string]bool)
+	for _, namespace := range tee.current.Namespaces {
+		tee.namespaces[namespace] = true
+	}
+	tee.until = tee.now().Add(settings.Duration)
+	tee.seen, tee.written = 0, 0
+	atomic.StoreInt32(&tee.active, 1)
+	Log("Info::tee::Debug tee enabled until %s, path: %s, sample rate: %d, namespaces: %v", tee.until.Format(time.RFC3339), settings.Path, settings.SampleRate, settings.Namespaces)
+	return nil
+}
+
+// Disable stops the tee and closes its output
+func (tee *DebugTee) Disable(reason string) {
+	tee.mutex.Lock()
+	defer tee.mutex.Unlock()
+	tee.disable(reason)
+}
+
+func (tee *DebugTee) disable(reason string) {
+	if atomic.SwapInt32(&tee.active, 0) == 0 {
+		return
+	}
+	tee.closeOutput()
+	Log("Info::tee::Debug tee disabled (%s) after %d of %d records", reason, tee.written, tee.seen)
+}
+
+func (tee *DebugTee) closeOutput() {
+	if closer, ok := tee.out.(io.Closer); ok && tee.out != os.Stdout {
+		closer.Close()
+	}
+	tee.out = nil
+}
+
+// Write tees the sampled entries of the namespace filter
+func (tee *DebugTee) Write(dataType string, stream string, entries []MsgPackEntry) {
+	if atomic.LoadInt32(&tee.active) == 0 {
+		return
+	}
+	tee.mutex.Lock()
+	defer tee.mutex.Unlock()
+	if tee.out == nil {
+		return
+	}
+	now := tee.now()
+	if now.After(tee.until) {
+		tee.disable("time limit")
+		return
+	}
+	for _, entry := range entries {
+		if len(tee.namespaces) > 0 && !tee.namespaces[entry.Record["PodNamespace"]] && !tee.namespaces[entry.Record["Namespace"]] {
+			continue
+		}
+		tee.seen++
+		if tee.current.SampleRate > 1 && (tee.seen-1)%int64(tee.current.SampleRate) != 0 {
+			continue
+		}
+		line, err := json.Marshal(debugTeeRecord{Time: now.UTC().Format(time.RFC3339Nano), DataType: dataType, Stream: stream, Record: entry.Record})
+		if err != nil {
+			continue
+		}
+		if _, err := tee.out.Write(append(line, '\n')); err != nil {
+			tee.disable("write error " + err.Error())
+			return
+		}
+		tee.written++
+	}
+}
+
+// Status returns the state of the tee
+func (tee *DebugTee) Status() DebugTeeStatus {
+	tee.mutex.Lock()
+	defer tee.mutex.Unlock()
+	status := DebugTeeStatus{Enabled: atomic.LoadInt32(&tee.active) == 1, Seen: tee.seen, Written: tee.written}
+	settings := tee.settings
+	if status.Enabled {
+		settings = tee.current
+		status.Until = tee.until.Format(time.RFC3339)
+	}
+	status.Path, status.SampleRate, status.Namespaces = settings.Path, settings.SampleRate, settings.Namespaces
+	return status
+}
+
+// debugTeeHandler returns the tee status on GET. PUT or POST with ?enabled=true enables it with the configured settings,
+// &minutes=<minutes>, &sample=<N> and &namespaces=<ns1,ns2> override them for this run. ?enabled=false disables it
+func debugTeeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		query := r.URL.Query()
+		enabled, err := strconv.ParseBool(query.Get("enabled"))
+		if err != nil {
+			http.Error(w, "invalid enabled value, expected true or false", http.StatusBadRequest)
+			return
+		}
+		if !enabled {
+			RecordTee.Disable("diagnostics request")
+			break
+		}
+		settings := RecordTee.Settings()
+		minutes := int(settings.Duration / time.Minute)
+		for name, value := range map[string]*int{"minutes": &minutes, "sample": &settings.SampleRate} {
+			if query.Get(name) == "" {
+				continue
+			}
+			if *value, err = strconv.Atoi(query.Get(name)); err != nil || *value < 1 {
+				http.Error(w, fmt.Sprintf("invalid %s value, expected an integer of at least 1", name), http.StatusBadRequest)
+				return
+			}
+		}
+		if query.Has("namespaces") {
+			settings.Namespaces = nil
+			for _, namespace := range strings.Split(query.Get("namespaces"), ",") {
+				if namespace = strings.TrimSpace(namespace); namespace != "" {
+					settings.Namespaces = append(settings.Namespaces, namespace)
+				}
+			}
+		}
+		settings.Duration = time.Duration(minutes) * time.Minute
+		if err := RecordTee.Enable(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeDiagnosticsJSON(w, RecordTee.Status())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetRecordTee disables the tee and restores its settings and clock at the end of the test
+func resetRecordTee(t *testing.T) {
+	settings, now := RecordTee.Settings(), RecordTee.now
+	t.Cleanup(func() {
+		RecordTee.Disable("test")
+		RecordTee.Configure(settings)
+		RecordTee.now = now
+	})
+}
+
+func readTeeLines(t *testing.T, path string) []debugTeeRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []debugTeeRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line debugTeeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid tee line %s %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestDebugTeeWrite(t *testing.T) {
+	resetRecordTee(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	RecordTee.now = func() time.Time { return now }
+	path := filepath.Join(t.TempDir(), "tee.ndjson")
+
+	// not enabled, nothing is written
+	entries := []MsgPackEntry{{Record: map[string]string{"PodNamespace": "default", "LogMessage": "skipped"}}}
+	RecordTee.Write("ContainerLogV2", "ContainerLogV2Source", entries)
+
+	if err := RecordTee.Enable(DebugTeeSettings{Path: path, MaxSizeMB: 1, SampleRate: 2, Namespaces: []string{"default"}, Duration: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	entries = []MsgPackEntry{
+		{Record: map[string]string{"PodNamespace": "default", "LogMessage": "first"}},
+		{Record: map[string]string{"PodNamespace": "other", "LogMessage": "filtered"}},
+		{Record: map[string]string{"PodNamespace": "default", "LogMessage": "sampled out"}},
+		{Record: map[string]string{"Namespace": "default", "Computer": "node"}},
+	}
+	RecordTee.Write("ContainerLogV2", "ContainerLogV2Source", entries)
+	if status := RecordTee.Status(); !status.Enabled || status.Seen != 3 || status.Written != 2 {
+		t.Errorf("expected 3 records seen and 2 written, got %+v", status)
+	}
+
+	// past the time limit the tee disables itself
+	now = now.Add(2 * time.Minute)
+	RecordTee.Write("KubeMonAgentEvents", "KubeMonAgentEventsSource", entries)
+	if RecordTee.Status().Enabled {
+		t.Errorf("expected the tee to be disabled after its time limit")
+	}
+
+	lines := readTeeLines(t, path)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 tee lines, got %+v", lines)
+	}
+	if lines[0].DataType != "ContainerLogV2" || lines[0].Stream != "ContainerLogV2Source" || lines[0].Record["LogMessage"] != "first" || lines[0].Time != "2024-05-01T12:00:00Z" {
+		t.Errorf("unexpected tee line %+v", lines[0])
+	}
+	if lines[1].Record["Computer"] != "node" {
+		t.Errorf("expected the Namespace field to match the filter, got %+v", lines[1])
+	}
+
+	if err := RecordTee.Enable(DebugTeeSettings{Path: filepath.Join(path, "missing", "tee.ndjson"), SampleRate: 1, Duration: time.Minute}); err == nil || RecordTee.Status().Enabled {
+		t.Errorf("expected a bad path to fail the enable")
+	}
+}
+
+func TestDiagnosticsDebugTee(t *testing.T) {
+	resetRecordTee(t)
+	path := filepath.Join(t.TempDir(), "tee.ndjson")
+	RecordTee.Configure(DebugTeeSettings{Path: path, MaxSizeMB: 1, SampleRate: 1, Duration: 30 * time.Minute})
+
+	handler := newDiagnosticsHandler()
+	for _, request := range []struct {
+		method   string
+		path     string
+		code     int
+		expected string
+	}{
+		{http.MethodGet, "/debug/tee", http.StatusOK, `"Enabled": false`},
+		{http.MethodPut, "/debug/tee?enabled=true&minutes=5&sample=10&namespaces=default,+app", http.StatusOK, `"SampleRate": 10`},
+		{http.MethodGet, "/debug/tee", http.StatusOK, `"app"`},
+		{http.MethodPost, "/debug/tee?enabled=true&sample=0", http.StatusBadRequest, "invalid sample value"},
+		{http.MethodPut, "/debug/tee?enabled=maybe", http.StatusBadRequest, "invalid enabled value"},
+		{http.MethodPut, "/debug/tee?enabled=false", http.StatusOK, `"Enabled": false`},
+		{http.MethodDelete, "/debug/tee", http.StatusMethodNotAllowed, "method not allowed"},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(request.method, request.path, nil))
+		if body := recorder.Body.String(); recorder.Code != request.code || !strings.Contains(body, request.expected) {
+			t.Errorf("%s %s returned %d %s, expected %d with %s", request.method, request.path, recorder.Code, body, request.code, request.expected)
+		}
+	}
+	if settings := RecordTee.Settings(); settings.SampleRate != 1 || len(settings.Namespaces) != 0 {
+		t.Errorf("expected the request overrides to leave the configured settings, got %+v", settings)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+// env variable to disable the delivery latency InsightsMetrics (enabled by default)
+const DeliveryLatencyMetricsEnabledEnv = "AZMON_DELIVERY_LATENCY_METRICS_ENABLED"
+
+// key of the fluent-bit event time that FLBPluginFlushCtx adds to each record
+const fluentBitTimeKey = "@flb_time"
+
+// InsightsMetrics namespace of the delivery latency metrics
+const deliveryLatencyMetricName = "containerinsights_delivery_latency"
+
+const deliveryLatencyMetricsIntervalSeconds = 60
+
+// Sinks of the delivery latency histograms
+const (
+	DeliverySinkMdsd = "mdsd"
+	DeliverySinkAMA  = "ama"
+	DeliverySinkODS  = "ods"
+)
+
+// upper bounds in milliseconds of the histogram buckets, the last bucket is unbounded
+var deliveryLatencyBucketsMs = []float64{100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 120000, 300000, 600000, 1800000, 3600000}
+
+// LatencyHistogram counts delivery latencies in fixed buckets
+type LatencyHistogram struct {
+	Buckets []uint64
+	Count   uint64
+	SumMs   float64
+	MaxMs   float64
+}
+
+func newLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{Buckets: make([]uint64, len(deliveryLatencyBucketsMs)+1)}
+}
+
+// Observe adds a latency. Records timestamped in the future (clock skew) count as 0
+func (h *LatencyHistogram) Observe(latencyMs float64) {
+	if latencyMs < 0 {
+		latencyMs = 0
+	}
+	bucket := len(deliveryLatencyBucketsMs)
+	for i, bound := range deliveryLatencyBucketsMs {
+		if latencyMs <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.Buckets[bucket]++
+	h.Count++
+	h.SumMs += latencyMs
+	if latencyMs > h.MaxMs {
+		h.MaxMs = latencyMs
+	}
+}
+
+// Percentile estimates the latency at p (0-1) as the upper bound of its bucket, capped at the max
+func (h *LatencyHistogram) Percentile(p float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p * float64(h.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var cumulative uint64
+	for i, count := range h.Buckets {
+		cumulative += count
+		if cumulative >= rank {
+			if i < len(deliveryLatencyBucketsMs) && deliveryLatencyBucketsMs[i] < h.MaxMs {
+				return deliveryLatencyBucketsMs[i]
+			}
+			return h.MaxMs
+		}
+	}
+	return h.MaxMs
+}
+
+type latencyKey struct {
+	DataType string
+	Sink     string
+}
+
+// LatencyHistograms per data type and sink, reset by their consumer
+type LatencyHistograms struct {
+	mutex      sync.Mutex
+	histograms map[latencyKey]*LatencyHistogram
+}
+
+func newLatencyHistograms() *LatencyHistograms {
+	return &LatencyHistograms{histograms: make(map[latencyKey]*LatencyHistogram)}
+}
+
+func (l *LatencyHistograms) observe(key latencyKey, latenciesMs []float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	h, ok := l.histograms[key]
+	if !ok {
+		h = newLatencyHistogram()
+		l.histograms[key] = h
+	}
+	for _, latencyMs := range latenciesMs {
+		h.Observe(latencyMs)
+	}
+}
+
+// take returns and resets the histograms
+func (l *LatencyHistograms) take() map[latencyKey]*LatencyHistogram {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	histograms := l.histograms
+	l.histograms = make(map[latencyKey]*LatencyHistogram)
+	return histograms
+}
+
+// snapshot returns a copy of the histograms without resetting them
+func (l *LatencyHistograms) snapshot() map[latencyKey]*LatencyHistogram {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	histograms := make(map[latencyKey]*LatencyHistogram, len(l.histograms))
+	for key, h := range l.histograms {
+		copied := *h
+		copied.Buckets = append([]uint64(nil), h.Buckets...)
+		histograms[key] = &copied
+	}
+	return histograms
+}
+
+var (
+	// TelemetryDeliveryLatency histograms reported to App Insights by SendContainerLogPluginMetrics
+	TelemetryDeliveryLatency = newLatencyHistograms()
+	// InsightsMetricsDeliveryLatency histograms sent as InsightsMetrics with the telegraf metrics
+	InsightsMetricsDeliveryLatency = newLatencyHistograms()
+	// DeliveryLatencyMetricsEnabled sends the delivery latency histograms as InsightsMetrics
+	DeliveryLatencyMetricsEnabled bool
+	// deliveryLatencyMetricsLastSent last time the latency InsightsMetrics were added to a telegraf flush
+	deliveryLatencyMetricsLastSent time.Time
+	// deliveryLatencyMetricsMutex read and write mutex access to deliveryLatencyMetricsLastSent
+	deliveryLatencyMetricsMutex = &sync.Mutex{}
+)
+
+func populateDeliveryLatencySettings(config *PluginConfig) {
+	DeliveryLatencyMetricsEnabled = config.DeliveryLatencyMetricsEnabled
+	deliveryLatencyMetricsLastSent = time.Now()
+	Log("DeliveryLatencyMetricsEnabled: %v", DeliveryLatencyMetricsEnabled)
+}
+
+// fluentBitTime converts the timestamp of output.GetRecord
+func fluentBitTime(ts interface{}) (time.Time, bool) {
+	switch t := ts.(type) {
+	case output.FLBTime:
+		return t.Time, true
+	case uint64:
+		return time.Unix(int64(t), 0), true
+	}
+	return time.Time{}, false
+}
+
+// getRecordTime returns the original time of the record from its RFC3339 time field e.g. the CRI time, falling back to
+// the fluent-bit event time
+func getRecordTime(record map[interface{}]interface{}, timeField string) (time.Time, bool) {
+	if value := ToString(record[timeField]); value != "" {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, true
+		}
+	}
+	t, ok := record[fluentBitTimeKey].(time.Time)
+	return t, ok
+}
+
+// observeDeliveryLatency records the delay between the original time of each delivered record and its delivery
+func observeDeliveryLatency(dataType string, sink string, recordTimes []time.Time, deliveredAt time.Time) {
+	if len(recordTimes) == 0 {
+		return
+	}
+	latenciesMs := make([]float64, len(recordTimes))
+	for i, recordTime := range recordTimes {
+		latenciesMs[i] = float64(deliveredAt.Sub(recordTime) / time.Millisecond)
+	}
+	key := latencyKey{DataType: dataType, Sink: sink}
+	TelemetryDeliveryLatency.observe(key, latenciesMs)
+	if DeliveryLatencyMetricsEnabled {
+		InsightsMetricsDeliveryLatency.observe(key, latenciesMs)
+	}
+	if PrometheusMetricsEnabled {
+		PrometheusDeliveryLatency.observe(key, latenciesMs)
+	}
+}
+
+// getDeliveryLatencyTelegrafRecords returns the latency histograms as telegraf records once per interval, so they are
+// sent as InsightsMetrics with the telegraf metrics of the flush
+func getDeliveryLatencyTelegrafRecords(now time.Time) []map[interface{}]interface{} {
+	if !DeliveryLatencyMetricsEnabled {
+		return nil
+	}
+	deliveryLatencyMetricsMutex.Lock()
+	if now.Sub(deliveryLatencyMetricsLastSent) < deliveryLatencyMetricsIntervalSeconds*time.Second {
+		deliveryLatencyMetricsMutex.Unlock()
+		return nil
+	}
+	deliveryLatencyMetricsLastSent = now
+	deliveryLatencyMetricsMutex.Unlock()
+	var records []map[interface{}]interface{}
+	for key, h := range InsightsMetricsDeliveryLatency.take() {
+		if h.Count == 0 {
+			continue
+		}
+		records = append(records, map[interface{}]interface{}{
+			"name": deliveryLatencyMetricName,
+			"tags": map[interface{}]interface{}{
+				"datatype": key.DataType,
+				"sink":     key.Sink,
+			},
+			"fields": map[interface{}]interface{}{
+				"p50_ms": h.Percentile(0.50),
+				"p95_ms": h.Percentile(0.95),
+				"p99_ms": h.Percentile(0.99),
+				"max_ms": h.MaxMs,
+				"count":  h.Count,
+			},
+			"timestamp": uint64(now.Unix()),
+		})
+	}
+	return records
+}
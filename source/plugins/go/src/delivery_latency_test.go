@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	h := newLatencyHistogram()
+	if h.Percentile(0.5) != 0 {
+		t.Errorf("expected 0 for an empty histogram")
+	}
+	// 90 fast, 9 slower and 1 very slow record
+	for i := 0; i < 90; i++ {
+		h.Observe(80)
+	}
+	for i := 0; i < 9; i++ {
+		h.Observe(4000)
+	}
+	h.Observe(7200000)
+	h.Observe(-50)
+
+	if h.Count != 101 || h.MaxMs != 7200000 {
+		t.Fatalf("unexpected count %d or max %v", h.Count, h.MaxMs)
+	}
+	if p50 := h.Percentile(0.50); p50 != 100 {
+		t.Errorf("expected p50 of 100, got %v", p50)
+	}
+	if p95 := h.Percentile(0.95); p95 != 5000 {
+		t.Errorf("expected p95 of 5000, got %v", p95)
+	}
+	if p99 := h.Percentile(0.99); p99 != 5000 {
+		t.Errorf("expected p99 of 5000, got %v", p99)
+	}
+	if p100 := h.Percentile(1); p100 != 7200000 {
+		t.Errorf("expected the unbounded bucket to report the max, got %v", p100)
+	}
+}
+
+func TestLatencyHistogramPercentileCappedAtMax(t *testing.T) {
+	h := newLatencyHistogram()
+	h.Observe(1200)
+	if p50 := h.Percentile(0.5); p50 != 1200 {
+		t.Errorf("expected the bucket bound to be capped at the max, got %v", p50)
+	}
+}
+
+func TestGetRecordTime(t *testing.T) {
+	flbTime := time.Date(2024, 5, 1, 12, 0, 5, 0, time.UTC)
+	record := map[interface{}]interface{}{
+		"time":           []byte("2024-05-01T12:00:00.123456789Z"),
+		fluentBitTimeKey: flbTime,
+	}
+	if recordTime, ok := getRecordTime(record, "time"); !ok || !recordTime.Equal(time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)) {
+		t.Errorf("expected the CRI time, got %s, %v", recordTime, ok)
+	}
+	record["time"] = []byte("not a time")
+	if recordTime, ok := getRecordTime(record, "time"); !ok || !recordTime.Equal(flbTime) {
+		t.Errorf("expected the fluent-bit time fallback, got %s, %v", recordTime, ok)
+	}
+	if _, ok := getRecordTime(map[interface{}]interface{}{}, "time"); ok {
+		t.Errorf("expected no time for a record without timestamps")
+	}
+}
+
+func TestFluentBitTime(t *testing.T) {
+	now := time.Now()
+	if recordTime, ok := fluentBitTime(output.FLBTime{Time: now}); !ok || !recordTime.Equal(now) {
+		t.Errorf("expected the FLBTime, got %s, %v", recordTime, ok)
+	}
+	if recordTime, ok := fluentBitTime(uint64(1714564800)); !ok || recordTime.Unix() != 1714564800 {
+		t.Errorf("expected the unix time, got %s, %v", recordTime, ok)
+	}
+	if _, ok := fluentBitTime("x"); ok {
+		t.Errorf("expected an unknown timestamp type to be ignored")
+	}
+}
+
+func TestDeliveryLatencyTelegrafRecords(t *testing.T) {
+	origEnabled, origLastSent := DeliveryLatencyMetricsEnabled, deliveryLatencyMetricsLastSent
+	defer func() {
+		DeliveryLatencyMetricsEnabled, deliveryLatencyMetricsLastSent = origEnabled, origLastSent
+		TelemetryDeliveryLatency.take()
+		InsightsMetricsDeliveryLatency.take()
+	}()
+	DeliveryLatencyMetricsEnabled = true
+	now := time.Now()
+	deliveryLatencyMetricsLastSent = now
+
+	observeDeliveryLatency("ContainerLogV2", DeliverySinkMdsd, []time.Time{now.Add(-2 * time.Second), now.Add(-30 * time.Second)}, now)
+	if records := getDeliveryLatencyTelegrafRecords(now.Add(time.Second)); records != nil {
+		t.Fatalf("expected no records before the interval elapsed, got %v", records)
+	}
+
+	records := getDeliveryLatencyTelegrafRecords(now.Add(deliveryLatencyMetricsIntervalSeconds * time.Second))
+	if len(records) != 1 {
+		t.Fatalf("expected one record per data type and sink, got %v", records)
+	}
+	laMetrics, err := translateTelegrafMetrics(records[0])
+	if err != nil {
+		t.Fatalf("translateTelegrafMetrics failed: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, laMetric := range laMetrics {
+		values[laMetric.Name] = laMetric.Value
+		if laMetric.Namespace != deliveryLatencyMetricName {
+			t.Errorf("unexpected namespace %s", laMetric.Namespace)
+		}
+	}
+	if values["count"] != 2 || values["max_ms"] != 30000 || values["p50_ms"] != 2500 || values["p99_ms"] != 30000 {
+		t.Errorf("unexpected latency metrics %v", values)
+	}
+
+	// the InsightsMetrics histograms are reset independently of the telemetry histograms
+	if histograms := TelemetryDeliveryLatency.take(); histograms[latencyKey{"ContainerLogV2", DeliverySinkMdsd}].Count != 2 {
+		t.Errorf("expected the telemetry histogram to keep its records, got %v", histograms)
+	}
+}
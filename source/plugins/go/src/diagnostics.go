@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"time"
+)
+
+// env variable to start the diagnostics server (opt-in, disabled when unset)
+const DiagnosticsServerEnabledEnv = "AZMON_DIAGNOSTICS_SERVER_ENABLED"
+
+// env variable with the localhost port of the diagnostics server
+const DiagnosticsServerPortEnv = "AZMON_DIAGNOSTICS_SERVER_PORT"
+
+const defaultDiagnosticsServerPort = 6060
+
+// diagnosticsStateEndpoints are the JSON dumps of the internal state served under /debug/state/
+var diagnosticsStateEndpoints = map[string]func() interface{}{
+	"extension":  diagnosticsExtensionState,
+	"filters":    diagnosticsFiltersState,
+	"imagemaps":  diagnosticsImageMapsState,
+	"tokens":     diagnosticsTokensState,
+	"events":     diagnosticsEventsState,
+	"config":     diagnosticsConfigState,
+	"schemas":    diagnosticsSchemasState,
+	"throttling": diagnosticsThrottlingState,
+}
+
+var (
+	// DiagnosticsServer serves pprof, expvar and the state dumps on localhost, nil when disabled
+	DiagnosticsServer *http.Server
+)
+
+func init() {
+	expvar.Publish("out_oms_instances", expvar.Func(diagnosticsInstancesState))
+}
+
+// startDiagnosticsServer starts the diagnostics server if it's enabled. It only listens on localhost, support reaches
+// it with kubectl exec or port-forward
+func startDiagnosticsServer(config *PluginConfig) {
+	if !config.DiagnosticsServerEnabled {
+		return
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", config.DiagnosticsServerPort))
+	if err != nil {
+		Log("Error::diagnostics::Unable to start the diagnostics server %s", err.Error())
+		return
+	}
+	server := &http.Server{Handler: newDiagnosticsHandler(), ReadHeaderTimeout: 10 * time.Second}
+	DiagnosticsServer = server
+	Log("Diagnostics server listening on %s", listener.Addr().String())
+	goBackground(func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			Log("Error::diagnostics::Diagnostics server stopped %s", err.Error())
+		}
+	})
+}
+
+// newDiagnosticsHandler returns the routes of the diagnostics server. It doesn't use http.DefaultServeMux, so only
+// these routes are exposed
+func newDiagnosticsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/loglevel", logLevelHandler)
+	mux.HandleFunc("/debug/tee", debugTeeHandler)
+	mux.HandleFunc("/debug/state/", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[len("/debug/state/"):]
+		if name == "" {
+			var names []string
+			for endpoint := range diagnosticsStateEndpoints {
+				names = append(names, "/debug/state/"+endpoint)
+			}
+			sort.Strings(names)
+			writeDiagnosticsJSON(w, names)
+			return
+		}
+		state, ok := diagnosticsStateEndpoints[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeDiagnosticsJSON(w, state())
+	})
+	return mux
+}
+
+func writeDiagnosticsJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		Log("Error::diagnostics::Unable to encode the diagnostics response %s", err.Error())
+	}
+}
+
+func diagnosticsExtensionState() interface{} {
+	namespaceStreamIdsMap, streamIdNamedPipeMap := getContainerLogV2ExtensionMaps()
+	return map[string]interface{}{
+		"NamespaceStreamIdsMap": namespaceStreamIdsMap,
+		"StreamIdNamedPipeMap":  streamIdNamedPipeMap,
+	}
+}
+
+// diagnosticsConfigState returns the current config snapshot, its Trigger and TimeGenerated are only set when it's sent
+func diagnosticsConfigState() interface{} {
+	config := getPluginSettings()
+	if config == nil {
+		return map[string]string{}
+	}
+	record, _ := buildConfigSnapshot(config)
+	return record
+}
+
+func diagnosticsFiltersState() interface{} {
+	return getLogCollectionFilters()
+}
+
+func diagnosticsImageMapsState() interface{} {
+	maps := ContainerImageNameMaps.Load()
+	if maps == nil {
+		return map[string]interface{}{}
+	}
+	return maps
+}
+
+// diagnosticsTokensState returns the expiry of the tokens, never the tokens
+func diagnosticsTokensState() interface{} {
+	IngestionAuthTokenUpdateMutex.Lock()
+	defer IngestionAuthTokenUpdateMutex.Unlock()
+	state := map[string]interface{}{
+		"IngestionAuthTokenPresent": ODSIngestionAuthToken != "",
+	}
+	if IMDSTokenExpiration > 0 {
+		state["IMDSTokenExpiration"] = time.Unix(IMDSTokenExpiration, 0).UTC().Format(time.RFC3339)
+	}
+	if !IngestionAuthTokenRefreshTime.IsZero() {
+		state["IngestionAuthTokenRefreshTime"] = IngestionAuthTokenRefreshTime.UTC().Format(time.RFC3339)
+	}
+	return state
+}
+
+func diagnosticsEventsState() interface{} {
+	EventHashUpdateMutex.Lock()
+	defer EventHashUpdateMutex.Unlock()
+	events := make(map[string]map[string]KubeMonAgentEventTags)
+	for name, hash := range map[string]map[string]KubeMonAgentEventTags{
+		"ConfigErrorEvent":        ConfigErrorEvent,
+		"PromScrapeErrorEvent":    PromScrapeErrorEvent,
+		"ConnectionErrorEvent":    ConnectionErrorEvent,
+		"VerboseCollectionEvent":  VerboseCollectionEvent,
+		"ResourceThrottlingEvent": ResourceThrottlingEvent,
+	} {
+		copied := make(map[string]KubeMonAgentEventTags, len(hash))
+		for k, v := range hash {
+			copied[k] = v
+		}
+		events[name] = copied
+	}
+	return events
+}
+
+func diagnosticsInstancesState() interface{} {
+	PluginInstancesMutex.Lock()
+	defer PluginInstancesMutex.Unlock()
+	var instances []map[string]interface{}
+	for _, instance := range PluginInstances {
+		workers := 0
+		if instance.workers != nil {
+			instance.workers.mutex.Lock()
+			workers = instance.workers.count
+			instance.workers.mutex.Unlock()
+		}
+		instances = append(instances, map[string]interface{}{
+			"ID":                        instance.ID,
+			"Name":                      instance.Name,
+			"ContainerLogsRouteV2":      instance.ContainerLogsRouteV2,
+			"ContainerLogSchemaVersion": instance.ContainerLogSchemaVersion,
+			"Workers":                   workers,
+		})
+	}
+	return instances
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"Docker-Provider/source/plugins/go/src/logging"
+)
+
+func getDiagnostics(t *testing.T, handler http.Handler, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	body, _ := io.ReadAll(recorder.Body)
+	return recorder.Code, string(body)
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	origFilters := getLogCollectionFilters()
+	defer setLogCollectionFilters(origFilters)
+	setLogCollectionFilters(newLogCollectionFilters(&PluginConfig{CollectStdoutLogs: true, StdoutExcludedNamespaces: []string{"dev"}}))
+	IngestionAuthTokenUpdateMutex.Lock()
+	origToken := ODSIngestionAuthToken
+	ODSIngestionAuthToken = "secret-token"
+	IngestionAuthTokenUpdateMutex.Unlock()
+	defer func() {
+		IngestionAuthTokenUpdateMutex.Lock()
+		ODSIngestionAuthToken = origToken
+		IngestionAuthTokenUpdateMutex.Unlock()
+	}()
+
+	handler := newDiagnosticsHandler()
+	for path, expected := range map[string]string{
+		"/debug/state/":           "/debug/state/filters",
+		"/debug/state/filters":    `"dev": true`,
+		"/debug/state/tokens":     `"IngestionAuthTokenPresent": true`,
+		"/debug/state/events":     "ConfigErrorEvent",
+		"/debug/state/extension":  "NamespaceStreamIdsMap",
+		"/debug/state/schemas":    "json_Collections",
+		"/debug/state/throttling": `"level": "none"`,
+		"/debug/vars":             "out_oms_instances",
+		"/debug/pprof/":           "goroutine",
+	} {
+		code, body := getDiagnostics(t, handler, path)
+		if code != http.StatusOK || !strings.Contains(body, expected) {
+			t.Errorf("GET %s returned %d, expected %s in %s", path, code, expected, body)
+		}
+		if strings.Contains(body, "secret-token") {
+			t.Errorf("GET %s exposed the ingestion token", path)
+		}
+	}
+	if code, _ := getDiagnostics(t, handler, "/debug/state/unknown"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown state, got %d", code)
+	}
+	if code, _ := getDiagnostics(t, handler, "/"); code != http.StatusNotFound {
+		t.Errorf("expected only the diagnostics routes, got %d for /", code)
+	}
+}
+
+func TestStartDiagnosticsServerListensOnLocalhost(t *testing.T) {
+	origServer := DiagnosticsServer
+	defer func() { DiagnosticsServer = origServer }()
+	DiagnosticsServer = nil
+
+	startDiagnosticsServer(&PluginConfig{})
+	if DiagnosticsServer != nil {
+		t.Fatalf("expected the diagnostics server to be opt-in")
+	}
+	startDiagnosticsServer(&PluginConfig{DiagnosticsServerEnabled: true, DiagnosticsServerPort: 0})
+	if DiagnosticsServer == nil {
+		t.Fatalf("expected the diagnostics server to start")
+	}
+	DiagnosticsServer.Close()
+}
+
+func TestDiagnosticsLogLevel(t *testing.T) {
+	origLogger := PluginLogger
+	defer func() { PluginLogger = origLogger }()
+	var out strings.Builder
+	PluginLogger = logging.New(&out, logging.Config{Format: logging.FormatText, Level: logging.LevelInfo})
+
+	handler := newDiagnosticsHandler()
+	for _, request := range []struct {
+		method   string
+		path     string
+		code     int
+		expected string
+	}{
+		{http.MethodGet, "/debug/loglevel", http.StatusOK, `"Level": "info"`},
+		{http.MethodPut, "/debug/loglevel?component=mdsd&level=debug", http.StatusOK, `"mdsd": "debug"`},
+		{http.MethodPost, "/debug/loglevel?level=warn", http.StatusOK, `"Level": "warn"`},
+		{http.MethodPut, "/debug/loglevel?level=loud", http.StatusBadRequest, "invalid log level"},
+		{http.MethodDelete, "/debug/loglevel", http.StatusMethodNotAllowed, "method not allowed"},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(request.method, request.path, nil))
+		if body := recorder.Body.String(); recorder.Code != request.code || !strings.Contains(body, request.expected) {
+			t.Errorf("%s %s returned %d %s, expected %d with %s", request.method, request.path, recorder.Code, body, request.code, request.expected)
+		}
+	}
+	if !PluginLogger.Enabled("mdsd", logging.LevelDebug) || PluginLogger.Enabled("flush", logging.LevelInfo) {
+		t.Errorf("expected the levels set through the endpoint to apply")
+	}
+
+	code := func(path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, path, nil))
+		return recorder.Code
+	}
+	if code("/debug/loglevel?component=mdsd&level=reset") != http.StatusOK || PluginLogger.Enabled("mdsd", logging.LevelDebug) {
+		t.Errorf("expected the reset component to use the default level again")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// env variable to log one in every N dropped records per reason (opt-in, disabled when unset)
+const DroppedRecordLogSampleRateEnv = "AZMON_DROPPED_RECORD_LOG_SAMPLE_RATE"
+
+// sampled dropped records are truncated to this size in the log
+const droppedRecordLogMaxBytes = 1024
+
+// DropReason why the output plugin discarded records instead of sending them
+type DropReason string
+
+// Drop reasons
+const (
+	// DropReasonExcludedNamespace container log of a namespace in exclude_namespaces
+	DropReasonExcludedNamespace DropReason = "ExcludedNamespace"
+	// DropReasonSystemResourceNotIncluded container log of a system pod that isn't in the include list
+	DropReasonSystemResourceNotIncluded DropReason = "SystemResourceNotIncluded"
+	// DropReasonMissingContainerId container log whose file path has no container id
+	DropReasonMissingContainerId DropReason = "MissingContainerId"
+	// DropReasonEmptyLogEntry record without a log message
+	DropReasonEmptyLogEntry DropReason = "EmptyLogEntry"
+	// DropReasonNonNumericField telegraf field that isn't numeric, LA metric values have to be numeric
+	DropReasonNonNumericField DropReason = "NonNumericField"
+	// DropReasonTranslationError telegraf metric that couldn't be translated to LA metrics
+	DropReasonTranslationError DropReason = "TranslationError"
+	// DropReasonMarshalError records that couldn't be serialized
+	DropReasonMarshalError DropReason = "MarshalError"
+	// DropReasonNonRetriableStatus records rejected by the destination with a non-retriable status
+	DropReasonNonRetriableStatus DropReason = "NonRetriableStatus"
+	// DropReasonStreamOptedOut records of a stream that isn't in the DCR
+	DropReasonStreamOptedOut DropReason = "StreamOptedOut"
+	// DropReasonStreamDisabled container log of a stream whose collection was disabled by a configmap reload
+	DropReasonStreamDisabled DropReason = "StreamDisabled"
+	// DropReasonUnsupportedRoute records of a data type the configured route can't send
+	DropReasonUnsupportedRoute DropReason = "UnsupportedRoute"
+	// DropReasonRetriesExhausted records that failed to send more than the dead-letter retry limit
+	DropReasonRetriesExhausted DropReason = "RetriesExhausted"
+	// DropReasonSendError records that failed to send and aren't retried
+	DropReasonSendError DropReason = "SendError"
+	// DropReasonProcessingPanic records of a flush that panicked
+	DropReasonProcessingPanic DropReason = "ProcessingPanic"
+	// DropReasonResourceThrottled container log of a low priority namespace sampled out near the resource limits
+	DropReasonResourceThrottled DropReason = "ResourceThrottled"
+)
+
+type dropKey struct {
+	Reason    DropReason
+	Namespace string
+}
+
+var (
+	// DroppedRecordCounts per reason and namespace since the last telemetry flush
+	DroppedRecordCounts = make(map[dropKey]float64)
+	// DroppedRecordTotals per reason and namespace since the start, exported as prometheus counters
+	DroppedRecordTotals = make(map[dropKey]float64)
+	// DroppedRecordCountsMutex read and write mutex access to DroppedRecordCounts, DroppedRecordTotals and droppedRecordSampleCounters
+	DroppedRecordCountsMutex = &sync.Mutex{}
+	// DroppedRecordLogSampleRate logs one in every N dropped records per reason, 0 disables the log
+	DroppedRecordLogSampleRate int
+	// droppedRecordSampleCounters count the drops of a reason towards the next sampled log
+	droppedRecordSampleCounters = make(map[DropReason]int)
+)
+
+func populateDropAccountingSettings(config *PluginConfig) {
+	DroppedRecordLogSampleRate = config.DroppedRecordLogSampleRate
+	Log("DroppedRecordLogSampleRate: %d", DroppedRecordLogSampleRate)
+}
+
+// recordDrop accounts count dropped records. record is only formatted for the sampled debug log, it may be nil
+func recordDrop(reason DropReason, namespace string, count int, record interface{}) {
+	if count <= 0 {
+		return
+	}
+	recordBatchDrop(reason, map[string]int{namespace: count}, record)
+}
+
+// recordBatchDrop accounts the drop of a whole batch with the record counts per namespace. detail is only formatted for
+// the sampled debug log
+func recordBatchDrop(reason DropReason, namespaceRecordCounts map[string]int, detail interface{}) {
+	count := 0
+	DroppedRecordCountsMutex.Lock()
+	for namespace, namespaceCount := range namespaceRecordCounts {
+		if namespaceCount <= 0 {
+			continue
+		}
+		count += namespaceCount
+		DroppedRecordCounts[dropKey{Reason: reason, Namespace: namespace}] += float64(namespaceCount)
+		DroppedRecordTotals[dropKey{Reason: reason, Namespace: namespace}] += float64(namespaceCount)
+	}
+	logSample := false
+	if DroppedRecordLogSampleRate > 0 && count > 0 {
+		droppedRecordSampleCounters[reason] += count
+		if droppedRecordSampleCounters[reason] >= DroppedRecordLogSampleRate {
+			droppedRecordSampleCounters[reason] = 0
+			logSample = true
+		}
+	}
+	DroppedRecordCountsMutex.Unlock()
+
+	if logSample {
+		namespaces := make([]string, 0, len(namespaceRecordCounts))
+		for namespace := range namespaceRecordCounts {
+			namespaces = append(namespaces, namespace)
+		}
+		sort.Strings(namespaces)
+		sample := fmt.Sprintf("%v", detail)
+		if len(sample) > droppedRecordLogMaxBytes {
+			sample = sample[:droppedRecordLogMaxBytes] + "..."
+		}
+		Log("Debug::drop::Dropped %d record(s) reason: %s namespace: %s record: %s", count, reason, strings.Join(namespaces, ","), sample)
+	}
+}
+
+// flushDrops accumulates the records a flush drops by reason and namespace, they are accounted once at the end of the
+// flush instead of taking DroppedRecordCountsMutex for every dropped record
+type flushDrops struct {
+	counts map[DropReason]map[string]int
+	// last dropped record of each reason, for the sampled debug log
+	samples map[DropReason]interface{}
+}
+
+func newFlushDrops() *flushDrops {
+	return &flushDrops{counts: make(map[DropReason]map[string]int), samples: make(map[DropReason]interface{})}
+}
+
+func (drops *flushDrops) add(reason DropReason, namespace string, record interface{}) {
+	namespaceRecordCounts, ok := drops.counts[reason]
+	if !ok {
+		namespaceRecordCounts = make(map[string]int)
+		drops.counts[reason] = namespaceRecordCounts
+	}
+	namespaceRecordCounts[namespace]++
+	drops.samples[reason] = record
+}
+
+// account records the accumulated drops
+func (drops *flushDrops) account() {
+	for reason, namespaceRecordCounts := range drops.counts {
+		recordBatchDrop(reason, namespaceRecordCounts, drops.samples[reason])
+	}
+}
+
+// takeDroppedRecordCounts returns and resets the dropped record counts
+func takeDroppedRecordCounts() map[dropKey]float64 {
+	DroppedRecordCountsMutex.Lock()
+	defer DroppedRecordCountsMutex.Unlock()
+	counts := DroppedRecordCounts
+	DroppedRecordCounts = make(map[dropKey]float64)
+	return counts
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func resetDroppedRecordCounts(t *testing.T) {
+	origSampleRate := DroppedRecordLogSampleRate
+	t.Cleanup(func() {
+		DroppedRecordLogSampleRate = origSampleRate
+		takeDroppedRecordCounts()
+		droppedRecordSampleCounters = make(map[DropReason]int)
+	})
+	takeDroppedRecordCounts()
+}
+
+func TestRecordDrop(t *testing.T) {
+	resetDroppedRecordCounts(t)
+	recordDrop(DropReasonExcludedNamespace, "kube-system", 1, nil)
+	recordDrop(DropReasonExcludedNamespace, "kube-system", 2, nil)
+	recordDrop(DropReasonMarshalError, "", 5, "error")
+	recordDrop(DropReasonMarshalError, "", 0, "error")
+	recordBatchDrop(DropReasonNonRetriableStatus, map[string]int{"default": 3, "web": 1}, "400 Bad Request")
+
+	counts := takeDroppedRecordCounts()
+	expected := map[dropKey]float64{
+		{Reason: DropReasonExcludedNamespace, Namespace: "kube-system"}: 3,
+		{Reason: DropReasonMarshalError, Namespace: ""}:                 5,
+		{Reason: DropReasonNonRetriableStatus, Namespace: "default"}:    3,
+		{Reason: DropReasonNonRetriableStatus, Namespace: "web"}:        1,
+	}
+	if len(counts) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, counts)
+	}
+	for key, count := range expected {
+		if counts[key] != count {
+			t.Errorf("%v: expected %v, got %v", key, count, counts[key])
+		}
+	}
+	if counts = takeDroppedRecordCounts(); len(counts) != 0 {
+		t.Errorf("expected the counts to be reset, got %v", counts)
+	}
+}
+
+func TestRecordDropSampling(t *testing.T) {
+	resetDroppedRecordCounts(t)
+	DroppedRecordLogSampleRate = 3
+	for i := 0; i < 2; i++ {
+		recordDrop(DropReasonEmptyLogEntry, "", 1, nil)
+	}
+	if droppedRecordSampleCounters[DropReasonEmptyLogEntry] != 2 {
+		t.Fatalf("expected 2 drops towards the next sample, got %d", droppedRecordSampleCounters[DropReasonEmptyLogEntry])
+	}
+	recordDrop(DropReasonEmptyLogEntry, "", 1, nil)
+	if droppedRecordSampleCounters[DropReasonEmptyLogEntry] != 0 {
+		t.Errorf("expected the sample counter to reset after a sampled log, got %d", droppedRecordSampleCounters[DropReasonEmptyLogEntry])
+	}
+	if droppedRecordSampleCounters[DropReasonExcludedNamespace] != 0 {
+		t.Errorf("expected sampling to be per reason")
+	}
+}
+
+func TestFlushDropsAccountsOnce(t *testing.T) {
+	resetDroppedRecordCounts(t)
+	DroppedRecordLogSampleRate = 3
+	drops := newFlushDrops()
+	drops.add(DropReasonExcludedNamespace, "kube-system", nil)
+	drops.add(DropReasonExcludedNamespace, "kube-system", nil)
+	drops.add(DropReasonExcludedNamespace, "dev", nil)
+	drops.add(DropReasonMissingContainerId, "", nil)
+	if counts := takeDroppedRecordCounts(); len(counts) != 0 {
+		t.Fatalf("expected the drops to be accumulated until the flush returns, got %v", counts)
+	}
+
+	drops.account()
+	counts := takeDroppedRecordCounts()
+	if counts[dropKey{Reason: DropReasonExcludedNamespace, Namespace: "kube-system"}] != 2 || counts[dropKey{Reason: DropReasonExcludedNamespace, Namespace: "dev"}] != 1 || counts[dropKey{Reason: DropReasonMissingContainerId}] != 1 {
+		t.Errorf("unexpected counts %v", counts)
+	}
+	// the 3 excluded namespace drops reached the sample rate
+	if droppedRecordSampleCounters[DropReasonExcludedNamespace] != 0 || droppedRecordSampleCounters[DropReasonMissingContainerId] != 1 {
+		t.Errorf("unexpected sample counters %v", droppedRecordSampleCounters)
+	}
+}
+
+func TestPostDataHelperAccountsDrops(t *testing.T) {
+	resetDroppedRecordCounts(t)
+	origIgnoreNsSet := StdoutIgnoreNsSet
+	StdoutIgnoreNsSet = map[string]bool{"excluded": true}
+	defer func() { StdoutIgnoreNsSet = origIgnoreNsSet }()
+
+	(&PluginInstance{}).PostDataHelper([]map[interface{}]interface{}{
+		{"filepath": []byte("/var/log/containers/pod_xyz.log"), "stream": []byte("stdout"), "log": []byte("no container id")},
+		{"filepath": []byte("/var/log/containers/app-5d4f_excluded_app-0123456789abcdef.log"), "stream": []byte("stdout"), "log": []byte("excluded")},
+	})
+
+	counts := takeDroppedRecordCounts()
+	if counts[dropKey{Reason: DropReasonMissingContainerId}] != 1 {
+		t.Errorf("expected one record without a container id, got %v", counts)
+	}
+	if counts[dropKey{Reason: DropReasonExcludedNamespace, Namespace: "excluded"}] != 1 {
+		t.Errorf("expected one record of an excluded namespace, got %v", counts)
+	}
+}
@@ -248,6 +248,22 @@ func (e *Extension) GetOutputNamedPipe(datatype string, useFromCache bool) strin
 	return e.datatypeNamedPipeMap[datatype]
 }
 
+// GetCachedSettings returns copies of the data type to stream id mapping and the data collection settings last read
+// from the extension, without querying the agent
+func (e *Extension) GetCachedSettings() (map[string]string, map[string]string) {
+	extensionconfiglock.Lock()
+	defer extensionconfiglock.Unlock()
+	streamIds := make(map[string]string, len(e.datatypeStreamIdMap))
+	for datatype, streamId := range e.datatypeStreamIdMap {
+		streamIds[datatype] = streamId
+	}
+	dataCollectionSettings := make(map[string]string, len(e.dataCollectionSettings))
+	for key, value := range e.dataCollectionSettings {
+		dataCollectionSettings[key] = value
+	}
+	return streamIds, dataCollectionSettings
+}
+
 func (e *Extension) IsDataCollectionSettingsConfigured() bool {
 	var err error
 	dataCollectionSettings, err := getDataCollectionSettingsInterface(ContainerInsightsExtension, ContainerInsightsExtensionVersion)
@@ -327,7 +343,7 @@ func (e *Extension) GetNamespaceFilteringModeForDataCollection() string {
 				if contains(extensionSettingsDataCollectionSettingsNamespaceFilteringModes, lowerMode) {
 					return lowerMode
 				} else {
-					fmt.Println("ExtensionUtils::getNamespaceFilteringModeForDataCollection: namespaceFilteringMode:", mode, "not supported hence using default")
+					logger.Println("Warn::ExtensionUtils::getNamespaceFilteringModeForDataCollection: namespaceFilteringMode:", mode, "not supported hence using default")
 				}
 			}
 		}
@@ -7,6 +7,8 @@ import (
 	"strings"
 
 	"github.com/ugorji/go/codec"
+
+	"Docker-Provider/source/plugins/go/src/paths"
 )
 
 const FluentSocketName = "/var/run/mdsd-ci/default_fluent.socket"
@@ -20,11 +22,11 @@ func getExtensionConfigResponse(jsonBytes []byte) ([]byte, error) {
 	}
 
 	fs := &FluentSocket{}
-	fs.sockAddress = FluentSocketName
+	fs.sockAddress = paths.Resolve(FluentSocketName)
 	genevaLogsIntegrationEnabled := strings.TrimSpace(strings.ToLower(os.Getenv("GENEVA_LOGS_INTEGRATION")))
 	if (containerType != "" && strings.Compare(strings.ToLower(containerType), "prometheussidecar") == 0) ||
 		(genevaLogsIntegrationEnabled != "" && strings.Compare(strings.ToLower(genevaLogsIntegrationEnabled), "true") == 0) {
-		fs.sockAddress = FluentSocketNamePrometheusSidecar
+		fs.sockAddress = paths.Resolve(FluentSocketNamePrometheusSidecar)
 	}
 	responseBytes, err := FluentSocketWriter.writeAndRead(fs, data)
 	defer FluentSocketWriter.disconnect(fs)
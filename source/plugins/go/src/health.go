@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/paths"
+)
+
+// env variable to start the health server with /healthz and /readyz (opt-in, disabled when unset)
+const HealthServerEnabledEnv = "AZMON_HEALTH_SERVER_ENABLED"
+
+// env variable with the localhost port of the health server
+const HealthServerPortEnv = "AZMON_HEALTH_SERVER_PORT"
+
+// env variable with the path of the health status file for exec probes, no file is written when unset
+const HealthStatusFileEnv = "AZMON_HEALTH_STATUS_FILE"
+
+// env variables with the staleness thresholds of the health checks
+const HealthFlushStalenessSecondsEnv = "AZMON_HEALTH_FLUSH_STALENESS_SECONDS"
+const HealthTokenStalenessSecondsEnv = "AZMON_HEALTH_TOKEN_STALENESS_SECONDS"
+const HealthExtensionConfigStalenessSecondsEnv = "AZMON_HEALTH_EXTENSION_CONFIG_STALENESS_SECONDS"
+const HealthInputPluginStalenessSecondsEnv = "AZMON_HEALTH_INPUT_PLUGIN_STALENESS_SECONDS"
+
+const defaultHealthServerPort = 6061
+const defaultHealthFlushStalenessSeconds = 900
+const defaultHealthTokenStalenessSeconds = 2 * defaultIngestionAuthTokenRefreshIntervalSeconds
+const defaultHealthExtensionConfigStalenessSeconds = 3 * defaultContainerLogV2ExtensionConfigRefreshIntervalSeconds
+const defaultHealthInputPluginStalenessSeconds = 900
+
+const healthStatusFileInterval = 30 * time.Second
+
+// data types of the flush health checks
+const (
+	healthContainerLog       = "ContainerLog"
+	healthInsightsMetrics    = "InsightsMetrics"
+	healthInputPluginRecords = "InputPluginRecords"
+	healthHostLogs           = "HostLogs"
+)
+
+// HealthCheck is the result of one check. Liveness checks fail /healthz, all checks fail /readyz
+type HealthCheck struct {
+	Name        string `json:"name"`
+	Healthy     bool   `json:"healthy"`
+	Liveness    bool   `json:"liveness"`
+	Message     string `json:"message,omitempty"`
+	LastSuccess string `json:"lastSuccess,omitempty"`
+}
+
+// HealthReport aggregates the checks served by the health server and written to the status file
+type HealthReport struct {
+	Live   bool          `json:"live"`
+	Ready  bool          `json:"ready"`
+	Time   string        `json:"time"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// flushHealth tracks the flushes of a data type
+type flushHealth struct {
+	lastSuccess  time.Time
+	failingSince time.Time
+}
+
+// pipelineHealth is the state of the pipeline recorded by the flushes, the input plugin records and the extension
+// config refresh
+type pipelineHealth struct {
+	mutex                   sync.Mutex
+	flushes                 map[string]*flushHealth
+	inputPluginRuns         map[string]time.Time
+	extensionConfigUpdateAt time.Time
+}
+
+// healthMonitor checks the pipeline state against the staleness thresholds of the configuration
+type healthMonitor struct {
+	startedAt                time.Time
+	flushStaleness           time.Duration
+	tokenStaleness           time.Duration
+	extensionConfigStaleness time.Duration
+	inputPluginStaleness     time.Duration
+	// the ingestion token and the extension config are only refreshed in some modes
+	checkToken           bool
+	checkExtensionConfig bool
+}
+
+var (
+	// PipelineHealth state of the pipeline the health checks read
+	PipelineHealth = newPipelineHealth()
+	// HealthMonitor created by InitializePlugin, nil before
+	HealthMonitor *healthMonitor
+	// HealthServer serves /healthz and /readyz on localhost, nil when disabled
+	HealthServer *http.Server
+	// HealthStatusFileTicker to write the health status file
+	HealthStatusFileTicker *time.Ticker
+)
+
+func newPipelineHealth() *pipelineHealth {
+	return &pipelineHealth{flushes: make(map[string]*flushHealth), inputPluginRuns: make(map[string]time.Time)}
+}
+
+// recordFlushResult records the result of a flush of the data type
+func (p *pipelineHealth) recordFlushResult(dataType string, success bool, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	flush, ok := p.flushes[dataType]
+	if !ok {
+		flush = &flushHealth{}
+		p.flushes[dataType] = flush
+	}
+	if success {
+		flush.lastSuccess = now
+		flush.failingSince = time.Time{}
+	} else if flush.failingSince.IsZero() {
+		flush.failingSince = now
+	}
+}
+
+// recordInputPluginRun records the records of an input plugin tag
+func (p *pipelineHealth) recordInputPluginRun(tag string, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inputPluginRuns[tag] = now
+}
+
+// recordExtensionConfigUpdate records a successful refresh of the extension config
+func (p *pipelineHealth) recordExtensionConfigUpdate(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.extensionConfigUpdateAt = now
+}
+
+// newHealthMonitor creates the monitor of the configuration, InitializePlugin has to start the refresh tickers before
+func newHealthMonitor(config *PluginConfig, now time.Time) *healthMonitor {
+	return &healthMonitor{
+		startedAt:                now,
+		flushStaleness:           time.Duration(config.HealthFlushStalenessSeconds) * time.Second,
+		tokenStaleness:           time.Duration(config.HealthTokenStalenessSeconds) * time.Second,
+		extensionConfigStaleness: time.Duration(config.HealthExtensionConfigStalenessSeconds) * time.Second,
+		inputPluginStaleness:     time.Duration(config.HealthInputPluginStalenessSeconds) * time.Second,
+		checkToken:               IngestionAuthTokenRefreshTicker != nil,
+		checkExtensionConfig:     ContainerLogV2ExtensionConfigRefreshTicker != nil,
+	}
+}
+
+// check returns the report of the pipeline state
+func (m *healthMonitor) check(health *pipelineHealth, now time.Time) *HealthReport {
+	checks := []HealthCheck{m.checkMdsdConnectivity()}
+
+	health.mutex.Lock()
+	var dataTypes []string
+	for dataType := range health.flushes {
+		dataTypes = append(dataTypes, dataType)
+	}
+	sort.Strings(dataTypes)
+	for _, dataType := range dataTypes {
+		flush := health.flushes[dataType]
+		check := HealthCheck{Name: "flush:" + dataType, Healthy: true, LastSuccess: formatHealthTime(flush.lastSuccess)}
+		if !flush.failingSince.IsZero() {
+			check.Message = fmt.Sprintf("flushes failing since %s", formatHealthTime(flush.failingSince))
+			check.Healthy = now.Sub(flush.failingSince) <= m.flushStaleness
+		}
+		checks = append(checks, check)
+	}
+	var tags []string
+	for tag := range health.inputPluginRuns {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		checks = append(checks, m.checkStaleness("inputPlugin:"+tag, health.inputPluginRuns[tag], m.inputPluginStaleness, now))
+	}
+	extensionConfigUpdateAt := health.extensionConfigUpdateAt
+	health.mutex.Unlock()
+
+	if m.checkToken {
+		IngestionAuthTokenUpdateMutex.Lock()
+		refreshTime, expiration := IngestionAuthTokenRefreshTime, IMDSTokenExpiration
+		IngestionAuthTokenUpdateMutex.Unlock()
+		check := m.checkStaleness("ingestionToken", refreshTime, m.tokenStaleness, now)
+		if expiration > 0 && now.Unix() >= expiration {
+			check.Healthy = false
+			check.Message = fmt.Sprintf("IMDS token expired at %s", formatHealthTime(time.Unix(expiration, 0)))
+		}
+		checks = append(checks, check)
+	}
+	if m.checkExtensionConfig {
+		checks = append(checks, m.checkStaleness("extensionConfig", extensionConfigUpdateAt, m.extensionConfigStaleness, now))
+	}
+
+	report := &HealthReport{Live: true, Ready: true, Time: formatHealthTime(now), Checks: checks}
+	for _, check := range checks {
+		if !check.Healthy {
+			report.Ready = false
+			if check.Liveness {
+				report.Live = false
+			}
+		}
+	}
+	return report
+}
+
+// checkMdsdConnectivity fails while a circuit breaker of the mdsd sockets or ama named pipes is open. It doesn't fail
+// liveness, restarting the plugin doesn't bring mdsd back
+func (m *healthMonitor) checkMdsdConnectivity() HealthCheck {
+	CircuitBreakersMutex.Lock()
+	breakers := make([]*CircuitBreaker, 0, len(CircuitBreakers))
+	for _, cb := range CircuitBreakers {
+		breakers = append(breakers, cb)
+	}
+	CircuitBreakersMutex.Unlock()
+
+	var open []string
+	for _, cb := range breakers {
+		if cb.State() == CircuitOpen {
+			open = append(open, cb.Destination)
+		}
+	}
+	check := HealthCheck{Name: "mdsd", Healthy: len(open) == 0}
+	if len(open) > 0 {
+		sort.Strings(open)
+		check.Message = fmt.Sprintf("circuit open for %v", open)
+	}
+	return check
+}
+
+// checkStaleness fails the liveness check if last, or the start of the monitor before the first success, is older
+// than the threshold
+func (m *healthMonitor) checkStaleness(name string, last time.Time, threshold time.Duration, now time.Time) HealthCheck {
+	check := HealthCheck{Name: name, Healthy: true, Liveness: true, LastSuccess: formatHealthTime(last)}
+	since := last
+	if since.IsZero() {
+		since = m.startedAt
+	}
+	if age := now.Sub(since); age > threshold {
+		check.Healthy = false
+		check.Message = fmt.Sprintf("last update %s ago, threshold %s", age.Truncate(time.Second), threshold)
+	}
+	return check
+}
+
+func formatHealthTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// startHealthMonitor creates the health monitor and starts the health server and the status file writer if they're
+// enabled
+func startHealthMonitor(config *PluginConfig) {
+	monitor := newHealthMonitor(config, time.Now())
+	HealthMonitor = monitor
+	if config.HealthStatusFile != "" {
+		statusFile := paths.Resolve(config.HealthStatusFile)
+		writeHealthStatusFile(statusFile, monitor.check(PipelineHealth, time.Now()))
+		HealthStatusFileTicker = time.NewTicker(healthStatusFileInterval)
+		ticker := HealthStatusFileTicker
+		goBackground(func() {
+			for waitForTick(ticker) {
+				writeHealthStatusFile(statusFile, monitor.check(PipelineHealth, time.Now()))
+			}
+		})
+	}
+	if !config.HealthServerEnabled {
+		return
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", config.HealthServerPort))
+	if err != nil {
+		Log("Error::health::Unable to start the health server %s", err.Error())
+		return
+	}
+	server := &http.Server{Handler: newHealthHandler(monitor), ReadHeaderTimeout: 10 * time.Second}
+	HealthServer = server
+	Log("Health server listening on %s", listener.Addr().String())
+	goBackground(func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			Log("Error::health::Health server stopped %s", err.Error())
+		}
+	})
+}
+
+// newHealthHandler returns the routes of the health server, 200 when the probe passes and 503 otherwise
+func newHealthHandler(monitor *healthMonitor) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := monitor.check(PipelineHealth, time.Now())
+		writeHealthReport(w, report, report.Live)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := monitor.check(PipelineHealth, time.Now())
+		writeHealthReport(w, report, report.Ready)
+	})
+	return mux
+}
+
+func writeHealthReport(w http.ResponseWriter, report *HealthReport, healthy bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		Log("Error::health::Unable to encode the health report %s", err.Error())
+	}
+}
+
+// writeHealthStatusFile replaces the status file with the report, exec probes never read a partial file
+func writeHealthStatusFile(path string, report *HealthReport) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		Log("Error::health::Unable to encode the health report %s", err.Error())
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		Log("Error::health::Unable to write the health status file %s", err.Error())
+		return
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		Log("Error::health::Unable to write the health status file %s", err.Error())
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHealthMonitor(startedAt time.Time) *healthMonitor {
+	return &healthMonitor{
+		startedAt:                startedAt,
+		flushStaleness:           10 * time.Minute,
+		tokenStaleness:           time.Hour,
+		extensionConfigStaleness: 10 * time.Minute,
+		inputPluginStaleness:     10 * time.Minute,
+		checkExtensionConfig:     true,
+	}
+}
+
+func findHealthCheck(report *HealthReport, name string) *HealthCheck {
+	for i := range report.Checks {
+		if report.Checks[i].Name == name {
+			return &report.Checks[i]
+		}
+	}
+	return nil
+}
+
+func TestHealthMonitorStaleness(t *testing.T) {
+	start := time.Now()
+	monitor := newTestHealthMonitor(start)
+	health := newPipelineHealth()
+
+	health.recordFlushResult(healthContainerLog, true, start)
+	health.recordFlushResult(healthContainerLog, false, start.Add(time.Minute))
+	health.recordInputPluginRun("oms.containerinsights.KubePodInventory", start)
+	health.recordExtensionConfigUpdate(start)
+
+	report := monitor.check(health, start.Add(5*time.Minute))
+	if !report.Live || !report.Ready {
+		t.Fatalf("expected a healthy pipeline within the thresholds, got %+v", report)
+	}
+	if check := findHealthCheck(report, "flush:ContainerLog"); check == nil || check.Message == "" || check.LastSuccess == "" {
+		t.Errorf("expected the failing flushes to be reported, got %+v", check)
+	}
+
+	report = monitor.check(health, start.Add(15*time.Minute))
+	if report.Ready || report.Live {
+		t.Errorf("expected stale checks to fail both probes, got %+v", report)
+	}
+	for _, name := range []string{"flush:ContainerLog", "inputPlugin:oms.containerinsights.KubePodInventory", "extensionConfig"} {
+		if check := findHealthCheck(report, name); check == nil || check.Healthy {
+			t.Errorf("expected %s to be unhealthy, got %+v", name, check)
+		}
+	}
+	if findHealthCheck(report, "ingestionToken") != nil {
+		t.Errorf("expected no token check without the token refresh")
+	}
+
+	// flushes that failed past the threshold only fail readiness
+	health.recordInputPluginRun("oms.containerinsights.KubePodInventory", start.Add(15*time.Minute))
+	health.recordExtensionConfigUpdate(start.Add(15 * time.Minute))
+	report = monitor.check(health, start.Add(15*time.Minute))
+	if report.Ready || !report.Live {
+		t.Errorf("expected failing flushes to fail readiness only, got %+v", report)
+	}
+	health.recordFlushResult(healthContainerLog, true, start.Add(16*time.Minute))
+	if report = monitor.check(health, start.Add(16*time.Minute)); !report.Ready {
+		t.Errorf("expected a successful flush to clear the flush check, got %+v", report)
+	}
+}
+
+func TestHealthMonitorTokenAndMdsd(t *testing.T) {
+	start := time.Now()
+	monitor := newTestHealthMonitor(start)
+	monitor.checkToken = true
+	IngestionAuthTokenUpdateMutex.Lock()
+	origRefreshTime, origExpiration := IngestionAuthTokenRefreshTime, IMDSTokenExpiration
+	IngestionAuthTokenRefreshTime, IMDSTokenExpiration = start, start.Add(30*time.Minute).Unix()
+	IngestionAuthTokenUpdateMutex.Unlock()
+	cb := NewCircuitBreaker("mdsd:healthtest", 1, time.Minute, time.Minute)
+	CircuitBreakersMutex.Lock()
+	CircuitBreakers[cb.Destination] = cb
+	CircuitBreakersMutex.Unlock()
+	defer func() {
+		IngestionAuthTokenUpdateMutex.Lock()
+		IngestionAuthTokenRefreshTime, IMDSTokenExpiration = origRefreshTime, origExpiration
+		IngestionAuthTokenUpdateMutex.Unlock()
+		CircuitBreakersMutex.Lock()
+		delete(CircuitBreakers, cb.Destination)
+		CircuitBreakersMutex.Unlock()
+	}()
+
+	health := newPipelineHealth()
+	health.recordExtensionConfigUpdate(start)
+	if report := monitor.check(health, start.Add(time.Minute)); !report.Ready {
+		t.Fatalf("expected a healthy pipeline, got %+v", report)
+	}
+	if check := findHealthCheck(monitor.check(health, start.Add(45*time.Minute)), "ingestionToken"); check == nil || check.Healthy || !strings.Contains(check.Message, "expired") {
+		t.Errorf("expected an expired IMDS token to be unhealthy, got %+v", check)
+	}
+
+	cb.RecordFailure()
+	report := monitor.check(health, start.Add(time.Minute))
+	if report.Ready || !report.Live {
+		t.Errorf("expected an open circuit to fail readiness only, got %+v", report)
+	}
+	if check := findHealthCheck(report, "mdsd"); check == nil || !strings.Contains(check.Message, "mdsd:healthtest") {
+		t.Errorf("expected the open destination in the mdsd check, got %+v", check)
+	}
+}
+
+func TestHealthHandlerAndStatusFile(t *testing.T) {
+	origHealth := PipelineHealth
+	defer func() { PipelineHealth = origHealth }()
+	PipelineHealth = newPipelineHealth()
+	monitor := newTestHealthMonitor(time.Now().Add(-time.Hour))
+	monitor.checkExtensionConfig = false
+	PipelineHealth.recordFlushResult(healthInsightsMetrics, false, time.Now().Add(-time.Hour))
+
+	handler := newHealthHandler(monitor)
+	if code, body := getDiagnostics(t, handler, "/healthz"); code != http.StatusOK || !strings.Contains(body, `"live": true`) {
+		t.Errorf("GET /healthz returned %d %s", code, body)
+	}
+	if code, body := getDiagnostics(t, handler, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "flush:InsightsMetrics") {
+		t.Errorf("GET /readyz returned %d %s", code, body)
+	}
+
+	path := filepath.Join(t.TempDir(), "health.json")
+	writeHealthStatusFile(path, monitor.check(PipelineHealth, time.Now()))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected the status file, got %v", err)
+	}
+	var report HealthReport
+	if err := json.Unmarshal(data, &report); err != nil || report.Ready || !report.Live {
+		t.Errorf("unexpected status file %s %v", data, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected no temporary files left, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+// DataType for node level (non-kubernetes) host log files
+const HostLogDataType = "CONTAINERINSIGHTS_HOSTLOGS"
+
+// Eventsource name in mdsd for host logs
+const MdsdHostLogSourceName = "HostLogSource"
+
+// Tag prefix of the fluent-bit tail inputs for host log files e.g. oms.container.hostlog.syslog.var.log.syslog
+const HostLogTagPrefix = "oms.container.hostlog"
+
+// env variable to override the default source name of host logs
+const HostLogSourceNameEnv = "AZMON_HOST_LOG_SOURCE_NAME"
+
+const defaultHostLogSourceName = "HostLog"
+
+// DataItemHostLog == host log record
+// Please keep the names same as destination column names, to avoid transforming one to another in the pipeline
+type DataItemHostLog struct {
+	TimeGenerated string `json:"TimeGenerated"`
+	Computer      string `json:"Computer"`
+	FilePath      string `json:"FilePath"`
+	SourceName    string `json:"SourceName"`
+	LogMessage    string `json:"LogMessage"`
+}
+
+var (
+	// HostLogSourceName is used when neither the record nor the tag carry a source name
+	HostLogSourceName string
+)
+
+// isHostLogTag returns true if the fluent-bit tag belongs to a host log tail input
+func isHostLogTag(tag string) bool {
+	return strings.HasPrefix(tag, HostLogTagPrefix+".") || tag == HostLogTagPrefix
+}
+
+// getHostLogSourceName returns the source name of a host log record. The record's source_name key takes precedence,
+// followed by the tag segment after the host log prefix (oms.container.hostlog.<source>.*) and then the configured default
+func getHostLogSourceName(tag string, record map[interface{}]interface{}) string {
+	if sourceName := ToString(record["source_name"]); sourceName != "" {
+		return sourceName
+	}
+	suffix := strings.TrimPrefix(strings.TrimPrefix(tag, HostLogTagPrefix), ".")
+	if suffix != "" {
+		if dot := strings.Index(suffix, "."); dot != -1 {
+			suffix = suffix[:dot]
+		}
+		if suffix != "" {
+			return suffix
+		}
+	}
+	if HostLogSourceName != "" {
+		return HostLogSourceName
+	}
+	return defaultHostLogSourceName
+}
+
+// getHostLogTime returns the fluent-bit event time of a host log record, the tail input reads the lines unparsed so
+// the flush time is used for records without an event time
+func getHostLogTime(record map[interface{}]interface{}, flushTime time.Time) time.Time {
+	if recordTime, ok := record[fluentBitTimeKey].(time.Time); ok {
+		return recordTime
+	}
+	return flushTime
+}
+
+// toHostLogRecord converts a fluent-bit tail record of a host log file into the host log schema
+func toHostLogRecord(record map[interface{}]interface{}, tag string, flushTime time.Time) map[string]string {
+	timeGenerated := getHostLogTime(record, flushTime).UTC().Format(time.RFC3339Nano)
+	logMessage := ToString(record["log"])
+	if logMessage == "" {
+		logMessage = ToString(record["message"])
+	}
+	return map[string]string{
+		"TimeGenerated": timeGenerated,
+		"Computer":      Computer,
+		"FilePath":      ToString(record["filepath"]),
+		"SourceName":    getHostLogSourceName(tag, record),
+		"LogMessage":    logMessage,
+	}
+}
+
+// PostHostLogRecords sends node level host log records to their own stream in mdsd/ama
+func (instance *PluginInstance) PostHostLogRecords(records []map[interface{}]interface{}, tag string) int {
+	start := time.Now()
+	var msgPackEntries []MsgPackEntry
+	var recordTimes []time.Time
+
+	for _, record := range records {
+		stringMap := toHostLogRecord(record, tag, start)
+		if stringMap["LogMessage"] == "" {
+			recordDrop(DropReasonEmptyLogEntry, "", 1, record)
+			continue
+		}
+		msgPackEntries = append(msgPackEntries, MsgPackEntry{Record: stringMap})
+		if recordTime, ok := record[fluentBitTimeKey].(time.Time); ok {
+			recordTimes = append(recordTimes, recordTime)
+		}
+	}
+
+	if len(msgPackEntries) == 0 {
+		return output.FLB_OK
+	}
+
+	if IsWindows && !IsAADMSIAuthMode {
+		Log("Warn::PostHostLogRecords::host logs are only supported through mdsd/ama route. dropping %d records", len(msgPackEntries))
+		recordDrop(DropReasonUnsupportedRoute, "", len(msgPackEntries), tag)
+		return output.FLB_OK
+	}
+
+	if instance.MdsdHostLogTagName == "" {
+		instance.MdsdHostLogTagName = MdsdHostLogSourceName
+	}
+	if IsAADMSIAuthMode {
+		instance.MdsdHostLogTagName = getOutputStreamIdTag(HostLogDataType, instance.MdsdHostLogTagName, &instance.MdsdHostLogTagRefreshTracker)
+		if instance.MdsdHostLogTagName == "" {
+			Log("Warn::mdsd::skipping host logs stream since its opted out")
+			recordDrop(DropReasonStreamOptedOut, "", len(msgPackEntries), HostLogDataType)
+			return output.FLB_OK
+		}
+	}
+
+	RecordTee.Write(HostLogs.String(), instance.MdsdHostLogTagName, msgPackEntries)
+	msgpBytes := convertMsgPackEntriesToMsgpBytes(instance.MdsdHostLogTagName, msgPackEntries)
+	var bts int
+	var er error
+	sink := DeliverySinkMdsd
+	deadline := 10 * time.Second
+	if !IsWindows {
+		if instance.MdsdHostLogsMsgpUnixSocketClient == nil {
+			logConnectionError(getMdsdCircuitBreaker(HostLogs), "Error::mdsd::mdsd connection for host logs does not exist. re-connecting ...")
+			CreateMDSDClient(&instance.MdsdHostLogsMsgpUnixSocketClient, HostLogs, ContainerType)
+			if instance.MdsdHostLogsMsgpUnixSocketClient == nil {
+				logConnectionError(getMdsdCircuitBreaker(HostLogs), "Error::mdsd::Unable to create mdsd client for host logs. Please check error log.")
+				ContainerLogTelemetryMutex.Lock()
+				defer ContainerLogTelemetryMutex.Unlock()
+				HostLogsClientCreateErrors += 1
+				return output.FLB_RETRY
+			}
+		}
+		instance.MdsdHostLogsMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+		bts, er = instance.MdsdHostLogsMsgpUnixSocketClient.Write(msgpBytes)
+		recordConnectionResult(getMdsdCircuitBreaker(HostLogs), er)
+	} else {
+		sink = DeliverySinkAMA
+		if !EnsureGenevaOr3PNamedPipeExists(&instance.HostLogsNamedPipe, HostLogDataType, &HostLogsClientCreateErrors, false, &instance.MdsdHostLogTagRefreshTracker) {
+			return output.FLB_RETRY
+		}
+		instance.HostLogsNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+		bts, er = instance.HostLogsNamedPipe.Write(msgpBytes)
+		recordConnectionResult(getAMACircuitBreaker(HostLogDataType), er)
+	}
+
+	elapsed := time.Since(start)
+	if er != nil {
+		LogRateLimited("hostlogs", "Error::mdsd/ama::Failed to write %d host log records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
+		if instance.MdsdHostLogsMsgpUnixSocketClient != nil {
+			instance.MdsdHostLogsMsgpUnixSocketClient.Close()
+			instance.MdsdHostLogsMsgpUnixSocketClient = nil
+		}
+		if instance.HostLogsNamedPipe != nil {
+			instance.HostLogsNamedPipe.Close()
+			instance.HostLogsNamedPipe = nil
+		}
+		ContainerLogTelemetryMutex.Lock()
+		defer ContainerLogTelemetryMutex.Unlock()
+		HostLogsSendErrors += 1
+		return output.FLB_RETRY
+	}
+
+	observeDeliveryLatency(HostLogs.String(), sink, recordTimes, time.Now())
+	Log("Debug::mdsd/ama::Successfully flushed %d host log records that was %d bytes in %s", len(msgPackEntries), bts, elapsed)
+	ContainerLogTelemetryMutex.Lock()
+	HostLogsFlushedCount += float64(len(msgPackEntries))
+	ContainerLogTelemetryMutex.Unlock()
+	return output.FLB_OK
+}
+
+func populateHostLogSettings(config *PluginConfig) {
+	HostLogSourceName = config.HostLogSourceName
+	if HostLogSourceName != "" {
+		Log("Host log source name: %s", HostLogSourceName)
+	}
+}
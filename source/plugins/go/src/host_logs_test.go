@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsHostLogTag(t *testing.T) {
+	tests := []struct {
+		tag      string
+		expected bool
+	}{
+		{"oms.container.hostlog.syslog.var.log.syslog", true},
+		{"oms.container.hostlog", true},
+		{"oms.container.hostlogs.syslog", false},
+		{"oms.container.log.la.var.log.containers.pod_ns_container-123.log", false},
+	}
+
+	for _, tt := range tests {
+		if got := isHostLogTag(tt.tag); got != tt.expected {
+			t.Errorf("isHostLogTag(%s) = %t, want %t", tt.tag, got, tt.expected)
+		}
+	}
+}
+
+func TestGetHostLogSourceName(t *testing.T) {
+	HostLogSourceName = "custom"
+	defer func() { HostLogSourceName = "" }()
+
+	tests := []struct {
+		name     string
+		tag      string
+		record   map[interface{}]interface{}
+		expected string
+	}{
+		{"from record", "oms.container.hostlog.syslog.var.log.syslog", map[interface{}]interface{}{"source_name": []byte("myapp")}, "myapp"},
+		{"from tag", "oms.container.hostlog.azure.var.log.azure.agent.log", map[interface{}]interface{}{}, "azure"},
+		{"configured default", "oms.container.hostlog", map[interface{}]interface{}{}, "custom"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getHostLogSourceName(tt.tag, tt.record); got != tt.expected {
+				t.Errorf("getHostLogSourceName(%s) = %s, want %s", tt.tag, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestToHostLogRecord(t *testing.T) {
+	Computer = "aks-nodepool1-000000"
+	flushTime := time.Date(2024, 1, 2, 3, 5, 0, 0, time.UTC)
+	record := map[interface{}]interface{}{
+		"filepath":       []byte("/var/log/syslog"),
+		"log":            []byte("Jan  2 03:04:05 node systemd[1]: Started Session 1 of user root."),
+		"time":           []byte("not the event time"),
+		fluentBitTimeKey: time.Date(2024, 1, 2, 4, 4, 5, 123000000, time.FixedZone("CET", 3600)),
+	}
+
+	result := toHostLogRecord(record, "oms.container.hostlog.syslog.var.log.syslog", flushTime)
+
+	expected := map[string]string{
+		"TimeGenerated": "2024-01-02T03:04:05.123Z",
+		"Computer":      "aks-nodepool1-000000",
+		"FilePath":      "/var/log/syslog",
+		"SourceName":    "syslog",
+		"LogMessage":    "Jan  2 03:04:05 node systemd[1]: Started Session 1 of user root.",
+	}
+	for key, value := range expected {
+		if result[key] != value {
+			t.Errorf("toHostLogRecord()[%s] = %s, want %s", key, result[key], value)
+		}
+	}
+	if _, ok := result["PodNamespace"]; ok {
+		t.Errorf("host log record should not have pod attribution")
+	}
+
+	delete(record, fluentBitTimeKey)
+	if result := toHostLogRecord(record, "oms.container.hostlog.syslog.var.log.syslog", flushTime); result["TimeGenerated"] != "2024-01-02T03:05:00Z" {
+		t.Errorf("expected the flush time without the fluent-bit event time, got %s", result["TimeGenerated"])
+	}
+}
@@ -16,6 +16,8 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"Docker-Provider/source/plugins/go/src/paths"
 )
 
 const IMDSTokenPathForWindows = "c:/etc/imds-access-token/token" // only used in windows
@@ -31,6 +33,9 @@ var ChannelId string
 
 var IngestionAuthToken string
 var IngestionAuthTokenExpiration int64
+
+// IngestionAuthTokenRefreshTime last time ODSIngestionAuthToken was refreshed, guarded by IngestionAuthTokenUpdateMutex
+var IngestionAuthTokenRefreshTime time.Time
 var AMCSRedirectedEndpoint string = ""
 
 // Arc k8s MSI related
@@ -226,14 +231,15 @@ func getAccessTokenFromIMDS() (string, int64, error) {
 	} else {
 		resourceId := os.Getenv("AKS_RESOURCE_ID")
 		if resourceId != "" && strings.Contains(strings.ToLower(resourceId), strings.ToLower("Microsoft.ContainerService/managedClusters")) {
-			Log("Info Reading IMDS Access Token from file : %s", IMDSTokenPathForWindows)
-			if _, err = os.Stat(IMDSTokenPathForWindows); os.IsNotExist(err) {
+			imdsTokenPath := paths.Resolve(IMDSTokenPathForWindows)
+			Log("Info Reading IMDS Access Token from file : %s", imdsTokenPath)
+			if _, err = os.Stat(imdsTokenPath); os.IsNotExist(err) {
 				Log("getAccessTokenFromIMDS: IMDS token file doesnt exist: %s", err.Error())
 				return imdsAccessToken, expiration, err
 			}
 			//adding retries incase if we ended up reading the token file while the token file being written
 			for retryCount := 0; retryCount < MaxRetries; retryCount++ {
-				responseBytes, err = ioutil.ReadFile(IMDSTokenPathForWindows)
+				responseBytes, err = ioutil.ReadFile(imdsTokenPath)
 				if err != nil {
 					Log("getAccessTokenFromIMDS: Could not read IMDS token from file: %s, retryCount: %d", err.Error(), retryCount)
 					time.Sleep(time.Duration((retryCount+1)*100) * time.Millisecond)
@@ -617,8 +623,23 @@ func getTokenRefreshIntervalFromAmcsResponse(header http.Header) (refreshInterva
 	return 0, errors.New("getTokenRefreshIntervalFromAmcsResponse: didn't find max-age in response header")
 }
 
+// fetchIngestionAuthToken gets a new ingestion auth token without updating the tokens cached by the plugin, e.g. for
+// the dead-letter re-drive
+func fetchIngestionAuthToken() (string, error) {
+	imdsToken, _, err := getAccessTokenFromIMDS()
+	if err != nil {
+		return "", err
+	}
+	configurationId, channelId, err := getAgentConfiguration(imdsToken)
+	if err != nil {
+		return "", err
+	}
+	ingestionAuthToken, _, err := getIngestionAuthToken(imdsToken, configurationId, channelId)
+	return ingestionAuthToken, err
+}
+
 func refreshIngestionAuthToken() {
-	for ; true; <-IngestionAuthTokenRefreshTicker.C {
+	for running := true; running; running = waitForTick(IngestionAuthTokenRefreshTicker) {
 		if IMDSToken == "" || IMDSTokenExpiration <= (time.Now().Unix()+60*60) { // token valid 24 hrs and refresh token 1 hr before expiry
 			imdsToken, imdsTokenExpiry, err := getAccessTokenFromIMDS()
 			if err != nil {
@@ -627,7 +648,9 @@ func refreshIngestionAuthToken() {
 				SendException(message)
 			} else {
 				IMDSToken = imdsToken
+				IngestionAuthTokenUpdateMutex.Lock()
 				IMDSTokenExpiration = imdsTokenExpiry
+				IngestionAuthTokenUpdateMutex.Unlock()
 			}
 		}
 		if IMDSToken == "" {
@@ -662,6 +685,7 @@ func refreshIngestionAuthToken() {
 		}
 		IngestionAuthTokenUpdateMutex.Lock()
 		ODSIngestionAuthToken = ingestionAuthToken
+		IngestionAuthTokenRefreshTime = time.Now()
 		IngestionAuthTokenUpdateMutex.Unlock()
 		if refreshIntervalInSeconds > 0 && refreshIntervalInSeconds != defaultIngestionAuthTokenRefreshIntervalSeconds {
 			//TODO - use Reset which is better when go version upgraded to 1.15 or up rather Stop() and NewTicker
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// env variables for the label/annotation key allowlists and node label selection of the KubernetesMetadata column
+const KubernetesMetadataLabelKeysEnv = "AZMON_KUBERNETES_METADATA_LABEL_KEYS"
+const KubernetesMetadataAnnotationKeysEnv = "AZMON_KUBERNETES_METADATA_ANNOTATION_KEYS"
+const KubernetesMetadataNodeLabelKeysEnv = "AZMON_KUBERNETES_METADATA_NODE_LABEL_KEYS"
+
+// zone and instance type are collected by default when nodelabels is included
+const defaultKubernetesMetadataNodeLabelKeys = "topology.kubernetes.io/zone,node.kubernetes.io/instance-type"
+
+// the namespace, node and pod owner caches are refreshed in the background, an entry that isn't refreshed (the object
+// is gone or the refreshes fail) expires after kubernetesMetadataCacheTTL
+const kubernetesMetadataRefreshIntervalSeconds = 60
+const kubernetesMetadataCacheTTL = 5 * time.Minute
+
+// KubernetesMetadataCacheSize bounds each of the namespace, node and pod owner caches, the least recently used entry
+// is evicted when a cache is full
+const KubernetesMetadataCacheSize = 500
+
+// timeout of the API server requests of a refresh
+const kubernetesMetadataRequestTimeout = 5 * time.Second
+
+type kubernetesObjectMetadata struct {
+	Labels          map[string]string
+	Annotations     map[string]string
+	OwnerReferences []map[string]string
+	ExpiresAt       time.Time
+}
+
+// kubernetesMetadataCache is an LRU cache of the metadata of kubernetes objects, expired entries are dropped on lookup
+type kubernetesMetadataCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// order has the most recently used entry at the front
+	order *list.List
+}
+
+type kubernetesMetadataCacheEntry struct {
+	key      string
+	metadata kubernetesObjectMetadata
+}
+
+func newKubernetesMetadataCache(size int) *kubernetesMetadataCache {
+	return &kubernetesMetadataCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the unexpired metadata of the key
+func (c *kubernetesMetadataCache) get(key string, now time.Time) (kubernetesObjectMetadata, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return kubernetesObjectMetadata{}, false
+	}
+	entry := element.Value.(*kubernetesMetadataCacheEntry)
+	if !now.Before(entry.metadata.ExpiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return kubernetesObjectMetadata{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.metadata, true
+}
+
+// set adds or replaces the metadata of the key, evicting the least recently used entry when the cache is full
+func (c *kubernetesMetadataCache) set(key string, metadata kubernetesObjectMetadata) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*kubernetesMetadataCacheEntry).metadata = metadata
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*kubernetesMetadataCacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&kubernetesMetadataCacheEntry{key: key, metadata: metadata})
+}
+
+// len returns the number of cached entries
+func (c *kubernetesMetadataCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// kubernetesMetadataIncludes are the include fields and key allowlists a flush applies to all its records
+type kubernetesMetadataIncludes struct {
+	Fields         []string
+	LabelKeys      []string
+	AnnotationKeys []string
+	NodeLabelKeys  []string
+}
+
+var (
+	// KubernetesMetadataIncludesMutex read and write mutex access to KubernetesMetadataIncludeList and the key
+	// allowlists, the config reload swaps them while the flushes read them
+	KubernetesMetadataIncludesMutex = &sync.RWMutex{}
+	// KubernetesMetadataLabelKeyFilter allowlist of label keys (entries ending with * or / are prefixes). empty means all keys
+	KubernetesMetadataLabelKeyFilter []string
+	// KubernetesMetadataAnnotationKeyFilter allowlist of annotation keys (entries ending with * or / are prefixes). empty means all keys
+	KubernetesMetadataAnnotationKeyFilter []string
+	// KubernetesMetadataNodeLabelKeys node label keys copied when nodelabels is included
+	KubernetesMetadataNodeLabelKeys []string
+	// NamespaceMetadataCache caches the namespace name to namespace labels and annotations
+	NamespaceMetadataCache = newKubernetesMetadataCache(KubernetesMetadataCacheSize)
+	// NodeMetadataCache caches the node name to node labels
+	NodeMetadataCache = newKubernetesMetadataCache(KubernetesMetadataCacheSize)
+	// PodOwnerCache caches the namespace/podname to pod ownerReferences
+	PodOwnerCache = newKubernetesMetadataCache(KubernetesMetadataCacheSize)
+	// KubernetesMetadataRefreshTicker refreshes the namespace, node and pod owner caches
+	KubernetesMetadataRefreshTicker *time.Ticker
+)
+
+// setKubernetesMetadataIncludes sets the include list and the key allowlists of the configuration
+func setKubernetesMetadataIncludes(config *PluginConfig) {
+	KubernetesMetadataIncludesMutex.Lock()
+	defer KubernetesMetadataIncludesMutex.Unlock()
+	KubernetesMetadataIncludeList = []string{}
+	if config.KubernetesMetadataEnabled && len(config.KubernetesMetadataIncludeFields) > 0 {
+		KubernetesMetadataIncludeList = config.KubernetesMetadataIncludeFields
+	}
+	KubernetesMetadataLabelKeyFilter = config.KubernetesMetadataLabelKeys
+	KubernetesMetadataAnnotationKeyFilter = config.KubernetesMetadataAnnotationKeys
+	KubernetesMetadataNodeLabelKeys = config.KubernetesMetadataNodeLabelKeys
+	Log("KubernetesMetadataIncludeList: %v, KubernetesMetadataLabelKeyFilter: %v, KubernetesMetadataAnnotationKeyFilter: %v, KubernetesMetadataNodeLabelKeys: %v", KubernetesMetadataIncludeList, KubernetesMetadataLabelKeyFilter, KubernetesMetadataAnnotationKeyFilter, KubernetesMetadataNodeLabelKeys)
+}
+
+// getKubernetesMetadataIncludes returns the current include list and key allowlists
+func getKubernetesMetadataIncludes() *kubernetesMetadataIncludes {
+	KubernetesMetadataIncludesMutex.RLock()
+	defer KubernetesMetadataIncludesMutex.RUnlock()
+	return &kubernetesMetadataIncludes{
+		Fields:         KubernetesMetadataIncludeList,
+		LabelKeys:      KubernetesMetadataLabelKeyFilter,
+		AnnotationKeys: KubernetesMetadataAnnotationKeyFilter,
+		NodeLabelKeys:  KubernetesMetadataNodeLabelKeys,
+	}
+}
+
+// matchesKeyFilter returns true if the key is allowed by the filter. Entries ending with * or / match as prefix
+func matchesKeyFilter(key string, filter []string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, allowed := range filter {
+		if strings.HasSuffix(allowed, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(allowed, "*")) {
+				return true
+			}
+		} else if strings.HasSuffix(allowed, "/") {
+			if strings.HasPrefix(key, allowed) {
+				return true
+			}
+		} else if key == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMetadataKeys returns the entries of a label or annotation map allowed by the filter
+func filterMetadataKeys(metadata interface{}, filter []string, skip func(string) bool) (map[string]interface{}, bool) {
+	filtered := make(map[string]interface{})
+	switch m := metadata.(type) {
+	case map[string]interface{}:
+		for key, value := range m {
+			if (skip == nil || !skip(key)) && matchesKeyFilter(key, filter) {
+				filtered[key] = value
+			}
+		}
+	case map[string]string:
+		for key, value := range m {
+			if (skip == nil || !skip(key)) && matchesKeyFilter(key, filter) {
+				filtered[key] = value
+			}
+		}
+	default:
+		return nil, false
+	}
+	return filtered, true
+}
+
+func isKubeletConfigAnnotation(key string) bool {
+	return strings.Contains(key, "kubernetes.io/config")
+}
+
+func selectNodeLabels(labels map[string]string, nodeLabelKeys []string) map[string]interface{} {
+	selected := make(map[string]interface{})
+	for _, key := range nodeLabelKeys {
+		if strings.HasSuffix(key, "*") || strings.HasSuffix(key, "/") {
+			for label, value := range labels {
+				if matchesKeyFilter(label, []string{key}) {
+					selected[label] = value
+				}
+			}
+		} else if value, ok := labels[key]; ok {
+			selected[key] = value
+		}
+	}
+	return selected
+}
+
+// getOwnerReferences returns the kind/name pairs from the fluent-bit kubernetes record if present, otherwise from the pod
+func getOwnerReferences(kubernetesMetadataMap map[string]interface{}) []map[string]string {
+	if refs, ok := kubernetesMetadataMap["ownerReferences"].([]interface{}); ok {
+		var owners []map[string]string
+		for _, ref := range refs {
+			if refMap, ok := ref.(map[string]interface{}); ok {
+				owners = append(owners, map[string]string{
+					"kind": fmt.Sprintf("%v", refMap["kind"]),
+					"name": fmt.Sprintf("%v", refMap["name"]),
+				})
+			}
+		}
+		return owners
+	}
+	namespace, _ := kubernetesMetadataMap["namespace_name"].(string)
+	podName, _ := kubernetesMetadataMap["pod_name"].(string)
+	if namespace == "" || podName == "" {
+		return nil
+	}
+	return getPodOwnerMetadata(namespace, podName).OwnerReferences
+}
+
+// getNamespaceMetadata returns the cached labels and annotations of the namespace
+func getNamespaceMetadata(namespace string) kubernetesObjectMetadata {
+	metadata, _ := NamespaceMetadataCache.get(namespace, time.Now())
+	return metadata
+}
+
+// getNodeMetadata returns the cached labels of the node
+func getNodeMetadata(nodeName string) kubernetesObjectMetadata {
+	metadata, _ := NodeMetadataCache.get(nodeName, time.Now())
+	return metadata
+}
+
+// getPodOwnerMetadata returns the cached ownerReferences kind/name of the pod
+func getPodOwnerMetadata(namespace string, podName string) kubernetesObjectMetadata {
+	metadata, _ := PodOwnerCache.get(namespace+"/"+podName, time.Now())
+	return metadata
+}
+
+// kubernetesMetadataLookups returns which of the namespace, node and pod owner caches the include list reads
+func kubernetesMetadataLookups(includes []string) (namespaces bool, node bool, podOwners bool) {
+	for _, include := range includes {
+		switch include {
+		case "namespacelabels", "namespaceannotations":
+			namespaces = true
+		case "nodelabels":
+			node = true
+		case "ownerreferences":
+			podOwners = true
+		}
+	}
+	return namespaces, node, podOwners
+}
+
+// updateKubernetesMetadataCaches refreshes the caches the include list reads, the flushes only read the caches so that
+// they never wait on the API server
+func updateKubernetesMetadataCaches() {
+	for running := true; running; running = waitForTick(KubernetesMetadataRefreshTicker) {
+		refreshKubernetesMetadataCaches(getKubernetesMetadataIncludes().Fields)
+	}
+}
+
+func refreshKubernetesMetadataCaches(includes []string) {
+	namespaces, node, podOwners := kubernetesMetadataLookups(includes)
+	if !namespaces && !node && !podOwners {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesMetadataRequestTimeout)
+	defer cancel()
+	if namespaces || podOwners {
+		listOptions := metav1.ListOptions{}
+		listOptions.FieldSelector = fmt.Sprintf("spec.nodeName=%s", Computer)
+		pods, err := ClientSet.CoreV1().Pods("").List(ctx, listOptions)
+		if err != nil {
+			Log("Error::kubernetesMetadata::Error getting pods %s. Keeping the cached metadata", err.Error())
+		} else {
+			if podOwners {
+				setPodOwnerMetadata(pods.Items, time.Now())
+			}
+			if namespaces {
+				if namespaceList, err := ClientSet.CoreV1().Namespaces().List(ctx, metav1.ListOptions{}); err != nil {
+					Log("Error::kubernetesMetadata::Error getting namespaces %s. Keeping the cached metadata", err.Error())
+				} else {
+					setNamespaceMetadata(namespaceList.Items, pods.Items, time.Now())
+				}
+			}
+		}
+	}
+	if node {
+		if nodeObject, err := ClientSet.CoreV1().Nodes().Get(ctx, Computer, metav1.GetOptions{}); err != nil {
+			Log("Error::kubernetesMetadata::Error getting node %s %s. Keeping the cached metadata", Computer, err.Error())
+		} else {
+			NodeMetadataCache.set(nodeObject.Name, kubernetesObjectMetadata{Labels: nodeObject.Labels, ExpiresAt: time.Now().Add(kubernetesMetadataCacheTTL)})
+		}
+	}
+}
+
+// setPodOwnerMetadata caches the ownerReferences kind/name of the pods
+func setPodOwnerMetadata(pods []corev1.Pod, now time.Time) {
+	for _, pod := range pods {
+		var owners []map[string]string
+		for _, owner := range pod.OwnerReferences {
+			owners = append(owners, map[string]string{"kind": owner.Kind, "name": owner.Name})
+		}
+		PodOwnerCache.set(pod.Namespace+"/"+pod.Name, kubernetesObjectMetadata{OwnerReferences: owners, ExpiresAt: now.Add(kubernetesMetadataCacheTTL)})
+	}
+}
+
+// setNamespaceMetadata caches the labels and annotations of the namespaces with pods on this node, the others are
+// never looked up
+func setNamespaceMetadata(namespaces []corev1.Namespace, pods []corev1.Pod, now time.Time) {
+	podNamespaces := make(map[string]bool)
+	for _, pod := range pods {
+		podNamespaces[pod.Namespace] = true
+	}
+	for _, namespace := range namespaces {
+		if podNamespaces[namespace.Name] {
+			NamespaceMetadataCache.set(namespace.Name, kubernetesObjectMetadata{Labels: namespace.Labels, Annotations: namespace.Annotations, ExpiresAt: now.Add(kubernetesMetadataCacheTTL)})
+		}
+	}
+}
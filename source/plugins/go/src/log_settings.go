@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/logging"
+)
+
+// LogRateLimitSecondsEnv is the interval of the rate limited messages of the hot error paths, 0 logs every message
+const LogRateLimitSecondsEnv = "AZMON_LOG_RATE_LIMIT_SECONDS"
+
+const defaultLogRateLimitSeconds = 60
+
+var (
+	// LogRateLimiter limits the socket and named pipe write failures to a message per interval and destination
+	LogRateLimiter = logging.NewRateLimiter(defaultLogRateLimitSeconds * time.Second)
+)
+
+// LogRateLimited logs the message unless a message of the key was logged within the rate limit interval. The next
+// logged message of the key has the number of suppressed ones
+func LogRateLimited(key string, format string, v ...interface{}) {
+	allowed, suppressed := LogRateLimiter.Allow(key, time.Now())
+	if !allowed {
+		return
+	}
+	message := fmt.Sprintf(format, v...)
+	if suppressed > 0 {
+		message = fmt.Sprintf("%s (%d similar messages suppressed)", message, suppressed)
+	}
+	FLBLogger.Output(2, message)
+}
+
+// applyLogSettings applies the validated log settings, they replace the ones read from the env at startup
+func applyLogSettings(config *PluginConfig) {
+	level, _ := logging.ParseLevel(config.LogLevel)
+	componentLevels, _ := logging.ParseComponentLevels(config.LogComponentLevels)
+	PluginLogger.Configure(logging.Config{Format: config.LogFormat, Level: level, ComponentLevels: componentLevels})
+	LogRateLimiter.SetInterval(time.Duration(config.LogRateLimitSeconds) * time.Second)
+	Log("Log level: %s, component levels: %s, format: %s, rate limit: %ds", config.LogLevel, config.LogComponentLevels, config.LogFormat, config.LogRateLimitSeconds)
+}
+
+// logLevelHandler returns the log levels on GET. PUT or POST with ?level=<level> sets the default level, with
+// &component=<component> the level of a component, level=reset removes the level of the component
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		component, value := r.URL.Query().Get("component"), r.URL.Query().Get("level")
+		if component != "" && value == "reset" {
+			PluginLogger.ResetLevel(component)
+			Log("Info::diagnostics::Log level of %s reset", component)
+			break
+		}
+		level, err := logging.ParseLevel(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		PluginLogger.SetLevel(component, level)
+		Log("Info::diagnostics::Log level of %q set to %s", component, logging.FormatLevel(level))
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	level, components := PluginLogger.Levels()
+	writeDiagnosticsJSON(w, map[string]interface{}{
+		"Level":           level,
+		"ComponentLevels": components,
+	})
+}
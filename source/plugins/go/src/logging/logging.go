@@ -0,0 +1,423 @@
+// Package logging is the leveled logger of the out_oms output plugin and the input plugins. Messages keep the
+// "Level::component::message" convention of the plugins, the level and component of a message come from its prefix.
+// Messages below the level of their component are dropped. The text format is the classic log line, the json format
+// is one slog JSON record per line
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// env variables of the log settings
+const (
+	// LevelEnv is the level of the components without their own level
+	LevelEnv = "AZMON_LOG_LEVEL"
+	// ComponentLevelsEnv overrides the level of components, e.g. mdsd=debug,configReload=warn
+	ComponentLevelsEnv = "AZMON_LOG_COMPONENT_LEVELS"
+	// FormatEnv is text or json
+	FormatEnv = "AZMON_LOG_FORMAT"
+)
+
+// Formats of the log records
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Levels of the log records
+const (
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
+)
+
+// source file prefix of the lines written by a log.Logger with the Lshortfile flag
+var sourcePrefix = regexp.MustCompile(`^([^\s:]+\.go:\d+): `)
+
+// Config of a Logger
+type Config struct {
+	Format          string
+	Level           slog.Level
+	ComponentLevels map[string]slog.Level
+}
+
+// ConfigFromEnv reads the config from the env, invalid values are ignored
+func ConfigFromEnv(getenv func(string) string) Config {
+	config := Config{Format: FormatText, Level: LevelInfo}
+	if level, err := ParseLevel(getenv(LevelEnv)); err == nil {
+		config.Level = level
+	}
+	if levels, err := ParseComponentLevels(getenv(ComponentLevelsEnv)); err == nil {
+		config.ComponentLevels = levels
+	}
+	if strings.EqualFold(strings.TrimSpace(getenv(FormatEnv)), FormatJSON) {
+		config.Format = FormatJSON
+	}
+	return config
+}
+
+// Logger writes the records of the enabled levels. It's safe for concurrent use
+type Logger struct {
+	mutex           sync.RWMutex
+	out             io.Writer
+	format          string
+	level           slog.Level
+	componentLevels map[string]slog.Level
+	json            *slog.Logger
+	// component of the messages without a component prefix
+	component string
+	// root holds the settings shared by the loggers of WithComponent
+	root *Logger
+	now  func() time.Time
+}
+
+// New creates a logger writing to out
+func New(out io.Writer, config Config) *Logger {
+	l := &Logger{out: out, now: time.Now}
+	l.root = l
+	l.Configure(config)
+	return l
+}
+
+// NewFile creates a logger writing to a file rotated at 10MB
+func NewFile(path string, config Config) *Logger {
+	return New(&lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    10, //megabytes
+		MaxBackups: 1,
+		MaxAge:     28,   //days
+		Compress:   true, // false by default
+	}, config)
+}
+
+// WithComponent returns a logger sharing the output and levels of l, for the messages without a component prefix
+func (l *Logger) WithComponent(component string) *Logger {
+	return &Logger{root: l.root, component: component}
+}
+
+// Configure replaces the format and the levels
+func (l *Logger) Configure(config Config) {
+	root := l.root
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	root.format = config.Format
+	root.level = config.Level
+	root.componentLevels = make(map[string]slog.Level)
+	for component, level := range config.ComponentLevels {
+		root.componentLevels[strings.ToLower(component)] = level
+	}
+	if root.format == FormatJSON {
+		root.json = slog.New(slog.NewJSONHandler(root.out, &slog.HandlerOptions{Level: LevelDebug}))
+	} else {
+		root.json = nil
+	}
+}
+
+// SetLevel sets the level of a component, or the default level when component is empty
+func (l *Logger) SetLevel(component string, level slog.Level) {
+	root := l.root
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	if component == "" {
+		root.level = level
+	} else {
+		root.componentLevels[strings.ToLower(component)] = level
+	}
+}
+
+// ResetLevel removes the level of a component, it uses the default level again
+func (l *Logger) ResetLevel(component string) {
+	root := l.root
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	delete(root.componentLevels, strings.ToLower(component))
+}
+
+// Levels returns the default level and the levels of the components
+func (l *Logger) Levels() (string, map[string]string) {
+	root := l.root
+	root.mutex.RLock()
+	defer root.mutex.RUnlock()
+	components := make(map[string]string, len(root.componentLevels))
+	for component, level := range root.componentLevels {
+		components[component] = FormatLevel(level)
+	}
+	return FormatLevel(root.level), components
+}
+
+// Enabled returns whether the messages of the component at level are written
+func (l *Logger) Enabled(component string, level slog.Level) bool {
+	root := l.root
+	root.mutex.RLock()
+	defer root.mutex.RUnlock()
+	return root.enabled(component, level)
+}
+
+func (l *Logger) enabled(component string, level slog.Level) bool {
+	if componentLevel, ok := l.componentLevels[strings.ToLower(component)]; ok {
+		return level >= componentLevel
+	}
+	return level >= l.level
+}
+
+// Write logs each line of p, it lets a log.Logger write through the logger
+func (l *Logger) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		source := ""
+		if match := sourcePrefix.FindStringSubmatch(line); match != nil {
+			source = match[1]
+			line = line[len(match[0]):]
+		}
+		l.log(source, line)
+	}
+	return len(p), nil
+}
+
+// StdLogger returns a log.Logger writing through the logger, for the code and packages taking a *log.Logger
+func (l *Logger) StdLogger() *log.Logger {
+	return log.New(l, "", log.Lshortfile)
+}
+
+// Close closes the output if it's a file, the next record reopens it
+func (l *Logger) Close() error {
+	if closer, ok := l.root.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Printf logs a "Level::component::message" message
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.log("", fmt.Sprintf(format, v...))
+}
+
+// Println logs a "Level::component::message" message
+func (l *Logger) Println(v ...interface{}) {
+	l.log("", strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Debugf logs a debug message
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.logLevel(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+// Infof logs an info message
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.logLevel(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Warnf logs a warning
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.logLevel(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs an error
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.logLevel(LevelError, fmt.Sprintf(format, v...))
+}
+
+// Fatalf logs an error and exits
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.logLevel(LevelError, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func (l *Logger) logLevel(level slog.Level, message string) {
+	component, text := l.component, message
+	if _, c, rest, ok := parsePrefix(message); ok && c != "" {
+		component, text = c, rest
+	}
+	prefix := strings.ToUpper(FormatLevel(level)[:1]) + FormatLevel(level)[1:] + "::"
+	if component != "" {
+		prefix += component + "::"
+	}
+	l.emit(level, component, "", prefix+text, text)
+}
+
+func (l *Logger) log(source string, message string) {
+	level, component, text, ok := parsePrefix(message)
+	if !ok || component == "" {
+		component = l.component
+	}
+	l.emit(level, component, source, message, text)
+}
+
+// emit writes the record, message is the full message of the text format and text the message without its prefix
+func (l *Logger) emit(level slog.Level, component string, source string, message string, text string) {
+	root := l.root
+	root.mutex.RLock()
+	defer root.mutex.RUnlock()
+	if !root.enabled(component, level) {
+		return
+	}
+	if root.json != nil {
+		attrs := make([]slog.Attr, 0, 2)
+		if component != "" {
+			attrs = append(attrs, slog.String("component", component))
+		}
+		if source != "" {
+			attrs = append(attrs, slog.String("source", source))
+		}
+		root.json.LogAttrs(context.Background(), level, text, attrs...)
+		return
+	}
+	line := root.now().Format("2006/01/02 15:04:05") + " "
+	if source != "" {
+		line += source + ": "
+	}
+	io.WriteString(root.out, line+message+"\n")
+}
+
+// parsePrefix splits "Level::component::message" and the older "component::Level::message". Without a level the
+// level is info and a leading "component::" is the component
+func parsePrefix(message string) (level slog.Level, component string, text string, ok bool) {
+	level, text = LevelInfo, message
+	first, rest, found := strings.Cut(message, "::")
+	if !found {
+		return level, "", text, false
+	}
+	if parsed, err := parsePrefixLevel(first); err == nil {
+		level, text = parsed, rest
+		if c, r, found := strings.Cut(rest, "::"); found && isComponent(c) {
+			component, text = c, r
+		}
+		return level, component, text, true
+	}
+	if !isComponent(first) {
+		return level, "", message, false
+	}
+	if second, r, found := strings.Cut(rest, "::"); found {
+		if parsed, err := parsePrefixLevel(second); err == nil {
+			return parsed, first, r, true
+		}
+	}
+	return level, first, rest, true
+}
+
+// parsePrefixLevel parses the level of a message prefix, Success is an info message
+func parsePrefixLevel(s string) (slog.Level, error) {
+	if strings.EqualFold(s, "success") {
+		return LevelInfo, nil
+	}
+	return ParseLevel(s)
+}
+
+func isComponent(s string) bool {
+	if s == "" || len(s) > 64 {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || r == '-' || r == '.' || r == '/' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLevel parses debug, info, warn or error in any case
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", s)
+}
+
+// FormatLevel returns the lower case name of the level
+func FormatLevel(level slog.Level) string {
+	switch {
+	case level <= LevelDebug:
+		return "debug"
+	case level <= LevelInfo:
+		return "info"
+	case level <= LevelWarn:
+		return "warn"
+	}
+	return "error"
+}
+
+// ParseComponentLevels parses comma separated component=level pairs
+func ParseComponentLevels(s string) (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level)
+	var invalid []string
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		component, value, found := strings.Cut(pair, "=")
+		component = strings.TrimSpace(component)
+		level, err := ParseLevel(value)
+		if !found || !isComponent(component) || err != nil {
+			invalid = append(invalid, strings.TrimSpace(pair))
+			continue
+		}
+		levels[strings.ToLower(component)] = level
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return levels, fmt.Errorf("invalid component levels %s, expected component=level", strings.Join(invalid, ", "))
+	}
+	return levels, nil
+}
+
+// RateLimiter limits the messages of hot error paths to one per interval and key
+type RateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	entries  map[string]*rateLimitEntry
+}
+
+type rateLimitEntry struct {
+	last       time.Time
+	suppressed int
+}
+
+// NewRateLimiter returns a limiter allowing a message per interval and key, a zero interval allows every message
+func NewRateLimiter(interval time.Duration) *RateLimiter {
+	return &RateLimiter{interval: interval, entries: make(map[string]*rateLimitEntry)}
+}
+
+// SetInterval replaces the interval
+func (r *RateLimiter) SetInterval(interval time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.interval = interval
+}
+
+// Allow returns whether the message of key is logged and how many of its messages were suppressed since the last
+// logged one
+func (r *RateLimiter) Allow(key string, now time.Time) (bool, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.entries[key]
+	if !ok {
+		r.entries[key] = &rateLimitEntry{last: now}
+		return true, 0
+	}
+	if now.Sub(entry.last) < r.interval {
+		entry.suppressed++
+		return false, 0
+	}
+	suppressed := entry.suppressed
+	entry.last, entry.suppressed = now, 0
+	return true, suppressed
+}
@@ -0,0 +1,153 @@
+package logging
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(config Config) (*Logger, *strings.Builder) {
+	var out strings.Builder
+	l := New(&out, config)
+	l.now = func() time.Time { return time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC) }
+	return l, &out
+}
+
+func TestParsePrefix(t *testing.T) {
+	for message, expected := range map[string]struct {
+		level     slog.Level
+		component string
+		text      string
+	}{
+		"Error::mdsd::Failed to write":                      {LevelError, "mdsd", "Failed to write"},
+		"Warn::config::invalid port":                        {LevelWarn, "config", "invalid port"},
+		"Debug::mdsd/ama::Successfully flushed":             {LevelDebug, "mdsd/ama", "Successfully flushed"},
+		"Success::mdsd::Successfully flushed":               {LevelInfo, "mdsd", "Successfully flushed"},
+		"FlushKubeMonAgentEventRecords::Info::Flushed 1":    {LevelInfo, "FlushKubeMonAgentEventRecords", "Flushed 1"},
+		"containerinventory::enumerate: Start":              {LevelInfo, "containerinventory", "enumerate: Start"},
+		"Error::Unable to read the config: error :: reason": {LevelError, "", "Unable to read the config: error :: reason"},
+		"Plugin started":                                    {LevelInfo, "", "Plugin started"},
+	} {
+		level, component, text, _ := parsePrefix(message)
+		if level != expected.level || component != expected.component || text != expected.text {
+			t.Errorf("parsePrefix(%q) = %s, %q, %q, expected %s, %q, %q", message, level, component, text, expected.level, expected.component, expected.text)
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	l, out := newTestLogger(Config{Format: FormatText, Level: LevelInfo, ComponentLevels: map[string]slog.Level{"mdsd": LevelDebug, "configReload": LevelError}})
+	std := l.StdLogger()
+	std.Printf("Debug::flush::dropped")
+	std.Printf("Debug::mdsd::Successfully flushed %d records", 3)
+	std.Printf("Warn::configReload::dropped")
+	std.Printf("Plugin started")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", out.String())
+	}
+	if !strings.HasPrefix(lines[0], "2024/05/01 10:30:00 logging_test.go:") || !strings.HasSuffix(lines[0], ": Debug::mdsd::Successfully flushed 3 records") {
+		t.Errorf("expected the classic log line, got %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], ": Plugin started") {
+		t.Errorf("expected the message without a prefix at info, got %q", lines[1])
+	}
+
+	l.SetLevel("", LevelDebug)
+	l.SetLevel("configReload", LevelWarn)
+	if !l.Enabled("flush", LevelDebug) || !l.Enabled("configreload", LevelWarn) {
+		t.Errorf("expected the runtime levels to apply")
+	}
+	l.ResetLevel("mdsd")
+	level, components := l.Levels()
+	if level != "debug" || len(components) != 1 || components["configreload"] != "warn" {
+		t.Errorf("unexpected levels %s %v", level, components)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	l, out := newTestLogger(Config{Format: FormatJSON, Level: LevelInfo})
+	l.StdLogger().Printf("Error::mdsd::Failed to write %d records", 2)
+	l.WithComponent("cadvisor").Warnf("Error getting %s", "stats")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", out.String())
+	}
+	for i, expected := range []map[string]string{
+		{"level": "ERROR", "component": "mdsd", "msg": "Failed to write 2 records"},
+		{"level": "WARN", "component": "cadvisor", "msg": "Error getting stats"},
+	} {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("invalid JSON record %q: %v", lines[i], err)
+		}
+		for key, value := range expected {
+			if record[key] != value {
+				t.Errorf("expected %s=%s in %q", key, value, lines[i])
+			}
+		}
+	}
+	if !strings.Contains(lines[0], `"source":"logging_test.go:`) {
+		t.Errorf("expected the source of the log.Logger message in %q", lines[0])
+	}
+}
+
+func TestLoggerWithComponentText(t *testing.T) {
+	l, out := newTestLogger(Config{Format: FormatText, Level: LevelWarn})
+	cadvisor := l.WithComponent("cadvisor")
+	cadvisor.Infof("dropped")
+	cadvisor.Errorf("Error getting %s", "stats")
+	if expected := "2024/05/01 10:30:00 Error::cadvisor::Error getting stats\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	env := map[string]string{LevelEnv: "WARN", ComponentLevelsEnv: "mdsd=debug", FormatEnv: "json"}
+	config := ConfigFromEnv(func(name string) string { return env[name] })
+	if config.Level != LevelWarn || config.Format != FormatJSON || config.ComponentLevels["mdsd"] != LevelDebug {
+		t.Errorf("unexpected config %+v", config)
+	}
+	config = ConfigFromEnv(func(string) string { return "" })
+	if config.Level != LevelInfo || config.Format != FormatText {
+		t.Errorf("unexpected default config %+v", config)
+	}
+}
+
+func TestParseComponentLevels(t *testing.T) {
+	levels, err := ParseComponentLevels("mdsd=debug, configReload = warn,,")
+	if err != nil || len(levels) != 2 || levels["configreload"] != LevelWarn {
+		t.Errorf("unexpected levels %v %v", levels, err)
+	}
+	levels, err = ParseComponentLevels("mdsd=loud,flush,ama=error")
+	if err == nil || len(levels) != 1 || levels["ama"] != LevelError {
+		t.Errorf("expected the invalid pairs to be reported and skipped, got %v %v", levels, err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(time.Minute)
+	start := time.Now()
+	if allowed, _ := limiter.Allow("mdsd", start); !allowed {
+		t.Errorf("expected the first message to be allowed")
+	}
+	for i := 1; i <= 3; i++ {
+		if allowed, _ := limiter.Allow("mdsd", start.Add(time.Duration(i)*time.Second)); allowed {
+			t.Errorf("expected message %d to be suppressed", i)
+		}
+	}
+	if allowed, _ := limiter.Allow("ama", start.Add(time.Second)); !allowed {
+		t.Errorf("expected the keys to be limited independently")
+	}
+	if allowed, suppressed := limiter.Allow("mdsd", start.Add(time.Minute)); !allowed || suppressed != 3 {
+		t.Errorf("expected the message after the interval with 3 suppressed, got %v %d", allowed, suppressed)
+	}
+	limiter.SetInterval(0)
+	if allowed, _ := limiter.Allow("mdsd", start.Add(time.Minute)); !allowed {
+		t.Errorf("expected every message to be allowed without an interval")
+	}
+}
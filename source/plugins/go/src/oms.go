@@ -9,20 +9,20 @@ import (
 	"log"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fluent/fluent-bit-go/output"
 	"github.com/google/uuid"
 
 	"Docker-Provider/source/plugins/go/src/extension"
-
-	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+	"Docker-Provider/source/plugins/go/src/logging"
+	"Docker-Provider/source/plugins/go/src/paths"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -131,14 +131,8 @@ var (
 	PluginConfiguration map[string]string
 	// HTTPClient for making POST requests to OMSEndpoint
 	HTTPClient http.Client
-	// Client for MDSD msgp Unix socket
-	MdsdMsgpUnixSocketClient net.Conn
 	// Client for MDSD msgp Unix socket for KubeMon Agent events
 	MdsdKubeMonMsgpUnixSocketClient net.Conn
-	// Client for MDSD msgp Unix socket for Insights Metrics
-	MdsdInsightsMetricsMsgpUnixSocketClient net.Conn
-	// Client for MDSD msgp Unix socket for Input Plugin Records
-	MdsdInputPluginRecordsMsgpUnixSocketClient net.Conn
 	// OMSEndpoint ingestion endpoint
 	OMSEndpoint string
 	// Computer (Hostname) when ingesting into ContainerLog table
@@ -173,18 +167,10 @@ var (
 	KubernetesMetadataEnabled bool
 	// Kubernetes Metadata enabled include list
 	KubernetesMetadataIncludeList []string
-	// container log or container log v2 tag name for oneagent route
-	MdsdContainerLogTagName string
-	// ContainerLog Tag Refresh Tracker
-	MdsdContainerLogTagRefreshTracker time.Time
 	// kubemonagent events tag name for oneagent route
 	MdsdKubeMonAgentEventsTagName string
 	// KubeMonAgentEvents Tag Refresh Tracker
 	MdsdKubeMonAgentEventsTagRefreshTracker time.Time
-	// InsightsMetrics tag name for oneagent route
-	MdsdInsightsMetricsTagName string
-	// InsightsMetrics Tag Refresh Tracker
-	MdsdInsightsMetricsTagRefreshTracker time.Time
 	// flag to check if its Windows OS
 	IsWindows bool
 	// container type
@@ -195,14 +181,8 @@ var (
 	IsGenevaLogsIntegrationEnabled bool
 	// flag to check whether Geneva Logs ServiceMode enabled or not
 	IsGenevaLogsTelemetryServiceMode bool
-	// named pipe connection to send ContainerLog for AMA
-	ContainerLogNamedPipe net.Conn
 	// named pipe connection to send KubeMonAgentEvents for AMA
 	KubeMonAgentEventsNamedPipe net.Conn
-	// named pipe connection to ContainerInventory for AMA
-	InputPluginNamedPipe net.Conn
-	// named pipe connection to send InsightsMetrics for AMA
-	InsightsMetricsNamedPipe net.Conn
 	// flag to check whether Azure Monitor Multi-tenancy Log Collection enabled or not
 	IsAzMonMultiTenancyLogCollectionEnabled bool
 	// flag to check whether Azure Monitor Multi-tenancy Log Collection Advanced Mode enabled or not
@@ -212,10 +192,8 @@ var (
 )
 
 var (
-	// ImageIDMap caches the container id to image mapping
-	ImageIDMap map[string]string
-	// NameIDMap caches the container it to Name mapping
-	NameIDMap map[string]string
+	// ContainerImageNameMaps caches the container id to image and name mappings
+	ContainerImageNameMaps atomic.Pointer[containerImageNameMaps]
 	// StdoutIgnoreNamespaceSet set of  excluded K8S namespaces for stdout logs
 	StdoutIgnoreNsSet map[string]bool
 	// StdoutIncludeSystemResourceSet set of included system pods for stdout logs
@@ -228,10 +206,17 @@ var (
 	StdoutIncludeSystemNamespaceSet map[string]bool
 	// StderrIncludeSystemNamespaceSet  set of included system namespaces for stderr logs
 	StderrIncludeSystemNamespaceSet map[string]bool
+	// StdoutCollectionDisabled drops stdout logs, fluent-bit only excludes the stream when it's disabled at startup
+	StdoutCollectionDisabled bool
+	// StderrCollectionDisabled drops stderr logs, fluent-bit only excludes the stream when it's disabled at startup
+	StderrCollectionDisabled bool
+	// LogCollectionFiltersMutex read and write mutex access to the stdout and stderr collection toggles and sets, the sets
+	// are swapped and never modified in place
+	LogCollectionFiltersMutex = &sync.RWMutex{}
 	// PodNameToControllerNameMap stores podName to potential controller name mapping
 	PodNameToControllerNameMap map[string][2]string
-	// DataUpdateMutex read and write mutex access to the container id set
-	DataUpdateMutex = &sync.Mutex{}
+	// PodNameToControllerNameMapMutex read and write mutex access to PodNameToControllerNameMap
+	PodNameToControllerNameMapMutex = &sync.RWMutex{}
 	// ContainerLogTelemetryMutex read and write mutex access to the Container Log Telemetry
 	ContainerLogTelemetryMutex = &sync.Mutex{}
 	// ClientSet for querying KubeAPIs
@@ -246,16 +231,22 @@ var (
 	IngestionAuthTokenUpdateMutex = &sync.Mutex{}
 	// ODSIngestionAuthToken for windows agent AAD MSI Auth
 	ODSIngestionAuthToken string
-	// NamespaceStreamIdsMap caches the Namespace to StreamIds map
-	NamespaceStreamIdsMap map[string][]string
-	// StreamIdNamedPipeMap caches the StreamId to NamedPipe map
-	StreamIdNamedPipeMap map[string]string
-	// ContainerLogV2ExtensionMapUpdateMutex read and write mutex access to the NamespaceStreamIdsMap
-	ContainerLogV2ExtensionMapUpdateMutex = &sync.Mutex{}
-	// NamedPipe and namedpipe connection cache for windows
-	NamedPipeConnectionCache map[string]net.Conn
+	// ContainerLogV2ExtensionMaps caches the Namespace to StreamIds and the StreamId to NamedPipe maps
+	ContainerLogV2ExtensionMaps atomic.Pointer[containerLogV2ExtensionMaps]
 )
 
+// containerImageNameMaps are replaced as a whole by updateContainerImageNameMaps, so flushes read them without locking
+type containerImageNameMaps struct {
+	ImageIDMap map[string]string
+	NameIDMap  map[string]string
+}
+
+// containerLogV2ExtensionMaps are replaced as a whole by updateContainerLogV2ExtensionMaps, so flushes read them without locking
+type containerLogV2ExtensionMaps struct {
+	NamespaceStreamIdsMap map[string][]string
+	StreamIdNamedPipeMap  map[string]string
+}
+
 var (
 	// ContainerImageNameRefreshTicker updates the container image and names periodically
 	ContainerImageNameRefreshTicker *time.Ticker
@@ -268,6 +259,8 @@ var (
 )
 
 var (
+	// PluginLogger leveled logger of the plugin, FLBLogger and Log write through it
+	PluginLogger *logging.Logger
 	// FLBLogger stream
 	FLBLogger = createLogger()
 	// Log wrapper function
@@ -305,6 +298,9 @@ type DataItemLAv2 struct {
 	LogMessage         string `json:"LogMessage"`
 	LogSource          string `json:"LogSource"`
 	KubernetesMetadata string `json:"KubernetesMetadata"`
+	TraceId            string `json:"TraceId,omitempty"`
+	SpanId             string `json:"SpanId,omitempty"`
+	TraceFlags         string `json:"TraceFlags,omitempty"`
 }
 
 // telegraf metric DataItem represents the object corresponding to the json that is sent by fluentbit tail plugin
@@ -398,55 +394,32 @@ const (
 	KubeMonAgentEvents
 	InsightsMetrics
 	InputPluginRecords
+	HostLogs
+	ConfigSnapshot
 )
 
-func createLogger() *log.Logger {
-	var logfile *os.File
-
-	osType := os.Getenv("OS_TYPE")
-
-	var logPath string
-
-	if strings.Compare(strings.ToLower(osType), "windows") != 0 {
-		logPath = "/var/opt/microsoft/docker-cimprov/log/fluent-bit-out-oms-runtime.log"
-	} else {
-		logPath = "/etc/amalogswindows/fluent-bit-out-oms-runtime.log"
-	}
-
-	if _, err := os.Stat(logPath); err == nil {
-		fmt.Printf("File Exists. Opening file in append mode...\n")
-		logfile, err = os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0600)
-		if err != nil {
-			SendException(err.Error())
-			fmt.Printf(err.Error())
-		}
+// kubeRestConfig returns the in-cluster config of the API server client, in local mode the local API server endpoint
+func kubeRestConfig() (*rest.Config, error) {
+	if paths.LocalMode() {
+		Log("Local mode, using the API server %s", paths.APIServerURL())
+		return &rest.Config{Host: paths.APIServerURL()}, nil
 	}
+	return rest.InClusterConfig()
+}
 
-	if _, err := os.Stat(logPath); os.IsNotExist(err) {
-		fmt.Printf("File Doesnt Exist. Creating file...\n")
-		logfile, err = os.Create(logPath)
-		if err != nil {
-			SendException(err.Error())
-			fmt.Printf(err.Error())
-		}
+// createLogger creates the leveled logger of the plugin from the AZMON_LOG_* env, InitializePlugin applies the
+// validated settings
+func createLogger() *log.Logger {
+	logPath := "/var/opt/microsoft/docker-cimprov/log/fluent-bit-out-oms-runtime.log"
+	if strings.EqualFold(os.Getenv("OS_TYPE"), "windows") {
+		logPath = "/etc/amalogswindows/fluent-bit-out-oms-runtime.log"
 	}
-
-	logger := log.New(logfile, "", 0)
-
-	logger.SetOutput(&lumberjack.Logger{
-		Filename:   logPath,
-		MaxSize:    10, //megabytes
-		MaxBackups: 1,
-		MaxAge:     28,   //days
-		Compress:   true, // false by default
-	})
-
-	logger.SetFlags(log.Ltime | log.Lshortfile | log.LstdFlags)
-	return logger
+	PluginLogger = logging.NewFile(paths.Resolve(logPath), logging.ConfigFromEnv(os.Getenv))
+	return PluginLogger.StdLogger()
 }
 
 func updateContainerImageNameMaps() {
-	for ; true; <-ContainerImageNameRefreshTicker.C {
+	for running := true; running; running = waitForTick(ContainerImageNameRefreshTicker) {
 		Log("Updating ImageIDMap and NameIDMap")
 
 		_imageIDMap := make(map[string]string)
@@ -484,17 +457,13 @@ func updateContainerImageNameMaps() {
 			}
 		}
 
-		Log("Locking to update image and name maps")
-		DataUpdateMutex.Lock()
-		ImageIDMap = _imageIDMap
-		NameIDMap = _nameIDMap
-		DataUpdateMutex.Unlock()
-		Log("Unlocking after updating image and name maps")
+		ContainerImageNameMaps.Store(&containerImageNameMaps{ImageIDMap: _imageIDMap, NameIDMap: _nameIDMap})
+		Log("Updated image and name maps")
 	}
 }
 
 func updateContainerLogV2ExtensionMaps(isWindows bool) {
-	for ; true; <-ContainerLogV2ExtensionConfigRefreshTicker.C {
+	for running := true; running; running = waitForTick(ContainerLogV2ExtensionConfigRefreshTicker) {
 		Log("updateContainerLogV2ExtensionMaps::Info: Invoking GetContainerLogV2ExtensionConfig")
 		maxRetries := 3
 		for attempt := 1; attempt <= maxRetries; attempt++ {
@@ -503,60 +472,94 @@ func updateContainerLogV2ExtensionMaps(isWindows bool) {
 				Log("updateContainerLogV2ExtensionMaps::error: %s attempt: %d", string(err.Error()), attempt)
 				time.Sleep(time.Duration(attempt+1) * time.Second)
 			} else {
-				Log("updateContainerLogV2ExtensionMaps:Info:Locking to update NamespaceStreamIdsMap and StreamIdNamedPipeMap")
-				ContainerLogV2ExtensionMapUpdateMutex.Lock()
-				for key := range NamespaceStreamIdsMap {
-					delete(NamespaceStreamIdsMap, key)
-				}
-				for key, value := range _namespaceStreamIdsMap {
-					NamespaceStreamIdsMap[key] = value
-				}
+				maps := &containerLogV2ExtensionMaps{NamespaceStreamIdsMap: _namespaceStreamIdsMap}
 				if isWindows {
-					for key := range StreamIdNamedPipeMap {
-						delete(StreamIdNamedPipeMap, key)
-					}
-					for key, np := range _streamIdNamedPipeMap {
-						StreamIdNamedPipeMap[key] = np
-					}
+					maps.StreamIdNamedPipeMap = _streamIdNamedPipeMap
+				} else {
+					_, maps.StreamIdNamedPipeMap = getContainerLogV2ExtensionMaps()
 				}
-				ContainerLogV2ExtensionMapUpdateMutex.Unlock()
-				Log("updateContainerLogV2ExtensionMaps::Info: Unlocking after updating NamespaceStreamIdsMap and StreamIdNamedPipeMap")
+				ContainerLogV2ExtensionMaps.Store(maps)
+				PipelineHealth.recordExtensionConfigUpdate(time.Now())
+				Log("updateContainerLogV2ExtensionMaps::Info: Updated NamespaceStreamIdsMap and StreamIdNamedPipeMap")
 				break
 			}
 		}
 	}
 }
 
-func populateExcludedStdoutNamespaces() {
-	collectStdoutLogs := os.Getenv("AZMON_COLLECT_STDOUT_LOGS")
-	var stdoutNSExcludeList []string
-	excludeList := os.Getenv("AZMON_STDOUT_EXCLUDED_NAMESPACES")
-	if (strings.Compare(collectStdoutLogs, "true") == 0) && (len(excludeList) > 0) {
-		stdoutNSExcludeList = strings.Split(excludeList, ",")
-		for _, ns := range stdoutNSExcludeList {
-			Log("Excluding namespace %s for stdout log collection", ns)
-			StdoutIgnoreNsSet[strings.TrimSpace(ns)] = true
-		}
+// logCollectionFilters are the stdout and stderr toggles and sets PostDataHelper filters container logs with
+type logCollectionFilters struct {
+	CollectStdoutLogs               bool
+	CollectStderrLogs               bool
+	StdoutIgnoreNsSet               map[string]bool
+	StdoutIncludeSystemResourceSet  map[string]bool
+	StdoutIncludeSystemNamespaceSet map[string]bool
+	StderrIgnoreNsSet               map[string]bool
+	StderrIncludeSystemResourceSet  map[string]bool
+	StderrIncludeSystemNamespaceSet map[string]bool
+}
+
+// newLogCollectionFilters builds the filters of the stdout and stderr settings of the configuration
+func newLogCollectionFilters(config *PluginConfig) *logCollectionFilters {
+	filters := &logCollectionFilters{
+		CollectStdoutLogs:               config.CollectStdoutLogs,
+		CollectStderrLogs:               config.CollectStderrLogs,
+		StdoutIgnoreNsSet:               make(map[string]bool),
+		StdoutIncludeSystemResourceSet:  make(map[string]bool),
+		StdoutIncludeSystemNamespaceSet: make(map[string]bool),
+		StderrIgnoreNsSet:               make(map[string]bool),
+		StderrIncludeSystemResourceSet:  make(map[string]bool),
+		StderrIncludeSystemNamespaceSet: make(map[string]bool),
+	}
+	populateExcludedNamespaces(config.CollectStdoutLogs, config.StdoutExcludedNamespaces, filters.StdoutIgnoreNsSet, "stdout")
+	populateExcludedNamespaces(config.CollectStderrLogs, config.StderrExcludedNamespaces, filters.StderrIgnoreNsSet, "stderr")
+	populateIncludedSystemResource(config.CollectStdoutLogs, config.StdoutIncludedSystemPods, filters.StdoutIncludeSystemResourceSet, filters.StdoutIncludeSystemNamespaceSet)
+	populateIncludedSystemResource(config.CollectStderrLogs, config.StderrIncludedSystemPods, filters.StderrIncludeSystemResourceSet, filters.StderrIncludeSystemNamespaceSet)
+	return filters
+}
+
+// setLogCollectionFilters swaps the filters used by the next flushes
+func setLogCollectionFilters(filters *logCollectionFilters) {
+	LogCollectionFiltersMutex.Lock()
+	defer LogCollectionFiltersMutex.Unlock()
+	StdoutCollectionDisabled = !filters.CollectStdoutLogs
+	StderrCollectionDisabled = !filters.CollectStderrLogs
+	StdoutIgnoreNsSet = filters.StdoutIgnoreNsSet
+	StdoutIncludeSystemResourceSet = filters.StdoutIncludeSystemResourceSet
+	StdoutIncludeSystemNamespaceSet = filters.StdoutIncludeSystemNamespaceSet
+	StderrIgnoreNsSet = filters.StderrIgnoreNsSet
+	StderrIncludeSystemResourceSet = filters.StderrIncludeSystemResourceSet
+	StderrIncludeSystemNamespaceSet = filters.StderrIncludeSystemNamespaceSet
+}
+
+// getLogCollectionFilters returns the current filters, a flush uses the same filters for all its records
+func getLogCollectionFilters() *logCollectionFilters {
+	LogCollectionFiltersMutex.RLock()
+	defer LogCollectionFiltersMutex.RUnlock()
+	return &logCollectionFilters{
+		CollectStdoutLogs:               !StdoutCollectionDisabled,
+		CollectStderrLogs:               !StderrCollectionDisabled,
+		StdoutIgnoreNsSet:               StdoutIgnoreNsSet,
+		StdoutIncludeSystemResourceSet:  StdoutIncludeSystemResourceSet,
+		StdoutIncludeSystemNamespaceSet: StdoutIncludeSystemNamespaceSet,
+		StderrIgnoreNsSet:               StderrIgnoreNsSet,
+		StderrIncludeSystemResourceSet:  StderrIncludeSystemResourceSet,
+		StderrIncludeSystemNamespaceSet: StderrIncludeSystemNamespaceSet,
 	}
 }
 
-func populateExcludedStderrNamespaces() {
-	collectStderrLogs := os.Getenv("AZMON_COLLECT_STDERR_LOGS")
-	var stderrNSExcludeList []string
-	excludeList := os.Getenv("AZMON_STDERR_EXCLUDED_NAMESPACES")
-	if (strings.Compare(collectStderrLogs, "true") == 0) && (len(excludeList) > 0) {
-		stderrNSExcludeList = strings.Split(excludeList, ",")
-		for _, ns := range stderrNSExcludeList {
-			Log("Excluding namespace %s for stderr log collection", ns)
-			StderrIgnoreNsSet[strings.TrimSpace(ns)] = true
+func populateExcludedNamespaces(collectLogs bool, excludeList []string, ignoreNsSet map[string]bool, stream string) {
+	if collectLogs {
+		for _, ns := range excludeList {
+			Log("Excluding namespace %s for %s log collection", ns, stream)
+			ignoreNsSet[ns] = true
 		}
 	}
 }
 
 // Helper function to populate included system resources for both stdout and stderr.
-func populateIncludedSystemResource(collectLogs string, includeListEnvVar string, includeSystemResourceSet map[string]bool, includeSystemNamespaceSet map[string]bool) {
-	if collectLogs == "true" && len(includeListEnvVar) > 0 {
-		includedSystemResourceList := strings.Split(includeListEnvVar, ",")
+func populateIncludedSystemResource(collectLogs bool, includedSystemResourceList []string, includeSystemResourceSet map[string]bool, includeSystemNamespaceSet map[string]bool) {
+	if collectLogs {
 		for _, resource := range includedSystemResourceList {
 			colonLoc := strings.Index(resource, ":")
 			if colonLoc == -1 {
@@ -565,24 +568,12 @@ func populateIncludedSystemResource(collectLogs string, includeListEnvVar string
 			}
 			namespace := resource[:colonLoc]
 			Log("Including system resource namespace:controller %s for log collection", resource)
-			includeSystemResourceSet[strings.TrimSpace(resource)] = true
+			includeSystemResourceSet[resource] = true
 			includeSystemNamespaceSet[strings.TrimSpace(namespace)] = true
 		}
 	}
 }
 
-func populateIncludedStdoutSystemResource() {
-	collectStdoutLogs := os.Getenv("AZMON_COLLECT_STDOUT_LOGS")
-	includeList := os.Getenv("AZMON_STDOUT_INCLUDED_SYSTEM_PODS")
-	populateIncludedSystemResource(collectStdoutLogs, includeList, StdoutIncludeSystemResourceSet, StdoutIncludeSystemNamespaceSet)
-}
-
-func populateIncludedStderrSystemResource() {
-	collectStderrLogs := os.Getenv("AZMON_COLLECT_STDERR_LOGS")
-	includeList := os.Getenv("AZMON_STDERR_INCLUDED_SYSTEM_PODS")
-	populateIncludedSystemResource(collectStderrLogs, includeList, StderrIncludeSystemResourceSet, StderrIncludeSystemNamespaceSet)
-}
-
 // Azure loganalytics metric values have to be numeric, so string values are dropped
 func convert(in interface{}) (float64, bool) {
 	switch v := in.(type) {
@@ -698,260 +689,220 @@ func populateKubeMonAgentEventHash(record map[interface{}]interface{}, errType K
 
 // Function to get config error log records after iterating through the two hashes
 func flushKubeMonAgentEventRecords() {
-	for ; true; <-KubeMonAgentConfigEventsSendTicker.C {
+	for running := true; running; running = waitForTick(KubeMonAgentConfigEventsSendTicker) {
 		if skipKubeMonEventsFlush != true {
-			Log("In flushConfigErrorRecords\n")
-			start := time.Now()
-			var elapsed time.Duration
-			var laKubeMonAgentEventsRecords []laKubeMonAgentEvents
-			var msgPackEntries []MsgPackEntry
-			telemetryDimensions := make(map[string]string)
-
-			telemetryDimensions["ConfigErrorEventCount"] = strconv.Itoa(len(ConfigErrorEvent))
-			telemetryDimensions["PromScrapeErrorEventCount"] = strconv.Itoa(len(PromScrapeErrorEvent))
-
-			if (len(ConfigErrorEvent) > 0) || (len(PromScrapeErrorEvent) > 0) {
-				EventHashUpdateMutex.Lock()
-				Log("Locked EventHashUpdateMutex for reading hashes\n")
-				for k, v := range ConfigErrorEvent {
-					tagJson, err := json.Marshal(v)
-
-					if err != nil {
-						message := fmt.Sprintf("Error while Marshalling config error event tags: %s", err.Error())
-						Log(message)
-						SendException(message)
-					} else {
-						laKubeMonAgentEventsRecord := laKubeMonAgentEvents{
-							Computer:       Computer,
-							CollectionTime: start.Format(time.RFC3339),
-							Category:       ConfigErrorEventCategory,
-							Level:          KubeMonAgentEventError,
-							ClusterId:      ResourceID,
-							ClusterName:    ResourceName,
-							Message:        k,
-							Tags:           fmt.Sprintf("%s", tagJson),
-						}
-						laKubeMonAgentEventsRecords = append(laKubeMonAgentEventsRecords, laKubeMonAgentEventsRecord)
-						var stringMap map[string]string
-						jsonBytes, err := json.Marshal(&laKubeMonAgentEventsRecord)
-						if err != nil {
-							message := fmt.Sprintf("Error while Marshalling laKubeMonAgentEventsRecord to json bytes: %s", err.Error())
-							Log(message)
-							SendException(message)
-						} else {
-							if err := json.Unmarshal(jsonBytes, &stringMap); err != nil {
-								message := fmt.Sprintf("Error while UnMarhalling json bytes to stringmap: %s", err.Error())
-								Log(message)
-								SendException(message)
-							} else {
-								msgPackEntry := MsgPackEntry{
-									Record: stringMap,
-								}
-								msgPackEntries = append(msgPackEntries, msgPackEntry)
-							}
-						}
-					}
-				}
+			flushKubeMonAgentEvents()
+		} else {
+			// Setting this to false to allow for subsequent flushes after the first hour
+			skipKubeMonEventsFlush = false
+		}
+	}
+	// final flush of the events recorded since the last tick
+	flushKubeMonAgentEvents()
+}
 
-				for k, v := range PromScrapeErrorEvent {
-					tagJson, err := json.Marshal(v)
-					if err != nil {
-						message := fmt.Sprintf("Error while Marshalling prom scrape error event tags: %s", err.Error())
-						Log(message)
-						SendException(message)
-					} else {
-						laKubeMonAgentEventsRecord := laKubeMonAgentEvents{
-							Computer:       Computer,
-							CollectionTime: start.Format(time.RFC3339),
-							Category:       PromScrapingErrorEventCategory,
-							Level:          KubeMonAgentEventWarning,
-							ClusterId:      ResourceID,
-							ClusterName:    ResourceName,
-							Message:        k,
-							Tags:           fmt.Sprintf("%s", tagJson),
-						}
-						laKubeMonAgentEventsRecords = append(laKubeMonAgentEventsRecords, laKubeMonAgentEventsRecord)
-						var stringMap map[string]string
-						jsonBytes, err := json.Marshal(&laKubeMonAgentEventsRecord)
-						if err != nil {
-							message := fmt.Sprintf("Error while Marshalling laKubeMonAgentEventsRecord to json bytes: %s", err.Error())
-							Log(message)
-							SendException(message)
-						} else {
-							if err := json.Unmarshal(jsonBytes, &stringMap); err != nil {
-								message := fmt.Sprintf("Error while UnMarhalling json bytes to stringmap: %s", err.Error())
-								Log(message)
-								SendException(message)
-							} else {
-								msgPackEntry := MsgPackEntry{
-									Record: stringMap,
-								}
-								msgPackEntries = append(msgPackEntries, msgPackEntry)
-							}
-						}
-					}
-				}
+// appendKubeMonAgentEventRecords converts the entries of an event hash to KubeMonAgentEvents records and msgpack entries
+func appendKubeMonAgentEventRecords(events map[string]KubeMonAgentEventTags, category string, level string, collectionTime time.Time, records []laKubeMonAgentEvents, msgPackEntries []MsgPackEntry) ([]laKubeMonAgentEvents, []MsgPackEntry) {
+	for k, v := range events {
+		tagJson, err := json.Marshal(v)
+		if err != nil {
+			message := fmt.Sprintf("Error while Marshalling %s event tags: %s", category, err.Error())
+			Log(message)
+			SendException(message)
+			continue
+		}
+		laKubeMonAgentEventsRecord := laKubeMonAgentEvents{
+			Computer:       Computer,
+			CollectionTime: collectionTime.Format(time.RFC3339),
+			Category:       category,
+			Level:          level,
+			ClusterId:      ResourceID,
+			ClusterName:    ResourceName,
+			Message:        k,
+			Tags:           fmt.Sprintf("%s", tagJson),
+		}
+		records = append(records, laKubeMonAgentEventsRecord)
+		var stringMap map[string]string
+		jsonBytes, err := json.Marshal(&laKubeMonAgentEventsRecord)
+		if err != nil {
+			message := fmt.Sprintf("Error while Marshalling laKubeMonAgentEventsRecord to json bytes: %s", err.Error())
+			Log(message)
+			SendException(message)
+		} else if err := json.Unmarshal(jsonBytes, &stringMap); err != nil {
+			message := fmt.Sprintf("Error while UnMarhalling json bytes to stringmap: %s", err.Error())
+			Log(message)
+			SendException(message)
+		} else {
+			msgPackEntries = append(msgPackEntries, MsgPackEntry{Record: stringMap})
+		}
+	}
+	return records, msgPackEntries
+}
 
-				//Clearing out the prometheus scrape hash so that it can be rebuilt with the errors in the next hour
-				for k := range PromScrapeErrorEvent {
-					delete(PromScrapeErrorEvent, k)
-				}
-				Log("PromScrapeErrorEvent cache cleared\n")
-				EventHashUpdateMutex.Unlock()
-				Log("Unlocked EventHashUpdateMutex for reading hashes\n")
-			} else {
-				//Sending a record in case there are no errors to be able to differentiate between no data vs no errors
-				tagsValue := KubeMonAgentEventTags{}
+// flushKubeMonAgentEvents sends the config error, prom scraping error, connection and verbose collection events
+func flushKubeMonAgentEvents() {
+	Log("In flushConfigErrorRecords\n")
+	start := time.Now()
+	var elapsed time.Duration
+	var laKubeMonAgentEventsRecords []laKubeMonAgentEvents
+	var msgPackEntries []MsgPackEntry
+	telemetryDimensions := make(map[string]string)
 
-				tagJson, err := json.Marshal(tagsValue)
-				if err != nil {
-					message := fmt.Sprintf("Error while Marshalling no error tags: %s", err.Error())
-					Log(message)
-					SendException(message)
-				} else {
-					laKubeMonAgentEventsRecord := laKubeMonAgentEvents{
-						Computer:       Computer,
-						CollectionTime: start.Format(time.RFC3339),
-						Category:       NoErrorEventCategory,
-						Level:          KubeMonAgentEventInfo,
-						ClusterId:      ResourceID,
-						ClusterName:    ResourceName,
-						Message:        "No errors",
-						Tags:           fmt.Sprintf("%s", tagJson),
-					}
-					laKubeMonAgentEventsRecords = append(laKubeMonAgentEventsRecords, laKubeMonAgentEventsRecord)
-					var stringMap map[string]string
-					jsonBytes, err := json.Marshal(&laKubeMonAgentEventsRecord)
-					if err != nil {
-						message := fmt.Sprintf("Error while Marshalling laKubeMonAgentEventsRecord to json bytes: %s", err.Error())
-						Log(message)
-						SendException(message)
-					} else {
-						if err := json.Unmarshal(jsonBytes, &stringMap); err != nil {
-							message := fmt.Sprintf("Error while UnMarshalling json bytes to stringmap: %s", err.Error())
-							Log(message)
-							SendException(message)
-						} else {
-							msgPackEntry := MsgPackEntry{
-								Record: stringMap,
-							}
-							msgPackEntries = append(msgPackEntries, msgPackEntry)
-						}
-					}
-				}
+	telemetryDimensions["ConfigErrorEventCount"] = strconv.Itoa(len(ConfigErrorEvent))
+	telemetryDimensions["PromScrapeErrorEventCount"] = strconv.Itoa(len(PromScrapeErrorEvent))
+	telemetryDimensions["ConnectionErrorEventCount"] = strconv.Itoa(len(ConnectionErrorEvent))
+	telemetryDimensions["VerboseCollectionEventCount"] = strconv.Itoa(len(VerboseCollectionEvent))
+	telemetryDimensions["ResourceThrottlingEventCount"] = strconv.Itoa(len(ResourceThrottlingEvent))
+
+	if (len(ConfigErrorEvent) > 0) || (len(PromScrapeErrorEvent) > 0) || (len(ConnectionErrorEvent) > 0) || (len(VerboseCollectionEvent) > 0) || (len(ResourceThrottlingEvent) > 0) {
+		EventHashUpdateMutex.Lock()
+		Log("Locked EventHashUpdateMutex for reading hashes\n")
+		laKubeMonAgentEventsRecords, msgPackEntries = appendKubeMonAgentEventRecords(ConfigErrorEvent, ConfigErrorEventCategory, KubeMonAgentEventError, start, laKubeMonAgentEventsRecords, msgPackEntries)
+		laKubeMonAgentEventsRecords, msgPackEntries = appendKubeMonAgentEventRecords(PromScrapeErrorEvent, PromScrapingErrorEventCategory, KubeMonAgentEventWarning, start, laKubeMonAgentEventsRecords, msgPackEntries)
+		laKubeMonAgentEventsRecords, msgPackEntries = appendKubeMonAgentEventRecords(ConnectionErrorEvent, ConnectionErrorEventCategory, KubeMonAgentEventWarning, start, laKubeMonAgentEventsRecords, msgPackEntries)
+		laKubeMonAgentEventsRecords, msgPackEntries = appendKubeMonAgentEventRecords(VerboseCollectionEvent, VerboseCollectionEventCategory, KubeMonAgentEventInfo, start, laKubeMonAgentEventsRecords, msgPackEntries)
+		laKubeMonAgentEventsRecords, msgPackEntries = appendKubeMonAgentEventRecords(ResourceThrottlingEvent, ResourceThrottlingEventCategory, KubeMonAgentEventWarning, start, laKubeMonAgentEventsRecords, msgPackEntries)
+
+		//Clearing out the connection error, verbose collection and throttling hashes, transitions and activations are reported once
+		for k := range ConnectionErrorEvent {
+			delete(ConnectionErrorEvent, k)
+		}
+		for k := range VerboseCollectionEvent {
+			delete(VerboseCollectionEvent, k)
+		}
+		for k := range ResourceThrottlingEvent {
+			delete(ResourceThrottlingEvent, k)
+		}
+
+		//Clearing out the prometheus scrape hash so that it can be rebuilt with the errors in the next hour
+		for k := range PromScrapeErrorEvent {
+			delete(PromScrapeErrorEvent, k)
+		}
+		Log("PromScrapeErrorEvent cache cleared\n")
+		EventHashUpdateMutex.Unlock()
+		Log("Unlocked EventHashUpdateMutex for reading hashes\n")
+	} else {
+		//Sending a record in case there are no errors to be able to differentiate between no data vs no errors
+		noErrorEvent := map[string]KubeMonAgentEventTags{"No errors": {}}
+		laKubeMonAgentEventsRecords, msgPackEntries = appendKubeMonAgentEventRecords(noErrorEvent, NoErrorEventCategory, KubeMonAgentEventInfo, start, laKubeMonAgentEventsRecords, msgPackEntries)
+	}
+	if (IsWindows == false || IsAADMSIAuthMode) && len(msgPackEntries) > 0 { //for linux, mdsd route and Windows MSI auth mode, AMA route
+		if IsAADMSIAuthMode == true {
+			MdsdKubeMonAgentEventsTagName = getOutputStreamIdTag(KubeMonAgentEventDataType, MdsdKubeMonAgentEventsTagName, &MdsdKubeMonAgentEventsTagRefreshTracker)
+			if MdsdKubeMonAgentEventsTagName == "" {
+				Log("Warn::mdsd::skipping Microsoft-KubeMonAgentEvents stream since its opted out")
+				recordDrop(DropReasonStreamOptedOut, "", len(msgPackEntries), KubeMonAgentEventDataType)
+				return
 			}
-			if (IsWindows == false || IsAADMSIAuthMode) && len(msgPackEntries) > 0 { //for linux, mdsd route and Windows MSI auth mode, AMA route
-				if IsAADMSIAuthMode == true {
-					MdsdKubeMonAgentEventsTagName = getOutputStreamIdTag(KubeMonAgentEventDataType, MdsdKubeMonAgentEventsTagName, &MdsdKubeMonAgentEventsTagRefreshTracker)
-					if MdsdKubeMonAgentEventsTagName == "" {
-						Log("Warn::mdsd::skipping Microsoft-KubeMonAgentEvents stream since its opted out")
-						return
-					}
+		}
+		Log("Info::mdsd:: using mdsdsource name for KubeMonAgentEvents: %s", MdsdKubeMonAgentEventsTagName)
+		validateRecords(KubeMonAgentEventsSchema, msgPackEntries)
+		RecordTee.Write(KubeMonAgentEvents.String(), MdsdKubeMonAgentEventsTagName, msgPackEntries)
+		msgpBytes := convertMsgPackEntriesToMsgpBytes(MdsdKubeMonAgentEventsTagName, msgPackEntries)
+		var er error
+		var bts int
+		if IsWindows == false {
+			if MdsdKubeMonMsgpUnixSocketClient == nil {
+				logConnectionError(getMdsdCircuitBreaker(KubeMonAgentEvents), "Error::mdsd::mdsd connection for KubeMonAgentEvents does not exist. re-connecting ...")
+				CreateMDSDClient(&MdsdKubeMonMsgpUnixSocketClient, KubeMonAgentEvents, ContainerType)
+				if MdsdKubeMonMsgpUnixSocketClient == nil {
+					logConnectionError(getMdsdCircuitBreaker(KubeMonAgentEvents), "Error::mdsd::Unable to create mdsd client for KubeMonAgentEvents. Please check error log.")
+					ContainerLogTelemetryMutex.Lock()
+					defer ContainerLogTelemetryMutex.Unlock()
+					KubeMonEventsMDSDClientCreateErrors += 1
 				}
-				Log("Info::mdsd:: using mdsdsource name for KubeMonAgentEvents: %s", MdsdKubeMonAgentEventsTagName)
-				msgpBytes := convertMsgPackEntriesToMsgpBytes(MdsdKubeMonAgentEventsTagName, msgPackEntries)
-				var er error
-				var bts int
-				if IsWindows == false {
-					if MdsdKubeMonMsgpUnixSocketClient == nil {
-						Log("Error::mdsd::mdsd connection for KubeMonAgentEvents does not exist. re-connecting ...")
-						CreateMDSDClient(KubeMonAgentEvents, ContainerType)
-						if MdsdKubeMonMsgpUnixSocketClient == nil {
-							Log("Error::mdsd::Unable to create mdsd client for KubeMonAgentEvents. Please check error log.")
-							ContainerLogTelemetryMutex.Lock()
-							defer ContainerLogTelemetryMutex.Unlock()
-							KubeMonEventsMDSDClientCreateErrors += 1
-						}
-					}
-					if MdsdKubeMonMsgpUnixSocketClient != nil {
-						deadline := 10 * time.Second
-						MdsdKubeMonMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-						bts, er = MdsdKubeMonMsgpUnixSocketClient.Write(msgpBytes)
-					} else {
-						Log("Error::mdsd::Unable to create mdsd client for KubeMonAgentEvents. Please check error log.")
-					}
-				} else {
-					if EnsureGenevaOr3PNamedPipeExists(&KubeMonAgentEventsNamedPipe, KubeMonAgentEventDataType, &KubeMonEventsWindowsAMAClientCreateErrors, false, &MdsdKubeMonAgentEventsTagRefreshTracker) {
-						deadline := 10 * time.Second
-						KubeMonAgentEventsNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-						bts, er = KubeMonAgentEventsNamedPipe.Write(msgpBytes)
-					} else {
-						Log("Error::mdsd::Unable to create ama named pipe for KubeMonAgentEvents. Please check error log.")
-					}
+			}
+			if MdsdKubeMonMsgpUnixSocketClient != nil {
+				deadline := 10 * time.Second
+				MdsdKubeMonMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+				bts, er = MdsdKubeMonMsgpUnixSocketClient.Write(msgpBytes)
+				recordConnectionResult(getMdsdCircuitBreaker(KubeMonAgentEvents), er)
+			} else {
+				logConnectionError(getMdsdCircuitBreaker(KubeMonAgentEvents), "Error::mdsd::Unable to create mdsd client for KubeMonAgentEvents. Please check error log.")
+			}
+		} else {
+			if EnsureGenevaOr3PNamedPipeExists(&KubeMonAgentEventsNamedPipe, KubeMonAgentEventDataType, &KubeMonEventsWindowsAMAClientCreateErrors, false, &MdsdKubeMonAgentEventsTagRefreshTracker) {
+				deadline := 10 * time.Second
+				KubeMonAgentEventsNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+				bts, er = KubeMonAgentEventsNamedPipe.Write(msgpBytes)
+				recordConnectionResult(getAMACircuitBreaker(KubeMonAgentEventDataType), er)
+			} else {
+				logConnectionError(getAMACircuitBreaker(KubeMonAgentEventDataType), "Error::mdsd::Unable to create ama named pipe for KubeMonAgentEvents. Please check error log.")
+			}
+		}
+		elapsed = time.Since(start)
+		if er != nil {
+			message := fmt.Sprintf("Error::mdsd/ama::Failed to write to kubemonagent %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
+			LogRateLimited("kubemonagent", "%s", message)
+			if IsWindows == false {
+				if MdsdKubeMonMsgpUnixSocketClient != nil {
+					MdsdKubeMonMsgpUnixSocketClient.Close()
+					MdsdKubeMonMsgpUnixSocketClient = nil
 				}
-				elapsed = time.Since(start)
-				if er != nil {
-					message := fmt.Sprintf("Error::mdsd/ama::Failed to write to kubemonagent %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
-					Log(message)
-					if IsWindows == false {
-						if MdsdKubeMonMsgpUnixSocketClient != nil {
-							MdsdKubeMonMsgpUnixSocketClient.Close()
-							MdsdKubeMonMsgpUnixSocketClient = nil
-						}
-					} else {
-						if KubeMonAgentEventsNamedPipe != nil {
-							KubeMonAgentEventsNamedPipe.Close()
-							KubeMonAgentEventsNamedPipe = nil
-						}
-					}
-					SendException(message)
-				} else {
-					numRecords := len(msgPackEntries)
-					Log("FlushKubeMonAgentEventRecords::Info::Successfully flushed %d records that was %d bytes in %s", numRecords, bts, elapsed)
-					// Send telemetry to AppInsights resource
-					SendEvent(KubeMonAgentEventsFlushedEvent, telemetryDimensions)
+			} else {
+				if KubeMonAgentEventsNamedPipe != nil {
+					KubeMonAgentEventsNamedPipe.Close()
+					KubeMonAgentEventsNamedPipe = nil
 				}
-			} else if len(laKubeMonAgentEventsRecords) > 0 { //for windows, ODS direct
-				kubeMonAgentEventEntry := KubeMonAgentEventBlob{
-					DataType:  KubeMonAgentEventDataType,
-					IPName:    IPName,
-					DataItems: laKubeMonAgentEventsRecords}
-
-				marshalled, err := json.Marshal(kubeMonAgentEventEntry)
-
-				if err != nil {
-					message := fmt.Sprintf("Error while marshalling kubemonagentevent entry: %s", err.Error())
-					Log(message)
-					SendException(message)
-				} else {
-					req, _ := http.NewRequest("POST", OMSEndpoint, bytes.NewBuffer(marshalled))
-					req.Header.Set("Content-Type", "application/json")
-					req.Header.Set("User-Agent", userAgent)
-					reqId := uuid.New().String()
-					req.Header.Set("X-Request-ID", reqId)
-					//expensive to do string len for every request, so use a flag
-					if ResourceCentric == true {
-						req.Header.Set("x-ms-AzureResourceId", ResourceID)
-					}
+			}
+			SendException(message)
+		} else {
+			numRecords := len(msgPackEntries)
+			Log("Debug::FlushKubeMonAgentEventRecords::Successfully flushed %d records that was %d bytes in %s", numRecords, bts, elapsed)
+			// Send telemetry to AppInsights resource
+			SendEvent(KubeMonAgentEventsFlushedEvent, telemetryDimensions)
+			recordKubeMonAgentEventsFlushed(laKubeMonAgentEventsRecords)
+		}
+	} else if len(laKubeMonAgentEventsRecords) > 0 { //for windows, ODS direct
+		kubeMonAgentEventEntry := KubeMonAgentEventBlob{
+			DataType:  KubeMonAgentEventDataType,
+			IPName:    IPName,
+			DataItems: laKubeMonAgentEventsRecords}
 
-					resp, err := HTTPClient.Do(req)
-					elapsed = time.Since(start)
+		marshalled, err := json.Marshal(kubeMonAgentEventEntry)
 
-					if err != nil {
-						message := fmt.Sprintf("Error when sending kubemonagentevent request %s \n", err.Error())
-						Log(message)
-						Log("Failed to flush %d records after %s", len(laKubeMonAgentEventsRecords), elapsed)
-					} else if resp == nil || resp.StatusCode != 200 {
-						if resp != nil {
-							Log("flushKubeMonAgentEventRecords: RequestId %s Status %s Status Code %d", reqId, resp.Status, resp.StatusCode)
-						}
-						Log("Failed to flush %d records after %s", len(laKubeMonAgentEventsRecords), elapsed)
-					} else {
-						numRecords := len(laKubeMonAgentEventsRecords)
-						Log("FlushKubeMonAgentEventRecords::Info::Successfully flushed %d records in %s", numRecords, elapsed)
+		if err != nil {
+			message := fmt.Sprintf("Error while marshalling kubemonagentevent entry: %s", err.Error())
+			Log(message)
+			SendException(message)
+		} else {
+			req, _ := http.NewRequest("POST", OMSEndpoint, bytes.NewBuffer(marshalled))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", userAgent)
+			reqId := uuid.New().String()
+			req.Header.Set("X-Request-ID", reqId)
+			//expensive to do string len for every request, so use a flag
+			if ResourceCentric == true {
+				req.Header.Set("x-ms-AzureResourceId", ResourceID)
+			}
 
-						// Send telemetry to AppInsights resource
-						SendEvent(KubeMonAgentEventsFlushedEvent, telemetryDimensions)
+			resp, err := HTTPClient.Do(req)
+			elapsed = time.Since(start)
 
-					}
-					if resp != nil && resp.Body != nil {
-						defer resp.Body.Close()
+			if err != nil {
+				message := fmt.Sprintf("Error when sending kubemonagentevent request %s \n", err.Error())
+				Log(message)
+				Log("Failed to flush %d records after %s", len(laKubeMonAgentEventsRecords), elapsed)
+			} else if resp == nil || resp.StatusCode != 200 {
+				if resp != nil {
+					Log("flushKubeMonAgentEventRecords: RequestId %s Status %s Status Code %d", reqId, resp.Status, resp.StatusCode)
+					if !IsRetriableError(resp.StatusCode) && !IsSuccessStatusCode(resp.StatusCode) {
+						WriteDeadLetter(KubeMonAgentEventDataType, OMSEndpoint, DeadLetterReasonNonRetriableStatus, resp.Status, getODSDeadLetterHeaders(), len(laKubeMonAgentEventsRecords), marshalled)
 					}
 				}
+				Log("Failed to flush %d records after %s", len(laKubeMonAgentEventsRecords), elapsed)
+			} else {
+				numRecords := len(laKubeMonAgentEventsRecords)
+				Log("Debug::FlushKubeMonAgentEventRecords::Successfully flushed %d records in %s", numRecords, elapsed)
+
+				// Send telemetry to AppInsights resource
+				SendEvent(KubeMonAgentEventsFlushedEvent, telemetryDimensions)
+				recordKubeMonAgentEventsFlushed(laKubeMonAgentEventsRecords)
+
+			}
+			if resp != nil && resp.Body != nil {
+				defer resp.Body.Close()
 			}
-		} else {
-			// Setting this to false to allow for subsequent flushes after the first hour
-			skipKubeMonEventsFlush = false
 		}
 	}
 }
@@ -991,6 +942,7 @@ func translateTelegrafMetrics(m map[interface{}]interface{}) ([]*laTelegrafMetri
 	for k, v := range fieldMap {
 		fv, ok := convert(v)
 		if !ok {
+			recordDrop(DropReasonNonNumericField, tagMap["namespace"], 1, fmt.Sprintf("%s.%s=%v", m["name"], k, v))
 			continue
 		}
 		i := m["timestamp"].(uint64)
@@ -1012,7 +964,7 @@ func translateTelegrafMetrics(m map[interface{}]interface{}) ([]*laTelegrafMetri
 }
 
 // send metrics from Telegraf to LA. 1) Translate telegraf timeseries to LA metric(s) 2) Send it to LA as 'InsightsMetrics' fixed type
-func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int {
+func (instance *PluginInstance) PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int {
 	var laMetrics []*laTelegrafMetric
 
 	if (telegrafRecords == nil) || !(len(telegrafRecords) > 0) {
@@ -1020,11 +972,20 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 		return output.FLB_OK
 	}
 
+	var recordTimes []time.Time
+	for _, record := range telegrafRecords {
+		if timestamp, ok := record["timestamp"].(uint64); ok {
+			recordTimes = append(recordTimes, time.Unix(int64(timestamp), 0))
+		}
+	}
+	telegrafRecords = append(telegrafRecords, getDeliveryLatencyTelegrafRecords(time.Now())...)
+
 	for _, record := range telegrafRecords {
 		translatedMetrics, err := translateTelegrafMetrics(record)
 		if err != nil {
 			message := fmt.Sprintf("PostTelegrafMetricsToLA::Error:when translating telegraf metric to log analytics metric %q", err)
 			Log(message)
+			recordDrop(DropReasonTranslationError, "", 1, record)
 			//SendException(message) //This will be too noisy
 		}
 		laMetrics = append(laMetrics, translatedMetrics...)
@@ -1052,12 +1013,18 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 				message := fmt.Sprintf("PostTelegrafMetricsToLA::Error:when marshalling json %q", err)
 				Log(message)
 				SendException(message)
+				if DeadLetterEnabled {
+					payload, skipped := msgpDeadLetterPayload(instance.MdsdInsightsMetricsTagName, laMetrics)
+					WriteDeadLetter(InsightsMetricsDataType, getMdsdDeadLetterDestination(InsightsMetrics), DeadLetterReasonMarshalError, deadLetterMarshalDetail(err, skipped), nil, len(laMetrics)-skipped, payload)
+				}
+				recordDrop(DropReasonMarshalError, "", len(laMetrics), err.Error())
 				return output.FLB_OK
 			} else {
 				if err := json.Unmarshal(jsonBytes, &interfaceMap); err != nil {
 					message := fmt.Sprintf("Error while UnMarshalling json bytes to interfaceMap: %s", err.Error())
 					Log(message)
 					SendException(message)
+					recordDrop(DropReasonMarshalError, "", len(laMetrics), err.Error())
 					return output.FLB_OK
 				} else {
 					for key, value := range interfaceMap {
@@ -1074,21 +1041,24 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 		}
 		if len(msgPackEntries) > 0 {
 			if IsAADMSIAuthMode == true {
-				MdsdInsightsMetricsTagName = getOutputStreamIdTag(InsightsMetricsDataType, MdsdInsightsMetricsTagName, &MdsdInsightsMetricsTagRefreshTracker)
-				if MdsdInsightsMetricsTagName == "" {
+				instance.MdsdInsightsMetricsTagName = getOutputStreamIdTag(InsightsMetricsDataType, instance.MdsdInsightsMetricsTagName, &instance.MdsdInsightsMetricsTagRefreshTracker)
+				if instance.MdsdInsightsMetricsTagName == "" {
 					Log("Warn::mdsd::skipping Microsoft-InsightsMetrics stream since its opted out")
+					recordDrop(DropReasonStreamOptedOut, "", len(msgPackEntries), InsightsMetricsDataType)
 					return output.FLB_OK
 				}
 			}
-			msgpBytes := convertMsgPackEntriesToMsgpBytes(MdsdInsightsMetricsTagName, msgPackEntries)
+			validateRecords(InsightsMetricsSchema, msgPackEntries)
+			RecordTee.Write(InsightsMetrics.String(), instance.MdsdInsightsMetricsTagName, msgPackEntries)
+			msgpBytes := convertMsgPackEntriesToMsgpBytes(instance.MdsdInsightsMetricsTagName, msgPackEntries)
 			var bts int
 			var er error
 			if IsWindows == false {
-				if MdsdInsightsMetricsMsgpUnixSocketClient == nil {
-					Log("Error::mdsd::mdsd connection does not exist. re-connecting ...")
-					CreateMDSDClient(InsightsMetrics, ContainerType)
-					if MdsdInsightsMetricsMsgpUnixSocketClient == nil {
-						Log("Error::mdsd::Unable to create mdsd client for insights metrics. Please check error log.")
+				if instance.MdsdInsightsMetricsMsgpUnixSocketClient == nil {
+					logConnectionError(getMdsdCircuitBreaker(InsightsMetrics), "Error::mdsd::mdsd connection does not exist. re-connecting ...")
+					CreateMDSDClient(&instance.MdsdInsightsMetricsMsgpUnixSocketClient, InsightsMetrics, ContainerType)
+					if instance.MdsdInsightsMetricsMsgpUnixSocketClient == nil {
+						logConnectionError(getMdsdCircuitBreaker(InsightsMetrics), "Error::mdsd::Unable to create mdsd client for insights metrics. Please check error log.")
 						ContainerLogTelemetryMutex.Lock()
 						defer ContainerLogTelemetryMutex.Unlock()
 						InsightsMetricsMDSDClientCreateErrors += 1
@@ -1097,13 +1067,14 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 				}
 
 				deadline := 10 * time.Second
-				MdsdInsightsMetricsMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-				bts, er = MdsdInsightsMetricsMsgpUnixSocketClient.Write(msgpBytes)
+				instance.MdsdInsightsMetricsMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+				bts, er = instance.MdsdInsightsMetricsMsgpUnixSocketClient.Write(msgpBytes)
+				recordConnectionResult(getMdsdCircuitBreaker(InsightsMetrics), er)
 			} else {
-				if InsightsMetricsNamedPipe == nil {
-					EnsureGenevaOr3PNamedPipeExists(&InsightsMetricsNamedPipe, InsightsMetricsDataType, &InsightsMetricsWindowsAMAClientCreateErrors, false, &MdsdInsightsMetricsTagRefreshTracker)
-					if InsightsMetricsNamedPipe == nil {
-						Log("Error::mdsd::Unable to create mdsd client for insights metrics. Please check error log.")
+				if instance.InsightsMetricsNamedPipe == nil {
+					EnsureGenevaOr3PNamedPipeExists(&instance.InsightsMetricsNamedPipe, InsightsMetricsDataType, &InsightsMetricsWindowsAMAClientCreateErrors, false, &instance.MdsdInsightsMetricsTagRefreshTracker)
+					if instance.InsightsMetricsNamedPipe == nil {
+						logConnectionError(getAMACircuitBreaker(InsightsMetricsDataType), "Error::mdsd::Unable to create mdsd client for insights metrics. Please check error log.")
 						ContainerLogTelemetryMutex.Lock()
 						defer ContainerLogTelemetryMutex.Unlock()
 						InsightsMetricsWindowsAMAClientCreateErrors += 1
@@ -1111,18 +1082,19 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 					}
 				}
 				deadline := 10 * time.Second
-				InsightsMetricsNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-				bts, er = InsightsMetricsNamedPipe.Write(msgpBytes)
+				instance.InsightsMetricsNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+				bts, er = instance.InsightsMetricsNamedPipe.Write(msgpBytes)
+				recordConnectionResult(getAMACircuitBreaker(InsightsMetricsDataType), er)
 			}
 
 			elapsed = time.Since(start)
 
 			if er != nil {
-				Log("Error::mdsd::Failed to write to ama/mdsd %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
+				LogRateLimited("telegraf", "Error::mdsd::Failed to write to ama/mdsd %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
 				UpdateNumTelegrafMetricsSentTelemetry(0, 1, 0, 0)
-				if MdsdInsightsMetricsMsgpUnixSocketClient != nil {
-					MdsdInsightsMetricsMsgpUnixSocketClient.Close()
-					MdsdInsightsMetricsMsgpUnixSocketClient = nil
+				if instance.MdsdInsightsMetricsMsgpUnixSocketClient != nil {
+					instance.MdsdInsightsMetricsMsgpUnixSocketClient.Close()
+					instance.MdsdInsightsMetricsMsgpUnixSocketClient = nil
 				}
 
 				ContainerLogTelemetryMutex.Lock()
@@ -1132,7 +1104,12 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 			} else {
 				numTelegrafMetricsRecords := len(msgPackEntries)
 				UpdateNumTelegrafMetricsSentTelemetry(numTelegrafMetricsRecords, 0, 0, 0)
-				Log("Success::mdsd::Successfully flushed %d telegraf metrics records that was %d bytes to mdsd/ama in %s ", numTelegrafMetricsRecords, bts, elapsed)
+				if IsWindows {
+					observeDeliveryLatency(InsightsMetrics.String(), DeliverySinkAMA, recordTimes, time.Now())
+				} else {
+					observeDeliveryLatency(InsightsMetrics.String(), DeliverySinkMdsd, recordTimes, time.Now())
+				}
+				Log("Debug::mdsd::Successfully flushed %d telegraf metrics records that was %d bytes to mdsd/ama in %s ", numTelegrafMetricsRecords, bts, elapsed)
 			}
 		}
 
@@ -1160,6 +1137,11 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 			message := fmt.Sprintf("PostTelegrafMetricsToLA::Error:when marshalling json %q", err)
 			Log(message)
 			SendException(message)
+			if DeadLetterEnabled {
+				payload, skipped := odsDeadLetterPayload(InsightsMetricsDataType, metrics)
+				WriteDeadLetter(InsightsMetricsDataType, OMSEndpoint, DeadLetterReasonMarshalError, deadLetterMarshalDetail(err, skipped), getODSDeadLetterHeaders(), len(metrics)-skipped, payload)
+			}
+			recordDrop(DropReasonMarshalError, "", len(metrics), err.Error())
 			return output.FLB_OK
 		}
 
@@ -1199,6 +1181,10 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 			message := fmt.Sprintf("PostTelegrafMetricsToLA::Error:(retriable) when sending %v metrics. duration:%v err:%q \n", len(laMetrics), elapsed, err.Error())
 			Log(message)
 			UpdateNumTelegrafMetricsSentTelemetry(0, 1, 0, 0)
+			if retryOrDeadLetter(payloadRetryKey(jsonBytes), InsightsMetricsDataType, OMSEndpoint, err.Error(), getODSDeadLetterHeaders(), len(laMetrics), jsonBytes) {
+				recordDrop(DropReasonRetriesExhausted, "", len(laMetrics), err.Error())
+				return output.FLB_OK
+			}
 			return output.FLB_RETRY
 		}
 
@@ -1213,13 +1199,21 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 			if resp != nil && resp.StatusCode == 429 {
 				UpdateNumTelegrafMetricsSentTelemetry(0, 1, 1, 0)
 			}
+			if resp != nil && retryOrDeadLetter(payloadRetryKey(jsonBytes), InsightsMetricsDataType, OMSEndpoint, resp.Status, getODSDeadLetterHeaders(), len(laMetrics), jsonBytes) {
+				recordDrop(DropReasonRetriesExhausted, "", len(laMetrics), resp.Status)
+				return output.FLB_OK
+			}
 			return output.FLB_RETRY
 		} else if IsSuccessStatusCode(resp.StatusCode) {
+			clearDeadLetterRetries(payloadRetryKey(jsonBytes))
 			numMetrics := len(laMetrics)
 			UpdateNumTelegrafMetricsSentTelemetry(numMetrics, 0, 0, numWinMetricsWithTagsSize64KBorMore)
-			Log("PostTelegrafMetricsToLA::Info:Successfully flushed %v records in %v", numMetrics, elapsed)
+			observeDeliveryLatency(InsightsMetrics.String(), DeliverySinkODS, recordTimes, time.Now())
+			Log("Debug::PostTelegrafMetricsToLA::Successfully flushed %v records in %v", numMetrics, elapsed)
 		} else {
 			Log("PostTelegrafMetricsToLA::Error:Failed with non-retriable error::RequestId %s Status %s Status Code %d", reqID, resp.Status, resp.StatusCode)
+			WriteDeadLetter(InsightsMetricsDataType, OMSEndpoint, DeadLetterReasonNonRetriableStatus, resp.Status, getODSDeadLetterHeaders(), len(laMetrics), jsonBytes)
+			recordDrop(DropReasonNonRetriableStatus, "", len(laMetrics), resp.Status)
 		}
 	}
 
@@ -1235,13 +1229,13 @@ func UpdateNumTelegrafMetricsSentTelemetry(numMetricsSent int, numSendErrors int
 	ContainerLogTelemetryMutex.Unlock()
 }
 
-func processIncludes(kubernetesMetadataMap map[string]interface{}, includesList []string) map[string]interface{} {
+func processIncludes(kubernetesMetadataMap map[string]interface{}, includes *kubernetesMetadataIncludes) map[string]interface{} {
 	includedMetadata := make(map[string]interface{})
 
 	// pre process image related fields
 	var imageRepo, imageName, imageTag, imageID string
 	imageProcessed := false // Flag to check if image processing is required
-	for _, include := range includesList {
+	for _, include := range includes.Fields {
 		if include == "imageid" || include == "imagerepo" || include == "image" || include == "imagetag" {
 			imageProcessed = true
 			break
@@ -1257,7 +1251,7 @@ func processIncludes(kubernetesMetadataMap map[string]interface{}, includesList
 		}
 	}
 
-	for _, include := range includesList {
+	for _, include := range includes.Fields {
 		switch include {
 		case "poduid":
 			if val, ok := kubernetesMetadataMap["pod_id"]; ok {
@@ -1265,20 +1259,42 @@ func processIncludes(kubernetesMetadataMap map[string]interface{}, includesList
 			}
 		case "podlabels":
 			if val, ok := kubernetesMetadataMap["labels"]; ok {
-				includedMetadata["podLabels"] = val
+				if filteredLabels, ok := filterMetadataKeys(val, includes.LabelKeys, nil); ok {
+					includedMetadata["podLabels"] = filteredLabels
+				}
 			}
 		case "podannotations":
 			if val, ok := kubernetesMetadataMap["annotations"]; ok {
-				if annotationsMap, ok := val.(map[string]interface{}); ok {
-					filteredAnnotations := make(map[string]interface{})
-					for key, annotationValue := range annotationsMap {
-						if !strings.Contains(key, "kubernetes.io/config") {
-							filteredAnnotations[key] = annotationValue
-						}
-					}
+				if filteredAnnotations, ok := filterMetadataKeys(val, includes.AnnotationKeys, isKubeletConfigAnnotation); ok {
 					includedMetadata["podAnnotations"] = filteredAnnotations
 				}
 			}
+		case "namespacelabels":
+			if namespace, ok := kubernetesMetadataMap["namespace_name"].(string); ok && namespace != "" {
+				if labels := getNamespaceMetadata(namespace).Labels; len(labels) > 0 {
+					includedMetadata["namespaceLabels"], _ = filterMetadataKeys(labels, includes.LabelKeys, nil)
+				}
+			}
+		case "namespaceannotations":
+			if namespace, ok := kubernetesMetadataMap["namespace_name"].(string); ok && namespace != "" {
+				if annotations := getNamespaceMetadata(namespace).Annotations; len(annotations) > 0 {
+					includedMetadata["namespaceAnnotations"], _ = filterMetadataKeys(annotations, includes.AnnotationKeys, isKubeletConfigAnnotation)
+				}
+			}
+		case "nodename":
+			if host, ok := kubernetesMetadataMap["host"].(string); ok && host != "" {
+				includedMetadata["nodeName"] = host
+			}
+		case "nodelabels":
+			if host, ok := kubernetesMetadataMap["host"].(string); ok && host != "" {
+				if nodeLabels := selectNodeLabels(getNodeMetadata(host).Labels, includes.NodeLabelKeys); len(nodeLabels) > 0 {
+					includedMetadata["nodeLabels"] = nodeLabels
+				}
+			}
+		case "ownerreferences":
+			if owners := getOwnerReferences(kubernetesMetadataMap); len(owners) > 0 {
+				includedMetadata["ownerReferences"] = owners
+			}
 		case "imageid":
 			if imageID != "" {
 				includedMetadata["imageID"] = imageID
@@ -1393,23 +1409,30 @@ func toStringMap(record map[interface{}]interface{}) map[string]interface{} {
 	return mp
 }
 
-func PostInputPluginRecords(inputPluginRecords []map[interface{}]interface{}) int {
+func (instance *PluginInstance) PostInputPluginRecords(inputPluginRecords []map[interface{}]interface{}) int {
 	start := time.Now()
 	Log("Info::PostInputPluginRecords starting")
 
+	// index of the record being sent
+	current := 0
 	defer func() {
 		if r := recover(); r != nil {
 			stacktrace := debug.Stack()
 			Log("Error::PostInputPluginRecords Error processing cadvisor metrics records: %v, stacktrace: %v", r, stacktrace)
 			SendException(fmt.Sprintf("Error:PostInputPluginRecords: %v, stackTrace: %v", r, stacktrace))
+			// the records before the one that panicked were sent
+			writeInputPluginDeadLetters(inputPluginRecords[current:], fmt.Sprintf("%v", r))
+			recordDrop(DropReasonProcessingPanic, "", len(inputPluginRecords)-current, r)
 		}
 	}()
 
-	for _, record := range inputPluginRecords {
+	for i, record := range inputPluginRecords {
+		current = i
 		var msgPackEntries []MsgPackEntry
 		val := toStringMap(record)
 		tag := val["tag"].(string)
 		Log("Info::PostInputPluginRecords tag: %s\n", tag)
+		PipelineHealth.recordInputPluginRun(tag, time.Now())
 		messages := val["messages"].([]map[string]interface{})
 		if len(messages) == 0 {
 			continue
@@ -1434,50 +1457,57 @@ func PostInputPluginRecords(inputPluginRecords []map[interface{}]interface{}) in
 			//for linux, mdsd route
 			//for Windows with MSI auth mode, AMA route
 			Log("Info::mdsd/AMA:: using mdsdsource name for input plugin records: %s", tag)
+			validateRecords(inputPluginRecordSchema(tag), msgPackEntries)
+			RecordTee.Write(InputPluginRecords.String(), tag, msgPackEntries)
 			msgpBytes := convertMsgPackEntriesToMsgpBytes(tag, msgPackEntries)
 			if !IsWindows {
-				if MdsdInputPluginRecordsMsgpUnixSocketClient == nil {
-					Log("Error::mdsd::mdsd connection for input plugin records does not exist. re-connecting ...")
-					CreateMDSDClient(InputPluginRecords, ContainerType)
+				if instance.MdsdInputPluginRecordsMsgpUnixSocketClient == nil {
+					logConnectionError(getMdsdCircuitBreaker(InputPluginRecords), "Error::mdsd::mdsd connection for input plugin records does not exist. re-connecting ...")
+					CreateMDSDClient(&instance.MdsdInputPluginRecordsMsgpUnixSocketClient, InputPluginRecords, ContainerType)
 				}
-				if MdsdInputPluginRecordsMsgpUnixSocketClient == nil {
-					Log("Error::mdsd::Unable to create mdsd client for input plugin records. Please check error log.")
+				if instance.MdsdInputPluginRecordsMsgpUnixSocketClient == nil {
+					logConnectionError(getMdsdCircuitBreaker(InputPluginRecords), "Error::mdsd::Unable to create mdsd client for input plugin records. Please check error log.")
 					ContainerLogTelemetryMutex.Lock()
 					defer ContainerLogTelemetryMutex.Unlock()
 					InputPluginRecordsErrors += 1
+					recordDrop(DropReasonSendError, "", len(msgPackEntries), tag)
 				} else {
-					MdsdInputPluginRecordsMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-					bts, er = MdsdInputPluginRecordsMsgpUnixSocketClient.Write(msgpBytes)
+					instance.MdsdInputPluginRecordsMsgpUnixSocketClient.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+					bts, er = instance.MdsdInputPluginRecordsMsgpUnixSocketClient.Write(msgpBytes)
+					recordConnectionResult(getMdsdCircuitBreaker(InputPluginRecords), er)
 					elapsed = time.Since(start)
 				}
 			} else {
-				if InputPluginNamedPipe == nil {
-					EnsureGenevaOr3PNamedPipeExists(&InputPluginNamedPipe, ContainerInventoryDataType, &ContainerLogsWindowsAMAClientCreateErrors, false, &MdsdContainerLogTagRefreshTracker)
+				if instance.InputPluginNamedPipe == nil {
+					EnsureGenevaOr3PNamedPipeExists(&instance.InputPluginNamedPipe, ContainerInventoryDataType, &ContainerLogsWindowsAMAClientCreateErrors, false, &instance.MdsdContainerLogTagRefreshTracker)
 				}
-				if InputPluginNamedPipe == nil {
-					Log("Error::mdsd::Unable to create AMA client for input plugin records. Please check error log.")
+				if instance.InputPluginNamedPipe == nil {
+					logConnectionError(getAMACircuitBreaker(ContainerInventoryDataType), "Error::mdsd::Unable to create AMA client for input plugin records. Please check error log.")
 					ContainerLogTelemetryMutex.Lock()
 					defer ContainerLogTelemetryMutex.Unlock()
 					InputPluginRecordsErrors += 1
+					recordDrop(DropReasonSendError, "", len(msgPackEntries), tag)
 				} else {
-					InputPluginNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
-					bts, er = InputPluginNamedPipe.Write(msgpBytes)
+					instance.InputPluginNamedPipe.SetWriteDeadline(time.Now().Add(deadline)) //this is based of clock time, so cannot reuse
+					bts, er = instance.InputPluginNamedPipe.Write(msgpBytes)
+					recordConnectionResult(getAMACircuitBreaker(ContainerInventoryDataType), er)
 					elapsed = time.Since(start)
 				}
 			}
 
 			if er != nil {
 				message := fmt.Sprintf("Error::mdsd/AMA::Failed to write to input plugin %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
-				Log(message)
-				if MdsdInputPluginRecordsMsgpUnixSocketClient != nil {
-					MdsdInputPluginRecordsMsgpUnixSocketClient.Close()
-					MdsdInputPluginRecordsMsgpUnixSocketClient = nil
+				LogRateLimited("inputplugin", "%s", message)
+				if instance.MdsdInputPluginRecordsMsgpUnixSocketClient != nil {
+					instance.MdsdInputPluginRecordsMsgpUnixSocketClient.Close()
+					instance.MdsdInputPluginRecordsMsgpUnixSocketClient = nil
 				}
-				if InputPluginNamedPipe != nil {
-					InputPluginNamedPipe.Close()
-					InputPluginNamedPipe = nil
+				if instance.InputPluginNamedPipe != nil {
+					instance.InputPluginNamedPipe.Close()
+					instance.InputPluginNamedPipe = nil
 				}
 				SendException(message)
+				recordDrop(DropReasonSendError, "", len(msgPackEntries), er.Error())
 			} else {
 				telemetryDimensions := make(map[string]string)
 				lowerTag := strings.ToLower(tag)
@@ -1491,7 +1521,7 @@ func PostInputPluginRecords(inputPluginRecords []map[interface{}]interface{}) in
 					Log("FlushInputPluginRecords::Warn::Flushed records of unknown data type %s", lowerTag)
 				}
 				numRecords := len(msgPackEntries)
-				Log("FlushInputPluginRecords::Info::Successfully flushed %d records that was %d bytes in %s", numRecords, bts, elapsed)
+				Log("Debug::FlushInputPluginRecords::Successfully flushed %d records that was %d bytes in %s", numRecords, bts, elapsed)
 				// Send telemetry to AppInsights resource
 				SendEvent(InputPluginRecordsFlushedEvent, telemetryDimensions)
 			}
@@ -1502,7 +1532,7 @@ func PostInputPluginRecords(inputPluginRecords []map[interface{}]interface{}) in
 }
 
 // PostDataHelper sends data to the ODS endpoint or oneagent or ADX
-func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
+func (instance *PluginInstance) PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 	start := time.Now()
 	var dataItemsLAv1 []DataItemLAv1
 	var dataItemsLAv2 []DataItemLAv2
@@ -1514,30 +1544,91 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 	var maxLatency float64
 	var maxLatencyContainer string
 
-	imageIDMap := make(map[string]string)
-	nameIDMap := make(map[string]string)
+	containerLogSchemaV2, containerLogSchemaFixed := instance.containerLogSchema()
 
-	DataUpdateMutex.Lock()
+	imageNameMaps := ContainerImageNameMaps.Load()
+	// records per namespace in the batch, to account drops of the whole batch
+	namespaceRecordCounts := make(map[string]int)
+	// original time of the records in the batch for the delivery latency
+	var recordTimes []time.Time
 
-	for k, v := range ImageIDMap {
-		imageIDMap[k] = v
-	}
-	for k, v := range NameIDMap {
-		nameIDMap[k] = v
-	}
-	DataUpdateMutex.Unlock()
+	// the service modes take the computer from the record
+	computer := Computer
+	var flushedRecordsSize, flushedMetadataSize float64
+	filters := getLogCollectionFilters()
+	metadataIncludes := getKubernetesMetadataIncludes()
+	// the filtered records are accounted once the flush returns
+	drops := newFlushDrops()
+	defer drops.account()
 
 	for _, record := range tailPluginRecords {
 		containerID, k8sNamespace, k8sPodName, containerName := GetContainerIDK8sNamespacePodNameFromFileName(ToString(record["filepath"]))
 		logEntrySource := ToString(record["stream"])
+		// pods with an unexpired verbose collection annotation bypass the namespace exclusion and system resource filters
+		verboseCollection := hasVerboseCollectionOverride(k8sNamespace, k8sPodName)
+		if strings.EqualFold(logEntrySource, "stdout") {
+			if containerID == "" {
+				drops.add(DropReasonMissingContainerId, k8sNamespace, record)
+				continue
+			}
+			if !filters.CollectStdoutLogs {
+				drops.add(DropReasonStreamDisabled, k8sNamespace, record)
+				continue
+			}
+			if !verboseCollection && containsKey(filters.StdoutIgnoreNsSet, k8sNamespace) {
+				drops.add(DropReasonExcludedNamespace, k8sNamespace, record)
+				continue
+			}
+			if !verboseCollection && len(filters.StdoutIncludeSystemNamespaceSet) > 0 && containsKey(filters.StdoutIncludeSystemNamespaceSet, k8sNamespace) {
+				if len(filters.StdoutIncludeSystemResourceSet) != 0 {
+					candidate1, candidate2 := GetControllerNameFromK8sPodName(k8sPodName)
+					if !containsKey(filters.StdoutIncludeSystemResourceSet, k8sNamespace+":"+candidate1) && !containsKey(filters.StdoutIncludeSystemResourceSet, k8sNamespace+":"+candidate2) {
+						drops.add(DropReasonSystemResourceNotIncluded, k8sNamespace, record)
+						continue
+					}
+				}
+			}
+		} else if strings.EqualFold(logEntrySource, "stderr") {
+			if containerID == "" {
+				drops.add(DropReasonMissingContainerId, k8sNamespace, record)
+				continue
+			}
+			if !filters.CollectStderrLogs {
+				drops.add(DropReasonStreamDisabled, k8sNamespace, record)
+				continue
+			}
+			if !verboseCollection && containsKey(filters.StderrIgnoreNsSet, k8sNamespace) {
+				drops.add(DropReasonExcludedNamespace, k8sNamespace, record)
+				continue
+			}
+			if !verboseCollection && len(filters.StderrIncludeSystemNamespaceSet) > 0 && containsKey(filters.StderrIncludeSystemNamespaceSet, k8sNamespace) {
+				if len(filters.StderrIncludeSystemResourceSet) != 0 {
+					candidate1, candidate2 := GetControllerNameFromK8sPodName(k8sPodName)
+					if !containsKey(filters.StderrIncludeSystemResourceSet, k8sNamespace+":"+candidate1) && !containsKey(filters.StderrIncludeSystemResourceSet, k8sNamespace+":"+candidate2) {
+						drops.add(DropReasonSystemResourceNotIncluded, k8sNamespace, record)
+						continue
+					}
+				}
+			}
+		}
+
+		// near the resource limits the low priority namespaces are sampled, pods with a verbose collection override are kept
+		if !verboseCollection && !ResourceThrottling.sample(k8sNamespace) {
+			drops.add(DropReasonResourceThrottled, k8sNamespace, record)
+			continue
+		}
+
+		// the records are enriched once they passed the filters, the enrichment is paused while the plugin throttles
+		// itself near its resource limits
 		kubernetesMetadata := ""
-		if KubernetesMetadataEnabled {
+		enrich := !ResourceThrottling.enrichmentPaused()
+		if KubernetesMetadataEnabled && enrich {
 			if kubernetesMetadataJson, exists := record["kubernetes"]; exists {
 				kubernetesMetadataMap, err := convertKubernetesMetadata(kubernetesMetadataJson)
 				if err != nil {
 					Log(fmt.Sprintf("Error convertKubernetesMetadata: %v", err))
 				}
-				includedMetadata := processIncludes(kubernetesMetadataMap, KubernetesMetadataIncludeList)
+				includedMetadata := processIncludes(kubernetesMetadataMap, metadataIncludes)
 				kubernetesMetadataBytes, err := json.Marshal(includedMetadata)
 				if err != nil {
 					message := fmt.Sprintf("Error while Marshalling kubernetesMetadataBytes to json bytes: %s", err.Error())
@@ -1552,32 +1643,6 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			}
 		}
 
-		if strings.EqualFold(logEntrySource, "stdout") {
-			if containerID == "" || containsKey(StdoutIgnoreNsSet, k8sNamespace) {
-				continue
-			}
-			if len(StdoutIncludeSystemNamespaceSet) > 0 && containsKey(StdoutIncludeSystemNamespaceSet, k8sNamespace) {
-				if len(StdoutIncludeSystemResourceSet) != 0 {
-					candidate1, candidate2 := GetControllerNameFromK8sPodName(k8sPodName)
-					if !containsKey(StdoutIncludeSystemResourceSet, k8sNamespace+":"+candidate1) && !containsKey(StdoutIncludeSystemResourceSet, k8sNamespace+":"+candidate2) {
-						continue
-					}
-				}
-			}
-		} else if strings.EqualFold(logEntrySource, "stderr") {
-			if containerID == "" || containsKey(StderrIgnoreNsSet, k8sNamespace) {
-				continue
-			}
-			if len(StderrIncludeSystemNamespaceSet) > 0 && containsKey(StderrIncludeSystemNamespaceSet, k8sNamespace) {
-				if len(StderrIncludeSystemResourceSet) != 0 {
-					candidate1, candidate2 := GetControllerNameFromK8sPodName(k8sPodName)
-					if !containsKey(StderrIncludeSystemResourceSet, k8sNamespace+":"+candidate1) && !containsKey(StderrIncludeSystemResourceSet, k8sNamespace+":"+candidate2) {
-						continue
-					}
-				}
-			}
-		}
-
 		stringMap = make(map[string]string)
 		//below id & name are used by latency telemetry in both v1 & v2 LA schemas
 		id := ""
@@ -1585,36 +1650,36 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 		if IsGenevaLogsTelemetryServiceMode == true {
 			//Incase of GenevaLogs Service mode, use the source Computer name from which log line originated
 			// And the ClusterResourceId in the receiving record
-			Computer = ToString(record["Computer"])
+			computer = ToString(record["Computer"])
 			stringMap["AzureResourceId"] = ToString(record["AzureResourceId"])
 		} else if IsGenevaLogsIntegrationEnabled == true {
 			stringMap["AzureResourceId"] = ResourceID
 		} else if IsAzMonMultitenancyLogsServiceMode {
-			Computer = ToString(record["Computer"])
+			computer = ToString(record["Computer"])
 		}
 
 		logEntry := ToString(record["log"])
 		logEntryTimeStamp := ToString(record["time"])
 
-		if !ContainerLogV2ConfigMap && IsAADMSIAuthMode == true && !IsGenevaLogsIntegrationEnabled {
-			if !IsWindows && MdsdMsgpUnixSocketClient == nil {
-				Log("Error::mdsd::mdsd connection does not exist. re-connecting ...")
-				CreateMDSDClient(ContainerLogV2, ContainerType)
-				if MdsdMsgpUnixSocketClient == nil {
-					Log("Error::mdsd::Unable to create mdsd client. Please check error log.")
+		if !containerLogSchemaFixed && IsAADMSIAuthMode == true && !IsGenevaLogsIntegrationEnabled {
+			if !IsWindows && instance.MdsdMsgpUnixSocketClient == nil {
+				logConnectionError(getMdsdCircuitBreaker(ContainerLogV2), "Error::mdsd::mdsd connection does not exist. re-connecting ...")
+				CreateMDSDClient(&instance.MdsdMsgpUnixSocketClient, ContainerLogV2, ContainerType)
+				if instance.MdsdMsgpUnixSocketClient == nil {
+					logConnectionError(getMdsdCircuitBreaker(ContainerLogV2), "Error::mdsd::Unable to create mdsd client. Please check error log.")
 					ContainerLogTelemetryMutex.Lock()
 					defer ContainerLogTelemetryMutex.Unlock()
 					ContainerLogsMDSDClientCreateErrors += 1
 					return output.FLB_RETRY
 				}
 			}
-			useFromCache := checkIfUseFromCache(&MdsdContainerLogTagRefreshTracker)
-			ContainerLogSchemaV2 = extension.GetInstance(FLBLogger, ContainerType).IsContainerLogV2(useFromCache)
+			useFromCache := checkIfUseFromCache(&instance.MdsdContainerLogTagRefreshTracker)
+			containerLogSchemaV2 = extension.GetInstance(FLBLogger, ContainerType).IsContainerLogV2(useFromCache)
 		}
 
 		//ADX Schema & LAv2 schema are almost the same (except resourceId)
-		if ContainerLogSchemaV2 == true {
-			stringMap["Computer"] = Computer
+		if containerLogSchemaV2 == true {
+			stringMap["Computer"] = computer
 			stringMap["ContainerId"] = containerID
 			stringMap["ContainerName"] = containerName
 			stringMap["PodName"] = k8sPodName
@@ -1623,8 +1688,15 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			stringMap["LogSource"] = logEntrySource
 			stringMap["TimeGenerated"] = logEntryTimeStamp
 			stringMap["KubernetesMetadata"] = kubernetesMetadata
+			if TraceContextExtractionEnabled && enrich {
+				if traceContext, ok := extractTraceContext(logEntry); ok {
+					stringMap["TraceId"] = traceContext.TraceId
+					stringMap["SpanId"] = traceContext.SpanId
+					stringMap["TraceFlags"] = traceContext.TraceFlags
+				}
+			}
 		} else if ContainerLogsRouteADX == true {
-			stringMap["Computer"] = Computer
+			stringMap["Computer"] = computer
 			stringMap["ContainerId"] = containerID
 			stringMap["ContainerName"] = containerName
 			stringMap["PodName"] = k8sPodName
@@ -1639,27 +1711,30 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			stringMap["SourceSystem"] = "Containers"
 			stringMap["Id"] = containerID
 
-			if val, ok := imageIDMap[containerID]; ok {
-				stringMap["Image"] = val
-			}
+			if imageNameMaps != nil {
+				if val, ok := imageNameMaps.ImageIDMap[containerID]; ok {
+					stringMap["Image"] = val
+				}
 
-			if val, ok := nameIDMap[containerID]; ok {
-				stringMap["Name"] = val
+				if val, ok := imageNameMaps.NameIDMap[containerID]; ok {
+					stringMap["Name"] = val
+				}
 			}
 
 			stringMap["TimeOfCommand"] = start.Format(time.RFC3339)
-			stringMap["Computer"] = Computer
+			stringMap["Computer"] = computer
 		}
 		var dataItemLAv1 DataItemLAv1
 		var dataItemLAv2 DataItemLAv2
 		var msgPackEntry MsgPackEntry
+		namespaceRecordCounts[k8sNamespace]++
 
-		FlushedRecordsSize += float64(len(stringMap["LogEntry"]))
+		flushedRecordsSize += float64(len(stringMap["LogEntry"]))
 		if KubernetesMetadataEnabled {
-			FlushedMetadataSize += float64(len(stringMap["KubernetesMetadata"]))
+			flushedMetadataSize += float64(len(stringMap["KubernetesMetadata"]))
 		}
 
-		if ContainerLogsRouteV2 == true {
+		if instance.ContainerLogsRouteV2 == true {
 			msgPackEntry = MsgPackEntry{
 				// this below time is what mdsd uses in its buffer/expiry calculations. better to be as close to flushtime as possible, so its filled just before flushing for each entry
 				//Time: start.Unix(),
@@ -1668,7 +1743,7 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			}
 			msgPackEntries = append(msgPackEntries, msgPackEntry)
 		} else {
-			if ContainerLogSchemaV2 == true {
+			if containerLogSchemaV2 == true {
 				dataItemLAv2 = DataItemLAv2{
 					TimeGenerated:      stringMap["TimeGenerated"],
 					Computer:           stringMap["Computer"],
@@ -1679,6 +1754,9 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 					LogMessage:         stringMap["LogMessage"],
 					LogSource:          stringMap["LogSource"],
 					KubernetesMetadata: stringMap["KubernetesMetadata"],
+					TraceId:            stringMap["TraceId"],
+					SpanId:             stringMap["SpanId"],
+					TraceFlags:         stringMap["TraceFlags"],
 				}
 				//ODS-v2 schema
 				dataItemsLAv2 = append(dataItemsLAv2, dataItemLAv2)
@@ -1703,6 +1781,7 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			}
 		}
 
+		recordTime, hasRecordTime := record[fluentBitTimeKey].(time.Time)
 		if logEntryTimeStamp != "" {
 			loggedTime, e := time.Parse(time.RFC3339, logEntryTimeStamp)
 			if e != nil {
@@ -1710,6 +1789,7 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 				Log(message)
 				SendException(message)
 			} else {
+				recordTime, hasRecordTime = loggedTime, true
 				ltncy := float64(start.Sub(loggedTime) / time.Millisecond)
 				if ltncy >= maxLatency {
 					maxLatency = ltncy
@@ -1721,45 +1801,61 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			ContainerLogRecordCountWithEmptyTimeStamp += 1
 			ContainerLogTelemetryMutex.Unlock()
 		}
+		if hasRecordTime {
+			recordTimes = append(recordTimes, recordTime)
+		}
+	}
+
+	latencyDataType := "ContainerLog"
+	if containerLogSchemaV2 == true {
+		latencyDataType = "ContainerLogV2"
 	}
 
+	ContainerLogTelemetryMutex.Lock()
+	FlushedRecordsSize += flushedRecordsSize
+	FlushedMetadataSize += flushedMetadataSize
+	ContainerLogTelemetryMutex.Unlock()
+
 	numContainerLogRecords := 0
 
-	if ContainerLogSchemaV2 == true {
-		MdsdContainerLogTagName = MdsdContainerLogV2SourceName
+	if containerLogSchemaV2 == true {
+		instance.MdsdContainerLogTagName = MdsdContainerLogV2SourceName
 	} else {
-		MdsdContainerLogTagName = MdsdContainerLogSourceName
+		instance.MdsdContainerLogTagName = MdsdContainerLogSourceName
 	}
 
-	if len(msgPackEntries) > 0 && ContainerLogsRouteV2 == true {
+	if len(msgPackEntries) > 0 && instance.ContainerLogsRouteV2 == true {
 		//flush to mdsd
 		if IsAADMSIAuthMode == true && !IsGenevaLogsIntegrationEnabled {
 			containerlogDataType := ContainerLogDataType
-			if ContainerLogSchemaV2 == true {
+			if containerLogSchemaV2 == true {
 				containerlogDataType = ContainerLogV2DataType
 			}
-			MdsdContainerLogTagName = getOutputStreamIdTag(containerlogDataType, MdsdContainerLogTagName, &MdsdContainerLogTagRefreshTracker)
-			if MdsdContainerLogTagName == "" {
+			instance.MdsdContainerLogTagName = getOutputStreamIdTag(containerlogDataType, instance.MdsdContainerLogTagName, &instance.MdsdContainerLogTagRefreshTracker)
+			if instance.MdsdContainerLogTagName == "" {
 				Log("Warn::mdsd::skipping Microsoft-ContainerLog or Microsoft-ContainerLogV2 or Microsoft-ContainerLogV2-HighScale stream since its opted out")
+				// not a drop, the chunk is retried until the DCR of the stream is refreshed and fluent-bit accounts
+				// the chunks it discards after its retry limit
 				return output.FLB_RETRY
 			}
 		}
 
 		if IsWindows {
 			var datatype string
-			if ContainerLogSchemaV2 {
+			if containerLogSchemaV2 {
 				datatype = ContainerLogV2DataType
 			} else {
 				datatype = ContainerLogDataType
 			}
-			if EnsureGenevaOr3PNamedPipeExists(&ContainerLogNamedPipe, datatype, &ContainerLogsWindowsAMAClientCreateErrors, IsGenevaLogsIntegrationEnabled, &MdsdContainerLogTagRefreshTracker) {
+			if EnsureGenevaOr3PNamedPipeExists(&instance.ContainerLogNamedPipe, datatype, &ContainerLogsWindowsAMAClientCreateErrors, IsGenevaLogsIntegrationEnabled, &instance.MdsdContainerLogTagRefreshTracker) {
 				Log("Info::AMA::Starting to write container logs to named pipe")
-				n, err := writeMsgPackEntries(ContainerLogNamedPipe, ContainerLogSchemaV2, MdsdContainerLogTagName, msgPackEntries)
+				n, err := instance.writeMsgPackEntries(instance.ContainerLogNamedPipe, containerLogSchemaV2, instance.MdsdContainerLogTagName, msgPackEntries)
+				recordConnectionResult(getAMACircuitBreaker(datatype), err)
 				if err != nil {
-					Log("Error::AMA::Failed to write to AMA %d records. Will retry ... error : %s", len(msgPackEntries), err.Error())
-					if ContainerLogNamedPipe != nil {
-						ContainerLogNamedPipe.Close()
-						ContainerLogNamedPipe = nil
+					LogRateLimited("containerlog.ama", "Error::AMA::Failed to write to AMA %d records. Will retry ... error : %s", len(msgPackEntries), err.Error())
+					if instance.ContainerLogNamedPipe != nil {
+						instance.ContainerLogNamedPipe.Close()
+						instance.ContainerLogNamedPipe = nil
 					}
 					ContainerLogTelemetryMutex.Lock()
 					defer ContainerLogTelemetryMutex.Unlock()
@@ -1767,17 +1863,18 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 					return output.FLB_RETRY
 				} else {
 					numContainerLogRecords = len(msgPackEntries)
-					Log("Success::AMA::Successfully flushed %d container log records that was %d bytes to AMA ", numContainerLogRecords, n)
+					observeDeliveryLatency(latencyDataType, DeliverySinkAMA, recordTimes, time.Now())
+					Log("Debug::AMA::Successfully flushed %d container log records that was %d bytes to AMA ", numContainerLogRecords, n)
 				}
 			} else {
 				return output.FLB_RETRY
 			}
 		} else {
-			if MdsdMsgpUnixSocketClient == nil {
-				Log("Error::mdsd::mdsd connection does not exist. re-connecting ...")
-				CreateMDSDClient(ContainerLogV2, ContainerType)
-				if MdsdMsgpUnixSocketClient == nil {
-					Log("Error::mdsd::Unable to create mdsd client. Please check error log.")
+			if instance.MdsdMsgpUnixSocketClient == nil {
+				logConnectionError(getMdsdCircuitBreaker(ContainerLogV2), "Error::mdsd::mdsd connection does not exist. re-connecting ...")
+				CreateMDSDClient(&instance.MdsdMsgpUnixSocketClient, ContainerLogV2, ContainerType)
+				if instance.MdsdMsgpUnixSocketClient == nil {
+					logConnectionError(getMdsdCircuitBreaker(ContainerLogV2), "Error::mdsd::Unable to create mdsd client. Please check error log.")
 
 					ContainerLogTelemetryMutex.Lock()
 					defer ContainerLogTelemetryMutex.Unlock()
@@ -1787,14 +1884,15 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 				}
 			}
 
-			bts, er := writeMsgPackEntries(MdsdMsgpUnixSocketClient, ContainerLogSchemaV2, MdsdContainerLogTagName, msgPackEntries)
+			bts, er := instance.writeMsgPackEntries(instance.MdsdMsgpUnixSocketClient, containerLogSchemaV2, instance.MdsdContainerLogTagName, msgPackEntries)
+			recordConnectionResult(getMdsdCircuitBreaker(ContainerLogV2), er)
 			elapsed = time.Since(start)
 
 			if er != nil {
-				Log("Error::mdsd::Failed to write to mdsd %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
-				if MdsdMsgpUnixSocketClient != nil {
-					MdsdMsgpUnixSocketClient.Close()
-					MdsdMsgpUnixSocketClient = nil
+				LogRateLimited("containerlog.mdsd", "Error::mdsd::Failed to write to mdsd %d records after %s. Will retry ... error : %s", len(msgPackEntries), elapsed, er.Error())
+				if instance.MdsdMsgpUnixSocketClient != nil {
+					instance.MdsdMsgpUnixSocketClient.Close()
+					instance.MdsdMsgpUnixSocketClient = nil
 				}
 
 				ContainerLogTelemetryMutex.Lock()
@@ -1804,15 +1902,16 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 				return output.FLB_RETRY
 			} else {
 				numContainerLogRecords = len(msgPackEntries)
-				Log("Success::mdsd::Successfully flushed %d container log records that was %d bytes to mdsd in %s ", numContainerLogRecords, bts, elapsed)
+				observeDeliveryLatency(latencyDataType, DeliverySinkMdsd, recordTimes, time.Now())
+				Log("Debug::mdsd::Successfully flushed %d container log records that was %d bytes to mdsd in %s ", numContainerLogRecords, bts, elapsed)
 			}
 		}
-	} else if (ContainerLogSchemaV2 == true && len(dataItemsLAv2) > 0) || len(dataItemsLAv1) > 0 { //ODS
+	} else if (containerLogSchemaV2 == true && len(dataItemsLAv2) > 0) || len(dataItemsLAv1) > 0 { //ODS
 		var logEntry interface{}
 		recordType := ""
 		loglinesCount := 0
 		//schema v2
-		if len(dataItemsLAv2) > 0 && ContainerLogSchemaV2 == true {
+		if len(dataItemsLAv2) > 0 && containerLogSchemaV2 == true {
 			logEntry = ContainerLogBlobLAv2{
 				DataType:  ContainerLogV2DataType,
 				IPName:    IPName,
@@ -1833,10 +1932,30 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 
 		marshalled, err := json.Marshal(logEntry)
 		//Log("LogEntry::e %s", marshalled)
+		// the retries of the chunk are counted by its records, the ContainerLog payload differs between the flushes
+		var retryKey deadLetterRetryKey
+		if DeadLetterEnabled && DeadLetterMaxRetries > 0 {
+			if recordType == "ContainerLog" {
+				retryKey = containerLogRetryKey(dataItemsLAv1)
+			} else {
+				retryKey = payloadRetryKey(marshalled)
+			}
+		}
 		if err != nil {
 			message := fmt.Sprintf("Error while Marshalling log Entry: %s", err.Error())
 			Log(message)
 			SendException(message)
+			if DeadLetterEnabled {
+				var payload []byte
+				var skipped int
+				if recordType == "ContainerLogV2" {
+					payload, skipped = odsDeadLetterPayload(ContainerLogV2DataType, dataItemsLAv2)
+				} else {
+					payload, skipped = odsDeadLetterPayload(ContainerLogDataType, dataItemsLAv1)
+				}
+				WriteDeadLetter(recordType, OMSEndpoint, DeadLetterReasonMarshalError, deadLetterMarshalDetail(err, skipped), getODSDeadLetterHeaders(), loglinesCount-skipped, payload)
+			}
+			recordBatchDrop(DropReasonMarshalError, namespaceRecordCounts, err.Error())
 			return output.FLB_OK
 		}
 
@@ -1861,6 +1980,10 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 
 			Log("Failed to flush %d records after %s", loglinesCount, elapsed)
 
+			if retryOrDeadLetter(retryKey, recordType, OMSEndpoint, err.Error(), getODSDeadLetterHeaders(), loglinesCount, marshalled) {
+				recordBatchDrop(DropReasonRetriesExhausted, namespaceRecordCounts, err.Error())
+				return output.FLB_OK
+			}
 			return output.FLB_RETRY
 		}
 
@@ -1871,13 +1994,21 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 		if resp == nil || IsRetriableError(resp.StatusCode) {
 			if resp != nil {
 				Log("PostDataHelper::Warn::Failed with retriable error code hence retrying .RequestId %s Status %s Status Code %d", reqId, resp.Status, resp.StatusCode)
+				if retryOrDeadLetter(retryKey, recordType, OMSEndpoint, resp.Status, getODSDeadLetterHeaders(), loglinesCount, marshalled) {
+					recordBatchDrop(DropReasonRetriesExhausted, namespaceRecordCounts, resp.Status)
+					return output.FLB_OK
+				}
 			}
 			return output.FLB_RETRY
 		} else if IsSuccessStatusCode(resp.StatusCode) {
+			clearDeadLetterRetries(retryKey)
 			numContainerLogRecords = loglinesCount
-			Log("PostDataHelper::Info::Successfully flushed %d %s records to ODS in %s", numContainerLogRecords, recordType, elapsed)
+			observeDeliveryLatency(recordType, DeliverySinkODS, recordTimes, time.Now())
+			Log("Debug::PostDataHelper::Successfully flushed %d %s records to ODS in %s", numContainerLogRecords, recordType, elapsed)
 		} else {
 			Log("PostDataHelper::Error:: Failed with non-retriable error::RequestId %s Status %s Status Code %d", reqId, resp.Status, resp.StatusCode)
+			WriteDeadLetter(recordType, OMSEndpoint, DeadLetterReasonNonRetriableStatus, resp.Status, getODSDeadLetterHeaders(), loglinesCount, marshalled)
+			recordBatchDrop(DropReasonNonRetriableStatus, namespaceRecordCounts, resp.Status)
 		}
 	}
 
@@ -1902,21 +2033,29 @@ func containsKey(currentMap map[string]bool, key string) bool {
 	return c
 }
 
-func writeMsgPackEntriesToNamedPipeConnection(streamTag string, msgPackEntries []MsgPackEntry, streamIdNamedPipeMap map[string]string) (int, error) {
+func (instance *PluginInstance) writeMsgPackEntriesToNamedPipeConnection(streamTag string, msgPackEntries []MsgPackEntry, streamIdNamedPipeMap map[string]string) (int, error) {
 	var bts int
 	var er error
 	namedPipe, ok := streamIdNamedPipeMap[streamTag]
 	if !ok {
 		return 0, fmt.Errorf("Error::ama:: namedPipe is empty for streamId: %s \n", streamTag)
 	}
-	namedPipeConn, ok := NamedPipeConnectionCache[namedPipe]
+	if instance.NamedPipeConnectionCache == nil {
+		instance.NamedPipeConnectionCache = make(map[string]net.Conn)
+	}
+	namedPipeConn, ok := instance.NamedPipeConnectionCache[namedPipe]
 	if !ok || namedPipeConn == nil {
+		cb := getAMACircuitBreaker(namedPipe)
+		if !cb.Allow() {
+			return 0, fmt.Errorf("Error::ama:: circuit breaker for namedPipe %s is open", namedPipe)
+		}
 		err := CreateWindowsNamedPipeClient(namedPipe, &namedPipeConn)
+		recordConnectionResult(cb, err)
 		if err != nil {
 			Log("Error::ama:: failed to create namedpipe client for streamId: %s \n", streamTag)
 			return 0, err
 		}
-		NamedPipeConnectionCache[namedPipe] = namedPipeConn
+		instance.NamedPipeConnectionCache[namedPipe] = namedPipeConn
 	}
 	msgpBytes := convertMsgPackEntriesToMsgpBytes(streamTag, msgPackEntries)
 	bts, er = namedPipeConn.Write(msgpBytes)
@@ -1925,34 +2064,41 @@ func writeMsgPackEntriesToNamedPipeConnection(streamTag string, msgPackEntries [
 		if namedPipeConn != nil {
 			namedPipeConn.Close()
 			namedPipeConn = nil
-			delete(NamedPipeConnectionCache, namedPipe)
+			delete(instance.NamedPipeConnectionCache, namedPipe)
 		}
 	}
 	// clear the cache if its cachesize limit is reached
-	if len(NamedPipeConnectionCache) >= NamedPipeConnectionCacheSize {
-		for np, conn := range NamedPipeConnectionCache {
+	if len(instance.NamedPipeConnectionCache) >= NamedPipeConnectionCacheSize {
+		for np, conn := range instance.NamedPipeConnectionCache {
 			if conn != nil {
 				conn.Close()
 			}
-			delete(NamedPipeConnectionCache, np)
+			delete(instance.NamedPipeConnectionCache, np)
 		}
 	}
 
 	return bts, er
 }
 
-func writeMsgPackEntries(connection net.Conn, isContainerLogV2Schema bool, fluentForwardTag string, msgPackEntries []MsgPackEntry) (totalBytes int, err error) {
+func (instance *PluginInstance) writeMsgPackEntries(connection net.Conn, isContainerLogV2Schema bool, fluentForwardTag string, msgPackEntries []MsgPackEntry) (totalBytes int, err error) {
 	var bts int
 	var er error
+	dataType := "ContainerLog"
+	if isContainerLogV2Schema {
+		dataType = "ContainerLogV2"
+		validateRecords(ContainerLogV2Schema, msgPackEntries)
+	}
 	if (IsAzMonMultiTenancyLogCollectionEnabled || IsAzMonMultitenancyLogsServiceMode) && isContainerLogV2Schema && !IsGenevaLogsIntegrationEnabled {
 		namespaceStreamIdsMap, streamIdNamedPipeMap := getContainerLogV2ExtensionMaps()
 		if len(namespaceStreamIdsMap) > 0 {
-			MultitenantNamespaceCount = len(namespaceStreamIdsMap)
 			streamTagCount := 0
 			for _, streamTags := range namespaceStreamIdsMap {
 				streamTagCount += len(streamTags)
 			}
+			ContainerLogTelemetryMutex.Lock()
+			MultitenantNamespaceCount = len(namespaceStreamIdsMap)
 			ContainerLogV2ExtensionDCRCount = streamTagCount
+			ContainerLogTelemetryMutex.Unlock()
 			msgPackEntriesByNamespace := getMsgPackEntriesByNamespace(msgPackEntries)
 			totalBytes := 0
 			for namespace, entries := range msgPackEntriesByNamespace {
@@ -1960,13 +2106,11 @@ func writeMsgPackEntries(connection net.Conn, isContainerLogV2Schema bool, fluen
 					msg := fmt.Sprintf("Info::ama:: namespace : %s streamTags: %s \n", namespace, strings.Join(streamTags, ", "))
 					Log(msg)
 					for _, streamTag := range streamTags {
+						RecordTee.Write(dataType, streamTag, entries)
 						if IsWindows {
-							bts, er = writeMsgPackEntriesToNamedPipeConnection(streamTag, entries, streamIdNamedPipeMap)
+							bts, er = instance.writeMsgPackEntriesToNamedPipeConnection(streamTag, entries, streamIdNamedPipeMap)
 						} else {
-							msgpBytes := convertMsgPackEntriesToMsgpBytes(streamTag, entries)
-							deadline := 10 * time.Second
-							connection.SetWriteDeadline(time.Now().Add(deadline))
-							bts, er = connection.Write(msgpBytes)
+							bts, er = writeMsgpBatches(connection, streamTag, entries)
 						}
 						if er != nil {
 							return bts, er
@@ -1975,10 +2119,8 @@ func writeMsgPackEntries(connection net.Conn, isContainerLogV2Schema bool, fluen
 					}
 				} else {
 					Log("Info::ama:: streamTag is empty for namespace: %s hence using default workspace stream id: %s \n", namespace, fluentForwardTag)
-					msgpBytes := convertMsgPackEntriesToMsgpBytes(fluentForwardTag, entries)
-					deadline := 10 * time.Second
-					connection.SetWriteDeadline(time.Now().Add(deadline))
-					bts, er = connection.Write(msgpBytes)
+					RecordTee.Write(dataType, fluentForwardTag, entries)
+					bts, er = writeMsgpBatches(connection, fluentForwardTag, entries)
 					if er != nil {
 						return bts, er
 					}
@@ -1987,19 +2129,15 @@ func writeMsgPackEntries(connection net.Conn, isContainerLogV2Schema bool, fluen
 			}
 			bts = totalBytes
 		} else {
-			msgpBytes := convertMsgPackEntriesToMsgpBytes(fluentForwardTag, msgPackEntries)
-			deadline := 10 * time.Second
-			connection.SetWriteDeadline(time.Now().Add(deadline))
-			bts, er = connection.Write(msgpBytes)
+			RecordTee.Write(dataType, fluentForwardTag, msgPackEntries)
+			bts, er = writeMsgpBatches(connection, fluentForwardTag, msgPackEntries)
 			if er != nil {
 				return bts, er
 			}
 		}
 	} else {
-		msgpBytes := convertMsgPackEntriesToMsgpBytes(fluentForwardTag, msgPackEntries)
-		deadline := 10 * time.Second
-		connection.SetWriteDeadline(time.Now().Add(deadline))
-		bts, er = connection.Write(msgpBytes)
+		RecordTee.Write(dataType, fluentForwardTag, msgPackEntries)
+		bts, er = writeMsgpBatches(connection, fluentForwardTag, msgPackEntries)
 		if er != nil {
 			return bts, er
 		}
@@ -2008,22 +2146,40 @@ func writeMsgPackEntries(connection net.Conn, isContainerLogV2Schema bool, fluen
 	return bts, er
 }
 
-func getContainerLogV2ExtensionMaps() (map[string][]string, map[string]string) {
-	namespaceStreamIdsMap := make(map[string][]string)
-	streamIdNamedPipeMap := make(map[string]string)
-
-	Log("Locking to read namespaceStreamIdsMap and streamIdNamedPipeMap")
-	ContainerLogV2ExtensionMapUpdateMutex.Lock()
-	for key, value := range NamespaceStreamIdsMap {
-		namespaceStreamIdsMap[key] = value
-	}
-	for key, value := range StreamIdNamedPipeMap {
-		streamIdNamedPipeMap[key] = value
+// writeMsgpBatches writes the entries to the connection, in batches of the throttling batch size while the plugin
+// throttles itself. A failed batch fails the write, the batches already written are sent again on retry and counted
+// as duplicates
+func writeMsgpBatches(connection net.Conn, fluentForwardTag string, msgPackEntries []MsgPackEntry) (int, error) {
+	batchSize := ResourceThrottling.batchSize()
+	if batchSize <= 0 {
+		batchSize = len(msgPackEntries)
+	}
+	totalBytes := 0
+	for start := 0; ; start += batchSize {
+		end := min(start+batchSize, len(msgPackEntries))
+		msgpBytes := convertMsgPackEntriesToMsgpBytes(fluentForwardTag, msgPackEntries[start:end])
+		deadline := 10 * time.Second
+		connection.SetWriteDeadline(time.Now().Add(deadline))
+		bts, er := connection.Write(msgpBytes)
+		totalBytes += bts
+		if er != nil {
+			if start > 0 {
+				ResourceThrottling.recordDuplicates(start)
+			}
+			return totalBytes, er
+		}
+		if end == len(msgPackEntries) {
+			return totalBytes, nil
+		}
 	}
-	ContainerLogV2ExtensionMapUpdateMutex.Unlock()
-	Log("Unlocking after reading namespaceStreamIdsMap and streamIdNamedPipeMap")
+}
 
-	return namespaceStreamIdsMap, streamIdNamedPipeMap
+func getContainerLogV2ExtensionMaps() (map[string][]string, map[string]string) {
+	maps := ContainerLogV2ExtensionMaps.Load()
+	if maps == nil {
+		return nil, nil
+	}
+	return maps.NamespaceStreamIdsMap, maps.StreamIdNamedPipeMap
 }
 
 func getMsgPackEntriesByNamespace(msgPackEntries []MsgPackEntry) map[string][]MsgPackEntry {
@@ -2091,13 +2247,10 @@ func GetContainerIDK8sNamespacePodNameFromFileName(filename string) (string, str
 // For sample pod name coredns-77d8fb66dd-hsgbb returns coredns-77d8fb66dd and coredns
 // The returned values are matched against configmap inputs eg kube-system:coredns and kube-system:kube-proxy
 func GetControllerNameFromK8sPodName(podName string) (string, string) {
-	// clear cache if it exceeds the cache size
-	if len(PodNameToControllerNameMap) > PodNameToControllerNameMapCacheSize {
-		Log("Clearing PodNameToControllerNameMap cache")
-		PodNameToControllerNameMap = make(map[string][2]string)
-	}
-
-	if values, ok := PodNameToControllerNameMap[podName]; ok {
+	PodNameToControllerNameMapMutex.RLock()
+	values, ok := PodNameToControllerNameMap[podName]
+	PodNameToControllerNameMapMutex.RUnlock()
+	if ok {
 		return values[0], values[1]
 	}
 
@@ -2111,7 +2264,14 @@ func GetControllerNameFromK8sPodName(podName string) (string, string) {
 			deploymentNameType = dsNameType[:last]
 		}
 	}
+	PodNameToControllerNameMapMutex.Lock()
+	// clear cache if it exceeds the cache size
+	if len(PodNameToControllerNameMap) > PodNameToControllerNameMapCacheSize {
+		Log("Clearing PodNameToControllerNameMap cache")
+		PodNameToControllerNameMap = make(map[string][2]string)
+	}
 	PodNameToControllerNameMap[podName] = [2]string{dsNameType, deploymentNameType}
+	PodNameToControllerNameMapMutex.Unlock()
 	return dsNameType, deploymentNameType
 }
 
@@ -2124,11 +2284,8 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	StderrIncludeSystemResourceSet = make(map[string]bool)
 	StderrIncludeSystemNamespaceSet = make(map[string]bool)
 	PodNameToControllerNameMap = make(map[string][2]string)
-	ImageIDMap = make(map[string]string)
-	NameIDMap = make(map[string]string)
-	NamespaceStreamIdsMap = make(map[string][]string)
-	StreamIdNamedPipeMap = make(map[string]string)
-	NamedPipeConnectionCache = make(map[string]net.Conn)
+	ContainerImageNameMaps.Store(&containerImageNameMaps{ImageIDMap: make(map[string]string), NameIDMap: make(map[string]string)})
+	ContainerLogV2ExtensionMaps.Store(&containerLogV2ExtensionMaps{NamespaceStreamIdsMap: make(map[string][]string), StreamIdNamedPipeMap: make(map[string]string)})
 	// Keeping the two error hashes separate since we need to keep the config error hash for the lifetime of the container
 	// whereas the prometheus scrape error hash needs to be refreshed every hour
 	ConfigErrorEvent = make(map[string]KubeMonAgentEventTags)
@@ -2136,15 +2293,6 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	// Initializing this to true to skip the first kubemonagentevent flush since the errors are not populated at this time
 	skipKubeMonEventsFlush = true
 
-	enrichContainerLogsSetting := os.Getenv("AZMON_CLUSTER_CONTAINER_LOG_ENRICH")
-	if strings.Compare(enrichContainerLogsSetting, "true") == 0 {
-		enrichContainerLogs = true
-		Log("ContainerLogEnrichment=true \n")
-	} else {
-		enrichContainerLogs = false
-		Log("ContainerLogEnrichment=false \n")
-	}
-
 	pluginConfig, err := ReadConfiguration(pluginConfPath)
 	if err != nil {
 		message := fmt.Sprintf("Error Reading plugin config path : %s \n", err.Error())
@@ -2153,26 +2301,27 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 		time.Sleep(30 * time.Second)
 		log.Fatalln(message)
 	}
+	settings := NewPluginConfig(pluginConfig, os.Getenv, paths.Resolve(ConfigMapMountPath))
+	settings.ConfFilePath = pluginConfPath
+	applyLogSettings(settings)
+	logConfigIssues(settings)
+	setPluginSettings(settings)
 
-	ContainerType = os.Getenv(ContainerTypeEnv)
+	enrichContainerLogs = settings.ContainerLogEnrichment
+	Log("ContainerLogEnrichment=%v \n", enrichContainerLogs)
+
+	ContainerType = settings.ContainerType
 	Log("Container Type %s", ContainerType)
 
-	IsAzMonMultitenancyLogsServiceMode = false
-	azMonMultitenancyLogsServiceMode := os.Getenv("AZMON_MULTI_TENANCY_LOGS_SERVICE_MODE")
-	if strings.Compare(strings.ToLower(azMonMultitenancyLogsServiceMode), "true") == 0 {
-		IsAzMonMultitenancyLogsServiceMode = true
-	}
+	IsAzMonMultitenancyLogsServiceMode = settings.MultiTenancyLogsServiceMode
 
-	osType := os.Getenv("OS_TYPE")
 	IsWindows = false
-	IsGenevaLogsTelemetryServiceMode = false
-	genevaLogsIntegrationServiceMode := os.Getenv("GENEVA_LOGS_INTEGRATION_SERVICE_MODE")
-	if strings.Compare(strings.ToLower(genevaLogsIntegrationServiceMode), "true") == 0 {
-		IsGenevaLogsTelemetryServiceMode = true
+	IsGenevaLogsTelemetryServiceMode = settings.GenevaLogsIntegrationServiceMode
+	if IsGenevaLogsTelemetryServiceMode {
 		Log("IsGenevaLogsTelemetryServiceMode %v", IsGenevaLogsTelemetryServiceMode)
-	} else if strings.Compare(strings.ToLower(osType), "windows") != 0 {
+	} else if !settings.IsWindows() {
 		Log("Reading configuration for Linux from %s", pluginConfPath)
-		WorkspaceID = os.Getenv("WSID")
+		WorkspaceID = settings.WorkspaceID
 		if WorkspaceID == "" {
 			message := fmt.Sprintf("WorkspaceID shouldnt be empty")
 			Log(message)
@@ -2180,7 +2329,7 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 			time.Sleep(30 * time.Second)
 			log.Fatalln(message)
 		}
-		LogAnalyticsWorkspaceDomain = os.Getenv("DOMAIN")
+		LogAnalyticsWorkspaceDomain = settings.WorkspaceDomain
 		if LogAnalyticsWorkspaceDomain == "" {
 			message := fmt.Sprintf("Workspace DOMAIN shouldnt be empty")
 			Log(message)
@@ -2190,23 +2339,22 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 		}
 		OMSEndpoint = "https://" + WorkspaceID + ".ods." + LogAnalyticsWorkspaceDomain + "/OperationalData.svc/PostJsonDataItems"
 		// Populate Computer field
-		containerHostName, err1 := ioutil.ReadFile(pluginConfig["container_host_file_path"])
+		containerHostName, err1 := ioutil.ReadFile(paths.Resolve(settings.ContainerHostFilePath))
 		if err1 != nil {
 			// It is ok to log here and continue, because only the Computer column will be missing,
 			// which can be deduced from a combination of containerId, and docker logs on the node
-			message := fmt.Sprintf("Error when reading containerHostName file %s.\n It is ok to log here and continue, because only the Computer column will be missing, which can be deduced from a combination of containerId, and docker logs on the nodes\n", err.Error())
+			message := fmt.Sprintf("Error when reading containerHostName file %s.\n It is ok to log here and continue, because only the Computer column will be missing, which can be deduced from a combination of containerId, and docker logs on the nodes\n", err1.Error())
 			Log(message)
 			SendException(message)
 		} else {
 			Computer = strings.TrimSuffix(ToString(containerHostName), "\n")
 		}
-		ignoreProxySettings := os.Getenv("IGNORE_PROXY_SETTINGS")
-		if strings.Compare(strings.ToLower(ignoreProxySettings), "true") == 0 {
-			Log("Ignoring reading of proxy configuration since ignoreProxySettings %v\n", ignoreProxySettings)
+		if settings.IgnoreProxySettings {
+			Log("Ignoring reading of proxy configuration since ignoreProxySettings %v\n", settings.IgnoreProxySettings)
 		} else {
 			// read proxyendpoint if proxy configured
 			ProxyEndpoint = ""
-			proxySecretPath := pluginConfig["amalogsproxy_secret_path"]
+			proxySecretPath := paths.Resolve(settings.ProxySecretPath)
 			if _, err := os.Stat(proxySecretPath); err == nil {
 				Log("Reading proxy configuration for Linux from %s", proxySecretPath)
 				proxyConfig, err := ioutil.ReadFile(proxySecretPath)
@@ -2223,20 +2371,18 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	} else {
 		// windows
 		IsWindows = true
-		Computer = os.Getenv("HOSTNAME")
-		WorkspaceID = os.Getenv("WSID")
-		logAnalyticsDomain := os.Getenv("DOMAIN")
-		ProxyEndpoint = os.Getenv("PROXY")
-		OMSEndpoint = "https://" + WorkspaceID + ".ods." + logAnalyticsDomain + "/OperationalData.svc/PostJsonDataItems"
+		Computer = settings.Hostname
+		WorkspaceID = settings.WorkspaceID
+		ProxyEndpoint = settings.Proxy
+		OMSEndpoint = "https://" + WorkspaceID + ".ods." + settings.WorkspaceDomain + "/OperationalData.svc/PostJsonDataItems"
 	}
 
 	Log("OMSEndpoint %s", OMSEndpoint)
-	IsAADMSIAuthMode = false
-	if strings.Compare(strings.ToLower(os.Getenv(AADMSIAuthMode)), "true") == 0 {
-		IsAADMSIAuthMode = true
+	IsAADMSIAuthMode = settings.AADMSIAuthMode
+	if IsAADMSIAuthMode {
 		Log("AAD MSI Auth Mode Configured")
 	}
-	ResourceID = os.Getenv(envAKSResourceID)
+	ResourceID = settings.ResourceID
 
 	if len(ResourceID) > 0 {
 		//AKS Scenario
@@ -2249,7 +2395,7 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	}
 	if ResourceCentric == false {
 		//AKS-Engine/hybrid scenario
-		ResourceName = os.Getenv(ResourceNameEnv)
+		ResourceName = settings.ResourceName
 		ResourceID = ResourceName
 		Log("ResourceCentric: False")
 		Log("ResourceID=%s", ResourceID)
@@ -2257,13 +2403,12 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	}
 
 	// log runtime info for debug purpose
-	containerRuntime = os.Getenv(ContainerRuntimeEnv)
+	containerRuntime = settings.ContainerRuntime
 	Log("Container Runtime engine %s", containerRuntime)
 
 	// set useragent to be used by ingestion
-	dockerCimprovVersionEnv := strings.TrimSpace(os.Getenv("DOCKER_CIMPROV_VERSION"))
-	if len(dockerCimprovVersionEnv) > 0 {
-		dockerCimprovVersion = dockerCimprovVersionEnv
+	if len(settings.DockerCimprovVersion) > 0 {
+		dockerCimprovVersion = settings.DockerCimprovVersion
 	}
 
 	userAgent = fmt.Sprintf("%s/%s", agentName, dockerCimprovVersion)
@@ -2271,14 +2416,7 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	Log("Usage-Agent = %s \n", userAgent)
 
 	// Initialize image,name map refresh ticker
-	containerInventoryRefreshInterval, err := strconv.Atoi(pluginConfig["container_inventory_refresh_interval"])
-	if err != nil {
-		message := fmt.Sprintf("Error Reading Container Inventory Refresh Interval %s", err.Error())
-		Log(message)
-		SendException(message)
-		Log("Using Default Refresh Interval of %d s\n", defaultContainerInventoryRefreshInterval)
-		containerInventoryRefreshInterval = defaultContainerInventoryRefreshInterval
-	}
+	containerInventoryRefreshInterval := settings.ContainerInventoryRefreshIntervalSeconds
 	Log("containerInventoryRefreshInterval = %d \n", containerInventoryRefreshInterval)
 	ContainerImageNameRefreshTicker = time.NewTicker(time.Second * time.Duration(containerInventoryRefreshInterval))
 
@@ -2287,15 +2425,14 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 
 	Log("Computer == %s \n", Computer)
 
-	ret, err := InitializeTelemetryClient(agentVersion)
+	ret, err := InitializeTelemetryClient(agentVersion, settings)
 	if ret != 0 || err != nil {
 		message := fmt.Sprintf("Error During Telemetry Initialization :%s", err.Error())
-		fmt.Printf(message)
 		Log(message)
 	}
 
 	// Initialize KubeAPI Client
-	config, err := rest.InClusterConfig()
+	config, err := kubeRestConfig()
 	if err != nil {
 		message := fmt.Sprintf("Error getting config %s.\nIt is ok to log here and continue, because the logs will be missing image and Name, but the logs will still have the containerID", err.Error())
 		Log(message)
@@ -2311,80 +2448,60 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 
 	PluginConfiguration = pluginConfig
 
-	ContainerLogsRoute := strings.TrimSpace(strings.ToLower(os.Getenv("AZMON_CONTAINER_LOGS_ROUTE")))
-	Log("AZMON_CONTAINER_LOGS_ROUTE:%s", ContainerLogsRoute)
+	Log("AZMON_CONTAINER_LOGS_ROUTE:%s", settings.ContainerLogsRoute)
 
-	ContainerLogsRouteV2 = false
+	ContainerLogsRouteV2 = settings.ContainerLogsRouteV2()
 	ContainerLogsRouteADX = false
-	IsGenevaLogsIntegrationEnabled = false
-	genevaLogsIntegrationEnabled := strings.TrimSpace(strings.ToLower(os.Getenv("GENEVA_LOGS_INTEGRATION")))
-	if genevaLogsIntegrationEnabled != "" && strings.Compare(strings.ToLower(genevaLogsIntegrationEnabled), "true") == 0 {
-		IsGenevaLogsIntegrationEnabled = true
+	IsGenevaLogsIntegrationEnabled = settings.GenevaLogsIntegration
+	if IsGenevaLogsIntegrationEnabled {
 		Log("Geneva Logs Integration Enabled")
-		ContainerLogsRouteV2 = true // AMA route for geneva logs integration
 	}
-	if strings.Compare(ContainerLogsRoute, ContainerLogsADXRoute) == 0 {
+	if settings.ContainerLogsRoute == ContainerLogsADXRoute {
 		Log("ERROR: ADX mode has been deprecated")
-	} else if IsWindows == false || IsAADMSIAuthMode { //for linux and windows AadMSIAuth, oneagent will be default route
-		ContainerLogsRouteV2 = true //default is mdsd route
-		Log("Routing container logs thru %s route...", ContainerLogsRoute)
-		fmt.Fprintf(os.Stdout, "Routing container logs thru %s route... \n", ContainerLogsRoute)
+	} else if ContainerLogsRouteV2 {
+		Log("Routing container logs thru %s route...", settings.ContainerLogsRoute)
+		fmt.Fprintf(os.Stdout, "Routing container logs thru %s route... \n", settings.ContainerLogsRoute)
 	}
 
-	ContainerLogSchemaVersion := strings.TrimSpace(strings.ToLower(os.Getenv("AZMON_CONTAINER_LOG_SCHEMA_VERSION")))
-	Log("AZMON_CONTAINER_LOG_SCHEMA_VERSION:%s", ContainerLogSchemaVersion)
+	Log("AZMON_CONTAINER_LOG_SCHEMA_VERSION:%s", settings.ContainerLogSchemaVersion)
 
 	ContainerLogSchemaV2 = false //default is v1 schema
-	ContainerLogV2ConfigMap = (strings.Compare(ContainerLogSchemaVersion, ContainerLogV2SchemaVersion) == 0)
+	ContainerLogV2ConfigMap = settings.ContainerLogSchemaV2()
 
-	IsAzMonMultiTenancyLogCollectionEnabled = false
-	multiTenancyEnabled := strings.TrimSpace(strings.ToLower(os.Getenv("AZMON_MULTI_TENANCY_LOG_COLLECTION")))
-	if multiTenancyEnabled != "" && strings.Compare(strings.ToLower(multiTenancyEnabled), "true") == 0 {
-		IsAzMonMultiTenancyLogCollectionEnabled = true
+	IsAzMonMultiTenancyLogCollectionEnabled = settings.MultiTenancyLogCollection
+	if IsAzMonMultiTenancyLogCollectionEnabled {
 		Log("Azure Monitor Multi-tenancy Log Collection Enabled")
 	}
 
-	IsAzMonMultiTenancyLogCollectionAdvancedModeEnabled = false
-	multiTenancyAdvancedModeEnabled := strings.TrimSpace(strings.ToLower(os.Getenv("AZMON_MULTI_TENANCY_LOG_COLLECTION_ADVANCED_MODE")))
-	if multiTenancyAdvancedModeEnabled != "" && strings.Compare(strings.ToLower(multiTenancyAdvancedModeEnabled), "true") == 0 {
-		IsAzMonMultiTenancyLogCollectionAdvancedModeEnabled = true
+	IsAzMonMultiTenancyLogCollectionAdvancedModeEnabled = settings.MultiTenancyLogCollectionAdvancedMode
+	if IsAzMonMultiTenancyLogCollectionAdvancedModeEnabled {
 		Log("Azure Monitor Multi-tenancy Log Collection Advanced Mode Enabled")
 	}
 
-	KubernetesMetadataEnabled = false
-	KubernetesMetadataEnabled = (strings.Compare(strings.ToLower(os.Getenv("AZMON_KUBERNETES_METADATA_ENABLED")), "true") == 0)
-	metadataIncludeList := strings.ToLower(os.Getenv("AZMON_KUBERNETES_METADATA_INCLUDES_FIELDS"))
+	KubernetesMetadataEnabled = settings.KubernetesMetadataEnabled
 	Log(fmt.Sprintf("KubernetesMetadataEnabled from configmap: %+v\n", KubernetesMetadataEnabled))
-	Log(fmt.Sprintf("KubernetesMetadataIncludeList from configmap: %+v\n", metadataIncludeList))
-	KubernetesMetadataIncludeList = []string{}
-	if KubernetesMetadataEnabled && len(metadataIncludeList) > 0 {
-		KubernetesMetadataIncludeList = strings.Split(metadataIncludeList, ",")
-	}
+	Log(fmt.Sprintf("KubernetesMetadataIncludeList from configmap: %+v\n", settings.KubernetesMetadataIncludeFields))
+	setKubernetesMetadataIncludes(settings)
+	populateTraceContextSettings(settings)
 	if ContainerLogV2ConfigMap && ContainerLogsRouteADX != true {
 		ContainerLogSchemaV2 = true
 		Log("Container logs schema=%s", ContainerLogV2SchemaVersion)
 		fmt.Fprintf(os.Stdout, "Container logs schema=%s... \n", ContainerLogV2SchemaVersion)
 	}
 
-	MdsdInsightsMetricsTagName = MdsdInsightsMetricsSourceName
 	MdsdKubeMonAgentEventsTagName = MdsdKubeMonAgentEventsSourceName
 	MdsdKubeMonAgentEventsTagRefreshTracker = time.Now()
-	MdsdInsightsMetricsTagRefreshTracker = time.Now()
-	MdsdContainerLogTagRefreshTracker = time.Now()
+	populateHostLogSettings(settings)
+	populateDeadLetterSettings(settings)
+	populateCircuitBreakerSettings(settings)
+	populatePriorityLaneSettings(settings)
+	populateDropAccountingSettings(settings)
+	populateDebugTeeSettings(settings)
+	populateConfigSnapshotSettings(settings)
+	populateDeliveryLatencySettings(settings)
+	populateSchemaValidationSettings(settings)
+	populateResourceThrottlingSettings(settings)
 
-	if ContainerLogsRouteV2 == true {
-		if IsWindows {
-			var datatype string
-			if ContainerLogSchemaV2 {
-				datatype = ContainerLogV2DataType
-			} else {
-				datatype = ContainerLogDataType
-			}
-			EnsureGenevaOr3PNamedPipeExists(&ContainerLogNamedPipe, datatype, &ContainerLogsWindowsAMAClientCreateErrors, IsGenevaLogsIntegrationEnabled, &MdsdContainerLogTagRefreshTracker)
-		} else {
-			CreateMDSDClient(ContainerLogV2, ContainerType)
-		}
-	}
 	if IsWindows || (!ContainerLogsRouteV2 && !ContainerLogsRouteADX) {
 		// windows for both Geneva and 3P for insights metrics and for ContainerLog in legacy auth
 		// configmap configured for direct ODS route
@@ -2393,33 +2510,39 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	}
 
 	if IsWindows == false { // mdsd linux specific
-		Log("Creating MDSD clients for KubeMonAgentEvents & InsightsMetrics")
-		CreateMDSDClient(KubeMonAgentEvents, ContainerType)
-		CreateMDSDClient(InsightsMetrics, ContainerType)
+		Log("Creating MDSD client for KubeMonAgentEvents")
+		CreateMDSDClient(&MdsdKubeMonMsgpUnixSocketClient, KubeMonAgentEvents, ContainerType)
 	} else if IsWindows && IsAADMSIAuthMode { // AMA windows specific
 		Log("Creating AMA client for KubeMonAgentEvents")
 		EnsureGenevaOr3PNamedPipeExists(&KubeMonAgentEventsNamedPipe, KubeMonAgentEventDataType, &KubeMonEventsWindowsAMAClientCreateErrors, false, &MdsdKubeMonAgentEventsTagRefreshTracker)
-		Log("Creating AMA client for InsightsMetrics")
-		EnsureGenevaOr3PNamedPipeExists(&InsightsMetricsNamedPipe, InsightsMetricsDataType, &InsightsMetricsWindowsAMAClientCreateErrors, false, &MdsdInsightsMetricsTagRefreshTracker)
 	}
 
-	if strings.Compare(strings.ToLower(os.Getenv("CONTROLLER_TYPE")), "daemonset") == 0 {
-		populateExcludedStdoutNamespaces()
-		populateExcludedStderrNamespaces()
-		populateIncludedStdoutSystemResource()
-		populateIncludedStderrSystemResource()
+	if settings.ControllerType == "daemonset" {
+		setLogCollectionFilters(newLogCollectionFilters(settings))
+		startConfigReloadWatcher(settings, paths.Resolve(ConfigMapMountPath))
 		Log("Included resources set stdout: %v, stderr: %v", StdoutIncludeSystemResourceSet, StderrIncludeSystemResourceSet)
 		Log("Included system namespaces set stdout: %v, stderr: %v", StdoutIncludeSystemNamespaceSet, StderrIncludeSystemNamespaceSet)
 		//enrichment not applicable for ADX and v2 schema
 		if enrichContainerLogs == true && ContainerLogsRouteADX != true && ContainerLogSchemaV2 != true {
 			Log("ContainerLogEnrichment=true; starting goroutine to update containerimagenamemaps \n")
-			go updateContainerImageNameMaps()
+			goBackground(updateContainerImageNameMaps)
 		} else {
 			Log("ContainerLogEnrichment=false \n")
 		}
 
 		// Flush config error records every hour
-		go flushKubeMonAgentEventRecords()
+		goBackground(flushKubeMonAgentEventRecords)
+
+		populateVerboseCollectionSettings(settings)
+		if VerboseCollectionOverrideEnabled {
+			VerboseCollectionRefreshTicker = time.NewTicker(time.Second * time.Duration(verboseCollectionRefreshIntervalSeconds))
+			goBackground(updateVerboseCollectionOverrides)
+		}
+
+		if KubernetesMetadataEnabled {
+			KubernetesMetadataRefreshTicker = time.NewTicker(time.Second * time.Duration(kubernetesMetadataRefreshIntervalSeconds))
+			goBackground(updateKubernetesMetadataCaches)
+		}
 	} else {
 		Log("Running in replicaset. Disabling container enrichment caching & updates \n")
 	}
@@ -2428,13 +2551,29 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	if !ContainerLogsRouteADX && IsWindows && IsAADMSIAuthMode {
 		Log("defaultIngestionAuthTokenRefreshIntervalSeconds = %d \n", defaultIngestionAuthTokenRefreshIntervalSeconds)
 		IngestionAuthTokenRefreshTicker = time.NewTicker(time.Second * time.Duration(defaultIngestionAuthTokenRefreshIntervalSeconds))
-		go refreshIngestionAuthToken()
+		goBackground(refreshIngestionAuthToken)
 	}
 
 	Log("IsAzMonMultitenancyLogsServiceMode: %v, IsAzMonMultiTenancyLogCollectionEnabled: %v, IsAzMonMultiTenancyLogCollectionAdvancedModeEnabled = %v \n", IsAzMonMultitenancyLogsServiceMode, IsAzMonMultiTenancyLogCollectionEnabled, IsAzMonMultiTenancyLogCollectionAdvancedModeEnabled)
 	if IsAADMSIAuthMode && (IsAzMonMultitenancyLogsServiceMode || (IsAzMonMultiTenancyLogCollectionEnabled && !IsAzMonMultiTenancyLogCollectionAdvancedModeEnabled)) {
 		Log("ContainerLogV2ExtensionConfigRefreshIntervalSeconds = %d \n", defaultContainerLogV2ExtensionConfigRefreshIntervalSeconds)
 		ContainerLogV2ExtensionConfigRefreshTicker = time.NewTicker(time.Second * time.Duration(defaultContainerLogV2ExtensionConfigRefreshIntervalSeconds))
-		go updateContainerLogV2ExtensionMaps(IsWindows)
+		goBackground(func() { updateContainerLogV2ExtensionMaps(IsWindows) })
 	}
+
+	if ConfigSnapshotEnabled {
+		Log("configSnapshotCheckInterval = %s, ConfigSnapshotInterval = %s \n", configSnapshotCheckInterval, ConfigSnapshotInterval)
+		ConfigSnapshotTicker = time.NewTicker(configSnapshotCheckInterval)
+		goBackground(sendConfigSnapshots)
+	}
+
+	if ResourceThrottlingEnabled {
+		ResourceThrottlingTicker = time.NewTicker(time.Second * time.Duration(settings.ThrottlingIntervalSeconds))
+		goBackground(monitorResourceUsage)
+	}
+
+	ShutdownTimeout = time.Duration(settings.ShutdownTimeoutSeconds) * time.Second
+	startDiagnosticsServer(settings)
+	startHealthMonitor(settings)
+	startPrometheusMetricsServer(settings)
 }
@@ -5,7 +5,11 @@ import (
 	"testing"
 	"fmt"
 	"reflect"
+	"sync"
+	"time"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var kubernetesJSON = `{
@@ -60,7 +64,7 @@ func TestPostDataHelperKuberneteMetadata(t *testing.T) {
 	}
 	KubernetesMetadataEnabled = true
 
-	output := PostDataHelper([]map[interface{}]interface{}{record})
+	output := (&PluginInstance{}).PostDataHelper([]map[interface{}]interface{}{record})
 
 	assert.Greater(t, output, 0, "Expected output to be greater than 0 indicating processing occurred")
 }
@@ -69,7 +73,7 @@ func TestPostDataHelperKuberneteMetadata(t *testing.T) {
 func TestPostDataHelperEmpty(t *testing.T) {
 	tailPluginRecords := []map[interface{}]interface{}{}
 	expectedOutput := 1
-	output := PostDataHelper(tailPluginRecords)
+	output := (&PluginInstance{}).PostDataHelper(tailPluginRecords)
 	if output != expectedOutput {
 		t.Errorf("Expected output to be %d, but got %d", expectedOutput, output)
 	}
@@ -130,7 +134,7 @@ func TestPostDataHelperMultiple(t *testing.T) {
 		},
 	}
 	expectedOutput := 2
-	output := PostDataHelper(tailPluginRecords)
+	output := (&PluginInstance{}).PostDataHelper(tailPluginRecords)
 	if output != expectedOutput {
 		t.Errorf("Expected output to be %d, but got %d", expectedOutput, output)
 	}
@@ -213,9 +217,242 @@ func TestProcessIncludes(t *testing.T) {
 		"podUid": "93bf47d2-5c1a-42bc-test-481939a93a66",
 	}
 
-	result := processIncludes(kubernetesMetadataMap, includesList)
+	result := processIncludes(kubernetesMetadataMap, &kubernetesMetadataIncludes{Fields: includesList})
 
 	if !reflect.DeepEqual(result, expectedResult) {
 		t.Errorf("Expected result to be %v, but got %v", expectedResult, result)
 	}
-}
\ No newline at end of file
+}
+func TestProcessIncludesKeyAllowlists(t *testing.T) {
+	kubernetesMetadataMap := map[string]interface{}{
+		"pod_name":       "test-publisher-ds-bssg6",
+		"namespace_name": "kube-system",
+		"labels": map[string]interface{}{
+			"app":                            "test",
+			"controller-revision-hash":       "f48799794",
+			"kubernetes.azure.com/managedby": "aks",
+		},
+		"annotations": map[string]interface{}{
+			"kubernetes.io/config.seen": "2023-10-02T08:21:49.954540360Z",
+			"team.contoso.com/owner":    "logs",
+			"prometheus.io/scrape":      "true",
+		},
+	}
+
+	includes := &kubernetesMetadataIncludes{
+		Fields:         []string{"podlabels", "podannotations"},
+		LabelKeys:      []string{"app", "kubernetes.azure.com/"},
+		AnnotationKeys: []string{"team.contoso.com/*", "kubernetes.io/config.seen"},
+	}
+
+	expectedResult := map[string]interface{}{
+		"podLabels": map[string]interface{}{
+			"app":                            "test",
+			"kubernetes.azure.com/managedby": "aks",
+		},
+		"podAnnotations": map[string]interface{}{
+			"team.contoso.com/owner": "logs",
+		},
+	}
+
+	result := processIncludes(kubernetesMetadataMap, includes)
+
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("Expected result to be %v, but got %v", expectedResult, result)
+	}
+}
+
+func TestProcessIncludesNamespaceAndNode(t *testing.T) {
+	kubernetesMetadataMap := map[string]interface{}{
+		"pod_name":       "test-publisher-ds-bssg6",
+		"namespace_name": "test-ns",
+		"host":           "test-agentpool-test-test000001",
+		"ownerReferences": []interface{}{
+			map[string]interface{}{"kind": "DaemonSet", "name": "test-publisher-ds", "uid": "abc"},
+		},
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	NamespaceMetadataCache.set("test-ns", kubernetesObjectMetadata{
+		Labels:      map[string]string{"team": "logs", "kubernetes.io/metadata.name": "test-ns"},
+		Annotations: map[string]string{"owner": "contoso"},
+		ExpiresAt:   expiresAt,
+	})
+	NodeMetadataCache.set("test-agentpool-test-test000001", kubernetesObjectMetadata{
+		Labels: map[string]string{
+			"topology.kubernetes.io/zone":      "eastus-1",
+			"node.kubernetes.io/instance-type": "Standard_D4s_v3",
+			"kubernetes.io/os":                 "linux",
+		},
+		ExpiresAt: expiresAt,
+	})
+	includes := &kubernetesMetadataIncludes{
+		Fields:        []string{"namespacelabels", "namespaceannotations", "nodename", "nodelabels", "ownerreferences"},
+		LabelKeys:     []string{"team"},
+		NodeLabelKeys: []string{"topology.kubernetes.io/zone", "node.kubernetes.io/instance-type"},
+	}
+
+	expectedResult := map[string]interface{}{
+		"namespaceLabels": map[string]interface{}{
+			"team": "logs",
+		},
+		"namespaceAnnotations": map[string]interface{}{
+			"owner": "contoso",
+		},
+		"nodeName": "test-agentpool-test-test000001",
+		"nodeLabels": map[string]interface{}{
+			"topology.kubernetes.io/zone":      "eastus-1",
+			"node.kubernetes.io/instance-type": "Standard_D4s_v3",
+		},
+		"ownerReferences": []map[string]string{
+			{"kind": "DaemonSet", "name": "test-publisher-ds"},
+		},
+	}
+
+	result := processIncludes(kubernetesMetadataMap, includes)
+
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Errorf("Expected result to be %v, but got %v", expectedResult, result)
+	}
+}
+
+func TestMatchesKeyFilter(t *testing.T) {
+	tests := []struct {
+		key      string
+		filter   []string
+		expected bool
+	}{
+		{"app", nil, true},
+		{"app", []string{"app"}, true},
+		{"app.kubernetes.io/name", []string{"app"}, false},
+		{"app.kubernetes.io/name", []string{"app.kubernetes.io/"}, true},
+		{"app.kubernetes.io/name", []string{"app.*"}, true},
+		{"team", []string{"app.*", "tier"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesKeyFilter(tt.key, tt.filter); got != tt.expected {
+			t.Errorf("matchesKeyFilter(%s, %v) = %t, want %t", tt.key, tt.filter, got, tt.expected)
+		}
+	}
+}
+
+func TestKubernetesMetadataCache(t *testing.T) {
+	now := time.Now()
+	cache := newKubernetesMetadataCache(2)
+	cache.set("a", kubernetesObjectMetadata{Labels: map[string]string{"name": "a"}, ExpiresAt: now.Add(time.Minute)})
+	cache.set("b", kubernetesObjectMetadata{ExpiresAt: now.Add(time.Minute)})
+	if _, ok := cache.get("a", now); !ok {
+		t.Fatalf("expected a to be cached")
+	}
+	// b is the least recently used entry
+	cache.set("c", kubernetesObjectMetadata{ExpiresAt: now.Add(time.Second)})
+	if _, ok := cache.get("b", now); ok || cache.len() != 2 {
+		t.Errorf("expected b to be evicted, got %d entries", cache.len())
+	}
+	if metadata, ok := cache.get("a", now); !ok || metadata.Labels["name"] != "a" {
+		t.Errorf("expected a to be kept, got %+v", metadata)
+	}
+	if _, ok := cache.get("c", now.Add(time.Second)); ok || cache.len() != 1 {
+		t.Errorf("expected c to expire, got %d entries", cache.len())
+	}
+}
+
+func TestSetKubernetesMetadataFromRefresh(t *testing.T) {
+	origNamespaces, origOwners := NamespaceMetadataCache, PodOwnerCache
+	defer func() { NamespaceMetadataCache, PodOwnerCache = origNamespaces, origOwners }()
+	NamespaceMetadataCache, PodOwnerCache = newKubernetesMetadataCache(KubernetesMetadataCacheSize), newKubernetesMetadataCache(KubernetesMetadataCacheSize)
+
+	pods := []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "app",
+		Name:            "app-5d4f",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app-7c9"}},
+	}}}
+	namespaces := []corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "app", Labels: map[string]string{"team": "logs"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "other", Labels: map[string]string{"team": "metrics"}}},
+	}
+	setPodOwnerMetadata(pods, time.Now())
+	setNamespaceMetadata(namespaces, pods, time.Now())
+
+	if owners := getPodOwnerMetadata("app", "app-5d4f").OwnerReferences; len(owners) != 1 || owners[0]["name"] != "app-7c9" {
+		t.Errorf("expected the cached pod owner, got %v", owners)
+	}
+	if labels := getNamespaceMetadata("app").Labels; labels["team"] != "logs" {
+		t.Errorf("expected the cached namespace labels, got %v", labels)
+	}
+	// only the namespaces with pods on the node are cached and an uncached lookup doesn't call the API server
+	if metadata := getNamespaceMetadata("other"); metadata.Labels != nil || NamespaceMetadataCache.len() != 1 {
+		t.Errorf("expected the namespace without pods on the node to be left out, got %+v", metadata)
+	}
+}
+
+func TestProcessIncludesDropsUnfilterableLabels(t *testing.T) {
+	includes := &kubernetesMetadataIncludes{Fields: []string{"podlabels"}, LabelKeys: []string{"team"}}
+	result := processIncludes(map[string]interface{}{"labels": []interface{}{"team=logs", "secret=value"}}, includes)
+	if _, ok := result["podLabels"]; ok {
+		t.Errorf("expected labels that can't be filtered to be left out, got %v", result)
+	}
+}
+
+// Test PostDataHelper from concurrent flush workers while the metadata maps and telemetry are updated
+func TestPostDataHelperConcurrent(t *testing.T) {
+	origRouteV2, origIncludeNs, origIncludeResources, origControllerNames := ContainerLogsRouteV2, StdoutIncludeSystemNamespaceSet, StdoutIncludeSystemResourceSet, PodNameToControllerNameMap
+	t.Cleanup(func() {
+		ContainerLogsRouteV2, StdoutIncludeSystemNamespaceSet, StdoutIncludeSystemResourceSet, PodNameToControllerNameMap = origRouteV2, origIncludeNs, origIncludeResources, origControllerNames
+	})
+	ContainerLogsRouteV2 = true
+	StdoutIncludeSystemNamespaceSet = map[string]bool{"kube-system": true}
+	StdoutIncludeSystemResourceSet = map[string]bool{"kube-system:coredns": true}
+	PodNameToControllerNameMap = make(map[string][2]string)
+
+	const workers = 8
+	const flushes = 50
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ContainerImageNameMaps.Store(&containerImageNameMaps{
+				ImageIDMap: map[string]string{fmt.Sprintf("%064d", i): "image"},
+				NameIDMap:  map[string]string{fmt.Sprintf("%064d", i): "name"},
+			})
+			ContainerLogTelemetryMutex.Lock()
+			FlushedRecordsSize = 0
+			ContainerLogTelemetryMutex.Unlock()
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		worker := &PluginInstance{ContainerLogsRouteV2: true, MdsdMsgpUnixSocketClient: newFakeMdsdConn(true)}
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < flushes; i++ {
+				records := []map[interface{}]interface{}{
+					{
+						"filepath": []byte(fmt.Sprintf("/var/log/containers/coredns-77d8fb66dd-%05d_kube-system_coredns-%064d.log", i, w)),
+						"stream":   []byte("stdout"),
+						"log":      []byte("system log"),
+						"time":     []byte(time.Now().Format(time.RFC3339)),
+					},
+					{
+						"filepath": []byte(fmt.Sprintf("/var/log/containers/app-%d_default_app-%064d.log", w, i)),
+						"stream":   []byte("stderr"),
+						"log":      []byte("app log"),
+						"time":     []byte(time.Now().Format(time.RFC3339)),
+					},
+				}
+				if ret := worker.PostDataHelper(records); ret != 1 {
+					t.Errorf("worker %d: expected FLB_OK, got %d", w, ret)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+}
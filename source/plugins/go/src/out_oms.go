@@ -2,12 +2,12 @@ package main
 
 import (
 	"github.com/fluent/fluent-bit-go/output"
-	"github.com/microsoft/ApplicationInsights-Go/appinsights"
 )
 import (
 	"C"
 	"os"
 	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -21,74 +21,122 @@ func FLBPluginRegister(ctx unsafe.Pointer) int {
 //
 //export FLBPluginInit
 func FLBPluginInit(ctx unsafe.Pointer) int {
-	Log("Initializing out_oms go plugin for fluentbit")
-	agentVersion := os.Getenv("AGENT_VERSION")
-
-	osType := os.Getenv("OS_TYPE")
-	if strings.Compare(strings.ToLower(osType), "windows") == 0 {
-		Log("Using %s for plugin config \n", WindowsContainerLogPluginConfFilePath)
-		InitializePlugin(WindowsContainerLogPluginConfFilePath, agentVersion)
-	} else {
-		if strings.Compare(strings.ToLower(os.Getenv("CONTROLLER_TYPE")), "replicaset") == 0 {
-			Log("Using %s for plugin config \n", ReplicaSetContainerLogPluginConfFilePath)
-			InitializePlugin(ReplicaSetContainerLogPluginConfFilePath, agentVersion)
-		} else {
-			Log("Using %s for plugin config \n", DaemonSetContainerLogPluginConfFilePath)
-			InitializePlugin(DaemonSetContainerLogPluginConfFilePath, agentVersion)
-		}
+	pluginInitialization.Do(initializePluginFromEnv)
+	name := output.FLBPluginConfigKey(ctx, "Alias")
+	getConfigKey := func(key string) string {
+		return output.FLBPluginConfigKey(ctx, key)
+	}
+	if err := checkPluginInstanceKeys(name, getConfigKey); err != nil {
+		Log("Error::config::%s", err.Error())
+		return output.FLB_ERROR
 	}
+	instance := NewPluginInstance(name, getConfigKey)
+	instance.connect()
+	output.FLBPluginSetContext(ctx, instance)
 
+	// telemetry is process wide, the first instance that enables it starts it
 	enableTelemetry := output.FLBPluginConfigKey(ctx, "EnableTelemetry")
 	if strings.Compare(strings.ToLower(enableTelemetry), "true") == 0 {
-		telemetryPushInterval := output.FLBPluginConfigKey(ctx, "TelemetryPushIntervalSeconds")
-		go SendContainerLogPluginMetrics(telemetryPushInterval)
-		go SendTracesAsMetrics(telemetryPushInterval)
+		telemetryStart.Do(func() {
+			telemetryPushInterval := output.FLBPluginConfigKey(ctx, "TelemetryPushIntervalSeconds")
+			goBackground(func() { SendContainerLogPluginMetrics(telemetryPushInterval) })
+			goBackground(func() { SendTracesAsMetrics(telemetryPushInterval) })
+		})
 	} else {
 		Log("Telemetry is not enabled for the plugin %s \n", output.FLBPluginConfigKey(ctx, "Name"))
-		return output.FLB_OK
 	}
 	return output.FLB_OK
 }
 
-//export FLBPluginFlush
-func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
+// fluent-bit may initialize the instances concurrently, the process wide state is initialized and the telemetry
+// goroutines are started once
+var (
+	pluginInitialization sync.Once
+	telemetryStart       sync.Once
+)
+
+// initializePluginFromEnv initializes the process wide plugin state once, before the first instance is created
+func initializePluginFromEnv() {
+	Log("Initializing out_oms go plugin for fluentbit")
+	agentVersion := os.Getenv("AGENT_VERSION")
+
+	pluginConfFilePath := getPluginConfFilePath(os.Getenv("OS_TYPE"), os.Getenv("CONTROLLER_TYPE"))
+	Log("Using %s for plugin config \n", pluginConfFilePath)
+	InitializePlugin(pluginConfFilePath, agentVersion)
+}
+
+// getPluginConfFilePath returns the out_oms.conf file of the agent
+func getPluginConfFilePath(osType string, controllerType string) string {
+	if strings.Compare(strings.ToLower(osType), "windows") == 0 {
+		return WindowsContainerLogPluginConfFilePath
+	}
+	if strings.Compare(strings.ToLower(controllerType), "replicaset") == 0 {
+		return ReplicaSetContainerLogPluginConfFilePath
+	}
+	return DaemonSetContainerLogPluginConfFilePath
+}
+
+//export FLBPluginFlushCtx
+func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
+	// Create Fluent Bit decoder
+	records := decodeFlushRecords(output.NewDecoder(data, int(length)))
+
+	incomingTag := strings.ToLower(C.GoString(tag))
+	instance, ok := output.FLBPluginGetContext(ctx).(*PluginInstance)
+	if !ok {
+		Log("Error::flush::No plugin instance for the flush of tag %s", incomingTag)
+		return output.FLB_ERROR
+	}
+	return instance.Flush(records, incomingTag)
+}
+
+// decodeFlushRecords returns the records of a chunk with their fluent-bit event time
+func decodeFlushRecords(dec *output.FLBDecoder) []map[interface{}]interface{} {
 	var ret int
+	var ts interface{}
 	var record map[interface{}]interface{}
 	var records []map[interface{}]interface{}
 
-	// Create Fluent Bit decoder
-	dec := output.NewDecoder(data, int(length))
-
 	// Iterate Records
 	for {
 		// Extract Record
-		ret, _, record = output.GetRecord(dec)
+		ret, ts, record = output.GetRecord(dec)
 		if ret != 0 {
 			break
 		}
+		if recordTime, ok := fluentBitTime(ts); ok {
+			record[fluentBitTimeKey] = recordTime
+		}
 		records = append(records, record)
 	}
-
-	incomingTag := strings.ToLower(C.GoString(tag))
-	switch {
-	case strings.Contains(incomingTag, "oms.container.log.flbplugin"):
-		// This will also include populating cache to be sent as for config events
-		return PushToAppInsightsTraces(records, appinsights.Information, incomingTag)
-	case strings.Contains(incomingTag, "oms.container.perf.telegraf"):
-		return PostTelegrafMetricsToLA(records)
-	case strings.Contains(incomingTag, "oms.container.oneagent.containerinsights"):
-		return PostInputPluginRecords(records)
-	default:
-		return PostDataHelper(records)
-	}
+	return records
 }
 
-// FLBPluginExit exits the plugin
+// FLBPluginExit exits the plugin, fluent-bit versions without FLBPluginExitCtx call it once on exit
+//
+//export FLBPluginExit
 func FLBPluginExit() int {
-	ContainerLogTelemetryTicker.Stop()
-	ContainerImageNameRefreshTicker.Stop()
+	shutdownPlugin(ShutdownTimeout)
+	return output.FLB_OK
+}
+
+// FLBPluginExitCtx exits an instance of the plugin, the plugin shuts down with its last instance
+//
+//export FLBPluginExitCtx
+func FLBPluginExitCtx(ctx unsafe.Pointer) int {
+	instance, ok := output.FLBPluginGetContext(ctx).(*PluginInstance)
+	if !ok {
+		Log("Error::shutdown::No plugin instance for the exit, shutting down the plugin")
+		shutdownPlugin(ShutdownTimeout)
+		return output.FLB_OK
+	}
+	exitPluginInstance(instance, ShutdownTimeout)
 	return output.FLB_OK
 }
 
+// main only runs when built as an executable (go build -o out_oms .) and serves the subcommands
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
 }
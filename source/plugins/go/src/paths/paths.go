@@ -0,0 +1,153 @@
+// Package paths relocates the files, sockets and endpoints of the out_oms output plugin and the input plugins. On a
+// node nothing is configured and paths are used as is. Outside a cluster AZMON_ROOT_DIR prefixes every absolute path,
+// AZMON_PATH_OVERRIDES redirects single paths or directories and AZMON_LOCAL_MODE points the kubelet and API server
+// clients at local endpoints, so the plugins run against fakes without root and without a node
+package paths
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// env variables of the path settings
+const (
+	// RootDirEnv prefixes the absolute paths, e.g. /tmp/azmon makes /etc/config/settings /tmp/azmon/etc/config/settings
+	RootDirEnv = "AZMON_ROOT_DIR"
+	// OverridesEnv redirects paths, comma separated from=to pairs. A from directory redirects the paths under it
+	OverridesEnv = "AZMON_PATH_OVERRIDES"
+	// LocalModeEnv runs the plugins outside a cluster against the local kubelet and API server endpoints
+	LocalModeEnv = "AZMON_LOCAL_MODE"
+	// KubeletURLEnv is the kubelet (cAdvisor) endpoint of the local mode
+	KubeletURLEnv = "AZMON_LOCAL_KUBELET_URL"
+	// APIServerURLEnv is the API server endpoint of the local mode
+	APIServerURLEnv = "AZMON_LOCAL_API_SERVER_URL"
+)
+
+// DefaultKubeletURL is the kubelet read-only port on the local host
+const DefaultKubeletURL = "http://127.0.0.1:10255"
+
+// DefaultAPIServerURL is the address of kubectl proxy
+const DefaultAPIServerURL = "http://127.0.0.1:8001"
+
+// Override redirects From, or the paths under the From directory, to To
+type Override struct {
+	From string
+	To   string
+}
+
+// Settings of the path resolution and the local mode
+type Settings struct {
+	RootDir      string
+	Overrides    []Override
+	LocalMode    bool
+	KubeletURL   string
+	APIServerURL string
+}
+
+var current atomic.Pointer[Settings]
+
+func init() {
+	settings, _ := Load(os.Getenv)
+	Configure(settings)
+}
+
+// Load reads the settings from the env. Invalid overrides are skipped and reported in the error
+func Load(getenv func(string) string) (Settings, error) {
+	settings := Settings{
+		RootDir:      cleanDir(getenv(RootDirEnv)),
+		LocalMode:    strings.EqualFold(strings.TrimSpace(getenv(LocalModeEnv)), "true"),
+		KubeletURL:   strings.TrimSpace(getenv(KubeletURLEnv)),
+		APIServerURL: strings.TrimSpace(getenv(APIServerURLEnv)),
+	}
+	if settings.KubeletURL == "" {
+		settings.KubeletURL = DefaultKubeletURL
+	}
+	if settings.APIServerURL == "" {
+		settings.APIServerURL = DefaultAPIServerURL
+	}
+	overrides, err := ParseOverrides(getenv(OverridesEnv))
+	settings.Overrides = overrides
+	return settings, err
+}
+
+// ParseOverrides parses comma separated from=to pairs, longer from paths take precedence
+func ParseOverrides(s string) ([]Override, error) {
+	var overrides []Override
+	var invalid []string
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		from, to, found := strings.Cut(pair, "=")
+		from, to = cleanDir(from), cleanDir(to)
+		if !found || from == "" || to == "" {
+			invalid = append(invalid, strings.TrimSpace(pair))
+			continue
+		}
+		overrides = append(overrides, Override{From: from, To: to})
+	}
+	sort.SliceStable(overrides, func(i, j int) bool { return len(overrides[i].From) > len(overrides[j].From) })
+	if len(invalid) > 0 {
+		return overrides, fmt.Errorf("invalid path overrides %s, expected from=to", strings.Join(invalid, ", "))
+	}
+	return overrides, nil
+}
+
+// Configure replaces the settings
+func Configure(settings Settings) {
+	current.Store(&settings)
+}
+
+// Current returns the settings
+func Current() Settings {
+	return *current.Load()
+}
+
+// Resolve returns where the file or socket at path is. Overrides are used as is, otherwise the root dir prefixes
+// absolute paths. Paths already under the root dir, relative paths and named pipes are unchanged
+func Resolve(path string) string {
+	settings := current.Load()
+	if path == "" {
+		return path
+	}
+	for _, override := range settings.Overrides {
+		if under(path, override.From) {
+			return override.To + path[len(override.From):]
+		}
+	}
+	if settings.RootDir == "" || !strings.HasPrefix(path, "/") || under(path, settings.RootDir) {
+		return path
+	}
+	return filepath.Join(settings.RootDir, path)
+}
+
+// LocalMode returns whether the plugins run outside a cluster
+func LocalMode() bool {
+	return current.Load().LocalMode
+}
+
+// KubeletURL returns the kubelet endpoint of the local mode
+func KubeletURL() string {
+	return strings.TrimSuffix(current.Load().KubeletURL, "/")
+}
+
+// APIServerURL returns the API server endpoint of the local mode
+func APIServerURL() string {
+	return strings.TrimSuffix(current.Load().APIServerURL, "/")
+}
+
+func under(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+func cleanDir(dir string) string {
+	dir = strings.TrimSpace(dir)
+	if len(dir) > 1 {
+		dir = strings.TrimSuffix(dir, "/")
+	}
+	return dir
+}
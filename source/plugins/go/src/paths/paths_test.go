@@ -0,0 +1,55 @@
+package paths
+
+import (
+	"testing"
+)
+
+func configureFromEnv(t *testing.T, env map[string]string) error {
+	original := Current()
+	t.Cleanup(func() { Configure(original) })
+	settings, err := Load(func(name string) string { return env[name] })
+	Configure(settings)
+	return err
+}
+
+func TestResolveWithoutSettings(t *testing.T) {
+	configureFromEnv(t, map[string]string{})
+	for _, path := range []string{"/etc/config/settings", "/var/run/mdsd-ci/default_fluent.socket", "./fluent-bit-input.log", ""} {
+		if resolved := Resolve(path); resolved != path {
+			t.Errorf("expected %s unchanged, got %s", path, resolved)
+		}
+	}
+	if LocalMode() || KubeletURL() != DefaultKubeletURL || APIServerURL() != DefaultAPIServerURL {
+		t.Errorf("unexpected default settings %+v", Current())
+	}
+}
+
+func TestResolve(t *testing.T) {
+	err := configureFromEnv(t, map[string]string{
+		RootDirEnv:   "/tmp/azmon/",
+		OverridesEnv: "/var/run/mdsd-ci=/tmp/mdsd, /var/run/mdsd-ci/default_fluent.socket=/tmp/fake.socket,/etc/config=,broken",
+	})
+	if err == nil {
+		t.Errorf("expected the invalid overrides to be reported")
+	}
+	for path, expected := range map[string]string{
+		"/etc/config/settings":                         "/tmp/azmon/etc/config/settings",
+		"/tmp/azmon/etc/config/settings":               "/tmp/azmon/etc/config/settings",
+		"/var/run/mdsd-ci/default_fluent.socket":       "/tmp/fake.socket",
+		"/var/run/mdsd-ci/other.socket":                "/tmp/mdsd/other.socket",
+		"/var/run/mdsd-ci-other/default_fluent.socket": "/tmp/azmon/var/run/mdsd-ci-other/default_fluent.socket",
+		"./fluent-bit-input.log":                       "./fluent-bit-input.log",
+		`\\.\pipe\ContainerLog`:                        `\\.\pipe\ContainerLog`,
+	} {
+		if resolved := Resolve(path); resolved != expected {
+			t.Errorf("Resolve(%s) = %s, expected %s", path, resolved, expected)
+		}
+	}
+}
+
+func TestLocalMode(t *testing.T) {
+	configureFromEnv(t, map[string]string{LocalModeEnv: "TRUE", KubeletURLEnv: "http://127.0.0.1:20255/", APIServerURLEnv: "http://127.0.0.1:28001"})
+	if !LocalMode() || KubeletURL() != "http://127.0.0.1:20255" || APIServerURL() != "http://127.0.0.1:28001" {
+		t.Errorf("unexpected local mode settings %+v", Current())
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/telemetry"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+// out_oms [OUTPUT] keys that override the env configuration of one instance
+const (
+	// PluginInstanceContainerLogsRouteKey v2 (mdsd/ama) or v1 (ODS direct)
+	PluginInstanceContainerLogsRouteKey = "ContainerLogsRoute"
+	// PluginInstanceContainerLogSchemaVersionKey v2 (ContainerLogV2) or v1 (ContainerLog)
+	PluginInstanceContainerLogSchemaVersionKey = "ContainerLogSchemaVersion"
+)
+
+// [OUTPUT] keys of the workspace, endpoint and stream settings, they are process wide and only read from the env. An
+// [OUTPUT] section that sets one is rejected instead of sending to the destination of the other sections
+var pluginInstanceProcessWideKeys = []string{"WSID", "DOMAIN", envAKSResourceID, "OMSEndpoint", "AZMON_CONTAINER_LOGS_ROUTE", "AZMON_CONTAINER_LOG_SCHEMA_VERSION", "GENEVA_LOGS_INTEGRATION"}
+
+// PluginInstance is one out_oms [OUTPUT] section with its own routing, stream tags and connections. fluent-bit flushes an
+// output concurrently from each of its Workers threads, so a flush runs on a worker of the instance, a copy of its
+// routing with its own stream tags and connections. Only the container log route and schema version are configured per
+// instance. The workspace and ODS endpoint, the HTTP client, the tickers, the container image and extension maps, the
+// KubeMonAgentEvents and config snapshot connections and the telemetry are process wide and shared by the instances,
+// checkPluginInstanceKeys rejects the [OUTPUT] sections that try to set them
+type PluginInstance struct {
+	ID   int
+	Name string
+	// container log route for routing thru oneagent
+	ContainerLogsRouteV2 bool
+	// container log schema version of the [OUTPUT] section, empty to use the configmap or DCR schema
+	ContainerLogSchemaVersion string
+
+	// container log or container log v2 tag name for oneagent route
+	MdsdContainerLogTagName string
+	// ContainerLog Tag Refresh Tracker
+	MdsdContainerLogTagRefreshTracker time.Time
+	// InsightsMetrics tag name for oneagent route
+	MdsdInsightsMetricsTagName string
+	// InsightsMetrics Tag Refresh Tracker
+	MdsdInsightsMetricsTagRefreshTracker time.Time
+	// host logs tag name for oneagent route
+	MdsdHostLogTagName string
+	// HostLogs Tag Refresh Tracker
+	MdsdHostLogTagRefreshTracker time.Time
+
+	// Client for MDSD msgp Unix socket
+	MdsdMsgpUnixSocketClient net.Conn
+	// Client for MDSD msgp Unix socket for Insights Metrics
+	MdsdInsightsMetricsMsgpUnixSocketClient net.Conn
+	// Client for MDSD msgp Unix socket for Input Plugin Records
+	MdsdInputPluginRecordsMsgpUnixSocketClient net.Conn
+	// Client for MDSD msgp Unix socket for host logs
+	MdsdHostLogsMsgpUnixSocketClient net.Conn
+	// named pipe connection to send ContainerLog for AMA
+	ContainerLogNamedPipe net.Conn
+	// named pipe connection to send InsightsMetrics for AMA
+	InsightsMetricsNamedPipe net.Conn
+	// named pipe connection to ContainerInventory for AMA
+	InputPluginNamedPipe net.Conn
+	// named pipe connection to send host logs for AMA
+	HostLogsNamedPipe net.Conn
+	// NamedPipe and namedpipe connection cache for windows multi-tenancy
+	NamedPipeConnectionCache map[string]net.Conn
+
+	// workers of the instance, the instance itself is its first worker. nil for the other workers
+	workers *flushWorkers
+	// exited is set once fluent-bit exited the instance, guarded by PluginInstancesMutex
+	exited bool
+}
+
+// maxFlushWorkers bounds the workers of an instance, each one has its own connections. fluent-bit flushes an output
+// from at most its Workers threads, a flush beyond the bound waits for an idle worker
+const maxFlushWorkers = 16
+
+// flushWorkers are the workers of an instance, idle ones are reused by the next flush
+type flushWorkers struct {
+	mutex sync.Mutex
+	// released signals that a worker became idle
+	released *sync.Cond
+	idle     []*PluginInstance
+	count    int
+}
+
+func newFlushWorkers(first *PluginInstance) *flushWorkers {
+	workers := &flushWorkers{idle: []*PluginInstance{first}, count: 1}
+	workers.released = sync.NewCond(&workers.mutex)
+	return workers
+}
+
+var (
+	// PluginInstances created by FLBPluginInit, in order
+	PluginInstances []*PluginInstance
+	// PluginInstancesMutex guards PluginInstances and pluginTelemetryPushInterval
+	PluginInstancesMutex = &sync.Mutex{}
+	// pluginTelemetryPushInterval of the first [OUTPUT] section that enables the telemetry, nil before
+	pluginTelemetryPushInterval *string
+)
+
+// checkPluginInstanceKeys returns an error for an [OUTPUT] section that sets a process wide setting or a telemetry
+// push interval other than the one of the section that started the telemetry
+func checkPluginInstanceKeys(name string, getConfigKey func(key string) string) error {
+	for _, key := range pluginInstanceProcessWideKeys {
+		if getConfigKey(key) != "" {
+			return fmt.Errorf("%s is process wide and can't be set in the [OUTPUT] section %s, set it in the env of the agent", key, name)
+		}
+	}
+	if !strings.EqualFold(getConfigKey("EnableTelemetry"), "true") {
+		return nil
+	}
+	interval := getConfigKey("TelemetryPushIntervalSeconds")
+	PluginInstancesMutex.Lock()
+	defer PluginInstancesMutex.Unlock()
+	if pluginTelemetryPushInterval == nil {
+		pluginTelemetryPushInterval = &interval
+	} else if *pluginTelemetryPushInterval != interval {
+		return fmt.Errorf("TelemetryPushIntervalSeconds %s of the [OUTPUT] section %s conflicts with %s of the telemetry, the telemetry is process wide", interval, name, *pluginTelemetryPushInterval)
+	}
+	return nil
+}
+
+// NewPluginInstance creates an instance from the env configuration and its [OUTPUT] overrides. getConfigKey returns
+// the value of an [OUTPUT] key or an empty string. InitializePlugin has to run before the first instance is created
+func NewPluginInstance(name string, getConfigKey func(key string) string) *PluginInstance {
+	instance := &PluginInstance{Name: name, ContainerLogsRouteV2: ContainerLogsRouteV2}
+
+	switch route := strings.TrimSpace(strings.ToLower(getConfigKey(PluginInstanceContainerLogsRouteKey))); route {
+	case "":
+	case ContainerLogsV2Route:
+		instance.ContainerLogsRouteV2 = true
+	case "v1":
+		instance.ContainerLogsRouteV2 = false
+	default:
+		Log("Error::config::Invalid %s value %s for output %s. Using %v", PluginInstanceContainerLogsRouteKey, route, name, instance.ContainerLogsRouteV2)
+	}
+
+	switch schemaVersion := strings.TrimSpace(strings.ToLower(getConfigKey(PluginInstanceContainerLogSchemaVersionKey))); schemaVersion {
+	case "":
+	case ContainerLogV2SchemaVersion, "v1":
+		instance.ContainerLogSchemaVersion = schemaVersion
+	default:
+		Log("Error::config::Invalid %s value %s for output %s", PluginInstanceContainerLogSchemaVersionKey, schemaVersion, name)
+	}
+
+	if !instance.ContainerLogsRouteV2 && !ContainerLogsRouteADX && HTTPClient.Transport == nil {
+		// the HTTP client is shared by the instances that use the ODS direct route
+		CreateHTTPClient()
+	}
+
+	PluginInstancesMutex.Lock()
+	defer PluginInstancesMutex.Unlock()
+	instance.ID = len(PluginInstances)
+	if instance.Name == "" {
+		instance.Name = fmt.Sprintf("oms.%d", instance.ID)
+	}
+	instance = instance.newWorker()
+	instance.workers = newFlushWorkers(instance)
+	PluginInstances = append(PluginInstances, instance)
+	Log("Plugin instance %d (%s): ContainerLogsRouteV2: %v, ContainerLogSchemaVersion: %s", instance.ID, instance.Name, instance.ContainerLogsRouteV2, instance.ContainerLogSchemaVersion)
+	return instance
+}
+
+// newWorker returns a worker with the routing of the instance and without connections
+func (instance *PluginInstance) newWorker() *PluginInstance {
+	now := time.Now()
+	return &PluginInstance{
+		ID:                                   instance.ID,
+		Name:                                 instance.Name,
+		ContainerLogsRouteV2:                 instance.ContainerLogsRouteV2,
+		ContainerLogSchemaVersion:            instance.ContainerLogSchemaVersion,
+		MdsdInsightsMetricsTagName:           MdsdInsightsMetricsSourceName,
+		MdsdInsightsMetricsTagRefreshTracker: now,
+		MdsdContainerLogTagRefreshTracker:    now,
+		MdsdHostLogTagName:                   MdsdHostLogSourceName,
+		MdsdHostLogTagRefreshTracker:         now,
+	}
+}
+
+// acquireWorker returns an idle worker of the instance or a new one when all of them are flushing. Once the instance
+// has maxFlushWorkers, it waits for a worker to become idle
+func (instance *PluginInstance) acquireWorker() *PluginInstance {
+	if instance.workers == nil {
+		return instance
+	}
+	instance.workers.mutex.Lock()
+	defer instance.workers.mutex.Unlock()
+	for len(instance.workers.idle) == 0 && instance.workers.count >= maxFlushWorkers {
+		instance.workers.released.Wait()
+	}
+	if n := len(instance.workers.idle); n > 0 {
+		worker := instance.workers.idle[n-1]
+		instance.workers.idle = instance.workers.idle[:n-1]
+		return worker
+	}
+	instance.workers.count++
+	Log("Info::flush::Creating flush worker %d of output %s", instance.workers.count, instance.Name)
+	return instance.newWorker()
+}
+
+// releaseWorker returns the worker to the idle workers of the instance
+func (instance *PluginInstance) releaseWorker(worker *PluginInstance) {
+	if instance.workers == nil {
+		return
+	}
+	instance.workers.mutex.Lock()
+	instance.workers.idle = append(instance.workers.idle, worker)
+	instance.workers.mutex.Unlock()
+	instance.workers.released.Signal()
+}
+
+// containerLogSchema returns whether the instance sends ContainerLogV2 and whether that is fixed by the configuration,
+// otherwise the DCR of the AAD MSI auth mode decides
+func (instance *PluginInstance) containerLogSchema() (schemaV2 bool, fixed bool) {
+	switch instance.ContainerLogSchemaVersion {
+	case ContainerLogV2SchemaVersion:
+		return true, true
+	case "v1":
+		return false, true
+	}
+	return ContainerLogSchemaV2, ContainerLogV2ConfigMap
+}
+
+// connect creates the connections of the instance at startup, flushes re-create them when they are missing
+func (instance *PluginInstance) connect() {
+	if instance.ContainerLogsRouteV2 {
+		if IsWindows {
+			datatype := ContainerLogDataType
+			if schemaV2, _ := instance.containerLogSchema(); schemaV2 {
+				datatype = ContainerLogV2DataType
+			}
+			EnsureGenevaOr3PNamedPipeExists(&instance.ContainerLogNamedPipe, datatype, &ContainerLogsWindowsAMAClientCreateErrors, IsGenevaLogsIntegrationEnabled, &instance.MdsdContainerLogTagRefreshTracker)
+		} else {
+			CreateMDSDClient(&instance.MdsdMsgpUnixSocketClient, ContainerLogV2, ContainerType)
+		}
+	}
+	if !IsWindows {
+		Log("Creating MDSD client for InsightsMetrics of output %s", instance.Name)
+		CreateMDSDClient(&instance.MdsdInsightsMetricsMsgpUnixSocketClient, InsightsMetrics, ContainerType)
+	} else if IsAADMSIAuthMode {
+		Log("Creating AMA client for InsightsMetrics of output %s", instance.Name)
+		EnsureGenevaOr3PNamedPipeExists(&instance.InsightsMetricsNamedPipe, InsightsMetricsDataType, &InsightsMetricsWindowsAMAClientCreateErrors, false, &instance.MdsdInsightsMetricsTagRefreshTracker)
+	}
+}
+
+// Flush sends the records of a fluent-bit flush through an idle worker of the instance
+func (instance *PluginInstance) Flush(records []map[interface{}]interface{}, incomingTag string) int {
+	atomic.AddInt64(&inFlightFlushes, 1)
+	defer atomic.AddInt64(&inFlightFlushes, -1)
+	worker := instance.acquireWorker()
+	defer instance.releaseWorker(worker)
+	return worker.flush(records, incomingTag)
+}
+
+// flush sends the records to the handler of their tag and records the result for the health checks
+func (instance *PluginInstance) flush(records []map[interface{}]interface{}, incomingTag string) int {
+	var ret int
+	var dataType string
+	switch {
+	case strings.Contains(incomingTag, "oms.container.log.flbplugin"):
+		// This will also include populating cache to be sent as for config events
+		return PushToAppInsightsTraces(records, telemetry.SeverityInformation, incomingTag)
+	case strings.Contains(incomingTag, "oms.container.perf.telegraf"):
+		ret, dataType = instance.PostTelegrafMetricsToLA(records), healthInsightsMetrics
+	case strings.Contains(incomingTag, "oms.container.oneagent.containerinsights"):
+		ret, dataType = instance.PostInputPluginRecords(records), healthInputPluginRecords
+	case isHostLogTag(incomingTag):
+		ret, dataType = instance.PostHostLogRecords(records, incomingTag), healthHostLogs
+	default:
+		ret, dataType = instance.PostDataHelper(records), healthContainerLog
+	}
+	PipelineHealth.recordFlushResult(dataType, ret == output.FLB_OK, time.Now())
+	return ret
+}
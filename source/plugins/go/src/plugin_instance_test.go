@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+// brokenMdsdConn fails every write like a connection mdsd has closed
+type brokenMdsdConn struct {
+	fakeMdsdConn
+}
+
+func (c *brokenMdsdConn) Write(b []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func resetPluginInstances(t *testing.T) {
+	origInstances, origRouteV2, origSchemaV2, origConfigMap, origInterval := PluginInstances, ContainerLogsRouteV2, ContainerLogSchemaV2, ContainerLogV2ConfigMap, pluginTelemetryPushInterval
+	t.Cleanup(func() {
+		PluginInstances, ContainerLogsRouteV2, ContainerLogSchemaV2, ContainerLogV2ConfigMap, pluginTelemetryPushInterval = origInstances, origRouteV2, origSchemaV2, origConfigMap, origInterval
+	})
+	PluginInstances, pluginTelemetryPushInterval = nil, nil
+}
+
+func instanceConfig(config map[string]string) func(key string) string {
+	return func(key string) string { return config[key] }
+}
+
+func TestNewPluginInstanceOverrides(t *testing.T) {
+	resetPluginInstances(t)
+	ContainerLogsRouteV2, ContainerLogSchemaV2, ContainerLogV2ConfigMap = true, false, false
+
+	first := NewPluginInstance("logs", instanceConfig(nil))
+	second := NewPluginInstance("", instanceConfig(map[string]string{
+		PluginInstanceContainerLogSchemaVersionKey: "V2",
+	}))
+	invalid := NewPluginInstance("invalid", instanceConfig(map[string]string{
+		PluginInstanceContainerLogsRouteKey:        "adx2",
+		PluginInstanceContainerLogSchemaVersionKey: "v3",
+	}))
+
+	if schemaV2, fixed := first.containerLogSchema(); schemaV2 || fixed {
+		t.Errorf("expected the first instance to leave the schema to the configmap and DCR, got %v, %v", schemaV2, fixed)
+	}
+	if second.Name != "oms.1" || !second.ContainerLogsRouteV2 {
+		t.Errorf("expected a default name and the env route, got %s %v", second.Name, second.ContainerLogsRouteV2)
+	}
+	if schemaV2, fixed := second.containerLogSchema(); !schemaV2 || !fixed {
+		t.Errorf("expected the schema override to apply, got %v, %v", schemaV2, fixed)
+	}
+	if !invalid.ContainerLogsRouteV2 || invalid.ContainerLogSchemaVersion != "" {
+		t.Errorf("expected invalid values to keep the defaults, got %+v", invalid)
+	}
+	if len(PluginInstances) != 3 || PluginInstances[2] != invalid {
+		t.Errorf("expected 3 instances in order, got %d", len(PluginInstances))
+	}
+
+	// the configmap schema applies to the instances without an override
+	ContainerLogSchemaV2, ContainerLogV2ConfigMap = true, true
+	if schemaV2, fixed := first.containerLogSchema(); !schemaV2 || !fixed {
+		t.Errorf("expected the configmap schema, got %v, %v", schemaV2, fixed)
+	}
+}
+
+func TestCheckPluginInstanceKeys(t *testing.T) {
+	resetPluginInstances(t)
+	telemetry := map[string]string{"EnableTelemetry": "true", "TelemetryPushIntervalSeconds": "300"}
+
+	if err := checkPluginInstanceKeys("logs", instanceConfig(telemetry)); err != nil {
+		t.Errorf("expected the first section to be accepted, got %v", err)
+	}
+	if err := checkPluginInstanceKeys("logsv2", instanceConfig(map[string]string{PluginInstanceContainerLogSchemaVersionKey: "v2", "EnableTelemetry": "true", "TelemetryPushIntervalSeconds": "300"})); err != nil {
+		t.Errorf("expected the per instance keys and the same telemetry interval to be accepted, got %v", err)
+	}
+	if err := checkPluginInstanceKeys("other", instanceConfig(map[string]string{"WSID": "other-workspace"})); err == nil {
+		t.Errorf("expected a section with its own workspace to be rejected")
+	}
+	if err := checkPluginInstanceKeys("fast", instanceConfig(map[string]string{"EnableTelemetry": "true", "TelemetryPushIntervalSeconds": "60"})); err == nil {
+		t.Errorf("expected a conflicting telemetry interval to be rejected")
+	}
+	if err := checkPluginInstanceKeys("quiet", instanceConfig(map[string]string{"TelemetryPushIntervalSeconds": "60"})); err != nil {
+		t.Errorf("expected the interval of a section without telemetry to be ignored, got %v", err)
+	}
+}
+
+func TestPluginInstancesDoNotShareConnections(t *testing.T) {
+	resetPluginInstances(t)
+	origWindows, origMSI, origGeneva := IsWindows, IsAADMSIAuthMode, IsGenevaLogsIntegrationEnabled
+	defer func() { IsWindows, IsAADMSIAuthMode, IsGenevaLogsIntegrationEnabled = origWindows, origMSI, origGeneva }()
+	IsWindows, IsAADMSIAuthMode, IsGenevaLogsIntegrationEnabled = false, false, false
+	ContainerLogsRouteV2 = true
+
+	logs := NewPluginInstance("logs", instanceConfig(nil))
+	logsV2 := NewPluginInstance("logsv2", instanceConfig(map[string]string{PluginInstanceContainerLogSchemaVersionKey: "v2"}))
+	logsConn, logsV2Conn := &brokenMdsdConn{}, newFakeMdsdConn(true)
+	logs.MdsdMsgpUnixSocketClient, logsV2.MdsdMsgpUnixSocketClient = logsConn, logsV2Conn
+
+	records := []map[interface{}]interface{}{{
+		"filepath": []byte("/var/log/containers/app-5d4f_default_app-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.log"),
+		"stream":   []byte("stdout"),
+		"log":      []byte("hello"),
+		"time":     []byte("2024-05-01T12:00:00Z"),
+	}}
+	if ret := logs.Flush(records, "oms.container.log.la.tail"); ret != output.FLB_RETRY {
+		t.Errorf("expected the failed write to be retried, got %d", ret)
+	}
+	if ret := logsV2.Flush(records, "oms.container.log.la.tail"); ret != output.FLB_OK {
+		t.Errorf("expected the second instance to flush through its own connection, got %d", ret)
+	}
+	if logs.MdsdMsgpUnixSocketClient != nil || logsV2.MdsdMsgpUnixSocketClient == nil {
+		t.Errorf("expected the failed connection to be closed only for its instance")
+	}
+	if logs.MdsdContainerLogTagName != MdsdContainerLogSourceName || logsV2.MdsdContainerLogTagName != MdsdContainerLogV2SourceName {
+		t.Errorf("expected a stream tag per instance, got %s and %s", logs.MdsdContainerLogTagName, logsV2.MdsdContainerLogTagName)
+	}
+}
+
+// exclusiveMdsdConn fails the test when two flushes write to it at the same time
+type exclusiveMdsdConn struct {
+	fakeMdsdConn
+	t      *testing.T
+	inUse  int32
+	writes int32
+}
+
+func (c *exclusiveMdsdConn) Write(b []byte) (int, error) {
+	if !atomic.CompareAndSwapInt32(&c.inUse, 0, 1) {
+		c.t.Errorf("expected a connection to be used by one flush at a time")
+		return len(b), nil
+	}
+	atomic.AddInt32(&c.writes, 1)
+	time.Sleep(time.Millisecond)
+	atomic.StoreInt32(&c.inUse, 0)
+	return len(b), nil
+}
+
+func TestFlushWorkersDoNotShareConnections(t *testing.T) {
+	resetPluginInstances(t)
+	ContainerLogsRouteV2 = true
+
+	const workers = 6
+	instance := NewPluginInstance("logs", instanceConfig(nil))
+	conns := []*exclusiveMdsdConn{{t: t}}
+	instance.MdsdMsgpUnixSocketClient = conns[0]
+	for i := 1; i < workers; i++ {
+		worker := instance.newWorker()
+		conn := &exclusiveMdsdConn{t: t}
+		worker.MdsdMsgpUnixSocketClient = conn
+		conns = append(conns, conn)
+		instance.releaseWorker(worker)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < workers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				records := []map[interface{}]interface{}{{
+					"filepath": []byte(fmt.Sprintf("/var/log/containers/app-%d_default_app-%064d.log", g, i)),
+					"stream":   []byte("stdout"),
+					"log":      []byte("hello"),
+				}}
+				if ret := instance.Flush(records, "oms.container.log.la.tail"); ret != output.FLB_OK {
+					t.Errorf("expected FLB_OK, got %d", ret)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var writes int32
+	for _, conn := range conns {
+		writes += atomic.LoadInt32(&conn.writes)
+	}
+	if writes != workers*20 {
+		t.Errorf("expected %d writes, got %d", workers*20, writes)
+	}
+	if len(instance.workers.idle) != workers {
+		t.Errorf("expected the %d workers to be idle after the flushes, got %d", workers, len(instance.workers.idle))
+	}
+}
+
+func TestAcquireWorkerIsBounded(t *testing.T) {
+	resetPluginInstances(t)
+	ContainerLogsRouteV2 = true
+	instance := NewPluginInstance("logs", instanceConfig(nil))
+
+	var workers []*PluginInstance
+	for i := 0; i < maxFlushWorkers; i++ {
+		workers = append(workers, instance.acquireWorker())
+	}
+	acquired := make(chan *PluginInstance)
+	go func() { acquired <- instance.acquireWorker() }()
+	select {
+	case <-acquired:
+		t.Fatalf("expected the flush to wait once the instance has %d workers", maxFlushWorkers)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	instance.releaseWorker(workers[0])
+	select {
+	case worker := <-acquired:
+		if worker != workers[0] {
+			t.Errorf("expected the released worker to be reused")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the released worker to be acquired")
+	}
+	if instance.workers.count != maxFlushWorkers {
+		t.Errorf("expected %d workers, got %d", maxFlushWorkers, instance.workers.count)
+	}
+}
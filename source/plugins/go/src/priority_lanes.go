@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// env variable to enable the priority send lanes of the mdsd route on linux. They are opt-in: the flush workers of an
+// instance share the connection of their lane instead of having their own one
+const PriorityLanesEnabledEnv = "AZMON_PRIORITY_LANES_ENABLED"
+
+// env variables for the queue size of each lane e.g. AZMON_PRIORITY_LANE_LOW_QUEUE_SIZE
+const priorityLaneQueueSizeEnvFormat = "AZMON_PRIORITY_LANE_%s_QUEUE_SIZE"
+
+// LanePriority of a send lane
+type LanePriority int
+
+const (
+	// LaneHigh KubeMonAgentEvents, config snapshots and agent health signals
+	LaneHigh LanePriority = iota
+	// LaneMedium InsightsMetrics, Perf and other input plugin records
+	LaneMedium
+	// LaneLow container logs and host logs
+	LaneLow
+)
+
+func (priority LanePriority) String() string {
+	switch priority {
+	case LaneHigh:
+		return "high"
+	case LaneMedium:
+		return "medium"
+	case LaneLow:
+		return "low"
+	}
+	return "unknown"
+}
+
+var (
+	// ErrLaneQueueFull is returned when a lane can't accept a payload within its enqueue timeout
+	ErrLaneQueueFull = errors.New("priority lane queue is full")
+	// ErrLaneTimeout is returned when the write of a queued payload didn't start within the lane wait timeout
+	ErrLaneTimeout = errors.New("priority lane write timed out")
+	// ErrLaneClosed is returned after the lane was closed
+	ErrLaneClosed = errors.New("priority lane is closed")
+)
+
+// laneSettings queue bounds and deadlines of a lane. Low priority waits the least for queue space so that a log flood is
+// pushed back to fluent-bit (FLB_RETRY) instead of holding up the flushes of higher priority data
+type laneSettings struct {
+	queueSize      int
+	enqueueTimeout time.Duration
+	writeDeadline  time.Duration
+}
+
+var defaultLaneSettings = map[LanePriority]laneSettings{
+	LaneHigh:   {queueSize: 64, enqueueTimeout: 10 * time.Second, writeDeadline: 5 * time.Second},
+	LaneMedium: {queueSize: 32, enqueueTimeout: 5 * time.Second, writeDeadline: 10 * time.Second},
+	LaneLow:    {queueSize: 8, enqueueTimeout: 1 * time.Second, writeDeadline: 10 * time.Second},
+}
+
+// SendLane serializes writes of one priority over its own mdsd connection
+type SendLane struct {
+	Priority       LanePriority
+	EnqueueTimeout time.Duration
+	WriteDeadline  time.Duration
+
+	// waitTimeout bounds the wait of a queued payload for its write to start
+	waitTimeout time.Duration
+	dial        func() (net.Conn, error)
+	conn        net.Conn
+	queue       chan *laneRequest
+	done        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+	rejected    int64
+	timedOut    int64
+	// rejected and timed out payloads since the start, exported as prometheus counters
+	rejectedTotal int64
+	timedOutTotal int64
+}
+
+type laneRequest struct {
+	payload []byte
+	// state is laneRequestQueued until the worker starts the write or the sender gives up waiting for it to start
+	state  int32
+	result chan laneResult
+}
+
+// states of a queued payload
+const (
+	laneRequestQueued int32 = iota
+	laneRequestStarted
+	laneRequestCancelled
+)
+
+type laneResult struct {
+	bytes int
+	err   error
+}
+
+var (
+	// PriorityLanesEnabled routes mdsd writes through the priority send lanes
+	PriorityLanesEnabled bool
+	// PriorityLanes per priority, only populated when PriorityLanesEnabled
+	PriorityLanes = make(map[LanePriority]*SendLane)
+)
+
+// NewSendLane creates a lane and starts its writer goroutine
+func NewSendLane(priority LanePriority, queueSize int, enqueueTimeout time.Duration, writeDeadline time.Duration, dial func() (net.Conn, error)) *SendLane {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	lane := &SendLane{
+		Priority:       priority,
+		EnqueueTimeout: enqueueTimeout,
+		WriteDeadline:  writeDeadline,
+		// the payload may wait behind a full queue, each of which is bounded by the write deadline and the dial timeout
+		waitTimeout: time.Duration(queueSize+1) * (writeDeadline + mdsdDialTimeout),
+		dial:        dial,
+		queue:       make(chan *laneRequest, queueSize),
+		done:        make(chan struct{}),
+	}
+	lane.wg.Add(1)
+	go lane.run()
+	return lane
+}
+
+func (lane *SendLane) run() {
+	defer lane.wg.Done()
+	for {
+		select {
+		case <-lane.done:
+			if lane.conn != nil {
+				lane.conn.Close()
+				lane.conn = nil
+			}
+			return
+		case req := <-lane.queue:
+			if !atomic.CompareAndSwapInt32(&req.state, laneRequestQueued, laneRequestStarted) {
+				continue
+			}
+			bts, err := lane.write(req.payload)
+			req.result <- laneResult{bytes: bts, err: err}
+		}
+	}
+}
+
+func (lane *SendLane) write(payload []byte) (int, error) {
+	if lane.conn == nil {
+		conn, err := lane.dial()
+		if err != nil {
+			return 0, err
+		}
+		lane.conn = conn
+	}
+	lane.conn.SetWriteDeadline(time.Now().Add(lane.WriteDeadline))
+	bts, err := lane.conn.Write(payload)
+	if err != nil {
+		lane.conn.Close()
+		lane.conn = nil
+		return bts, err
+	}
+	return bts, nil
+}
+
+// Write queues the payload and waits for the lane to write it. Payloads that can't be queued within the enqueue timeout
+// or whose write didn't start in time fail, so the caller can return FLB_RETRY. A write that started is waited for, it
+// is bounded by the write deadline, so that a payload mdsd received isn't retried
+func (lane *SendLane) Write(payload []byte) (int, error) {
+	req := &laneRequest{payload: payload, result: make(chan laneResult, 1)}
+	enqueueTimer := time.NewTimer(lane.EnqueueTimeout)
+	defer enqueueTimer.Stop()
+	select {
+	case <-lane.done:
+		return 0, ErrLaneClosed
+	case lane.queue <- req:
+	case <-enqueueTimer.C:
+		atomic.AddInt64(&lane.rejected, 1)
+		atomic.AddInt64(&lane.rejectedTotal, 1)
+		return 0, ErrLaneQueueFull
+	}
+
+	waitTimer := time.NewTimer(lane.waitTimeout)
+	defer waitTimer.Stop()
+	select {
+	case res := <-req.result:
+		return res.bytes, res.err
+	case <-lane.done:
+		if atomic.CompareAndSwapInt32(&req.state, laneRequestQueued, laneRequestCancelled) {
+			return 0, ErrLaneClosed
+		}
+	case <-waitTimer.C:
+		if atomic.CompareAndSwapInt32(&req.state, laneRequestQueued, laneRequestCancelled) {
+			atomic.AddInt64(&lane.timedOut, 1)
+			atomic.AddInt64(&lane.timedOutTotal, 1)
+			return 0, ErrLaneTimeout
+		}
+	}
+	res := <-req.result
+	return res.bytes, res.err
+}
+
+// Close stops the writer goroutine and closes the lane connection. Queued payloads fail with ErrLaneClosed
+func (lane *SendLane) Close() {
+	lane.closeOnce.Do(func() {
+		close(lane.done)
+	})
+	lane.wg.Wait()
+}
+
+// takeRejectedCounts returns and resets the number of rejected and timed out payloads of the lane
+func (lane *SendLane) takeRejectedCounts() (int64, int64) {
+	return atomic.SwapInt64(&lane.rejected, 0), atomic.SwapInt64(&lane.timedOut, 0)
+}
+
+// totalRejectedCounts returns the number of rejected and timed out payloads of the lane since the start
+func (lane *SendLane) totalRejectedCounts() (int64, int64) {
+	return atomic.LoadInt64(&lane.rejectedTotal), atomic.LoadInt64(&lane.timedOutTotal)
+}
+
+// getLanePriority returns the lane of an mdsd data type
+func getLanePriority(dataType DataType) LanePriority {
+	switch dataType {
+	case KubeMonAgentEvents, ConfigSnapshot:
+		return LaneHigh
+	case InsightsMetrics, InputPluginRecords:
+		return LaneMedium
+	}
+	return LaneLow
+}
+
+// getPriorityLane returns the lane of the data type or nil if priority lanes are disabled
+func getPriorityLane(dataType DataType) *SendLane {
+	if !PriorityLanesEnabled {
+		return nil
+	}
+	return PriorityLanes[getLanePriority(dataType)]
+}
+
+// newMdsdLaneDialer dials the mdsd socket of the data type. The circuit breaker of the lane is checked by CreateMDSDClient
+// before a data type client is handed the lane. A failed dial fails the write, whose result the sender records on the
+// breaker, so the dial doesn't record it again
+func newMdsdLaneDialer(dataType DataType) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return net.DialTimeout("unix", getMdsdSocketPath(dataType, ContainerType), mdsdDialTimeout)
+	}
+}
+
+func getLaneDestination(priority LanePriority) string {
+	return "mdsd:lane-" + priority.String()
+}
+
+// laneConn lets a data type client (e.g. MdsdMsgpUnixSocketClient) write through its lane, so the writers in oms.go are
+// the same with and without priority lanes. Closing it doesn't close the lane, the lane owns the mdsd connection
+type laneConn struct {
+	lane *SendLane
+}
+
+func (c *laneConn) Write(payload []byte) (int, error) { return c.lane.Write(payload) }
+
+func (c *laneConn) Read(b []byte) (int, error) {
+	return 0, fmt.Errorf("priority lane %s is write only", c.lane.Priority)
+}
+
+func (c *laneConn) Close() error { return nil }
+
+func (c *laneConn) LocalAddr() net.Addr { return nil }
+
+func (c *laneConn) RemoteAddr() net.Addr { return nil }
+
+// the lane applies its own write deadline
+func (c *laneConn) SetDeadline(t time.Time) error { return nil }
+
+func (c *laneConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *laneConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func populatePriorityLaneSettings(config *PluginConfig) {
+	PriorityLanesEnabled = !IsWindows && config.PriorityLanesEnabled
+	if !PriorityLanesEnabled {
+		Log("Priority lanes disabled")
+		return
+	}
+	laneDataTypes := map[LanePriority]DataType{LaneHigh: KubeMonAgentEvents, LaneMedium: InsightsMetrics, LaneLow: ContainerLogV2}
+	for priority, dataType := range laneDataTypes {
+		settings := defaultLaneSettings[priority]
+		queueSize := config.PriorityLaneQueueSizes[priority]
+		PriorityLanes[priority] = NewSendLane(priority, queueSize, settings.enqueueTimeout, settings.writeDeadline, newMdsdLaneDialer(dataType))
+		Log("Priority lane %s: queue size %d, enqueue timeout %s, write deadline %s", priority, queueSize, settings.enqueueTimeout, settings.writeDeadline)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/paths"
+)
+
+// fakeMdsdConn is a net.Conn that blocks writes while the gate is closed and records the written payloads
+type fakeMdsdConn struct {
+	net.Conn
+	gate    chan struct{}
+	mutex   sync.Mutex
+	written [][]byte
+}
+
+func (c *fakeMdsdConn) Write(b []byte) (int, error) {
+	<-c.gate
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *fakeMdsdConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *fakeMdsdConn) Close() error { return nil }
+
+func newFakeMdsdConn(open bool) *fakeMdsdConn {
+	c := &fakeMdsdConn{gate: make(chan struct{})}
+	if open {
+		close(c.gate)
+	}
+	return c
+}
+
+func TestSendLaneWritesInOrder(t *testing.T) {
+	conn := newFakeMdsdConn(true)
+	lane := NewSendLane(LaneMedium, 4, time.Second, time.Second, func() (net.Conn, error) { return conn, nil })
+	defer lane.Close()
+
+	for _, payload := range []string{"a", "b", "c"} {
+		if n, err := lane.Write([]byte(payload)); err != nil || n != 1 {
+			t.Fatalf("Write(%s) = %d, %v", payload, n, err)
+		}
+	}
+	if len(conn.written) != 3 || string(conn.written[0]) != "a" || string(conn.written[2]) != "c" {
+		t.Errorf("expected payloads in order, got %q", conn.written)
+	}
+}
+
+func TestSlowLowLaneDoesNotStarveHighLane(t *testing.T) {
+	lowConn := newFakeMdsdConn(false)
+	highConn := newFakeMdsdConn(true)
+	low := NewSendLane(LaneLow, 1, 50*time.Millisecond, time.Second, func() (net.Conn, error) { return lowConn, nil })
+	high := NewSendLane(LaneHigh, 4, time.Second, time.Second, func() (net.Conn, error) { return highConn, nil })
+	defer high.Close()
+
+	// fill the low lane: one payload blocked in the write, one queued
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			low.Write([]byte("log"))
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := low.Write([]byte("log")); err != ErrLaneQueueFull {
+		t.Errorf("expected a full low lane to reject the payload, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the low lane to reject within its enqueue timeout, took %s", elapsed)
+	}
+
+	if _, err := high.Write([]byte("event")); err != nil {
+		t.Fatalf("expected the high lane to write while the low lane is blocked, got %v", err)
+	}
+	if len(highConn.written) != 1 {
+		t.Errorf("expected one high priority payload, got %d", len(highConn.written))
+	}
+	if rejected, _ := low.takeRejectedCounts(); rejected != 1 {
+		t.Errorf("expected one rejected low priority payload, got %d", rejected)
+	}
+
+	close(lowConn.gate)
+	wg.Wait()
+	low.Close()
+}
+
+func TestSendLaneRedialsAfterWriteError(t *testing.T) {
+	dials := 0
+	lane := NewSendLane(LaneLow, 1, time.Second, time.Second, func() (net.Conn, error) {
+		dials++
+		client, server := net.Pipe()
+		if dials == 1 {
+			server.Close()
+		} else {
+			go io.Copy(io.Discard, server)
+		}
+		return client, nil
+	})
+	defer lane.Close()
+
+	if _, err := lane.Write([]byte("first")); err == nil {
+		t.Fatalf("expected the write to a closed connection to fail")
+	}
+	if _, err := lane.Write([]byte("second")); err != nil {
+		t.Fatalf("expected the lane to redial after a write error, got %v", err)
+	}
+	if dials != 2 {
+		t.Errorf("expected 2 dials, got %d", dials)
+	}
+}
+
+func TestSendLaneWaitsForStartedWrite(t *testing.T) {
+	conn := newFakeMdsdConn(false)
+	lane := NewSendLane(LaneLow, 1, time.Second, time.Second, func() (net.Conn, error) { return conn, nil })
+	lane.waitTimeout = 50 * time.Millisecond
+
+	type writeResult struct {
+		n   int
+		err error
+	}
+	started := make(chan writeResult, 1)
+	go func() {
+		n, err := lane.Write([]byte("started"))
+		started <- writeResult{n, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// the second payload is queued behind the blocked write and never starts
+	if _, err := lane.Write([]byte("queued")); err != ErrLaneTimeout {
+		t.Errorf("expected the queued payload to time out, got %v", err)
+	}
+	select {
+	case res := <-started:
+		t.Fatalf("expected the started write to be waited for, got %d, %v", res.n, res.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(conn.gate)
+	if res := <-started; res.err != nil || res.n != len("started") {
+		t.Errorf("expected the started write to succeed, got %d, %v", res.n, res.err)
+	}
+	lane.Close()
+	if len(conn.written) != 1 || string(conn.written[0]) != "started" {
+		t.Errorf("expected only the started payload to be written, got %q", conn.written)
+	}
+	if _, timedOut := lane.takeRejectedCounts(); timedOut != 1 {
+		t.Errorf("expected one timed out payload, got %d", timedOut)
+	}
+}
+
+func TestLaneDialFailureIsRecordedOnce(t *testing.T) {
+	original := paths.Current()
+	defer paths.Configure(original)
+	settings, _ := paths.Load(func(name string) string { return map[string]string{paths.RootDirEnv: t.TempDir()}[name] })
+	paths.Configure(settings)
+	origBreakers := CircuitBreakers
+	CircuitBreakers = make(map[string]*CircuitBreaker)
+	defer func() { CircuitBreakers = origBreakers }()
+
+	lane := NewSendLane(LaneLow, 1, time.Second, time.Second, newMdsdLaneDialer(ContainerLogV2))
+	defer lane.Close()
+	cb := getCircuitBreaker(getLaneDestination(LaneLow))
+	// the sender records the result of the write, which fails with the dial to the missing mdsd socket
+	_, err := (&laneConn{lane: lane}).Write([]byte("log"))
+	recordConnectionResult(cb, err)
+	if err == nil {
+		t.Fatalf("expected the write to fail without the mdsd socket")
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.consecutiveFailures != 1 {
+		t.Errorf("expected one failure for the send attempt, got %d", cb.consecutiveFailures)
+	}
+}
+
+func TestSendLaneClose(t *testing.T) {
+	lane := NewSendLane(LaneHigh, 1, time.Second, time.Second, func() (net.Conn, error) { return newFakeMdsdConn(true), nil })
+	lane.Close()
+	lane.Close()
+	if _, err := lane.Write([]byte("x")); err != ErrLaneClosed {
+		t.Errorf("expected ErrLaneClosed after Close, got %v", err)
+	}
+}
+
+func TestLaneConnThroughWriteMsgPackEntries(t *testing.T) {
+	conn := newFakeMdsdConn(true)
+	lane := NewSendLane(LaneLow, 1, time.Second, time.Second, func() (net.Conn, error) { return conn, nil })
+	defer lane.Close()
+
+	entries := []MsgPackEntry{{Record: map[string]string{"LogMessage": "hello"}}}
+	if _, err := (&PluginInstance{}).writeMsgPackEntries(&laneConn{lane: lane}, true, "ContainerLogV2Source", entries); err != nil {
+		t.Fatalf("writeMsgPackEntries through lane failed: %v", err)
+	}
+	if len(conn.written) != 1 || !bytes.Contains(conn.written[0], []byte("hello")) {
+		t.Errorf("expected the msgpack payload to be written through the lane, got %q", conn.written)
+	}
+}
+
+func TestGetLanePriority(t *testing.T) {
+	expected := map[DataType]LanePriority{
+		KubeMonAgentEvents: LaneHigh,
+		ConfigSnapshot:     LaneHigh,
+		InsightsMetrics:    LaneMedium,
+		InputPluginRecords: LaneMedium,
+		ContainerLogV2:     LaneLow,
+		HostLogs:           LaneLow,
+	}
+	for dataType, priority := range expected {
+		if got := getLanePriority(dataType); got != priority {
+			t.Errorf("getLanePriority(%s) = %s, want %s", dataType, got, priority)
+		}
+	}
+}
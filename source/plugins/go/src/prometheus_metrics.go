@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// env variable to start the prometheus /metrics server (opt-in, disabled when unset)
+const PrometheusMetricsEnabledEnv = "AZMON_PROMETHEUS_METRICS_ENABLED"
+
+// env variable with the port of the prometheus /metrics server
+const PrometheusMetricsPortEnv = "AZMON_PROMETHEUS_METRICS_PORT"
+
+// env variable with the listen address of the prometheus /metrics server, 0.0.0.0 to be scraped from other pods
+const PrometheusMetricsListenAddressEnv = "AZMON_PROMETHEUS_METRICS_LISTEN_ADDRESS"
+
+const defaultPrometheusMetricsPort = 9102
+const defaultPrometheusMetricsListenAddress = "127.0.0.1"
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// telemetryCounter mirrors a telemetry counter that SendContainerLogPluginMetrics resets every period as a prometheus
+// counter. value is guarded by ContainerLogTelemetryMutex
+type telemetryCounter struct {
+	name   string
+	labels []string
+	value  *float64
+	// scale converts the unit of the telemetry counter, 0 keeps it
+	scale float64
+}
+
+// prometheusTelemetryCounters are the counters of telemetry.go exported on /metrics
+var prometheusTelemetryCounters = []telemetryCounter{
+	{name: "out_oms_container_log_records_flushed_total", value: &FlushedRecordsCount},
+	{name: "out_oms_container_log_flushed_bytes_total", value: &FlushedRecordsSize},
+	{name: "out_oms_container_log_metadata_bytes_total", value: &FlushedMetadataSize},
+	{name: "out_oms_container_log_flush_seconds_total", value: &FlushedRecordsTimeTaken, scale: 0.001},
+	{name: "out_oms_container_log_records_empty_timestamp_total", value: &ContainerLogRecordCountWithEmptyTimeStamp},
+	{name: "out_oms_host_log_records_flushed_total", value: &HostLogsFlushedCount},
+	{name: "out_oms_telegraf_metrics_sent_total", value: &TelegrafMetricsSentCount},
+	{name: "out_oms_telegraf_metrics_send_errors_total", value: &TelegrafMetricsSendErrorCount},
+	{name: "out_oms_telegraf_metrics_throttled_total", value: &TelegrafMetricsSend429ErrorCount},
+	{name: "out_oms_windows_telegraf_metrics_large_tags_total", value: &WinTelegrafMetricsCountWithTagsSize64KBorMore},
+	{name: "out_oms_send_errors_total", labels: []string{"data_type", "ContainerLog", "destination", "mdsd"}, value: &ContainerLogsSendErrorsToMDSDFromFluent},
+	{name: "out_oms_send_errors_total", labels: []string{"data_type", "ContainerLog", "destination", "ama"}, value: &ContainerLogsSendErrorsToWindowsAMAFromFluent},
+	{name: "out_oms_send_errors_total", labels: []string{"data_type", "ContainerLog", "destination", "adx"}, value: &ContainerLogsSendErrorsToADXFromFluent},
+	{name: "out_oms_send_errors_total", labels: []string{"data_type", "HostLogs", "destination", "agent"}, value: &HostLogsSendErrors},
+	{name: "out_oms_send_errors_total", labels: []string{"data_type", "ConfigSnapshot", "destination", "agent"}, value: &ConfigSnapshotSendErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "ContainerLog", "destination", "mdsd"}, value: &ContainerLogsMDSDClientCreateErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "ContainerLog", "destination", "ama"}, value: &ContainerLogsWindowsAMAClientCreateErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "ContainerLog", "destination", "adx"}, value: &ContainerLogsADXClientCreateErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "InsightsMetrics", "destination", "mdsd"}, value: &InsightsMetricsMDSDClientCreateErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "InsightsMetrics", "destination", "ama"}, value: &InsightsMetricsWindowsAMAClientCreateErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "KubeMonAgentEvents", "destination", "mdsd"}, value: &KubeMonEventsMDSDClientCreateErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "KubeMonAgentEvents", "destination", "ama"}, value: &KubeMonEventsWindowsAMAClientCreateErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "InputPluginRecords", "destination", "agent"}, value: &InputPluginRecordsErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "HostLogs", "destination", "agent"}, value: &HostLogsClientCreateErrors},
+	{name: "out_oms_client_create_errors_total", labels: []string{"data_type", "ConfigSnapshot", "destination", "agent"}, value: &ConfigSnapshotClientCreateErrors},
+	{name: "out_oms_dead_letter_records_total", value: &DeadLetterRecordCount},
+	{name: "out_oms_circuit_breaker_opens_total", value: &CircuitBreakerOpenCount},
+}
+
+// help text of the metric families
+var prometheusMetricHelp = map[string]string{
+	"out_oms_container_log_records_flushed_total":         "Container log records flushed.",
+	"out_oms_container_log_flushed_bytes_total":           "Size of the container log records flushed.",
+	"out_oms_container_log_metadata_bytes_total":          "Size of the kubernetes metadata of the container log records flushed.",
+	"out_oms_container_log_flush_seconds_total":           "Time taken to flush the container log records.",
+	"out_oms_container_log_records_empty_timestamp_total": "Container log records with an empty timestamp.",
+	"out_oms_host_log_records_flushed_total":              "Host log records flushed.",
+	"out_oms_telegraf_metrics_sent_total":                 "Telegraf metrics sent.",
+	"out_oms_telegraf_metrics_send_errors_total":          "Telegraf metrics send errors.",
+	"out_oms_telegraf_metrics_throttled_total":            "Telegraf metrics sends throttled with 429.",
+	"out_oms_windows_telegraf_metrics_large_tags_total":   "Windows telegraf metrics with tags of 64KB or more.",
+	"out_oms_send_errors_total":                           "Write errors to the destination of a data type, agent is mdsd on linux and ama on windows.",
+	"out_oms_client_create_errors_total":                  "Errors creating the client of the destination of a data type, agent is mdsd on linux and ama on windows.",
+	"out_oms_dead_letter_records_total":                   "Records written to the dead-letter store.",
+	"out_oms_circuit_breaker_opens_total":                 "Times a circuit breaker of an mdsd socket or ama named pipe opened.",
+	"out_oms_container_log_max_latency_milliseconds":      "Max agent side latency of the container logs in the current telemetry period.",
+	"out_oms_priority_lane_rejected_total":                "Payloads rejected by a full priority lane.",
+	"out_oms_priority_lane_timeouts_total":                "Payloads that timed out in a priority lane.",
+	"out_oms_dropped_records_total":                       "Records dropped by reason and namespace.",
+	"out_oms_schema_violations_total":                     "Record fields that don't match their schema by schema, field and violation.",
+	"out_oms_agent_trace_errors_total":                    "Errors found in the mdsd and addon-token-adapter traces.",
+	"out_oms_kubemonagent_events_flushed_total":           "KubeMonAgentEvents flushed by category.",
+	"out_oms_kubemonagent_events_pending":                 "KubeMonAgentEvents waiting for the next flush by category.",
+	"out_oms_multitenancy_namespaces":                     "Namespaces with a ContainerLogV2 extension DCR.",
+	"out_oms_multitenancy_stream_ids":                     "Stream ids of the ContainerLogV2 extension DCRs.",
+	"out_oms_multitenancy_namespace_stream_ids":           "Stream ids of the ContainerLogV2 extension DCRs of a namespace.",
+	"out_oms_prometheus_sidecar_osm_namespaces":           "OSM namespaces of the prometheus sidecar.",
+	"out_oms_prometheus_sidecar_monitor_pods_namespaces":  "Namespaces of the prometheus sidecar pod monitoring.",
+	"out_oms_prometheus_sidecar_label_selector_length":    "Length of the label selector of the prometheus sidecar pod monitoring.",
+	"out_oms_prometheus_sidecar_field_selector_length":    "Length of the field selector of the prometheus sidecar pod monitoring.",
+	"out_oms_delivery_latency_seconds":                    "Delivery latency of the records by data type and sink.",
+	"out_oms_resource_throttling_level":                   "Level of the self-throttling near the resource limits, 0 when not throttling.",
+	"out_oms_process_rss_bytes":                           "Resident memory of the fluent-bit process.",
+	"out_oms_go_heap_bytes":                               "Heap of the Go plugins.",
+	"out_oms_container_memory_working_set_bytes":          "Working set of the agent container.",
+	"out_oms_container_memory_limit_bytes":                "Memory limit of the agent container, 0 without a limit.",
+	"out_oms_container_cpu_usage_cores":                   "CPU usage of the agent container.",
+	"out_oms_container_cpu_limit_cores":                   "CPU limit of the agent container, 0 without a limit.",
+}
+
+var (
+	// PrometheusMetricsEnabled observes the delivery latencies for /metrics
+	PrometheusMetricsEnabled bool
+	// PrometheusDeliveryLatency histograms exported on /metrics, never reset
+	PrometheusDeliveryLatency = newLatencyHistograms()
+	// PrometheusMetricsServer serves /metrics, nil when disabled
+	PrometheusMetricsServer *http.Server
+	// telemetryCounterTotals of the periods already reset by SendContainerLogPluginMetrics, guarded by ContainerLogTelemetryMutex
+	telemetryCounterTotals = make(map[*float64]float64)
+	// kubeMonAgentEventTotals flushed per category
+	kubeMonAgentEventTotals      = make(map[string]float64)
+	kubeMonAgentEventTotalsMutex = &sync.Mutex{}
+)
+
+// rollOverTelemetryCounters adds the counters of the period to their totals before they're reset. The caller holds
+// ContainerLogTelemetryMutex
+func rollOverTelemetryCounters() {
+	for _, counter := range prometheusTelemetryCounters {
+		telemetryCounterTotals[counter.value] += *counter.value
+	}
+}
+
+// recordKubeMonAgentEventsFlushed counts the flushed KubeMonAgentEvents per category
+func recordKubeMonAgentEventsFlushed(records []laKubeMonAgentEvents) {
+	kubeMonAgentEventTotalsMutex.Lock()
+	defer kubeMonAgentEventTotalsMutex.Unlock()
+	for _, record := range records {
+		kubeMonAgentEventTotals[record.Category]++
+	}
+}
+
+// startPrometheusMetricsServer starts the /metrics server if it's enabled
+func startPrometheusMetricsServer(config *PluginConfig) {
+	if !config.PrometheusMetricsEnabled {
+		return
+	}
+	address := net.JoinHostPort(config.PrometheusMetricsListenAddress, strconv.Itoa(config.PrometheusMetricsPort))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		Log("Error::prometheus::Unable to start the prometheus metrics server %s", err.Error())
+		return
+	}
+	PrometheusMetricsEnabled = true
+	server := &http.Server{Handler: newPrometheusMetricsHandler(), ReadHeaderTimeout: 10 * time.Second}
+	PrometheusMetricsServer = server
+	Log("Prometheus metrics server listening on %s", listener.Addr().String())
+	goBackground(func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			Log("Error::prometheus::Prometheus metrics server stopped %s", err.Error())
+		}
+	})
+}
+
+func newPrometheusMetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", prometheusContentType)
+		if err := writePrometheusMetrics(w, collectPrometheusMetrics()); err != nil {
+			Log("Error::prometheus::Unable to write the metrics %s", err.Error())
+		}
+	})
+	return mux
+}
+
+// prometheusFamily is a metric family of the text exposition format
+type prometheusFamily struct {
+	name    string
+	kind    string
+	samples []prometheusSample
+}
+
+type prometheusSample struct {
+	// suffix of the family name, e.g. _bucket of a histogram
+	suffix string
+	// label name and value pairs
+	labels []string
+	value  float64
+}
+
+// prometheusFamilies collects the samples of the families in the order they're added
+type prometheusFamilies struct {
+	families []*prometheusFamily
+	byName   map[string]*prometheusFamily
+}
+
+func (f *prometheusFamilies) add(name string, kind string, suffix string, labels []string, value float64) {
+	if f.byName == nil {
+		f.byName = make(map[string]*prometheusFamily)
+	}
+	family, ok := f.byName[name]
+	if !ok {
+		family = &prometheusFamily{name: name, kind: kind}
+		f.byName[name] = family
+		f.families = append(f.families, family)
+	}
+	family.samples = append(family.samples, prometheusSample{suffix: suffix, labels: labels, value: value})
+}
+
+// collectPrometheusMetrics returns the telemetry counters and gauges as prometheus metric families
+func collectPrometheusMetrics() []*prometheusFamily {
+	var f prometheusFamilies
+
+	ContainerLogTelemetryMutex.Lock()
+	for _, counter := range prometheusTelemetryCounters {
+		value := telemetryCounterTotals[counter.value] + *counter.value
+		if counter.scale != 0 {
+			value *= counter.scale
+		}
+		f.add(counter.name, "counter", "", counter.labels, value)
+	}
+	f.add("out_oms_container_log_max_latency_milliseconds", "gauge", "", nil, AgentLogProcessingMaxLatencyMs)
+	ContainerLogTelemetryMutex.Unlock()
+
+	var priorities []LanePriority
+	for priority := range PriorityLanes {
+		priorities = append(priorities, priority)
+	}
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+	for _, priority := range priorities {
+		rejected, timedOut := PriorityLanes[priority].totalRejectedCounts()
+		f.add("out_oms_priority_lane_rejected_total", "counter", "", []string{"lane", priority.String()}, float64(rejected))
+		f.add("out_oms_priority_lane_timeouts_total", "counter", "", []string{"lane", priority.String()}, float64(timedOut))
+	}
+
+	DroppedRecordCountsMutex.Lock()
+	drops := make([]dropKey, 0, len(DroppedRecordTotals))
+	for key := range DroppedRecordTotals {
+		drops = append(drops, key)
+	}
+	sort.Slice(drops, func(i, j int) bool {
+		if drops[i].Reason != drops[j].Reason {
+			return drops[i].Reason < drops[j].Reason
+		}
+		return drops[i].Namespace < drops[j].Namespace
+	})
+	for _, key := range drops {
+		f.add("out_oms_dropped_records_total", "counter", "", []string{"reason", string(key.Reason), "namespace", key.Namespace}, DroppedRecordTotals[key])
+	}
+	DroppedRecordCountsMutex.Unlock()
+
+	SchemaViolationMutex.Lock()
+	for _, key := range sortedSchemaViolationKeys(SchemaViolationTotals) {
+		f.add("out_oms_schema_violations_total", "counter", "", []string{"schema", key.Schema, "field", key.Field, "violation", string(key.Violation)}, SchemaViolationTotals[key])
+	}
+	SchemaViolationMutex.Unlock()
+
+	throttling := ResourceThrottling.Status()
+	f.add("out_oms_resource_throttling_level", "gauge", "", nil, float64(ResourceThrottling.Level()))
+	f.add("out_oms_process_rss_bytes", "gauge", "", nil, float64(throttling.Usage.ProcessRSSBytes))
+	f.add("out_oms_go_heap_bytes", "gauge", "", nil, float64(throttling.Usage.GoHeapBytes))
+	f.add("out_oms_container_memory_working_set_bytes", "gauge", "", nil, float64(throttling.Usage.MemoryBytes))
+	f.add("out_oms_container_memory_limit_bytes", "gauge", "", nil, float64(throttling.Usage.MemoryLimitBytes))
+	f.add("out_oms_container_cpu_usage_cores", "gauge", "", nil, throttling.Usage.CPUCores)
+	f.add("out_oms_container_cpu_limit_cores", "gauge", "", nil, throttling.Usage.CPULimitCores)
+
+	TracesErrorMetricsMutex.Lock()
+	traceErrors := make(map[string]float64, len(TracesErrorMetricTotals))
+	for name, total := range TracesErrorMetricTotals {
+		traceErrors[name] = total
+	}
+	for name, value := range TracesErrorMetrics {
+		traceErrors[name] += value
+	}
+	TracesErrorMetricsMutex.Unlock()
+	for _, name := range sortedKeys(traceErrors) {
+		f.add("out_oms_agent_trace_errors_total", "counter", "", []string{"error", name}, traceErrors[name])
+	}
+
+	kubeMonAgentEventTotalsMutex.Lock()
+	for _, category := range sortedKeys(kubeMonAgentEventTotals) {
+		f.add("out_oms_kubemonagent_events_flushed_total", "counter", "", []string{"category", category}, kubeMonAgentEventTotals[category])
+	}
+	kubeMonAgentEventTotalsMutex.Unlock()
+
+	EventHashUpdateMutex.Lock()
+	pending := map[string]int{
+		ConfigErrorEventCategory:        len(ConfigErrorEvent),
+		PromScrapingErrorEventCategory:  len(PromScrapeErrorEvent),
+		ConnectionErrorEventCategory:    len(ConnectionErrorEvent),
+		VerboseCollectionEventCategory:  len(VerboseCollectionEvent),
+		ResourceThrottlingEventCategory: len(ResourceThrottlingEvent),
+	}
+	EventHashUpdateMutex.Unlock()
+	for _, category := range []string{ConfigErrorEventCategory, PromScrapingErrorEventCategory, ConnectionErrorEventCategory, VerboseCollectionEventCategory, ResourceThrottlingEventCategory} {
+		f.add("out_oms_kubemonagent_events_pending", "gauge", "", []string{"category", category}, float64(pending[category]))
+	}
+
+	if IsAzMonMultiTenancyLogCollectionEnabled || IsAzMonMultitenancyLogsServiceMode {
+		namespaceStreamIdsMap, _ := getContainerLogV2ExtensionMaps()
+		streamIds := 0
+		namespaces := make([]string, 0, len(namespaceStreamIdsMap))
+		for namespace, streamTags := range namespaceStreamIdsMap {
+			streamIds += len(streamTags)
+			namespaces = append(namespaces, namespace)
+		}
+		sort.Strings(namespaces)
+		f.add("out_oms_multitenancy_namespaces", "gauge", "", nil, float64(len(namespaceStreamIdsMap)))
+		f.add("out_oms_multitenancy_stream_ids", "gauge", "", nil, float64(streamIds))
+		for _, namespace := range namespaces {
+			f.add("out_oms_multitenancy_namespace_stream_ids", "gauge", "", []string{"namespace", namespace}, float64(len(namespaceStreamIdsMap[namespace])))
+		}
+	}
+
+	if strings.EqualFold(ContainerType, "prometheussidecar") {
+		f.add("out_oms_prometheus_sidecar_osm_namespaces", "gauge", "", nil, float64(OSMNamespaceCount))
+		f.add("out_oms_prometheus_sidecar_monitor_pods_namespaces", "gauge", "", nil, float64(PromMonitorPodsNamespaceLength))
+		f.add("out_oms_prometheus_sidecar_label_selector_length", "gauge", "", nil, float64(PromMonitorPodsLabelSelectorLength))
+		f.add("out_oms_prometheus_sidecar_field_selector_length", "gauge", "", nil, float64(PromMonitorPodsFieldSelectorLength))
+	}
+
+	histograms := PrometheusDeliveryLatency.snapshot()
+	keys := make([]latencyKey, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].DataType != keys[j].DataType {
+			return keys[i].DataType < keys[j].DataType
+		}
+		return keys[i].Sink < keys[j].Sink
+	})
+	for _, key := range keys {
+		h := histograms[key]
+		// full slice expression so the le label of each bucket gets its own copy
+		labels := []string{"data_type", key.DataType, "sink", key.Sink}
+		labels = labels[:len(labels):len(labels)]
+		var cumulative uint64
+		for i, bound := range deliveryLatencyBucketsMs {
+			cumulative += h.Buckets[i]
+			f.add("out_oms_delivery_latency_seconds", "histogram", "_bucket", append(labels, "le", formatPrometheusValue(bound/1000)), float64(cumulative))
+		}
+		f.add("out_oms_delivery_latency_seconds", "histogram", "_bucket", append(labels, "le", "+Inf"), float64(h.Count))
+		f.add("out_oms_delivery_latency_seconds", "histogram", "_sum", labels, h.SumMs/1000)
+		f.add("out_oms_delivery_latency_seconds", "histogram", "_count", labels, float64(h.Count))
+	}
+
+	return f.families
+}
+
+// writePrometheusMetrics writes the families in the prometheus text exposition format
+func writePrometheusMetrics(w io.Writer, families []*prometheusFamily) error {
+	writer := bufio.NewWriter(w)
+	for _, family := range families {
+		if help, ok := prometheusMetricHelp[family.name]; ok {
+			fmt.Fprintf(writer, "# HELP %s %s\n", family.name, help)
+		}
+		fmt.Fprintf(writer, "# TYPE %s %s\n", family.name, family.kind)
+		for _, sample := range family.samples {
+			writer.WriteString(family.name + sample.suffix)
+			if len(sample.labels) > 0 {
+				writer.WriteString("{")
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					if i > 0 {
+						writer.WriteString(",")
+					}
+					writer.WriteString(sample.labels[i] + `="` + escapePrometheusLabelValue(sample.labels[i+1]) + `"`)
+				}
+				writer.WriteString("}")
+			}
+			writer.WriteString(" " + formatPrometheusValue(sample.value) + "\n")
+		}
+	}
+	return writer.Flush()
+}
+
+func escapePrometheusLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatPrometheusValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
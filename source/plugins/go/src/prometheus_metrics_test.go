@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func collectPrometheusText(t *testing.T) string {
+	var out bytes.Buffer
+	if err := writePrometheusMetrics(&out, collectPrometheusMetrics()); err != nil {
+		t.Fatalf("writePrometheusMetrics failed: %v", err)
+	}
+	return out.String()
+}
+
+func TestPrometheusTelemetryCountersSurviveTelemetryReset(t *testing.T) {
+	ContainerLogTelemetryMutex.Lock()
+	origCount, origTimeTaken, origTotals := FlushedRecordsCount, FlushedRecordsTimeTaken, telemetryCounterTotals
+	telemetryCounterTotals = make(map[*float64]float64)
+	FlushedRecordsCount, FlushedRecordsTimeTaken = 5, 1500
+	ContainerLogTelemetryMutex.Unlock()
+	defer func() {
+		ContainerLogTelemetryMutex.Lock()
+		FlushedRecordsCount, FlushedRecordsTimeTaken, telemetryCounterTotals = origCount, origTimeTaken, origTotals
+		ContainerLogTelemetryMutex.Unlock()
+	}()
+
+	text := collectPrometheusText(t)
+	if !strings.Contains(text, "out_oms_container_log_records_flushed_total 5\n") || !strings.Contains(text, "out_oms_container_log_flush_seconds_total 1.5\n") {
+		t.Errorf("unexpected counters %s", text)
+	}
+
+	// the telemetry goroutine resets the period, the prometheus counter keeps counting
+	ContainerLogTelemetryMutex.Lock()
+	rollOverTelemetryCounters()
+	FlushedRecordsCount, FlushedRecordsTimeTaken = 2, 0
+	ContainerLogTelemetryMutex.Unlock()
+	if text = collectPrometheusText(t); !strings.Contains(text, "out_oms_container_log_records_flushed_total 7\n") {
+		t.Errorf("expected the counter to survive the reset, got %s", text)
+	}
+	if strings.Count(text, "# TYPE out_oms_send_errors_total counter") != 1 || !strings.Contains(text, `out_oms_send_errors_total{data_type="ContainerLog",destination="mdsd"}`) {
+		t.Errorf("expected a single labeled send errors family, got %s", text)
+	}
+}
+
+func TestPrometheusDroppedRecordsAndLatency(t *testing.T) {
+	resetDroppedRecordCounts(t)
+	DroppedRecordCountsMutex.Lock()
+	origTotals := DroppedRecordTotals
+	DroppedRecordTotals = make(map[dropKey]float64)
+	DroppedRecordCountsMutex.Unlock()
+	origLatency, origEnabled := PrometheusDeliveryLatency, PrometheusMetricsEnabled
+	defer func() {
+		DroppedRecordCountsMutex.Lock()
+		DroppedRecordTotals = origTotals
+		DroppedRecordCountsMutex.Unlock()
+		PrometheusDeliveryLatency, PrometheusMetricsEnabled = origLatency, origEnabled
+	}()
+	PrometheusDeliveryLatency, PrometheusMetricsEnabled = newLatencyHistograms(), true
+
+	recordDrop(DropReasonSendError, `team "a"`, 3, nil)
+	takeDroppedRecordCounts()
+	recordDrop(DropReasonSendError, `team "a"`, 1, nil)
+	now := time.Now()
+	observeDeliveryLatency("ContainerLogV2", DeliverySinkMdsd, []time.Time{now.Add(-200 * time.Millisecond), now.Add(-2 * time.Second)}, now)
+
+	text := collectPrometheusText(t)
+	for _, expected := range []string{
+		`out_oms_dropped_records_total{reason="SendError",namespace="team \"a\""} 4`,
+		`out_oms_delivery_latency_seconds_bucket{data_type="ContainerLogV2",sink="mdsd",le="0.25"} 1`,
+		`out_oms_delivery_latency_seconds_bucket{data_type="ContainerLogV2",sink="mdsd",le="+Inf"} 2`,
+		`out_oms_delivery_latency_seconds_sum{data_type="ContainerLogV2",sink="mdsd"} 2.2`,
+		`out_oms_delivery_latency_seconds_count{data_type="ContainerLogV2",sink="mdsd"} 2`,
+		"# TYPE out_oms_delivery_latency_seconds histogram",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected %s in %s", expected, text)
+		}
+	}
+}
+
+func TestPrometheusMetricsHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	newPrometheusMetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != prometheusContentType {
+		t.Errorf("GET /metrics returned %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "# HELP out_oms_kubemonagent_events_pending") {
+		t.Errorf("unexpected /metrics body %s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// env variable to validate the records against their schema before they are sent to mdsd and AMA (opt-in, disabled
+// when unset). Violations are counted and sampled, the records are sent as is
+const SchemaValidationEnabledEnv = "AZMON_SCHEMA_VALIDATION_ENABLED"
+
+// env variable to log one in every N schema violations per schema, 0 disables the log
+const SchemaValidationLogSampleRateEnv = "AZMON_SCHEMA_VALIDATION_LOG_SAMPLE_RATE"
+
+const defaultSchemaValidationLogSampleRate = 100
+
+// sampled records are truncated to this size in the log and the diagnostics state
+const schemaViolationSampleMaxBytes = 1024
+
+// the diagnostics state keeps this many of the latest sampled violations
+const schemaViolationMaxSamples = 20
+
+// Tags of 64KB or more are rejected by the ingestion
+const maxInsightsMetricsTagsSize = 64*1024 - 1
+
+// SchemaFieldType of the string value of a record field
+type SchemaFieldType string
+
+// Schema field types
+const (
+	SchemaFieldString  SchemaFieldType = "string"
+	SchemaFieldNumber  SchemaFieldType = "number"
+	SchemaFieldInteger SchemaFieldType = "integer"
+	// SchemaFieldTime RFC3339 timestamp, with or without fractional seconds
+	SchemaFieldTime SchemaFieldType = "time"
+	// SchemaFieldJSON serialized JSON object or array
+	SchemaFieldJSON SchemaFieldType = "json"
+)
+
+// SchemaViolation kind of a field that doesn't match its schema
+type SchemaViolation string
+
+// Schema violations
+const (
+	// SchemaViolationMissing required field that is missing or empty
+	SchemaViolationMissing SchemaViolation = "Missing"
+	// SchemaViolationType field whose value can't be parsed as its type
+	SchemaViolationType SchemaViolation = "Type"
+	// SchemaViolationSize field that is larger than its max size
+	SchemaViolationSize SchemaViolation = "Size"
+)
+
+// SchemaField of a record. Optional fields are only validated when they aren't empty
+type SchemaField struct {
+	Name     string          `json:"name"`
+	Type     SchemaFieldType `json:"type"`
+	Required bool            `json:"required,omitempty"`
+	MaxSize  int             `json:"maxSize,omitempty"`
+}
+
+// RecordSchema of the records of a data type as they are written to mdsd and AMA
+type RecordSchema struct {
+	Name   string        `json:"name"`
+	Fields []SchemaField `json:"fields"`
+}
+
+// FieldViolation is a field of a record that doesn't match the schema
+type FieldViolation struct {
+	Field     string          `json:"field"`
+	Violation SchemaViolation `json:"violation"`
+}
+
+type schemaViolationKey struct {
+	Schema    string
+	Field     string
+	Violation SchemaViolation
+}
+
+// SchemaViolationSample is a sampled record with its violations
+type SchemaViolationSample struct {
+	Time       string           `json:"time"`
+	Schema     string           `json:"schema"`
+	Violations []FieldViolation `json:"violations"`
+	Record     string           `json:"record"`
+}
+
+// Record schemas
+var (
+	// ContainerLogV2Schema of DataItemLAv2
+	ContainerLogV2Schema = &RecordSchema{Name: "ContainerLogV2", Fields: []SchemaField{
+		{Name: "TimeGenerated", Type: SchemaFieldTime, Required: true},
+		{Name: "Computer", Type: SchemaFieldString, Required: true},
+		{Name: "ContainerId", Type: SchemaFieldString, Required: true},
+		{Name: "ContainerName", Type: SchemaFieldString},
+		{Name: "PodName", Type: SchemaFieldString},
+		{Name: "PodNamespace", Type: SchemaFieldString},
+		{Name: "LogMessage", Type: SchemaFieldString, Required: true},
+		{Name: "LogSource", Type: SchemaFieldString},
+		{Name: "KubernetesMetadata", Type: SchemaFieldJSON},
+		{Name: "TraceId", Type: SchemaFieldString},
+		{Name: "SpanId", Type: SchemaFieldString},
+		{Name: "TraceFlags", Type: SchemaFieldString},
+	}}
+	// InsightsMetricsSchema of laTelegrafMetric
+	InsightsMetricsSchema = &RecordSchema{Name: "InsightsMetrics", Fields: []SchemaField{
+		{Name: "Origin", Type: SchemaFieldString, Required: true},
+		{Name: "Namespace", Type: SchemaFieldString, Required: true},
+		{Name: "Name", Type: SchemaFieldString, Required: true},
+		{Name: "Value", Type: SchemaFieldNumber, Required: true},
+		{Name: "Tags", Type: SchemaFieldJSON, MaxSize: maxInsightsMetricsTagsSize},
+		{Name: "CollectionTime", Type: SchemaFieldTime, Required: true},
+		{Name: "Computer", Type: SchemaFieldString, Required: true},
+	}}
+	// KubeMonAgentEventsSchema of laKubeMonAgentEvents
+	KubeMonAgentEventsSchema = &RecordSchema{Name: "KubeMonAgentEvents", Fields: []SchemaField{
+		{Name: "Computer", Type: SchemaFieldString, Required: true},
+		{Name: "CollectionTime", Type: SchemaFieldTime, Required: true},
+		{Name: "Category", Type: SchemaFieldString, Required: true},
+		{Name: "Level", Type: SchemaFieldString, Required: true},
+		{Name: "ClusterId", Type: SchemaFieldString, Required: true},
+		{Name: "ClusterName", Type: SchemaFieldString, Required: true},
+		{Name: "Message", Type: SchemaFieldString},
+		{Name: "Tags", Type: SchemaFieldJSON},
+	}}
+	// ContainerInventorySchema of the records of the containerinventory input plugin
+	ContainerInventorySchema = &RecordSchema{Name: "ContainerInventory", Fields: []SchemaField{
+		{Name: "CollectionTime", Type: SchemaFieldTime, Required: true},
+		{Name: "InstanceID", Type: SchemaFieldString, Required: true},
+		{Name: "Computer", Type: SchemaFieldString, Required: true},
+		{Name: "ImageId", Type: SchemaFieldString},
+		{Name: "ExitCode", Type: SchemaFieldInteger, Required: true},
+		{Name: "State", Type: SchemaFieldString, Required: true},
+		{Name: "CreatedTime", Type: SchemaFieldTime},
+		{Name: "StartedTime", Type: SchemaFieldTime},
+		{Name: "FinishedTime", Type: SchemaFieldTime},
+		{Name: "Image", Type: SchemaFieldString},
+		{Name: "Repository", Type: SchemaFieldString},
+		{Name: "ImageTag", Type: SchemaFieldString},
+		{Name: "ElementName", Type: SchemaFieldString},
+		{Name: "ContainerHostname", Type: SchemaFieldString},
+		{Name: "EnvironmentVar", Type: SchemaFieldString},
+		{Name: "Ports", Type: SchemaFieldString},
+		{Name: "Command", Type: SchemaFieldString},
+	}}
+	// PerfSchema of the records of the perf input plugin
+	PerfSchema = &RecordSchema{Name: "Perf", Fields: []SchemaField{
+		{Name: "Timestamp", Type: SchemaFieldTime, Required: true},
+		{Name: "Host", Type: SchemaFieldString, Required: true},
+		{Name: "ObjectName", Type: SchemaFieldString, Required: true},
+		{Name: "InstanceName", Type: SchemaFieldString, Required: true},
+		{Name: "json_Collections", Type: SchemaFieldJSON, Required: true},
+	}}
+
+	// RecordSchemas are the schemas of the records the plugin sends
+	RecordSchemas = []*RecordSchema{ContainerLogV2Schema, InsightsMetricsSchema, KubeMonAgentEventsSchema, ContainerInventorySchema, PerfSchema}
+)
+
+var (
+	// SchemaValidationEnabled validates the records before they are sent
+	SchemaValidationEnabled bool
+	// SchemaValidationLogSampleRate logs one in every N schema violations per schema, 0 disables the log
+	SchemaValidationLogSampleRate int
+	// SchemaViolationCounts per schema, field and violation since the last telemetry flush
+	SchemaViolationCounts = make(map[schemaViolationKey]float64)
+	// SchemaViolationTotals per schema, field and violation since the start, exported as prometheus counters
+	SchemaViolationTotals = make(map[schemaViolationKey]float64)
+	// SchemaViolationMutex read and write mutex access to the schema violation counts, totals and samples
+	SchemaViolationMutex = &sync.Mutex{}
+	// schemaViolationSampleCounters count the violations of a schema towards the next sample
+	schemaViolationSampleCounters = make(map[string]int)
+	// schemaViolationSamples are the latest sampled violations, oldest first
+	schemaViolationSamples []SchemaViolationSample
+)
+
+func populateSchemaValidationSettings(config *PluginConfig) {
+	SchemaValidationEnabled = config.SchemaValidationEnabled
+	SchemaValidationLogSampleRate = config.SchemaValidationLogSampleRate
+	Log("SchemaValidationEnabled: %v", SchemaValidationEnabled)
+}
+
+// inputPluginRecordSchema returns the schema of the records of an input plugin tag, nil for tags without a schema
+func inputPluginRecordSchema(tag string) *RecordSchema {
+	lowerTag := strings.ToLower(tag)
+	switch {
+	case strings.Contains(lowerTag, strings.ToLower(ContainerInventoryDataType)):
+		return ContainerInventorySchema
+	case strings.Contains(lowerTag, strings.ToLower(PerfDataType)):
+		return PerfSchema
+	}
+	return nil
+}
+
+// Validate returns the fields of the record that don't match the schema
+func (s *RecordSchema) Validate(record map[string]string) []FieldViolation {
+	var violations []FieldViolation
+	for _, field := range s.Fields {
+		value, ok := record[field.Name]
+		if !ok || value == "" {
+			if field.Required {
+				violations = append(violations, FieldViolation{Field: field.Name, Violation: SchemaViolationMissing})
+			}
+			continue
+		}
+		if !field.Type.valid(value) {
+			violations = append(violations, FieldViolation{Field: field.Name, Violation: SchemaViolationType})
+		}
+		if field.MaxSize > 0 && len(value) > field.MaxSize {
+			violations = append(violations, FieldViolation{Field: field.Name, Violation: SchemaViolationSize})
+		}
+	}
+	return violations
+}
+
+func (t SchemaFieldType) valid(value string) bool {
+	switch t {
+	case SchemaFieldNumber:
+		number, err := strconv.ParseFloat(value, 64)
+		return err == nil && !math.IsNaN(number) && !math.IsInf(number, 0)
+	case SchemaFieldInteger:
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err == nil
+	case SchemaFieldTime:
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	case SchemaFieldJSON:
+		return json.Valid([]byte(value))
+	}
+	return true
+}
+
+// validateRecords accounts the schema violations of the records when the validation is enabled, the records are sent
+// regardless
+func validateRecords(schema *RecordSchema, msgPackEntries []MsgPackEntry) {
+	if !SchemaValidationEnabled || schema == nil {
+		return
+	}
+	for _, entry := range msgPackEntries {
+		if violations := schema.Validate(entry.Record); len(violations) > 0 {
+			recordSchemaViolations(schema.Name, violations, entry.Record)
+		}
+	}
+}
+
+// recordSchemaViolations accounts the violations of a record. record is only formatted for the sampled log
+func recordSchemaViolations(schema string, violations []FieldViolation, record map[string]string) {
+	SchemaViolationMutex.Lock()
+	for _, violation := range violations {
+		key := schemaViolationKey{Schema: schema, Field: violation.Field, Violation: violation.Violation}
+		SchemaViolationCounts[key]++
+		SchemaViolationTotals[key]++
+	}
+	logSample := false
+	if SchemaValidationLogSampleRate > 0 {
+		schemaViolationSampleCounters[schema] += len(violations)
+		if schemaViolationSampleCounters[schema] >= SchemaValidationLogSampleRate {
+			schemaViolationSampleCounters[schema] = 0
+			logSample = true
+		}
+	}
+	SchemaViolationMutex.Unlock()
+
+	if logSample {
+		sample := fmt.Sprintf("%v", record)
+		if len(sample) > schemaViolationSampleMaxBytes {
+			sample = sample[:schemaViolationSampleMaxBytes] + "..."
+		}
+		SchemaViolationMutex.Lock()
+		schemaViolationSamples = append(schemaViolationSamples, SchemaViolationSample{
+			Time:       time.Now().UTC().Format(time.RFC3339),
+			Schema:     schema,
+			Violations: violations,
+			Record:     sample,
+		})
+		if len(schemaViolationSamples) > schemaViolationMaxSamples {
+			schemaViolationSamples = schemaViolationSamples[len(schemaViolationSamples)-schemaViolationMaxSamples:]
+		}
+		SchemaViolationMutex.Unlock()
+		Log("Warn::schema::%s record with violations %+v record: %s", schema, violations, sample)
+	}
+}
+
+// takeSchemaViolationCounts returns and resets the schema violation counts
+func takeSchemaViolationCounts() map[schemaViolationKey]float64 {
+	SchemaViolationMutex.Lock()
+	defer SchemaViolationMutex.Unlock()
+	counts := SchemaViolationCounts
+	SchemaViolationCounts = make(map[schemaViolationKey]float64)
+	return counts
+}
+
+// sortedSchemaViolationKeys returns the keys of the violation counts ordered by schema, field and violation
+func sortedSchemaViolationKeys(counts map[schemaViolationKey]float64) []schemaViolationKey {
+	keys := make([]schemaViolationKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Schema != keys[j].Schema {
+			return keys[i].Schema < keys[j].Schema
+		}
+		if keys[i].Field != keys[j].Field {
+			return keys[i].Field < keys[j].Field
+		}
+		return keys[i].Violation < keys[j].Violation
+	})
+	return keys
+}
+
+// diagnosticsSchemasState returns the schemas with the violation totals and the latest samples
+func diagnosticsSchemasState() interface{} {
+	SchemaViolationMutex.Lock()
+	defer SchemaViolationMutex.Unlock()
+	type violationTotal struct {
+		Schema    string          `json:"schema"`
+		Field     string          `json:"field"`
+		Violation SchemaViolation `json:"violation"`
+		Count     float64         `json:"count"`
+	}
+	totals := []violationTotal{}
+	for _, key := range sortedSchemaViolationKeys(SchemaViolationTotals) {
+		totals = append(totals, violationTotal{key.Schema, key.Field, key.Violation, SchemaViolationTotals[key]})
+	}
+	return map[string]interface{}{
+		"enabled":    SchemaValidationEnabled,
+		"schemas":    RecordSchemas,
+		"violations": totals,
+		"samples":    append([]SchemaViolationSample{}, schemaViolationSamples...),
+	}
+}
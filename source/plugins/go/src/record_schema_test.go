@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func resetSchemaViolations(t *testing.T) {
+	origEnabled, origSampleRate := SchemaValidationEnabled, SchemaValidationLogSampleRate
+	t.Cleanup(func() {
+		SchemaValidationEnabled, SchemaValidationLogSampleRate = origEnabled, origSampleRate
+		takeSchemaViolationCounts()
+		SchemaViolationMutex.Lock()
+		SchemaViolationTotals = make(map[schemaViolationKey]float64)
+		schemaViolationSampleCounters = make(map[string]int)
+		schemaViolationSamples = nil
+		SchemaViolationMutex.Unlock()
+	})
+	takeSchemaViolationCounts()
+}
+
+// schemaRecord returns the record of a struct as the plugin writes it to mdsd
+func schemaRecord(t *testing.T, v interface{}) map[string]string {
+	t.Helper()
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	var interfaceMap map[string]interface{}
+	if err := json.Unmarshal(jsonBytes, &interfaceMap); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	record := make(map[string]string)
+	for key, value := range interfaceMap {
+		record[key] = fmt.Sprintf("%v", value)
+	}
+	return record
+}
+
+// assertSchemaValid fails the test if the record doesn't match the schema
+func assertSchemaValid(t *testing.T, schema *RecordSchema, record map[string]string) {
+	t.Helper()
+	if violations := schema.Validate(record); len(violations) > 0 {
+		t.Errorf("%s record %v has violations %+v", schema.Name, record, violations)
+	}
+}
+
+func jsonFieldNames(v interface{}) []string {
+	var names []string
+	structType := reflect.TypeOf(v)
+	for i := 0; i < structType.NumField(); i++ {
+		names = append(names, strings.Split(structType.Field(i).Tag.Get("json"), ",")[0])
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRecordSchemasMatchStructs(t *testing.T) {
+	for schema, v := range map[*RecordSchema]interface{}{
+		ContainerLogV2Schema:     DataItemLAv2{},
+		InsightsMetricsSchema:    laTelegrafMetric{},
+		KubeMonAgentEventsSchema: laKubeMonAgentEvents{},
+	} {
+		var names []string
+		for _, field := range schema.Fields {
+			names = append(names, field.Name)
+		}
+		sort.Strings(names)
+		if expected := jsonFieldNames(v); !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s schema has fields %v, expected %v", schema.Name, names, expected)
+		}
+	}
+}
+
+func TestRecordSchemaValidate(t *testing.T) {
+	origComputer := Computer
+	defer func() { Computer = origComputer }()
+	Computer = "node-1"
+
+	laMetrics, err := translateTelegrafMetrics(map[interface{}]interface{}{
+		"name":      "container.azm.ms/disk",
+		"timestamp": uint64(1700000000),
+		"tags":      map[interface{}]interface{}{"device": "sda"},
+		"fields":    map[interface{}]interface{}{"used": 1.5e9, "free": uint64(42)},
+	})
+	if err != nil || len(laMetrics) != 2 {
+		t.Fatalf("translateTelegrafMetrics returned %v %v", laMetrics, err)
+	}
+	for _, laMetric := range laMetrics {
+		assertSchemaValid(t, InsightsMetricsSchema, schemaRecord(t, *laMetric))
+	}
+	assertSchemaValid(t, ContainerLogV2Schema, schemaRecord(t, DataItemLAv2{
+		TimeGenerated:      "2024-01-02T03:04:05.123456789Z",
+		Computer:           "node-1",
+		ContainerId:        "0123456789ab",
+		LogMessage:         "hello",
+		KubernetesMetadata: `{"podLabels":{"app":"web"}}`,
+	}))
+	assertSchemaValid(t, ContainerInventorySchema, convertMap(map[string]interface{}{
+		"CollectionTime": "2024-01-02T03:04:05Z",
+		"InstanceID":     "0123456789ab",
+		"Computer":       "node-1",
+		"ExitCode":       int64(137),
+		"State":          "Failed",
+		"FinishedTime":   "2024-01-02T03:00:00Z",
+	}))
+
+	for _, test := range []struct {
+		schema   *RecordSchema
+		record   map[string]string
+		expected []FieldViolation
+	}{
+		{InsightsMetricsSchema, map[string]string{"Origin": "o", "Namespace": "n", "Name": "x", "Value": "NaN", "Tags": strings.Repeat("a", 64*1024), "CollectionTime": "2024-01-02T03:04:05Z"},
+			[]FieldViolation{{"Value", SchemaViolationType}, {"Tags", SchemaViolationType}, {"Tags", SchemaViolationSize}, {"Computer", SchemaViolationMissing}}},
+		{KubeMonAgentEventsSchema, map[string]string{"Computer": "node-1", "CollectionTime": "yesterday", "Category": "c", "Level": "l", "ClusterId": "id", "ClusterName": "", "Tags": "{}"},
+			[]FieldViolation{{"CollectionTime", SchemaViolationType}, {"ClusterName", SchemaViolationMissing}}},
+		{ContainerInventorySchema, map[string]string{"CollectionTime": "2024-01-02T03:04:05Z", "InstanceID": "id", "Computer": "node-1", "ExitCode": "1.00", "State": "Failed"},
+			[]FieldViolation{{"ExitCode", SchemaViolationType}}},
+		{PerfSchema, map[string]string{"Timestamp": "2024-01-02T03:04:05Z", "Host": "node-1", "ObjectName": "K8SContainer", "InstanceName": "id", "json_Collections": "[{\"CounterName\":"},
+			[]FieldViolation{{"json_Collections", SchemaViolationType}}},
+	} {
+		if violations := test.schema.Validate(test.record); !reflect.DeepEqual(violations, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.schema.Name, test.expected, violations)
+		}
+	}
+}
+
+func TestValidateRecords(t *testing.T) {
+	resetSchemaViolations(t)
+	entries := []MsgPackEntry{
+		{Record: map[string]string{"Timestamp": "2024-01-02T03:04:05Z", "Host": "node-1", "ObjectName": "K8SNode", "InstanceName": "id", "json_Collections": "[]"}},
+		{Record: map[string]string{"Timestamp": "2024-01-02T03:04:05Z", "ObjectName": "K8SNode", "InstanceName": "id", "json_Collections": "[]"}},
+	}
+	SchemaValidationEnabled = false
+	validateRecords(PerfSchema, entries)
+	if counts := takeSchemaViolationCounts(); len(counts) != 0 {
+		t.Fatalf("expected no validation when disabled, got %v", counts)
+	}
+
+	SchemaValidationEnabled = true
+	SchemaValidationLogSampleRate = 2
+	validateRecords(inputPluginRecordSchema("oneagent.containerInsights.LINUX_PERF_BLOB"), entries)
+	validateRecords(inputPluginRecordSchema("oneagent.containerInsights.LINUX_PERF_BLOB"), entries)
+	validateRecords(inputPluginRecordSchema("oneagent.containerInsights.UNKNOWN_BLOB"), entries)
+	key := schemaViolationKey{Schema: "Perf", Field: "Host", Violation: SchemaViolationMissing}
+	if counts := takeSchemaViolationCounts(); len(counts) != 1 || counts[key] != 2 {
+		t.Errorf("expected 2 missing Host violations, got %v", counts)
+	}
+	if state := diagnosticsSchemasState().(map[string]interface{}); len(state["samples"].([]SchemaViolationSample)) != 1 {
+		t.Errorf("expected one sampled violation, got %+v", state["samples"])
+	}
+	if text := collectPrometheusText(t); !strings.Contains(text, `out_oms_schema_violations_total{schema="Perf",field="Host",violation="Missing"} 2`) {
+		t.Errorf("expected the schema violation counter, got %s", text)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/tinylib/msgp/msgp"
+	"github.com/ugorji/go/codec"
+
+	"Docker-Provider/source/plugins/go/src/logging"
+	"Docker-Provider/source/plugins/go/src/paths"
+)
+
+// replayEnvDefaults run the replay with the default log collection settings of the agent configmap, without a node,
+// a workspace or the agent servers. Variables that are set are kept
+var replayEnvDefaults = [][2]string{
+	{"WSID", "00000000-0000-0000-0000-000000000000"},
+	{"DOMAIN", "opinsights.azure.com"},
+	{"CONTROLLER_TYPE", "daemonset"},
+	{"AZMON_COLLECT_STDOUT_LOGS", "true"},
+	{"AZMON_COLLECT_STDERR_LOGS", "true"},
+	{"AZMON_STDOUT_EXCLUDED_NAMESPACES", "kube-system,gatekeeper-system"},
+	{"AZMON_STDERR_EXCLUDED_NAMESPACES", "kube-system,gatekeeper-system"},
+	{paths.LocalModeEnv, "true"},
+	{"AZMON_TELEMETRY_BACKEND", "noop"},
+	{DeadLetterEnabledEnv, "false"},
+	{ConfigHotReloadEnabledEnv, "false"},
+	{VerboseCollectionOverrideEnabledEnv, "false"},
+	{DiagnosticsServerEnabledEnv, "false"},
+	{HealthServerEnabledEnv, "false"},
+	{PrometheusMetricsEnabledEnv, "false"},
+	{DebugTeeEnabledEnv, "false"},
+	{ConfigSnapshotEnabledEnv, "false"},
+	{ResourceThrottlingEnabledEnv, "false"},
+}
+
+// replayFilterReasons are the drops of the collection settings, the other drop reasons are counted as dropped
+var replayFilterReasons = map[DropReason]bool{
+	DropReasonExcludedNamespace:         true,
+	DropReasonSystemResourceNotIncluded: true,
+	DropReasonStreamDisabled:            true,
+	DropReasonStreamOptedOut:            true,
+}
+
+// replayEnrichmentFields are added to the routed records by the enrichment of the plugin
+var replayEnrichmentFields = []string{"KubernetesMetadata", "TraceId", "Image", "Name"}
+
+// chunkio file header: 2 bytes magic, 4 bytes CRC32, 16 bytes padding and the 2 bytes metadata length
+var chunkFileMagic = []byte{0xC1, 0x00}
+
+const chunkFileHeaderSize = 22
+
+// ReplayInput is a chunk file and the tag of its flush
+type ReplayInput struct {
+	Tag  string
+	File string
+}
+
+// ReplayInputStats counts the records of an input through the filter and drop stages of the flush
+type ReplayInputStats struct {
+	Tag      string `json:"tag"`
+	File     string `json:"file"`
+	Read     int    `json:"read"`
+	Filtered int    `json:"filtered"`
+	Dropped  int    `json:"dropped"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ReplayStreamStats counts the records the capture sink received for a stream
+type ReplayStreamStats struct {
+	Stream   string `json:"stream"`
+	Routed   int    `json:"routed"`
+	Enriched int    `json:"enriched"`
+}
+
+// parseReplayInputs parses the tag=file arguments of the replay command
+func parseReplayInputs(args []string) ([]ReplayInput, error) {
+	var inputs []ReplayInput
+	for _, arg := range args {
+		tag, file, found := strings.Cut(arg, "=")
+		if !found || strings.TrimSpace(tag) == "" || file == "" {
+			return nil, fmt.Errorf("invalid input %q, expected <tag>=<file>", arg)
+		}
+		inputs = append(inputs, ReplayInput{Tag: strings.TrimSpace(tag), File: file})
+	}
+	return inputs, nil
+}
+
+// readReplayChunk returns the msgpack records of a fluent-bit chunk file, a raw msgpack file or an NDJSON file
+func readReplayChunk(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json", ".ndjson", ".jsonl":
+		return ndjsonToChunk(bytes.NewReader(data))
+	}
+	if !bytes.HasPrefix(data, chunkFileMagic) {
+		return data, nil
+	}
+	if len(data) < chunkFileHeaderSize+2 {
+		return nil, fmt.Errorf("truncated chunk file header")
+	}
+	start := chunkFileHeaderSize + 2 + int(binary.BigEndian.Uint16(data[chunkFileHeaderSize:]))
+	if start > len(data) {
+		return nil, fmt.Errorf("truncated chunk file metadata")
+	}
+	return data[start:], nil
+}
+
+// ndjsonToChunk encodes NDJSON records as a fluent-bit chunk. A line is a record or a [time, record] pair with the
+// time in seconds, records without a time get the current time
+func ndjsonToChunk(r io.Reader) ([]byte, error) {
+	var chunk []byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		eventTime := time.Now()
+		record, ok := value.(map[string]interface{})
+		if pair, isPair := value.([]interface{}); isPair && len(pair) == 2 {
+			number, _ := pair[0].(json.Number)
+			seconds, err := number.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid record time %v", line, pair[0])
+			}
+			eventTime = time.Unix(0, int64(seconds*float64(time.Second)))
+			record, ok = pair[1].(map[string]interface{})
+		}
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a record or a [time, record] pair", line)
+		}
+
+		// [EventTime, record], EventTime is the msgpack extension 0 of fluent-bit with the seconds and nanoseconds
+		chunk = msgp.AppendArrayHeader(chunk, 2)
+		chunk = append(chunk, 0xd7, 0x00)
+		chunk = binary.BigEndian.AppendUint32(chunk, uint32(eventTime.Unix()))
+		chunk = binary.BigEndian.AppendUint32(chunk, uint32(eventTime.Nanosecond()))
+		var err error
+		if chunk, err = msgp.AppendIntf(chunk, jsonNumbersToMsgp(record)); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+	}
+	return chunk, scanner.Err()
+}
+
+// jsonNumbersToMsgp converts the JSON numbers of a value to integers or floats
+func jsonNumbersToMsgp(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonNumbersToMsgp(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonNumbersToMsgp(item)
+		}
+	}
+	return value
+}
+
+// replayChunk flushes the records of the chunk through the instance like fluent-bit does and counts their drops
+func replayChunk(instance *PluginInstance, tag string, chunk []byte) ReplayInputStats {
+	stats := ReplayInputStats{Tag: tag}
+	if len(chunk) == 0 {
+		stats.Result = "ok"
+		return stats
+	}
+	records := decodeFlushRecords(output.NewDecoder(unsafe.Pointer(&chunk[0]), len(chunk)))
+	stats.Read = len(records)
+
+	filteredBefore, droppedBefore := replayDropTotals()
+	ret := instance.Flush(records, strings.ToLower(tag))
+	filteredAfter, droppedAfter := replayDropTotals()
+	stats.Filtered, stats.Dropped = int(filteredAfter-filteredBefore), int(droppedAfter-droppedBefore)
+
+	switch ret {
+	case output.FLB_OK:
+		stats.Result = "ok"
+	case output.FLB_RETRY:
+		stats.Result = "retry"
+	default:
+		stats.Result = "error"
+	}
+	return stats
+}
+
+// replayDropTotals returns the records dropped since the start by the filters and by the other drop reasons
+func replayDropTotals() (filtered float64, dropped float64) {
+	DroppedRecordCountsMutex.Lock()
+	defer DroppedRecordCountsMutex.Unlock()
+	for key, count := range DroppedRecordTotals {
+		if replayFilterReasons[key.Reason] {
+			filtered += count
+		} else {
+			dropped += count
+		}
+	}
+	return filtered, dropped
+}
+
+// captureSink listens on the mdsd sockets of a directory and writes the received records as NDJSON
+type captureSink struct {
+	dir       string
+	listeners []*net.UnixListener
+	accepting sync.WaitGroup
+	wg        sync.WaitGroup
+
+	mutex   sync.Mutex
+	conns   map[net.Conn]bool
+	streams map[string]*ReplayStreamStats
+	encoder *json.Encoder
+}
+
+// newCaptureSink listens on the default and the prometheus sidecar mdsd sockets under dir
+func newCaptureSink(dir string, out io.Writer) (*captureSink, error) {
+	sink := &captureSink{dir: dir, conns: make(map[net.Conn]bool), streams: make(map[string]*ReplayStreamStats), encoder: json.NewEncoder(out)}
+	for _, override := range sink.overrides() {
+		if err := os.MkdirAll(override.To, 0755); err != nil {
+			sink.Close()
+			return nil, err
+		}
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(override.To, "default_fluent.socket"), Net: "unix"})
+		if err != nil {
+			sink.Close()
+			return nil, err
+		}
+		sink.listeners = append(sink.listeners, listener)
+		sink.accepting.Add(1)
+		go sink.accept(listener)
+	}
+	return sink, nil
+}
+
+// overrides redirect the mdsd socket directories to the sink
+func (sink *captureSink) overrides() []paths.Override {
+	return []paths.Override{
+		{From: "/var/run/mdsd-ci", To: filepath.Join(sink.dir, "mdsd-ci")},
+		{From: "/var/run/mdsd-PrometheusSidecar", To: filepath.Join(sink.dir, "mdsd-PrometheusSidecar")},
+	}
+}
+
+func (sink *captureSink) accept(listener *net.UnixListener) {
+	defer sink.accepting.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		sink.mutex.Lock()
+		sink.conns[conn] = true
+		sink.mutex.Unlock()
+		sink.wg.Add(1)
+		go sink.serve(conn)
+	}
+}
+
+// serve decodes the fluent forward messages [tag, [[time, record], ...]] of a connection
+func (sink *captureSink) serve(conn net.Conn) {
+	defer sink.wg.Done()
+	defer func() {
+		sink.mutex.Lock()
+		delete(sink.conns, conn)
+		sink.mutex.Unlock()
+		conn.Close()
+	}()
+	handle := &codec.MsgpackHandle{}
+	handle.RawToString = true
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	decoder := codec.NewDecoder(bufio.NewReader(conn), handle)
+	for {
+		var message []interface{}
+		if err := decoder.Decode(&message); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				Log("Warn::replay::Capture sink stopped reading a connection %s", err.Error())
+			}
+			return
+		}
+		if len(message) != 2 {
+			continue
+		}
+		stream, _ := message[0].(string)
+		entries, _ := message[1].([]interface{})
+		sink.mutex.Lock()
+		stats, ok := sink.streams[stream]
+		if !ok {
+			stats = &ReplayStreamStats{Stream: stream}
+			sink.streams[stream] = stats
+		}
+		for _, entry := range entries {
+			pair, ok := entry.([]interface{})
+			if !ok || len(pair) != 2 {
+				continue
+			}
+			record, _ := pair[1].(map[string]interface{})
+			stats.Routed++
+			for _, field := range replayEnrichmentFields {
+				if value, _ := record[field].(string); value != "" {
+					stats.Enriched++
+					break
+				}
+			}
+			sink.encoder.Encode(map[string]interface{}{"stream": stream, "time": pair[0], "record": record})
+		}
+		sink.mutex.Unlock()
+	}
+}
+
+// Close stops listening, reads what the connections still have and returns the counts per stream
+func (sink *captureSink) Close() []ReplayStreamStats {
+	// connections the plugin made just before it shut down may not be accepted yet, closing the listener would drop them
+	for _, listener := range sink.listeners {
+		listener.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	}
+	sink.accepting.Wait()
+	for _, listener := range sink.listeners {
+		listener.Close()
+	}
+	// the plugin closed its connections at shutdown, connections that are still open get a second to drain
+	sink.mutex.Lock()
+	for conn := range sink.conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+	}
+	sink.mutex.Unlock()
+	sink.wg.Wait()
+
+	var streams []ReplayStreamStats
+	for _, stats := range sink.streams {
+		streams = append(streams, *stats)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Stream < streams[j].Stream })
+	return streams
+}
+
+// replayCommand initializes the plugin against a capture sink, flushes the inputs in order and prints the counters of
+// each stage
+func replayCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	for _, env := range replayEnvDefaults {
+		if _, set := os.LookupEnv(env[0]); !set {
+			os.Setenv(env[0], env[1])
+		}
+	}
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	confPath := flags.String("conf", getPluginConfFilePath(os.Getenv("OS_TYPE"), os.Getenv("CONTROLLER_TYPE")), "out_oms.conf file of the plugin")
+	outDir := flags.String("out", "replay", "directory of the captured records (capture.ndjson) and the plugin log (out_oms.log)")
+	asJSON := flags.Bool("json", false, "print the counters as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	inputs, err := parseReplayInputs(flags.Args())
+	if err != nil || len(inputs) == 0 {
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %s\n", err.Error())
+		}
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+	if strings.EqualFold(os.Getenv("OS_TYPE"), "windows") {
+		fmt.Fprintln(stderr, "error: replay captures the mdsd sockets of linux, windows named pipes aren't supported")
+		return 1
+	}
+	if _, err := os.Stat(*confPath); err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err.Error())
+		return 1
+	}
+
+	stats, streams, err := replay(*confPath, *outDir, inputs)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err.Error())
+		return 1
+	}
+	if err := writeReplayReport(stdout, stats, streams, *asJSON); err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err.Error())
+		return 1
+	}
+	for _, input := range stats {
+		if input.Error != "" || input.Result != "ok" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// replay runs the inputs through the plugin with its log and captured records in outDir
+func replay(confPath string, outDir string, inputs []ReplayInput) ([]ReplayInputStats, []ReplayStreamStats, error) {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	captureFile, err := os.Create(filepath.Join(outDir, "capture.ndjson"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer captureFile.Close()
+	// unix socket paths are limited to about 100 bytes, the sockets go to a short temporary directory
+	socketDir, err := os.MkdirTemp("", "azmon-replay")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(socketDir)
+	sink, err := newCaptureSink(socketDir, captureFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	settings, err := paths.Load(os.Getenv)
+	if err != nil {
+		sink.Close()
+		return nil, nil, err
+	}
+	settings.Overrides = append(sink.overrides(), settings.Overrides...)
+	paths.Configure(settings)
+
+	PluginLogger = logging.NewFile(filepath.Join(outDir, "out_oms.log"), logging.ConfigFromEnv(os.Getenv))
+	FLBLogger.SetOutput(PluginLogger)
+	// the plugin prints its routing to stdout for the container log, stdout is kept for the report
+	origStdout := os.Stdout
+	os.Stdout = os.Stderr
+	InitializePlugin(confPath, os.Getenv("AGENT_VERSION"))
+	os.Stdout = origStdout
+	instance := NewPluginInstance("replay", func(string) string { return "" })
+	instance.connect()
+
+	var stats []ReplayInputStats
+	for _, input := range inputs {
+		chunk, err := readReplayChunk(input.File)
+		if err != nil {
+			stats = append(stats, ReplayInputStats{Tag: input.Tag, File: input.File, Result: "error", Error: err.Error()})
+			continue
+		}
+		inputStats := replayChunk(instance, input.Tag, chunk)
+		inputStats.File = input.File
+		stats = append(stats, inputStats)
+	}
+	shutdownPlugin(ShutdownTimeout)
+	return stats, sink.Close(), nil
+}
+
+// writeReplayReport prints the counters of each input, each captured stream and their totals
+func writeReplayReport(w io.Writer, stats []ReplayInputStats, streams []ReplayStreamStats, asJSON bool) error {
+	var totals struct {
+		Read     int `json:"read"`
+		Filtered int `json:"filtered"`
+		Enriched int `json:"enriched"`
+		Routed   int `json:"routed"`
+		Dropped  int `json:"dropped"`
+	}
+	for _, input := range stats {
+		totals.Read += input.Read
+		totals.Filtered += input.Filtered
+		totals.Dropped += input.Dropped
+	}
+	for _, stream := range streams {
+		totals.Enriched += stream.Enriched
+		totals.Routed += stream.Routed
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(map[string]interface{}{"inputs": stats, "streams": streams, "totals": totals})
+	}
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TAG\tFILE\tREAD\tFILTERED\tDROPPED\tRESULT")
+	for _, input := range stats {
+		result := input.Result
+		if input.Error != "" {
+			result = input.Result + ": " + input.Error
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%d\t%s\n", input.Tag, input.File, input.Read, input.Filtered, input.Dropped, result)
+	}
+	fmt.Fprintln(writer)
+	fmt.Fprintln(writer, "STREAM\tROUTED\tENRICHED")
+	for _, stream := range streams {
+		fmt.Fprintf(writer, "%s\t%d\t%d\n", stream.Stream, stream.Routed, stream.Enriched)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\nread: %d, filtered: %d, enriched: %d, routed: %d, dropped: %d\n", totals.Read, totals.Filtered, totals.Enriched, totals.Routed, totals.Dropped)
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+const replayTestRecords = `{"filepath":"/var/log/containers/app-5d4f_default_app-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.log","stream":"stdout","log":"hello","time":"2024-05-01T12:00:00Z"}
+
+[1714564800.5, {"filepath":"/var/log/containers/app-5d4f_excluded_app-0123456789abcdef.log","stream":"stdout","log":"excluded","count":3}]
+{"filepath":"/var/log/containers/pod_xyz.log","stream":"stdout","log":"no container id"}
+`
+
+func TestReadReplayChunk(t *testing.T) {
+	dir := t.TempDir()
+	ndjsonFile := filepath.Join(dir, "records.ndjson")
+	if err := os.WriteFile(ndjsonFile, []byte(replayTestRecords), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := readReplayChunk(ndjsonFile)
+	if err != nil {
+		t.Fatalf("expected the NDJSON file to convert, got %v", err)
+	}
+
+	// the same records in a chunkio file with 3 bytes of metadata
+	header := append(append([]byte{0xC1, 0x00}, make([]byte, 20)...), 0x00, 0x03, 'm', 'e', 't')
+	chunkFile := filepath.Join(dir, "1-1714564800.123.flb")
+	if err := os.WriteFile(chunkFile, append(header, chunk...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fromChunkFile, err := readReplayChunk(chunkFile)
+	if err != nil || !bytes.Equal(fromChunkFile, chunk) {
+		t.Fatalf("expected the chunk file header and metadata to be skipped, got %v", err)
+	}
+
+	records := decodeFlushRecords(output.NewDecoder(unsafe.Pointer(&chunk[0]), len(chunk)))
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	if ToString(records[1]["log"]) != "excluded" || fmt.Sprint(records[1]["count"]) != "3" {
+		t.Errorf("expected the fluent-bit value types, got %#v", records[1])
+	}
+	if recordTime := records[1][fluentBitTimeKey].(time.Time); !recordTime.Equal(time.Unix(1714564800, 500000000)) {
+		t.Errorf("expected the time of the pair, got %s", recordTime)
+	}
+
+	if _, err := ndjsonToChunk(strings.NewReader("[\"now\", {}]\n")); err == nil {
+		t.Errorf("expected an invalid time to fail")
+	}
+	if _, err := parseReplayInputs([]string{"oms.container.log.la.tail"}); err == nil {
+		t.Errorf("expected an input without a file to fail")
+	}
+}
+
+func TestReplayChunkCapturesRecords(t *testing.T) {
+	resetPluginInstances(t)
+	resetDroppedRecordCounts(t)
+	origWindows, origMSI, origGeneva, origIgnoreNsSet := IsWindows, IsAADMSIAuthMode, IsGenevaLogsIntegrationEnabled, StdoutIgnoreNsSet
+	defer func() {
+		IsWindows, IsAADMSIAuthMode, IsGenevaLogsIntegrationEnabled, StdoutIgnoreNsSet = origWindows, origMSI, origGeneva, origIgnoreNsSet
+	}()
+	IsWindows, IsAADMSIAuthMode, IsGenevaLogsIntegrationEnabled = false, false, false
+	StdoutIgnoreNsSet = map[string]bool{"excluded": true}
+	ContainerLogsRouteV2 = true
+
+	var captured bytes.Buffer
+	sink, err := newCaptureSink(t.TempDir(), &captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := NewPluginInstance("replay", instanceConfig(map[string]string{PluginInstanceContainerLogSchemaVersionKey: "v2"}))
+	conn, err := net.Dial("unix", filepath.Join(sink.overrides()[0].To, "default_fluent.socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.MdsdMsgpUnixSocketClient = conn
+
+	chunk, err := ndjsonToChunk(strings.NewReader(replayTestRecords))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := replayChunk(instance, "oms.container.log.la.tail", chunk)
+	conn.Close()
+	streams := sink.Close()
+
+	if stats.Read != 3 || stats.Filtered != 1 || stats.Dropped != 1 || stats.Result != "ok" {
+		t.Errorf("expected 3 records read, 1 filtered and 1 dropped, got %+v", stats)
+	}
+	if len(streams) != 1 || streams[0].Stream != MdsdContainerLogV2SourceName || streams[0].Routed != 1 {
+		t.Fatalf("expected one record routed to %s, got %+v", MdsdContainerLogV2SourceName, streams)
+	}
+	var line struct {
+		Stream string            `json:"stream"`
+		Record map[string]string `json:"record"`
+	}
+	if err := json.Unmarshal(captured.Bytes(), &line); err != nil || line.Record["LogMessage"] != "hello" || line.Record["PodNamespace"] != "default" {
+		t.Errorf("expected the captured ContainerLogV2 record, got %s %v", captured.String(), err)
+	}
+
+	var report bytes.Buffer
+	if err := writeReplayReport(&report, []ReplayInputStats{stats}, streams, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.String(), "read: 3, filtered: 1, enriched: 0, routed: 1, dropped: 1") {
+		t.Errorf("unexpected report %s", report.String())
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/paths"
+)
+
+// env variable to enable the adaptive self-throttling (disabled when unset). Beyond the memory or CPU threshold the
+// plugin pauses the container log enrichment and shrinks its batches, further on it samples the container logs of the
+// low priority namespaces
+const ResourceThrottlingEnabledEnv = "AZMON_RESOURCE_THROTTLING_ENABLED"
+
+// env variable with the memory usage in percent of the container memory limit at which throttling starts
+const ResourceThrottlingMemoryPercentEnv = "AZMON_RESOURCE_THROTTLING_MEMORY_PERCENT"
+
+// env variable with the CPU usage in percent of the container CPU limit at which throttling starts
+const ResourceThrottlingCPUPercentEnv = "AZMON_RESOURCE_THROTTLING_CPU_PERCENT"
+
+// env variable to keep one in every N container log records of the low priority namespaces when sampling, the severe
+// level keeps one in every N*N
+const ResourceThrottlingSampleRateEnv = "AZMON_RESOURCE_THROTTLING_SAMPLE_RATE"
+
+// env variable with the records per write to mdsd and AMA when throttling, halved with every further level
+const ResourceThrottlingBatchSizeEnv = "AZMON_RESOURCE_THROTTLING_BATCH_SIZE"
+
+// env variable with the comma separated namespaces whose container logs are sampled, every namespace but kube-system
+// when unset. Pods with a verbose collection override are never sampled
+const ResourceThrottlingLowPriorityNamespacesEnv = "AZMON_RESOURCE_THROTTLING_LOW_PRIORITY_NAMESPACES"
+
+// env variable with the seconds between the resource usage checks
+const ResourceThrottlingIntervalSecondsEnv = "AZMON_RESOURCE_THROTTLING_INTERVAL_SECONDS"
+
+// env variable with the memory limit of the container from the pod spec, used when the cgroup has no limit e.g. on windows
+const ContainerMemoryLimitEnv = "CONTAINER_MEMORY_LIMIT_IN_BYTES"
+
+const ResourceThrottlingEventCategory = "container.azm.ms/resourcethrottling"
+
+const (
+	defaultResourceThrottlingMemoryPercent   = 80
+	defaultResourceThrottlingCPUPercent      = 90
+	defaultResourceThrottlingSampleRate      = 10
+	defaultResourceThrottlingBatchSize       = 1000
+	defaultResourceThrottlingIntervalSeconds = 10
+)
+
+// the usage has to drop this many percentage points below a level before throttling steps down
+const resourceThrottlingHysteresisPercent = 5
+
+// cgroup v1 reports no memory limit as a page aligned max int64
+const cgroupV1UnlimitedMemory = uint64(1) << 62
+
+const defaultCgroupDir = "/sys/fs/cgroup"
+
+const procSelfStatmPath = "/proc/self/statm"
+
+const procSelfStatPath = "/proc/self/stat"
+
+// USER_HZ of the utime and stime in /proc/self/stat
+const procClockTicksPerSecond = 100
+
+// ThrottleLevel of the adaptive self-throttling
+type ThrottleLevel int32
+
+// Throttle levels, the levels split the range from the threshold to the limit evenly
+const (
+	ThrottleNone ThrottleLevel = iota
+	// ThrottleLight pauses the enrichment and shrinks the batches
+	ThrottleLight
+	// ThrottleModerate also samples the container logs of the low priority namespaces
+	ThrottleModerate
+	// ThrottleSevere samples with the square of the sample rate and halves the batches again
+	ThrottleSevere
+)
+
+func (l ThrottleLevel) String() string {
+	switch l {
+	case ThrottleNone:
+		return "none"
+	case ThrottleLight:
+		return "light"
+	case ThrottleModerate:
+		return "moderate"
+	case ThrottleSevere:
+		return "severe"
+	}
+	return "unknown"
+}
+
+// ResourceUsage of the fluent-bit process and the limits of the agent container, zero when unknown
+type ResourceUsage struct {
+	ProcessRSSBytes uint64 `json:"processRssBytes"`
+	GoHeapBytes     uint64 `json:"goHeapBytes"`
+	// MemoryBytes is the working set of the container cgroup, the usage without the inactive page cache. The cgroup
+	// is shared with mdsd, fluentd and telegraf, so it only caps the usage of the process
+	MemoryBytes      uint64 `json:"memoryBytes"`
+	MemoryLimitBytes uint64 `json:"memoryLimitBytes"`
+	// CPUCores used by the fluent-bit process
+	CPUCores      float64 `json:"cpuCores"`
+	CPULimitCores float64 `json:"cpuLimitCores"`
+}
+
+// MemoryPercent returns the memory usage of the process in percent of the limit. The process RSS and the Go heap are
+// lower bounds of the usage, the larger one is used up to the container working set
+func (u ResourceUsage) MemoryPercent() float64 {
+	if u.MemoryLimitBytes == 0 {
+		return 0
+	}
+	used := max(u.ProcessRSSBytes, u.GoHeapBytes)
+	if u.MemoryBytes > 0 && used > u.MemoryBytes {
+		used = u.MemoryBytes
+	}
+	return 100 * float64(used) / float64(u.MemoryLimitBytes)
+}
+
+// CPUPercent returns the CPU usage of the process in percent of the limit
+func (u ResourceUsage) CPUPercent() float64 {
+	if u.CPULimitCores == 0 {
+		return 0
+	}
+	return 100 * u.CPUCores / u.CPULimitCores
+}
+
+// resourceMonitor reads the resource usage of the process from /proc and the limits from the cgroup of the container
+type resourceMonitor struct {
+	cgroupDir   string
+	statmPath   string
+	statPath    string
+	memoryLimit uint64
+	readFile    func(name string) ([]byte, error)
+	// lastCPUUsage and lastCPUTime of the previous read for the CPU usage rate
+	lastCPUUsage time.Duration
+	lastCPUTime  time.Time
+}
+
+// ResourceThrottlingSettings of the adaptive self-throttling
+type ResourceThrottlingSettings struct {
+	MemoryPercent int
+	CPUPercent    int
+	SampleRate    int
+	BatchSize     int
+	// LowPriorityNamespaces are sampled, every namespace but kube-system when empty
+	LowPriorityNamespaces map[string]bool
+}
+
+// ResourceThrottlingStatus is the state of the throttling served on /debug/state/throttling
+type ResourceThrottlingStatus struct {
+	Enabled bool          `json:"enabled"`
+	Level   string        `json:"level"`
+	Reason  string        `json:"reason,omitempty"`
+	Since   string        `json:"since,omitempty"`
+	Usage   ResourceUsage `json:"usage"`
+}
+
+// resourceThrottler keeps the throttle level, the flush paths read it without locking
+type resourceThrottler struct {
+	level         int32
+	sampleCounter uint64
+	mutex         sync.Mutex
+	settings      ResourceThrottlingSettings
+	usage         ResourceUsage
+	reason        string
+	since         time.Time
+	// maxLevel since the last telemetry flush
+	maxLevel ThrottleLevel
+	// duplicateRecords written again since the last telemetry flush, the records of the batches written before a
+	// failed batch are sent again when fluent-bit retries the chunk
+	duplicateRecords uint64
+}
+
+var (
+	// ResourceThrottlingEnabled watches the resource usage and throttles the plugin near the limits
+	ResourceThrottlingEnabled bool
+	// ResourceThrottlingTicker checks the resource usage
+	ResourceThrottlingTicker *time.Ticker
+	// ResourceThrottling is the throttle level of the flush paths
+	ResourceThrottling = &resourceThrottler{}
+	// ResourceThrottlingEvent hash of the throttling starts and stops sent as KubeMonAgentEvents
+	ResourceThrottlingEvent = make(map[string]KubeMonAgentEventTags)
+)
+
+func populateResourceThrottlingSettings(config *PluginConfig) {
+	ResourceThrottlingEnabled = config.ThrottlingEnabled
+	lowPriorityNamespaces := make(map[string]bool)
+	for _, namespace := range config.ThrottlingLowPriorityNamespaces {
+		lowPriorityNamespaces[namespace] = true
+	}
+	ResourceThrottling.configure(ResourceThrottlingSettings{
+		MemoryPercent:         config.ThrottlingMemoryPercent,
+		CPUPercent:            config.ThrottlingCPUPercent,
+		SampleRate:            config.ThrottlingSampleRate,
+		BatchSize:             config.ThrottlingBatchSize,
+		LowPriorityNamespaces: lowPriorityNamespaces,
+	})
+	Log("ResourceThrottlingEnabled: %v, memory threshold: %d%%, cpu threshold: %d%%", ResourceThrottlingEnabled, config.ThrottlingMemoryPercent, config.ThrottlingCPUPercent)
+}
+
+func newResourceMonitor() *resourceMonitor {
+	memoryLimit, _ := strconv.ParseUint(strings.TrimSpace(os.Getenv(ContainerMemoryLimitEnv)), 10, 64)
+	return &resourceMonitor{
+		cgroupDir:   paths.Resolve(defaultCgroupDir),
+		statmPath:   paths.Resolve(procSelfStatmPath),
+		statPath:    paths.Resolve(procSelfStatPath),
+		memoryLimit: memoryLimit,
+		readFile:    os.ReadFile,
+	}
+}
+
+// readUint returns the unsigned integer in a cgroup file, false if it doesn't exist or has no limit
+func (m *resourceMonitor) readUint(name string) (uint64, bool) {
+	content, err := m.readFile(filepath.Join(m.cgroupDir, name))
+	if err != nil {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	return value, err == nil
+}
+
+// readStat returns a key of a cgroup stat file with "key value" lines
+func (m *resourceMonitor) readStat(name string, key string) uint64 {
+	content, err := m.readFile(filepath.Join(m.cgroupDir, name))
+	if err != nil {
+		return 0
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			value, _ := strconv.ParseUint(fields[1], 10, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+// readProcessCPU returns the CPU time of the process from /proc/self/stat
+func (m *resourceMonitor) readProcessCPU() time.Duration {
+	content, err := m.readFile(m.statPath)
+	if err != nil {
+		return 0
+	}
+	// the fields after the command, which may have spaces, start with the state
+	end := bytes.LastIndexByte(content, ')')
+	if end == -1 {
+		return 0
+	}
+	fields := strings.Fields(string(content[end+1:]))
+	if len(fields) < 13 {
+		return 0
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	return time.Duration(utime+stime) * time.Second / procClockTicksPerSecond
+}
+
+// read returns the resource usage, the CPU usage is the rate since the previous read
+func (m *resourceMonitor) read(now time.Time) ResourceUsage {
+	var usage ResourceUsage
+	if _, err := m.readFile(filepath.Join(m.cgroupDir, "cgroup.controllers")); err == nil {
+		// cgroup v2
+		if limit, ok := m.readUint("memory.max"); ok {
+			usage.MemoryLimitBytes = limit
+		}
+		if current, ok := m.readUint("memory.current"); ok {
+			usage.MemoryBytes = current - min(current, m.readStat("memory.stat", "inactive_file"))
+		}
+		if content, err := m.readFile(filepath.Join(m.cgroupDir, "cpu.max")); err == nil {
+			fields := strings.Fields(string(content))
+			if len(fields) == 2 {
+				quota, quotaErr := strconv.ParseFloat(fields[0], 64)
+				period, periodErr := strconv.ParseFloat(fields[1], 64)
+				if quotaErr == nil && periodErr == nil && period > 0 {
+					usage.CPULimitCores = quota / period
+				}
+			}
+		}
+	} else {
+		// cgroup v1
+		if limit, ok := m.readUint("memory/memory.limit_in_bytes"); ok && limit < cgroupV1UnlimitedMemory {
+			usage.MemoryLimitBytes = limit
+		}
+		if current, ok := m.readUint("memory/memory.usage_in_bytes"); ok {
+			usage.MemoryBytes = current - min(current, m.readStat("memory/memory.stat", "total_inactive_file"))
+		}
+		// the quota is -1 without a limit and doesn't parse as unsigned
+		if quota, ok := m.readUint("cpu/cpu.cfs_quota_us"); ok {
+			if period, ok := m.readUint("cpu/cpu.cfs_period_us"); ok && period > 0 {
+				usage.CPULimitCores = float64(quota) / float64(period)
+			}
+		}
+	}
+	if usage.MemoryLimitBytes == 0 {
+		usage.MemoryLimitBytes = m.memoryLimit
+	}
+	if cpuUsage := m.readProcessCPU(); cpuUsage > 0 {
+		if !m.lastCPUTime.IsZero() && now.After(m.lastCPUTime) && cpuUsage >= m.lastCPUUsage {
+			usage.CPUCores = float64(cpuUsage-m.lastCPUUsage) / float64(now.Sub(m.lastCPUTime))
+		}
+		m.lastCPUUsage, m.lastCPUTime = cpuUsage, now
+	}
+	if content, err := m.readFile(m.statmPath); err == nil {
+		if fields := strings.Fields(string(content)); len(fields) > 1 {
+			pages, _ := strconv.ParseUint(fields[1], 10, 64)
+			usage.ProcessRSSBytes = pages * uint64(os.Getpagesize())
+		}
+	}
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	usage.GoHeapBytes = memStats.HeapAlloc
+	return usage
+}
+
+// resourceThrottleLevel returns the level of a usage in percent of the limit
+func resourceThrottleLevel(percent float64, threshold int) ThrottleLevel {
+	if threshold <= 0 || threshold >= 100 || percent < float64(threshold) {
+		return ThrottleNone
+	}
+	step := float64(100-threshold) / float64(ThrottleSevere)
+	level := ThrottleLight + ThrottleLevel(math.Floor((percent-float64(threshold))/step))
+	if level > ThrottleSevere {
+		level = ThrottleSevere
+	}
+	return level
+}
+
+func (t *resourceThrottler) configure(settings ResourceThrottlingSettings) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.settings = settings
+}
+
+// Level returns the current throttle level
+func (t *resourceThrottler) Level() ThrottleLevel {
+	return ThrottleLevel(atomic.LoadInt32(&t.level))
+}
+
+// targetLevel returns the level of the usage and the resource it's due to. Throttling steps down only once the usage
+// is below the lower level by the hysteresis
+func (t *resourceThrottler) targetLevel(usage ResourceUsage, current ThrottleLevel) (ThrottleLevel, string) {
+	memoryPercent, cpuPercent := usage.MemoryPercent(), usage.CPUPercent()
+	level, reason := resourceThrottleLevel(memoryPercent, t.settings.MemoryPercent), "memory"
+	if cpuLevel := resourceThrottleLevel(cpuPercent, t.settings.CPUPercent); cpuLevel > level {
+		level, reason = cpuLevel, "cpu"
+	}
+	if level < current {
+		held := resourceThrottleLevel(memoryPercent+resourceThrottlingHysteresisPercent, t.settings.MemoryPercent)
+		if cpuLevel := resourceThrottleLevel(cpuPercent+resourceThrottlingHysteresisPercent, t.settings.CPUPercent); cpuLevel > held {
+			held = cpuLevel
+		}
+		if held > level {
+			level = min(held, current)
+		}
+	}
+	return level, reason
+}
+
+// update sets the throttle level of the usage and records a KubeMonAgentEvent when throttling starts or stops
+func (t *resourceThrottler) update(usage ResourceUsage, now time.Time) {
+	t.mutex.Lock()
+	current := t.Level()
+	level, reason := t.targetLevel(usage, current)
+	t.usage = usage
+	if level > t.maxLevel {
+		t.maxLevel = level
+	}
+	if level != current {
+		atomic.StoreInt32(&t.level, int32(level))
+		if current == ThrottleNone {
+			t.reason, t.since = reason, now
+		} else if level == ThrottleNone {
+			t.reason, t.since = "", time.Time{}
+		}
+	}
+	threshold := t.settings.MemoryPercent
+	if reason == "cpu" {
+		threshold = t.settings.CPUPercent
+	}
+	t.mutex.Unlock()
+
+	if level == current {
+		return
+	}
+	Log("Info::throttling::Throttle level changed from %s to %s, memory %.1f%% cpu %.1f%% of the container limits, rss %d bytes, go heap %d bytes",
+		current, level, usage.MemoryPercent(), usage.CPUPercent(), usage.ProcessRSSBytes, usage.GoHeapBytes)
+	switch {
+	case current == ThrottleNone:
+		recordResourceThrottlingEvent(fmt.Sprintf("Resource throttling started, %s usage is above %d%% of the container limit", reason, threshold), now)
+	case level == ThrottleNone:
+		recordResourceThrottlingEvent("Resource throttling stopped", now)
+	}
+}
+
+// recordResourceThrottlingEvent adds a throttling start or stop to the KubeMonAgentEvents of the next flush
+func recordResourceThrottlingEvent(key string, now time.Time) {
+	eventTimeStamp := now.Format(time.RFC3339)
+	EventHashUpdateMutex.Lock()
+	defer EventHashUpdateMutex.Unlock()
+	if val, ok := ResourceThrottlingEvent[key]; ok {
+		ResourceThrottlingEvent[key] = KubeMonAgentEventTags{
+			FirstOccurrence: val.FirstOccurrence,
+			LastOccurrence:  eventTimeStamp,
+			Count:           val.Count + 1,
+		}
+	} else {
+		ResourceThrottlingEvent[key] = KubeMonAgentEventTags{
+			FirstOccurrence: eventTimeStamp,
+			LastOccurrence:  eventTimeStamp,
+			Count:           1,
+		}
+	}
+}
+
+// enrichmentPaused returns true if the container log enrichment is paused
+func (t *resourceThrottler) enrichmentPaused() bool {
+	return t.Level() >= ThrottleLight
+}
+
+// batchSize returns the max records per write, 0 when the batches aren't limited
+func (t *resourceThrottler) batchSize() int {
+	level := t.Level()
+	if level == ThrottleNone {
+		return 0
+	}
+	t.mutex.Lock()
+	batchSize := t.settings.BatchSize >> (level - ThrottleLight)
+	t.mutex.Unlock()
+	return max(batchSize, 1)
+}
+
+// sample returns false if the container log record of the namespace is sampled out
+func (t *resourceThrottler) sample(namespace string) bool {
+	level := t.Level()
+	if level < ThrottleModerate {
+		return true
+	}
+	t.mutex.Lock()
+	lowPriority := t.settings.LowPriorityNamespaces[namespace] || (len(t.settings.LowPriorityNamespaces) == 0 && namespace != "kube-system")
+	rate := uint64(t.settings.SampleRate)
+	t.mutex.Unlock()
+	if !lowPriority || rate <= 1 {
+		return true
+	}
+	if level == ThrottleSevere {
+		rate *= rate
+	}
+	return atomic.AddUint64(&t.sampleCounter, 1)%rate == 0
+}
+
+// recordDuplicates counts the records that are sent again when fluent-bit retries the chunk
+func (t *resourceThrottler) recordDuplicates(count int) {
+	atomic.AddUint64(&t.duplicateRecords, uint64(count))
+}
+
+// takeDuplicates returns and resets the duplicate records since the last telemetry flush
+func (t *resourceThrottler) takeDuplicates() uint64 {
+	return atomic.SwapUint64(&t.duplicateRecords, 0)
+}
+
+// takeMaxLevel returns and resets the max level since the last telemetry flush with the latest usage
+func (t *resourceThrottler) takeMaxLevel() (ThrottleLevel, ResourceUsage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	level := t.maxLevel
+	t.maxLevel = t.Level()
+	return level, t.usage
+}
+
+// Status returns the state of the throttling
+func (t *resourceThrottler) Status() ResourceThrottlingStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	status := ResourceThrottlingStatus{Enabled: ResourceThrottlingEnabled, Level: t.Level().String(), Reason: t.reason, Usage: t.usage}
+	if !t.since.IsZero() {
+		status.Since = t.since.Format(time.RFC3339)
+	}
+	return status
+}
+
+func diagnosticsThrottlingState() interface{} {
+	return ResourceThrottling.Status()
+}
+
+// monitorResourceUsage updates the throttle level from the resource usage until shutdown
+func monitorResourceUsage() {
+	monitor := newResourceMonitor()
+	for running := true; running; running = waitForTick(ResourceThrottlingTicker) {
+		now := time.Now()
+		ResourceThrottling.update(monitor.read(now), now)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetResourceThrottling(t *testing.T, settings ResourceThrottlingSettings) {
+	orig := ResourceThrottling
+	ResourceThrottling = &resourceThrottler{settings: settings}
+	t.Cleanup(func() {
+		ResourceThrottling = orig
+		EventHashUpdateMutex.Lock()
+		ResourceThrottlingEvent = make(map[string]KubeMonAgentEventTags)
+		EventHashUpdateMutex.Unlock()
+	})
+}
+
+func fakeCgroupFiles(files map[string]string) func(string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		if content, ok := files[filepath.ToSlash(name)]; ok {
+			return []byte(content), nil
+		}
+		return nil, errors.New("no such file")
+	}
+}
+
+func TestResourceMonitorRead(t *testing.T) {
+	now := time.Now()
+	files := map[string]string{
+		"/cgroup/cgroup.controllers": "cpu memory",
+		"/cgroup/memory.max":         "1000000",
+		"/cgroup/memory.current":     "700000",
+		"/cgroup/memory.stat":        "anon 500000\ninactive_file 100000\n",
+		"/cgroup/cpu.max":            "50000 100000",
+		"/cgroup/cpu.stat":           "usage_usec 9000000\nuser_usec 8000000\n",
+		"/proc/statm":                "1000 10 5 1 0 20 0",
+		"/proc/stat":                 "42 (fluent bit) S 1 42 42 0 -1 4194560 100 0 0 0 60 40 0 0 20 0 12 0 100",
+	}
+	monitor := &resourceMonitor{cgroupDir: "/cgroup", statmPath: "/proc/statm", statPath: "/proc/stat", readFile: fakeCgroupFiles(files)}
+	usage := monitor.read(now)
+	if usage.MemoryLimitBytes != 1000000 || usage.MemoryBytes != 600000 || usage.CPULimitCores != 0.5 || usage.CPUCores != 0 {
+		t.Errorf("unexpected cgroup v2 usage %+v", usage)
+	}
+	if usage.ProcessRSSBytes == 0 || usage.GoHeapBytes == 0 {
+		t.Errorf("expected the process RSS and the Go heap, got %+v", usage)
+	}
+	// the cgroup CPU usage of the other agent processes doesn't count
+	files["/cgroup/cpu.stat"] = "usage_usec 10000000\n"
+	files["/proc/stat"] = "42 (fluent bit) S 1 42 42 0 -1 4194560 100 0 0 0 80 45 0 0 20 0 12 0 100"
+	if usage = monitor.read(now.Add(time.Second)); usage.CPUCores != 0.25 || usage.CPUPercent() != 50 {
+		t.Errorf("expected a quarter core of the process, half of the limit, got %+v", usage)
+	}
+
+	monitor = &resourceMonitor{cgroupDir: "/cgroup", statmPath: "/proc/statm", memoryLimit: 2000000, readFile: fakeCgroupFiles(map[string]string{
+		"/cgroup/memory/memory.limit_in_bytes": "9223372036854771712",
+		"/cgroup/memory/memory.usage_in_bytes": "500000",
+		"/cgroup/memory/memory.stat":           "total_inactive_file 100000\n",
+		"/cgroup/cpu/cpu.cfs_quota_us":         "-1",
+		"/cgroup/cpu/cpu.cfs_period_us":        "100000",
+	})}
+	if usage = monitor.read(now); usage.MemoryLimitBytes != 2000000 || usage.MemoryBytes != 400000 || usage.CPULimitCores != 0 {
+		t.Errorf("expected the cgroup v1 usage with the limit of the pod spec, got %+v", usage)
+	}
+}
+
+func TestResourceUsageMemoryPercent(t *testing.T) {
+	for _, test := range []struct {
+		usage    ResourceUsage
+		expected float64
+	}{
+		// the working set of the other agent processes doesn't count
+		{ResourceUsage{ProcessRSSBytes: 200, GoHeapBytes: 100, MemoryBytes: 900, MemoryLimitBytes: 1000}, 20},
+		{ResourceUsage{ProcessRSSBytes: 200, GoHeapBytes: 300, MemoryBytes: 900, MemoryLimitBytes: 1000}, 30},
+		// the container working set caps the usage of the process
+		{ResourceUsage{ProcessRSSBytes: 800, MemoryBytes: 500, MemoryLimitBytes: 1000}, 50},
+		{ResourceUsage{ProcessRSSBytes: 800, MemoryLimitBytes: 1000}, 80},
+		{ResourceUsage{ProcessRSSBytes: 800}, 0},
+	} {
+		if percent := test.usage.MemoryPercent(); percent != test.expected {
+			t.Errorf("%+v: expected %.0f%%, got %.0f%%", test.usage, test.expected, percent)
+		}
+	}
+}
+
+func TestResourceThrottleLevel(t *testing.T) {
+	for _, test := range []struct {
+		percent   float64
+		threshold int
+		expected  ThrottleLevel
+	}{
+		{50, 80, ThrottleNone},
+		{80, 80, ThrottleLight},
+		{87, 80, ThrottleModerate},
+		{94, 80, ThrottleSevere},
+		{120, 80, ThrottleSevere},
+		{99, 0, ThrottleNone},
+	} {
+		if level := resourceThrottleLevel(test.percent, test.threshold); level != test.expected {
+			t.Errorf("%.0f%% of threshold %d%%: expected %s, got %s", test.percent, test.threshold, test.expected, level)
+		}
+	}
+}
+
+func TestResourceThrottlerUpdate(t *testing.T) {
+	resetResourceThrottling(t, ResourceThrottlingSettings{MemoryPercent: 80, CPUPercent: 90, SampleRate: 10, BatchSize: 1000})
+	now := time.Now()
+	usage := func(memoryPercent float64) ResourceUsage {
+		return ResourceUsage{ProcessRSSBytes: uint64(memoryPercent * 10), MemoryLimitBytes: 1000}
+	}
+
+	ResourceThrottling.update(usage(50), now)
+	if ResourceThrottling.Level() != ThrottleNone || ResourceThrottling.batchSize() != 0 || ResourceThrottling.enrichmentPaused() {
+		t.Fatalf("expected no throttling below the threshold, got %s", ResourceThrottling.Level())
+	}
+	ResourceThrottling.update(usage(95), now)
+	if ResourceThrottling.Level() != ThrottleSevere || ResourceThrottling.batchSize() != 250 || !ResourceThrottling.enrichmentPaused() {
+		t.Errorf("expected severe throttling with a quarter of the batch size, got %s %d", ResourceThrottling.Level(), ResourceThrottling.batchSize())
+	}
+	// within the hysteresis of the severe level
+	ResourceThrottling.update(usage(90), now)
+	if ResourceThrottling.Level() != ThrottleSevere {
+		t.Errorf("expected the level to be held within the hysteresis, got %s", ResourceThrottling.Level())
+	}
+	// below the threshold, but within its hysteresis
+	ResourceThrottling.update(usage(78), now)
+	if ResourceThrottling.Level() != ThrottleLight || ResourceThrottling.batchSize() != 1000 {
+		t.Errorf("expected light throttling, got %s %d", ResourceThrottling.Level(), ResourceThrottling.batchSize())
+	}
+	ResourceThrottling.update(usage(60), now)
+	if ResourceThrottling.Level() != ThrottleNone {
+		t.Errorf("expected throttling to stop, got %s", ResourceThrottling.Level())
+	}
+
+	if level, _ := ResourceThrottling.takeMaxLevel(); level != ThrottleSevere {
+		t.Errorf("expected the max level since the last telemetry flush, got %s", level)
+	}
+	EventHashUpdateMutex.Lock()
+	defer EventHashUpdateMutex.Unlock()
+	if len(ResourceThrottlingEvent) != 2 || ResourceThrottlingEvent["Resource throttling stopped"].Count != 1 {
+		t.Errorf("expected a start and a stop event, got %v", ResourceThrottlingEvent)
+	}
+	for message := range ResourceThrottlingEvent {
+		if strings.Contains(message, "started") && !strings.Contains(message, "memory usage is above 80%") {
+			t.Errorf("expected the start event to name the resource and threshold, got %s", message)
+		}
+	}
+}
+
+func TestResourceThrottlerSample(t *testing.T) {
+	resetResourceThrottling(t, ResourceThrottlingSettings{SampleRate: 2})
+	ResourceThrottling.level = int32(ThrottleLight)
+	if !ResourceThrottling.sample("default") {
+		t.Errorf("expected no sampling at the light level")
+	}
+
+	ResourceThrottling.level = int32(ThrottleModerate)
+	kept := 0
+	for i := 0; i < 10; i++ {
+		if ResourceThrottling.sample("default") {
+			kept++
+		}
+		if !ResourceThrottling.sample("kube-system") {
+			t.Fatalf("expected kube-system not to be sampled")
+		}
+	}
+	if kept != 5 {
+		t.Errorf("expected one in two records to be kept, got %d", kept)
+	}
+
+	ResourceThrottling.settings.LowPriorityNamespaces = map[string]bool{"batch": true}
+	if !ResourceThrottling.sample("default") {
+		t.Errorf("expected only the low priority namespaces to be sampled")
+	}
+}
+
+func TestPostDataHelperSamplesWhenThrottled(t *testing.T) {
+	resetDroppedRecordCounts(t)
+	resetResourceThrottling(t, ResourceThrottlingSettings{SampleRate: 2, LowPriorityNamespaces: map[string]bool{"batch": true}})
+	ResourceThrottling.level = int32(ThrottleModerate)
+	resetVerboseCollectionOverrides(t)
+	VerboseCollectionOverrideEnabled = true
+	setVerboseCollectionOverrides(map[string]verboseCollectionOverride{"batch/debug-5d4f": {Value: "until", Expiry: time.Now().Add(time.Hour)}}, time.Now())
+
+	var records []map[interface{}]interface{}
+	for i := 0; i < 4; i++ {
+		records = append(records,
+			map[interface{}]interface{}{"filepath": []byte("/var/log/containers/job-5d4f_batch_job-0123456789abcdef.log"), "stream": []byte("stdout"), "log": []byte("batch")},
+			map[interface{}]interface{}{"filepath": []byte("/var/log/containers/debug-5d4f_batch_debug-0123456789abcdef.log"), "stream": []byte("stdout"), "log": []byte("verbose")},
+			map[interface{}]interface{}{"filepath": []byte("/var/log/containers/web-5d4f_web_web-0123456789abcdef.log"), "stream": []byte("stdout"), "log": []byte("web")})
+	}
+	(&PluginInstance{}).PostDataHelper(records)
+
+	counts := takeDroppedRecordCounts()
+	if counts[dropKey{Reason: DropReasonResourceThrottled, Namespace: "batch"}] != 2 || counts[dropKey{Reason: DropReasonResourceThrottled, Namespace: "web"}] != 0 {
+		t.Errorf("expected half of the low priority records without a verbose collection override to be sampled out, got %v", counts)
+	}
+}
+
+func TestWriteMsgpBatches(t *testing.T) {
+	resetResourceThrottling(t, ResourceThrottlingSettings{BatchSize: 4})
+	entries := make([]MsgPackEntry, 10)
+	for i := range entries {
+		entries[i] = MsgPackEntry{Record: map[string]string{"LogMessage": "hello"}}
+	}
+
+	conn := newFakeMdsdConn(true)
+	if _, err := writeMsgpBatches(conn, "ContainerLogV2Source", entries); err != nil || len(conn.written) != 1 {
+		t.Fatalf("expected a single write without throttling, got %d writes %v", len(conn.written), err)
+	}
+	ResourceThrottling.level = int32(ThrottleModerate)
+	conn = newFakeMdsdConn(true)
+	if _, err := writeMsgpBatches(conn, "ContainerLogV2Source", entries); err != nil || len(conn.written) != 5 {
+		t.Errorf("expected batches of 2 records, got %d writes %v", len(conn.written), err)
+	}
+	if _, err := writeMsgpBatches(&brokenMdsdConn{}, "ContainerLogV2Source", entries); err == nil {
+		t.Errorf("expected the write error")
+	}
+	if duplicates := ResourceThrottling.takeDuplicates(); duplicates != 0 {
+		t.Errorf("expected no duplicates when the first batch fails, got %d", duplicates)
+	}
+
+	// the 2 batches written before the failed one are sent again on retry
+	failing := &failingMdsdConn{writes: 2}
+	if _, err := writeMsgpBatches(failing, "ContainerLogV2Source", entries); err == nil {
+		t.Errorf("expected the write error of the third batch")
+	}
+	if duplicates := ResourceThrottling.takeDuplicates(); duplicates != 4 {
+		t.Errorf("expected the records of the written batches to be counted as duplicates, got %d", duplicates)
+	}
+}
+
+// failingMdsdConn fails the writes after the first ones
+type failingMdsdConn struct {
+	fakeMdsdConn
+	writes int
+}
+
+func (c *failingMdsdConn) Write(b []byte) (int, error) {
+	if c.writes == 0 {
+		return 0, errors.New("broken pipe")
+	}
+	c.writes--
+	return len(b), nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/telemetry"
+)
+
+// ShutdownTimeoutSecondsEnv bounds the drain of the in-flight flushes and the final KubeMonAgentEvent and telemetry
+// flushes on exit
+const ShutdownTimeoutSecondsEnv = "AZMON_SHUTDOWN_TIMEOUT_SECONDS"
+
+const defaultShutdownTimeoutSeconds = 10
+
+var (
+	// ShutdownContext is cancelled by FLBPluginExit or the exit of the last instance, the background goroutines return once it's done
+	ShutdownContext context.Context
+	cancelShutdown  context.CancelFunc
+	shutdownOnce    *sync.Once
+	// ShutdownTimeout bounds the shutdown of the plugin
+	ShutdownTimeout = defaultShutdownTimeoutSeconds * time.Second
+	// backgroundTasks are the goroutines started with goBackground, the shutdown waits for them
+	backgroundTasks sync.WaitGroup
+	// inFlightFlushes is the number of fluent-bit flushes being processed
+	inFlightFlushes int64
+)
+
+func init() {
+	ShutdownContext, cancelShutdown = context.WithCancel(context.Background())
+	shutdownOnce = &sync.Once{}
+}
+
+// goBackground starts a goroutine the shutdown waits for
+func goBackground(task func()) {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		task()
+	}()
+}
+
+// waitForTick waits for the next tick of the ticker, false once the plugin is shutting down
+func waitForTick(ticker *time.Ticker) bool {
+	select {
+	case <-ShutdownContext.Done():
+		return false
+	case <-ticker.C:
+		return true
+	}
+}
+
+// shutdownPlugin stops the plugin, flushes the pending KubeMonAgentEvents and telemetry and closes the servers and
+// connections. Steps that don't complete before the timeout are logged and skipped
+func shutdownPlugin(timeout time.Duration) {
+	shutdownOnce.Do(func() {
+		Log("Info::shutdown::Shutting down the plugin, timeout %s", timeout)
+		deadline := time.Now().Add(timeout)
+		cancelShutdown()
+
+		if !waitUntil(deadline, func() bool { return atomic.LoadInt64(&inFlightFlushes) == 0 }) {
+			Log("Warn::shutdown::%d flushes still in flight at the shutdown deadline", atomic.LoadInt64(&inFlightFlushes))
+		}
+
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		for _, server := range []**http.Server{&DiagnosticsServer, &HealthServer, &PrometheusMetricsServer} {
+			if *server == nil {
+				continue
+			}
+			if err := (*server).Shutdown(ctx); err != nil {
+				Log("Warn::shutdown::Server didn't shut down gracefully %s", err.Error())
+				(*server).Close()
+			}
+			*server = nil
+		}
+		if ConfigReloadWatcher != nil {
+			ConfigReloadWatcher.Close()
+			ConfigReloadWatcher = nil
+		}
+
+		// the ticker loops return after their final KubeMonAgentEvent and telemetry flush
+		done := make(chan struct{})
+		go func() {
+			backgroundTasks.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			Log("Warn::shutdown::Background goroutines still running at the shutdown deadline")
+		}
+		stopTickers()
+
+		for priority, lane := range PriorityLanes {
+			lane.Close()
+			delete(PriorityLanes, priority)
+		}
+		PluginInstancesMutex.Lock()
+		for _, instance := range PluginInstances {
+			instance.close()
+		}
+		PluginInstancesMutex.Unlock()
+		closeConnection(&MdsdKubeMonMsgpUnixSocketClient)
+		closeConnection(&KubeMonAgentEventsNamedPipe)
+		closeConnection(&MdsdConfigSnapshotMsgpUnixSocketClient)
+		closeConnection(&ConfigSnapshotNamedPipe)
+		RecordTee.Disable("shutdown")
+
+		client := TelemetryClient
+		TelemetryClient = telemetry.NewNoopClient()
+		client.Close()
+
+		Log("Info::shutdown::Plugin shut down")
+		if closer, ok := FLBLogger.Writer().(io.Closer); ok {
+			closer.Close()
+		}
+	})
+}
+
+// exitPluginInstance marks the instance as exited and shuts the plugin down once all of the instances exited
+func exitPluginInstance(instance *PluginInstance, timeout time.Duration) {
+	PluginInstancesMutex.Lock()
+	running := 0
+	for _, other := range PluginInstances {
+		if other == instance {
+			other.exited = true
+		}
+		if !other.exited {
+			running++
+		}
+	}
+	PluginInstancesMutex.Unlock()
+	Log("Info::shutdown::Plugin instance %d (%s) exited, %d instances still running", instance.ID, instance.Name, running)
+	if running == 0 {
+		shutdownPlugin(timeout)
+	}
+}
+
+// waitUntil polls condition until it's true or the deadline passed
+func waitUntil(deadline time.Time, condition func() bool) bool {
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func stopTickers() {
+	for _, ticker := range []*time.Ticker{
+		ContainerLogTelemetryTicker,
+		TracesErrorMetricsTicker,
+		ContainerImageNameRefreshTicker,
+		KubeMonAgentConfigEventsSendTicker,
+		IngestionAuthTokenRefreshTicker,
+		ContainerLogV2ExtensionConfigRefreshTicker,
+		VerboseCollectionRefreshTicker,
+		KubernetesMetadataRefreshTicker,
+		HealthStatusFileTicker,
+		ConfigSnapshotTicker,
+		ResourceThrottlingTicker,
+	} {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}
+}
+
+// close closes the connections of the instance and its idle workers
+func (instance *PluginInstance) close() {
+	workers := []*PluginInstance{instance}
+	if instance.workers != nil {
+		instance.workers.mutex.Lock()
+		workers = append([]*PluginInstance(nil), instance.workers.idle...)
+		instance.workers.mutex.Unlock()
+	}
+	for _, worker := range workers {
+		for _, conn := range []*net.Conn{
+			&worker.MdsdMsgpUnixSocketClient,
+			&worker.MdsdInsightsMetricsMsgpUnixSocketClient,
+			&worker.MdsdInputPluginRecordsMsgpUnixSocketClient,
+			&worker.MdsdHostLogsMsgpUnixSocketClient,
+			&worker.ContainerLogNamedPipe,
+			&worker.InsightsMetricsNamedPipe,
+			&worker.InputPluginNamedPipe,
+			&worker.HostLogsNamedPipe,
+		} {
+			closeConnection(conn)
+		}
+		for key, conn := range worker.NamedPipeConnectionCache {
+			conn.Close()
+			delete(worker.NamedPipeConnectionCache, key)
+		}
+	}
+}
+
+func closeConnection(conn *net.Conn) {
+	if *conn != nil {
+		(*conn).Close()
+		*conn = nil
+	}
+}
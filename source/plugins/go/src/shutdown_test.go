@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go/parser"
+	"go/token"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/telemetry"
+)
+
+// resetShutdown lets the next tests start background goroutines again
+func resetShutdown(t *testing.T) {
+	t.Cleanup(func() {
+		ShutdownContext, cancelShutdown = context.WithCancel(context.Background())
+		shutdownOnce = &sync.Once{}
+	})
+}
+
+func TestShutdownPluginStopsGoroutinesAndFlushes(t *testing.T) {
+	resetShutdown(t)
+	origClient, origInstances, origHealthMonitor, origPrometheusEnabled := TelemetryClient, PluginInstances, HealthMonitor, PrometheusMetricsEnabled
+	origTelemetryTicker, origTracesTicker, origHealthFileTicker := ContainerLogTelemetryTicker, TracesErrorMetricsTicker, HealthStatusFileTicker
+	defer func() {
+		TelemetryClient, PluginInstances, HealthMonitor, PrometheusMetricsEnabled = origClient, origInstances, origHealthMonitor, origPrometheusEnabled
+		ContainerLogTelemetryTicker, TracesErrorMetricsTicker, HealthStatusFileTicker = origTelemetryTicker, origTracesTicker, origHealthFileTicker
+	}()
+	// the log writer starts its rotation goroutine on the first write, it lives as long as the process
+	Log("Info::shutdown::Testing the shutdown")
+	baseline := runtime.NumGoroutine()
+
+	client := telemetry.NewMemoryClient()
+	TelemetryClient = client
+	goBackground(func() { SendContainerLogPluginMetrics("3600") })
+	goBackground(func() { SendTracesAsMetrics("3600") })
+
+	config := NewPluginConfig(map[string]string{}, mapGetenv(map[string]string{
+		DiagnosticsServerEnabledEnv: "true",
+		HealthServerEnabledEnv:      "true",
+		PrometheusMetricsEnabledEnv: "true",
+		HealthStatusFileEnv:         filepath.Join(t.TempDir(), "health.json"),
+	}), "")
+	config.DiagnosticsServerPort, config.HealthServerPort, config.PrometheusMetricsPort = 0, 0, 0
+	startDiagnosticsServer(config)
+	startHealthMonitor(config)
+	startPrometheusMetricsServer(config)
+	startConfigReloadWatcher(config, t.TempDir())
+	if DiagnosticsServer == nil || HealthServer == nil || PrometheusMetricsServer == nil || ConfigReloadWatcher == nil {
+		t.Fatalf("expected the servers and the configmap watcher to start")
+	}
+	PriorityLanes[LaneHigh] = NewSendLane(LaneHigh, 1, time.Second, time.Second, func() (net.Conn, error) {
+		return nil, errors.New("no mdsd")
+	})
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	instance := &PluginInstance{Name: "shutdown", MdsdMsgpUnixSocketClient: conn}
+	instance.workers = newFlushWorkers(instance)
+	PluginInstances = []*PluginInstance{instance}
+
+	UpdateTracesErrorMetrics("ShutdownTestError")
+	shutdownPlugin(5 * time.Second)
+
+	if len(client.Find(telemetry.KindMetric, "ShutdownTestError")) != 1 {
+		t.Errorf("expected the final flush of the trace error metrics, got %+v", client.Items())
+	}
+	if !client.Closed() {
+		t.Errorf("expected the telemetry client to be closed")
+	}
+	if instance.MdsdMsgpUnixSocketClient != nil {
+		t.Errorf("expected the instance connection to be closed")
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the peer of the instance connection to be closed, got %v", err)
+	}
+	if DiagnosticsServer != nil || HealthServer != nil || PrometheusMetricsServer != nil || ConfigReloadWatcher != nil || len(PriorityLanes) != 0 {
+		t.Errorf("expected the servers, the configmap watcher and the lanes to be released")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines leaked\n%s", n-baseline, buf[:runtime.Stack(buf, true)])
+	}
+
+	// the shutdown runs once
+	shutdownPlugin(time.Second)
+}
+
+func TestPluginExitIsExported(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "out_oms.go", nil, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("parsing out_oms.go failed: %v", err)
+	}
+	exported := make(map[string]bool)
+	for _, group := range file.Comments {
+		for _, comment := range group.List {
+			if name := strings.TrimPrefix(comment.Text, "//export "); name != comment.Text {
+				exported[name] = true
+			}
+		}
+	}
+	// fluent-bit looks the callbacks up by their exported C symbol, a missing //export silently skips the callback
+	for _, name := range []string{"FLBPluginRegister", "FLBPluginInit", "FLBPluginFlushCtx", "FLBPluginExit", "FLBPluginExitCtx"} {
+		if !exported[name] {
+			t.Errorf("expected %s to be exported", name)
+		}
+	}
+}
+
+func TestExitPluginInstanceShutsDownWithTheLastInstance(t *testing.T) {
+	resetShutdown(t)
+	origClient, origInstances := TelemetryClient, PluginInstances
+	defer func() { TelemetryClient, PluginInstances = origClient, origInstances }()
+	TelemetryClient = telemetry.NewMemoryClient()
+	first, second := &PluginInstance{ID: 0, Name: "first"}, &PluginInstance{ID: 1, Name: "second"}
+	PluginInstances = []*PluginInstance{first, second}
+
+	exitPluginInstance(first, time.Second)
+	exitPluginInstance(first, time.Second)
+	if ShutdownContext.Err() != nil {
+		t.Fatalf("expected the plugin to keep running while an instance is running")
+	}
+	exitPluginInstance(second, time.Second)
+	if ShutdownContext.Err() == nil {
+		t.Errorf("expected the plugin to shut down with its last instance")
+	}
+}
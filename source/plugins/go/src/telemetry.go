@@ -3,17 +3,16 @@ package main
 import (
 	"encoding/base64"
 	"errors"
-	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"Docker-Provider/source/plugins/go/src/paths"
+	"Docker-Provider/source/plugins/go/src/telemetry"
+
 	"github.com/fluent/fluent-bit-go/output"
-	"github.com/microsoft/ApplicationInsights-Go/appinsights"
-	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
 )
 
 var (
@@ -32,7 +31,7 @@ var (
 	// CommonProperties indicates the dimensions that are sent with every event/metric
 	CommonProperties map[string]string
 	// TelemetryClient is the client used to send the telemetry
-	TelemetryClient appinsights.TelemetryClient
+	TelemetryClient telemetry.Client = telemetry.NewNoopClient()
 	// ContainerLogTelemetryTicker sends telemetry periodically
 	ContainerLogTelemetryTicker *time.Ticker
 	//Tracks the number of windows telegraf metrics count with Tags size 64KB or more between telemetry ticker periods (uses ContainerLogTelemetryTicker)
@@ -67,6 +66,20 @@ var (
 	ContainerLogsADXClientCreateErrors float64
 	//Tracks the number of container log records with empty Timestamp (uses ContainerLogTelemetryTicker)
 	ContainerLogRecordCountWithEmptyTimeStamp float64
+	//Tracks the number of host log records flushed successfully (uses ContainerLogTelemetryTicker)
+	HostLogsFlushedCount float64
+	//Tracks the number of mdsd/ama client create errors for host logs (uses ContainerLogTelemetryTicker)
+	HostLogsClientCreateErrors float64
+	//Tracks the number of write/send errors to mdsd/ama for host logs (uses ContainerLogTelemetryTicker)
+	HostLogsSendErrors float64
+	//Tracks the number of mdsd/ama client create errors for the config snapshots (uses ContainerLogTelemetryTicker)
+	ConfigSnapshotClientCreateErrors float64
+	//Tracks the number of write/send errors to mdsd/ama for the config snapshots (uses ContainerLogTelemetryTicker)
+	ConfigSnapshotSendErrors float64
+	//Tracks the number of records written to the dead-letter store (uses ContainerLogTelemetryTicker)
+	DeadLetterRecordCount float64
+	//Tracks the number of times a circuit breaker of an mdsd socket or ama named pipe opened (uses ContainerLogTelemetryTicker)
+	CircuitBreakerOpenCount float64
 	//Tracks the number of OSM namespaces and sent only from prometheus sidecar (uses ContainerLogTelemetryTicker)
 	OSMNamespaceCount int
 	//Tracks whether monitor kubernetes pods is set to true and sent only from prometheus sidecar (uses ContainerLogTelemetryTicker)
@@ -86,6 +99,8 @@ var (
 	TracesErrorMetrics = map[string]float64{}
 	//Time ticker for sending mdsd errors as metrics
 	TracesErrorMetricsTicker *time.Ticker
+	//Totals of the mdsd error metrics sent before the last reset, guarded by TracesErrorMetricsMutex
+	TracesErrorMetricTotals = map[string]float64{}
 	//Mutex for mdsd error metrics
 	TracesErrorMetricsMutex = &sync.Mutex{}
 	// ContainerLogV2ExtensionDCRCount indicates the number of ContainerLogV2 extension DCRs
@@ -94,6 +109,10 @@ var (
 	MultitenantNamespaceCount int
 )
 
+// local files of the file telemetry backend
+const defaultTelemetryFilePath = "/var/opt/microsoft/docker-cimprov/log/out_oms_telemetry.json"
+const defaultWindowsTelemetryFilePath = "/etc/amalogswindows/out_oms_telemetry.json"
+
 const (
 	clusterTypeACS                                                    = "ACS"
 	clusterTypeAKS                                                    = "AKS"
@@ -121,6 +140,23 @@ const (
 	metricNameErrorCountContainerLogsSendErrorsToADXFromFluent        = "ContainerLogs2ADXSendErrorCount"
 	metricNameErrorCountContainerLogsADXClientCreateError             = "ContainerLogsADXClientCreateErrorCount"
 	metricNameContainerLogRecordCountWithEmptyTimeStamp               = "ContainerLogRecordCountWithEmptyTimeStamp"
+	metricNameHostLogsFlushedCount                                    = "HostLogsFlushedCount"
+	metricNameErrorCountHostLogsClientCreateError                     = "HostLogsClientCreateErrorCount"
+	metricNameErrorCountHostLogsSendError                             = "HostLogsSendErrorCount"
+	metricNameErrorCountConfigSnapshotClientCreateError               = "ConfigSnapshotClientCreateErrorCount"
+	metricNameErrorCountConfigSnapshotSendError                       = "ConfigSnapshotSendErrorCount"
+	metricNameDeadLetterRecordCount                                   = "DeadLetterRecordCount"
+	metricNameCircuitBreakerOpenCount                                 = "MdsdCircuitBreakerOpenCount"
+	metricNamePriorityLaneRejectedCount                               = "PriorityLaneRejectedCount"
+	metricNamePriorityLaneTimeoutCount                                = "PriorityLaneTimeoutCount"
+	metricNameDroppedRecordCount                                      = "DroppedRecordCount"
+	metricNameSchemaViolationCount                                    = "SchemaViolationCount"
+	metricNameResourceThrottlingMaxLevel                              = "ResourceThrottlingMaxLevel"
+	metricNameResourceThrottlingDuplicateRecordCount                  = "ResourceThrottlingDuplicateRecordCount"
+	metricNameDeliveryLatencyP50Ms                                    = "DeliveryLatencyP50Ms"
+	metricNameDeliveryLatencyP95Ms                                    = "DeliveryLatencyP95Ms"
+	metricNameDeliveryLatencyP99Ms                                    = "DeliveryLatencyP99Ms"
+	metricNameDeliveryLatencyMaxMs                                    = "DeliveryLatencyMaxMs"
 
 	defaultTelemetryPushIntervalSeconds = 300
 
@@ -143,238 +179,332 @@ func SendContainerLogPluginMetrics(telemetryPushIntervalProperty string) {
 	start := time.Now()
 	SendEvent(eventNameContainerLogInit, make(map[string]string))
 
-	for ; true; <-ContainerLogTelemetryTicker.C {
-		elapsed := time.Since(start)
-
-		ContainerLogTelemetryMutex.Lock()
-		flushRate := FlushedRecordsCount / FlushedRecordsTimeTaken * 1000
-		logRate := FlushedRecordsCount / float64(elapsed/time.Second)
-		logSizeRate := FlushedRecordsSize / float64(elapsed/time.Second)
-		metadataSizeRate := FlushedMetadataSize / float64(elapsed/time.Second)
-		telegrafMetricsSentCount := TelegrafMetricsSentCount
-		telegrafMetricsSendErrorCount := TelegrafMetricsSendErrorCount
-		telegrafMetricsSend429ErrorCount := TelegrafMetricsSend429ErrorCount
-		winTelegrafMetricsCountWithTagsSize64KBorMore := WinTelegrafMetricsCountWithTagsSize64KBorMore
-		containerLogsSendErrorsToMDSDFromFluent := ContainerLogsSendErrorsToMDSDFromFluent
-		containerLogsMDSDClientCreateErrors := ContainerLogsMDSDClientCreateErrors
-		containerLogsSendErrorsToADXFromFluent := ContainerLogsSendErrorsToADXFromFluent
-		containerLogsADXClientCreateErrors := ContainerLogsADXClientCreateErrors
-		containerLogsSendErrorsToWindowsAMAFromFluent := ContainerLogsSendErrorsToWindowsAMAFromFluent
-		containerLogsWindowsAMAClientCreateErrors := ContainerLogsWindowsAMAClientCreateErrors
-		insightsMetricsMDSDClientCreateErrors := InsightsMetricsMDSDClientCreateErrors
-		insightsMetricsWindowsAMAClientCreateErrors := InsightsMetricsWindowsAMAClientCreateErrors
-		kubeMonEventsMDSDClientCreateErrors := KubeMonEventsMDSDClientCreateErrors
-		kubeMonEventsWindowsAMAClientCreateErrors := KubeMonEventsWindowsAMAClientCreateErrors
-		osmNamespaceCount := OSMNamespaceCount
-		promMonitorPods := PromMonitorPods
-		promMonitorPodsNamespaceLength := PromMonitorPodsNamespaceLength
-		promMonitorPodsLabelSelectorLength := PromMonitorPodsLabelSelectorLength
-		promMonitorPodsFieldSelectorLength := PromMonitorPodsFieldSelectorLength
-		containerLogRecordCountWithEmptyTimeStamp := ContainerLogRecordCountWithEmptyTimeStamp
-		containerLogV2ExtensionDCRCount := ContainerLogV2ExtensionDCRCount
-		multitenantNamespaceCount := MultitenantNamespaceCount
-
-		TelegrafMetricsSentCount = 0.0
-		TelegrafMetricsSendErrorCount = 0.0
-		TelegrafMetricsSend429ErrorCount = 0.0
-		WinTelegrafMetricsCountWithTagsSize64KBorMore = 0.0
-		FlushedRecordsCount = 0.0
-		ContainerLogV2ExtensionDCRCount = 0
-		MultitenantNamespaceCount = 0
-		FlushedRecordsSize = 0.0
-		FlushedMetadataSize = 0.0
-		FlushedRecordsTimeTaken = 0.0
-		logLatencyMs := AgentLogProcessingMaxLatencyMs
-		logLatencyMsContainer := AgentLogProcessingMaxLatencyMsContainer
-		AgentLogProcessingMaxLatencyMs = 0
-		AgentLogProcessingMaxLatencyMsContainer = ""
-		ContainerLogsSendErrorsToMDSDFromFluent = 0.0
-		ContainerLogsMDSDClientCreateErrors = 0.0
-		ContainerLogsSendErrorsToWindowsAMAFromFluent = 0.0
-		ContainerLogsWindowsAMAClientCreateErrors = 0.0
-		ContainerLogsSendErrorsToADXFromFluent = 0.0
-		ContainerLogsSendErrorsToWindowsAMAFromFluent = 0.0
-		ContainerLogsADXClientCreateErrors = 0.0
-		InsightsMetricsMDSDClientCreateErrors = 0.0
-		InsightsMetricsWindowsAMAClientCreateErrors = 0.0
-		KubeMonEventsMDSDClientCreateErrors = 0.0
-		KubeMonEventsWindowsAMAClientCreateErrors = 0.0
-		ContainerLogRecordCountWithEmptyTimeStamp = 0.0
-		ContainerLogTelemetryMutex.Unlock()
-
-		if strings.Compare(strings.ToLower(os.Getenv("CONTROLLER_TYPE")), "daemonset") == 0 {
-			telemetryDimensions := make(map[string]string)
-			if strings.Compare(strings.ToLower(os.Getenv("CONTAINER_TYPE")), "prometheussidecar") == 0 {
-				telemetryDimensions["CustomPromMonitorPods"] = promMonitorPods
-				if promMonitorPodsNamespaceLength > 0 {
-					telemetryDimensions["CustomPromMonitorPodsNamespaceLength"] = strconv.Itoa(promMonitorPodsNamespaceLength)
-				}
-				if promMonitorPodsLabelSelectorLength > 0 {
-					telemetryDimensions["CustomPromMonitorPodsLabelSelectorLength"] = strconv.Itoa(promMonitorPodsLabelSelectorLength)
-				}
-				if promMonitorPodsFieldSelectorLength > 0 {
-					telemetryDimensions["CustomPromMonitorPodsFieldSelectorLength"] = strconv.Itoa(promMonitorPodsFieldSelectorLength)
-				}
-				if osmNamespaceCount > 0 {
-					telemetryDimensions["OsmNamespaceCount"] = strconv.Itoa(osmNamespaceCount)
-				}
+	for running := true; running; running = waitForTick(ContainerLogTelemetryTicker) {
+		flushContainerLogPluginMetrics(start)
+		start = time.Now()
+	}
+	// final flush of the telemetry of the period cut short by the shutdown
+	flushContainerLogPluginMetrics(start)
+}
 
-				telemetryDimensions["PromFbitChunkSize"] = os.Getenv("AZMON_SIDECAR_FBIT_CHUNK_SIZE")
-				telemetryDimensions["PromFbitBufferSize"] = os.Getenv("AZMON_SIDECAR_FBIT_BUFFER_SIZE")
-				telemetryDimensions["PromFbitMemBufLimit"] = os.Getenv("AZMON_SIDECAR_FBIT_MEM_BUF_LIMIT")
+// flushContainerLogPluginMetrics sends the telemetry of the period since start and resets its counters
+func flushContainerLogPluginMetrics(start time.Time) {
+	elapsed := time.Since(start)
+
+	ContainerLogTelemetryMutex.Lock()
+	flushRate := FlushedRecordsCount / FlushedRecordsTimeTaken * 1000
+	logRate := FlushedRecordsCount / float64(elapsed/time.Second)
+	logSizeRate := FlushedRecordsSize / float64(elapsed/time.Second)
+	metadataSizeRate := FlushedMetadataSize / float64(elapsed/time.Second)
+	telegrafMetricsSentCount := TelegrafMetricsSentCount
+	telegrafMetricsSendErrorCount := TelegrafMetricsSendErrorCount
+	telegrafMetricsSend429ErrorCount := TelegrafMetricsSend429ErrorCount
+	winTelegrafMetricsCountWithTagsSize64KBorMore := WinTelegrafMetricsCountWithTagsSize64KBorMore
+	containerLogsSendErrorsToMDSDFromFluent := ContainerLogsSendErrorsToMDSDFromFluent
+	containerLogsMDSDClientCreateErrors := ContainerLogsMDSDClientCreateErrors
+	containerLogsSendErrorsToADXFromFluent := ContainerLogsSendErrorsToADXFromFluent
+	containerLogsADXClientCreateErrors := ContainerLogsADXClientCreateErrors
+	containerLogsSendErrorsToWindowsAMAFromFluent := ContainerLogsSendErrorsToWindowsAMAFromFluent
+	containerLogsWindowsAMAClientCreateErrors := ContainerLogsWindowsAMAClientCreateErrors
+	insightsMetricsMDSDClientCreateErrors := InsightsMetricsMDSDClientCreateErrors
+	insightsMetricsWindowsAMAClientCreateErrors := InsightsMetricsWindowsAMAClientCreateErrors
+	kubeMonEventsMDSDClientCreateErrors := KubeMonEventsMDSDClientCreateErrors
+	kubeMonEventsWindowsAMAClientCreateErrors := KubeMonEventsWindowsAMAClientCreateErrors
+	osmNamespaceCount := OSMNamespaceCount
+	promMonitorPods := PromMonitorPods
+	promMonitorPodsNamespaceLength := PromMonitorPodsNamespaceLength
+	promMonitorPodsLabelSelectorLength := PromMonitorPodsLabelSelectorLength
+	promMonitorPodsFieldSelectorLength := PromMonitorPodsFieldSelectorLength
+	containerLogRecordCountWithEmptyTimeStamp := ContainerLogRecordCountWithEmptyTimeStamp
+	hostLogsFlushedCount := HostLogsFlushedCount
+	hostLogsClientCreateErrors := HostLogsClientCreateErrors
+	hostLogsSendErrors := HostLogsSendErrors
+	configSnapshotClientCreateErrors := ConfigSnapshotClientCreateErrors
+	configSnapshotSendErrors := ConfigSnapshotSendErrors
+	deadLetterRecordCount := DeadLetterRecordCount
+	circuitBreakerOpenCount := CircuitBreakerOpenCount
+	containerLogV2ExtensionDCRCount := ContainerLogV2ExtensionDCRCount
+	multitenantNamespaceCount := MultitenantNamespaceCount
+
+	rollOverTelemetryCounters()
+	TelegrafMetricsSentCount = 0.0
+	TelegrafMetricsSendErrorCount = 0.0
+	TelegrafMetricsSend429ErrorCount = 0.0
+	WinTelegrafMetricsCountWithTagsSize64KBorMore = 0.0
+	FlushedRecordsCount = 0.0
+	ContainerLogV2ExtensionDCRCount = 0
+	MultitenantNamespaceCount = 0
+	FlushedRecordsSize = 0.0
+	FlushedMetadataSize = 0.0
+	FlushedRecordsTimeTaken = 0.0
+	logLatencyMs := AgentLogProcessingMaxLatencyMs
+	logLatencyMsContainer := AgentLogProcessingMaxLatencyMsContainer
+	AgentLogProcessingMaxLatencyMs = 0
+	AgentLogProcessingMaxLatencyMsContainer = ""
+	ContainerLogsSendErrorsToMDSDFromFluent = 0.0
+	ContainerLogsMDSDClientCreateErrors = 0.0
+	ContainerLogsSendErrorsToWindowsAMAFromFluent = 0.0
+	ContainerLogsWindowsAMAClientCreateErrors = 0.0
+	ContainerLogsSendErrorsToADXFromFluent = 0.0
+	ContainerLogsSendErrorsToWindowsAMAFromFluent = 0.0
+	ContainerLogsADXClientCreateErrors = 0.0
+	InsightsMetricsMDSDClientCreateErrors = 0.0
+	InsightsMetricsWindowsAMAClientCreateErrors = 0.0
+	KubeMonEventsMDSDClientCreateErrors = 0.0
+	KubeMonEventsWindowsAMAClientCreateErrors = 0.0
+	ContainerLogRecordCountWithEmptyTimeStamp = 0.0
+	HostLogsFlushedCount = 0.0
+	HostLogsClientCreateErrors = 0.0
+	HostLogsSendErrors = 0.0
+	ConfigSnapshotClientCreateErrors = 0.0
+	ConfigSnapshotSendErrors = 0.0
+	DeadLetterRecordCount = 0.0
+	CircuitBreakerOpenCount = 0.0
+	ContainerLogTelemetryMutex.Unlock()
 
-				mdsdBackPressureThresholdInMB := os.Getenv("MDSD_BACKPRESSURE_MONITOR_MEMORY_THRESHOLD_IN_MB")
-				if mdsdBackPressureThresholdInMB != "" {
-					telemetryDimensions["mdsdBackPressureThresholdInMB"] = mdsdBackPressureThresholdInMB
-				}
+	if strings.Compare(strings.ToLower(os.Getenv("CONTROLLER_TYPE")), "daemonset") == 0 {
+		telemetryDimensions := make(map[string]string)
+		if strings.Compare(strings.ToLower(os.Getenv("CONTAINER_TYPE")), "prometheussidecar") == 0 {
+			telemetryDimensions["CustomPromMonitorPods"] = promMonitorPods
+			if promMonitorPodsNamespaceLength > 0 {
+				telemetryDimensions["CustomPromMonitorPodsNamespaceLength"] = strconv.Itoa(promMonitorPodsNamespaceLength)
+			}
+			if promMonitorPodsLabelSelectorLength > 0 {
+				telemetryDimensions["CustomPromMonitorPodsLabelSelectorLength"] = strconv.Itoa(promMonitorPodsLabelSelectorLength)
+			}
+			if promMonitorPodsFieldSelectorLength > 0 {
+				telemetryDimensions["CustomPromMonitorPodsFieldSelectorLength"] = strconv.Itoa(promMonitorPodsFieldSelectorLength)
+			}
+			if osmNamespaceCount > 0 {
+				telemetryDimensions["OsmNamespaceCount"] = strconv.Itoa(osmNamespaceCount)
+			}
 
-				SendEvent(eventNameCustomPrometheusSidecarHeartbeat, telemetryDimensions)
+			telemetryDimensions["PromFbitChunkSize"] = os.Getenv("AZMON_SIDECAR_FBIT_CHUNK_SIZE")
+			telemetryDimensions["PromFbitBufferSize"] = os.Getenv("AZMON_SIDECAR_FBIT_BUFFER_SIZE")
+			telemetryDimensions["PromFbitMemBufLimit"] = os.Getenv("AZMON_SIDECAR_FBIT_MEM_BUF_LIMIT")
 
-			} else {
-				fbitFlushIntervalSecs := os.Getenv("FBIT_SERVICE_FLUSH_INTERVAL")
-				if fbitFlushIntervalSecs != "" {
-					telemetryDimensions["FbitServiceFlushIntervalSecs"] = fbitFlushIntervalSecs
-				}
-				fbitTailBufferChunkSizeMBs := os.Getenv("FBIT_TAIL_BUFFER_CHUNK_SIZE")
-				if fbitTailBufferChunkSizeMBs != "" {
-					telemetryDimensions["FbitBufferChunkSizeMBs"] = fbitTailBufferChunkSizeMBs
-				}
-				fbitTailBufferMaxSizeMBs := os.Getenv("FBIT_TAIL_BUFFER_MAX_SIZE")
-				if fbitTailBufferMaxSizeMBs != "" {
-					telemetryDimensions["FbitBufferMaxSizeMBs"] = fbitTailBufferMaxSizeMBs
-				}
-				fbitTailMemBufLimitMBs := os.Getenv("FBIT_TAIL_MEM_BUF_LIMIT")
-				if fbitTailMemBufLimitMBs != "" {
-					telemetryDimensions["FbitMemBufLimitSizeMBs"] = fbitTailMemBufLimitMBs
-				}
-				mdsdMonitoringMaxEventRate := os.Getenv("MONITORING_MAX_EVENT_RATE")
-				if mdsdMonitoringMaxEventRate != "" {
-					telemetryDimensions["mdsdMonitoringMaxEventRate"] = mdsdMonitoringMaxEventRate
-				}
-				mdsdUploadMaxSizeInMB := os.Getenv("MDSD_ODS_UPLOAD_CHUNKING_SIZE_IN_MB")
-				if mdsdUploadMaxSizeInMB != "" {
-					telemetryDimensions["mdsdUploadMaxSizeInMB"] = mdsdUploadMaxSizeInMB
-				}
-				mdsdUploadFrequencyInSeconds := os.Getenv("AMA_MAX_PUBLISH_LATENCY")
-				if mdsdUploadFrequencyInSeconds != "" {
-					telemetryDimensions["mdsdUploadFrequencyInSeconds"] = mdsdUploadFrequencyInSeconds
-				}
-				mdsdBackPressureThresholdInMB := os.Getenv("MDSD_BACKPRESSURE_MONITOR_MEMORY_THRESHOLD_IN_MB")
-				if mdsdBackPressureThresholdInMB != "" {
-					telemetryDimensions["mdsdBackPressureThresholdInMB"] = mdsdBackPressureThresholdInMB
-				}
-				mdsdCompressionLevel := os.Getenv("MDSD_ODS_COMPRESSION_LEVEL")
-				if mdsdCompressionLevel != "" {
-					telemetryDimensions["mdsdCompressionLevel"] = mdsdCompressionLevel
-				}
-				logsAndEventsOnly := os.Getenv("LOGS_AND_EVENTS_ONLY")
-				if logsAndEventsOnly != "" {
-					telemetryDimensions["logsAndEventsOnly"] = logsAndEventsOnly
-				}
+			mdsdBackPressureThresholdInMB := os.Getenv("MDSD_BACKPRESSURE_MONITOR_MEMORY_THRESHOLD_IN_MB")
+			if mdsdBackPressureThresholdInMB != "" {
+				telemetryDimensions["mdsdBackPressureThresholdInMB"] = mdsdBackPressureThresholdInMB
+			}
 
-				isHighLogScaleMode := os.Getenv("IS_HIGH_LOG_SCALE_MODE")
-				if isHighLogScaleMode != "" {
-					telemetryDimensions["isHighLogScaleMode"] = isHighLogScaleMode
-				}
+			SendEvent(eventNameCustomPrometheusSidecarHeartbeat, telemetryDimensions)
 
-				isAzMonMultitenancyEnabled := os.Getenv("AZMON_MULTI_TENANCY_LOG_COLLECTION")
-				isAzMonMultitenancyAdvancedMode := os.Getenv("AZMON_MULTI_TENANCY_LOG_COLLECTION_ADVANCED_MODE")
-				if isAzMonMultitenancyEnabled != "" {
-					telemetryDimensions["isAzMonMultitenancyEnabled"] = isAzMonMultitenancyEnabled
-					telemetryDimensions["isAzMonMultitenancyAdvancedMode"] = isAzMonMultitenancyAdvancedMode
-					telemetryDimensions["containerLogV2ExtensionDCRCount"] = strconv.Itoa(containerLogV2ExtensionDCRCount)
-					telemetryDimensions["multitenantNamespaceCount"] = strconv.Itoa(multitenantNamespaceCount)
-				}
+		} else {
+			fbitFlushIntervalSecs := os.Getenv("FBIT_SERVICE_FLUSH_INTERVAL")
+			if fbitFlushIntervalSecs != "" {
+				telemetryDimensions["FbitServiceFlushIntervalSecs"] = fbitFlushIntervalSecs
+			}
+			fbitTailBufferChunkSizeMBs := os.Getenv("FBIT_TAIL_BUFFER_CHUNK_SIZE")
+			if fbitTailBufferChunkSizeMBs != "" {
+				telemetryDimensions["FbitBufferChunkSizeMBs"] = fbitTailBufferChunkSizeMBs
+			}
+			fbitTailBufferMaxSizeMBs := os.Getenv("FBIT_TAIL_BUFFER_MAX_SIZE")
+			if fbitTailBufferMaxSizeMBs != "" {
+				telemetryDimensions["FbitBufferMaxSizeMBs"] = fbitTailBufferMaxSizeMBs
+			}
+			fbitTailMemBufLimitMBs := os.Getenv("FBIT_TAIL_MEM_BUF_LIMIT")
+			if fbitTailMemBufLimitMBs != "" {
+				telemetryDimensions["FbitMemBufLimitSizeMBs"] = fbitTailMemBufLimitMBs
+			}
+			mdsdMonitoringMaxEventRate := os.Getenv("MONITORING_MAX_EVENT_RATE")
+			if mdsdMonitoringMaxEventRate != "" {
+				telemetryDimensions["mdsdMonitoringMaxEventRate"] = mdsdMonitoringMaxEventRate
+			}
+			mdsdUploadMaxSizeInMB := os.Getenv("MDSD_ODS_UPLOAD_CHUNKING_SIZE_IN_MB")
+			if mdsdUploadMaxSizeInMB != "" {
+				telemetryDimensions["mdsdUploadMaxSizeInMB"] = mdsdUploadMaxSizeInMB
+			}
+			mdsdUploadFrequencyInSeconds := os.Getenv("AMA_MAX_PUBLISH_LATENCY")
+			if mdsdUploadFrequencyInSeconds != "" {
+				telemetryDimensions["mdsdUploadFrequencyInSeconds"] = mdsdUploadFrequencyInSeconds
+			}
+			mdsdBackPressureThresholdInMB := os.Getenv("MDSD_BACKPRESSURE_MONITOR_MEMORY_THRESHOLD_IN_MB")
+			if mdsdBackPressureThresholdInMB != "" {
+				telemetryDimensions["mdsdBackPressureThresholdInMB"] = mdsdBackPressureThresholdInMB
+			}
+			mdsdCompressionLevel := os.Getenv("MDSD_ODS_COMPRESSION_LEVEL")
+			if mdsdCompressionLevel != "" {
+				telemetryDimensions["mdsdCompressionLevel"] = mdsdCompressionLevel
+			}
+			logsAndEventsOnly := os.Getenv("LOGS_AND_EVENTS_ONLY")
+			if logsAndEventsOnly != "" {
+				telemetryDimensions["logsAndEventsOnly"] = logsAndEventsOnly
+			}
 
-				enableCustomMetrics := os.Getenv("ENABLE_CUSTOM_METRICS")
-				if enableCustomMetrics != "" {
-					telemetryDimensions["enableCustomMetrics"] = enableCustomMetrics
-				}
+			isHighLogScaleMode := os.Getenv("IS_HIGH_LOG_SCALE_MODE")
+			if isHighLogScaleMode != "" {
+				telemetryDimensions["isHighLogScaleMode"] = isHighLogScaleMode
+			}
 
-				telemetryDimensions["PromFbitChunkSize"] = os.Getenv("AZMON_FBIT_CHUNK_SIZE")
-				telemetryDimensions["PromFbitBufferSize"] = os.Getenv("AZMON_FBIT_BUFFER_SIZE")
-				telemetryDimensions["PromFbitMemBufLimit"] = os.Getenv("AZMON_FBIT_MEM_BUF_LIMIT")
+			isAzMonMultitenancyEnabled := os.Getenv("AZMON_MULTI_TENANCY_LOG_COLLECTION")
+			isAzMonMultitenancyAdvancedMode := os.Getenv("AZMON_MULTI_TENANCY_LOG_COLLECTION_ADVANCED_MODE")
+			if isAzMonMultitenancyEnabled != "" {
+				telemetryDimensions["isAzMonMultitenancyEnabled"] = isAzMonMultitenancyEnabled
+				telemetryDimensions["isAzMonMultitenancyAdvancedMode"] = isAzMonMultitenancyAdvancedMode
+				telemetryDimensions["containerLogV2ExtensionDCRCount"] = strconv.Itoa(containerLogV2ExtensionDCRCount)
+				telemetryDimensions["multitenantNamespaceCount"] = strconv.Itoa(multitenantNamespaceCount)
+			}
 
-				SendEvent(eventNameDaemonSetHeartbeat, telemetryDimensions)
-				flushRateMetric := appinsights.NewMetricTelemetry(metricNameAvgFlushRate, flushRate)
-				TelemetryClient.Track(flushRateMetric)
+			enableCustomMetrics := os.Getenv("ENABLE_CUSTOM_METRICS")
+			if enableCustomMetrics != "" {
+				telemetryDimensions["enableCustomMetrics"] = enableCustomMetrics
+			}
 
-				logRateMetric := appinsights.NewMetricTelemetry(metricNameAvgLogGenerationRate, logRate)
-				logSizeMetric := appinsights.NewMetricTelemetry(metricNameLogSize, logSizeRate)
-				TelemetryClient.Track(logRateMetric)
-				Log("Log Size Rate: %f\n", logSizeRate)
-				TelemetryClient.Track(logSizeMetric)
+			telemetryDimensions["PromFbitChunkSize"] = os.Getenv("AZMON_FBIT_CHUNK_SIZE")
+			telemetryDimensions["PromFbitBufferSize"] = os.Getenv("AZMON_FBIT_BUFFER_SIZE")
+			telemetryDimensions["PromFbitMemBufLimit"] = os.Getenv("AZMON_FBIT_MEM_BUF_LIMIT")
 
-				if KubernetesMetadataEnabled {
-					metadataSizeMetric := appinsights.NewMetricTelemetry(metricNameMetadataSize, metadataSizeRate)
-					TelemetryClient.Track(metadataSizeMetric)
-				}
+			SendEvent(eventNameDaemonSetHeartbeat, telemetryDimensions)
+			flushRateMetric := telemetry.Metric(metricNameAvgFlushRate, flushRate, nil)
+			TelemetryClient.Track(flushRateMetric)
 
-				logLatencyMetric := appinsights.NewMetricTelemetry(metricNameAgentLogProcessingMaxLatencyMs, logLatencyMs)
-				logLatencyMetric.Properties["Container"] = logLatencyMsContainer
-				TelemetryClient.Track(logLatencyMetric)
+			logRateMetric := telemetry.Metric(metricNameAvgLogGenerationRate, logRate, nil)
+			logSizeMetric := telemetry.Metric(metricNameLogSize, logSizeRate, nil)
+			TelemetryClient.Track(logRateMetric)
+			Log("Log Size Rate: %f\n", logSizeRate)
+			TelemetryClient.Track(logSizeMetric)
+
+			if KubernetesMetadataEnabled {
+				metadataSizeMetric := telemetry.Metric(metricNameMetadataSize, metadataSizeRate, nil)
+				TelemetryClient.Track(metadataSizeMetric)
 			}
+
+			logLatencyMetric := telemetry.Metric(metricNameAgentLogProcessingMaxLatencyMs, logLatencyMs, nil)
+			logLatencyMetric.Properties["Container"] = logLatencyMsContainer
+			TelemetryClient.Track(logLatencyMetric)
 		}
-		telegrafConfig := make(map[string]string)
-		osType := os.Getenv("OS_TYPE")
-		if osType != "" && strings.EqualFold(osType, "windows") {
-			// check if telegraf is enabled
-			isTelegrafEnabled := os.Getenv("TELEMETRY_CUSTOM_PROM_MONITOR_PODS") // If TELEMETRY_CUSTOM_PROM_MONITOR_PODS, then telegraf is enabled
-			telegrafConfig["IsTelegrafEnabled"] = isTelegrafEnabled
-			// check if telegraf is running
-			if isTelegrafEnabled == "true" {
-				isTelegrafRunning, err := isProcessRunning("telegraf.exe")
-				if err != nil {
-					Log("Error checking Telegraf process: %s", err.Error())
-				}
-				telegrafConfig["IsTelegrafRunning"] = isTelegrafRunning
+	}
+	telegrafConfig := make(map[string]string)
+	osType := os.Getenv("OS_TYPE")
+	if osType != "" && strings.EqualFold(osType, "windows") {
+		// check if telegraf is enabled
+		isTelegrafEnabled := os.Getenv("TELEMETRY_CUSTOM_PROM_MONITOR_PODS") // If TELEMETRY_CUSTOM_PROM_MONITOR_PODS, then telegraf is enabled
+		telegrafConfig["IsTelegrafEnabled"] = isTelegrafEnabled
+		// check if telegraf is running
+		if isTelegrafEnabled == "true" {
+			isTelegrafRunning, err := isProcessRunning("telegraf.exe")
+			if err != nil {
+				Log("Error checking Telegraf process: %s", err.Error())
 			}
+			telegrafConfig["IsTelegrafRunning"] = isTelegrafRunning
 		}
-		SendMetric(metricNameNumberofTelegrafMetricsSentSuccessfully, telegrafMetricsSentCount, telegrafConfig)
-		if telegrafMetricsSendErrorCount > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameNumberofSendErrorsTelegrafMetrics, telegrafMetricsSendErrorCount))
-		}
-		if telegrafMetricsSend429ErrorCount > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameNumberofSend429ErrorsTelegrafMetrics, telegrafMetricsSend429ErrorCount))
-		}
-		if containerLogsSendErrorsToMDSDFromFluent > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsSendErrorsToMDSDFromFluent, containerLogsSendErrorsToMDSDFromFluent))
-		}
-		if containerLogsMDSDClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsMDSDClientCreateError, containerLogsMDSDClientCreateErrors))
-		}
-		if containerLogsSendErrorsToWindowsAMAFromFluent > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsSendErrorsToWindowsAMAFromFluent, containerLogsSendErrorsToWindowsAMAFromFluent))
-		}
-		if containerLogsWindowsAMAClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsWindowsAMAClientCreateError, containerLogsWindowsAMAClientCreateErrors))
-		}
-		if containerLogsSendErrorsToADXFromFluent > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsSendErrorsToADXFromFluent, containerLogsSendErrorsToADXFromFluent))
-		}
-		if containerLogsADXClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsADXClientCreateError, containerLogsADXClientCreateErrors))
-		}
-		if insightsMetricsMDSDClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountInsightsMetricsMDSDClientCreateError, insightsMetricsMDSDClientCreateErrors))
-		}
-		if insightsMetricsWindowsAMAClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountInsightsMetricsWindowsAMAClientCreateError, insightsMetricsWindowsAMAClientCreateErrors))
-		}
-		if kubeMonEventsMDSDClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountKubeMonEventsMDSDClientCreateError, kubeMonEventsMDSDClientCreateErrors))
+	}
+	SendMetric(metricNameNumberofTelegrafMetricsSentSuccessfully, telegrafMetricsSentCount, telegrafConfig)
+	if telegrafMetricsSendErrorCount > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameNumberofSendErrorsTelegrafMetrics, telegrafMetricsSendErrorCount, nil))
+	}
+	if telegrafMetricsSend429ErrorCount > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameNumberofSend429ErrorsTelegrafMetrics, telegrafMetricsSend429ErrorCount, nil))
+	}
+	if containerLogsSendErrorsToMDSDFromFluent > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountContainerLogsSendErrorsToMDSDFromFluent, containerLogsSendErrorsToMDSDFromFluent, nil))
+	}
+	if containerLogsMDSDClientCreateErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountContainerLogsMDSDClientCreateError, containerLogsMDSDClientCreateErrors, nil))
+	}
+	if containerLogsSendErrorsToWindowsAMAFromFluent > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountContainerLogsSendErrorsToWindowsAMAFromFluent, containerLogsSendErrorsToWindowsAMAFromFluent, nil))
+	}
+	if containerLogsWindowsAMAClientCreateErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountContainerLogsWindowsAMAClientCreateError, containerLogsWindowsAMAClientCreateErrors, nil))
+	}
+	if containerLogsSendErrorsToADXFromFluent > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountContainerLogsSendErrorsToADXFromFluent, containerLogsSendErrorsToADXFromFluent, nil))
+	}
+	if containerLogsADXClientCreateErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountContainerLogsADXClientCreateError, containerLogsADXClientCreateErrors, nil))
+	}
+	if insightsMetricsMDSDClientCreateErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountInsightsMetricsMDSDClientCreateError, insightsMetricsMDSDClientCreateErrors, nil))
+	}
+	if insightsMetricsWindowsAMAClientCreateErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountInsightsMetricsWindowsAMAClientCreateError, insightsMetricsWindowsAMAClientCreateErrors, nil))
+	}
+	if kubeMonEventsMDSDClientCreateErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountKubeMonEventsMDSDClientCreateError, kubeMonEventsMDSDClientCreateErrors, nil))
+	}
+	if kubeMonEventsWindowsAMAClientCreateErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountKubeMonEventsWindowsAMAClientCreateError, kubeMonEventsWindowsAMAClientCreateErrors, nil))
+	}
+	if winTelegrafMetricsCountWithTagsSize64KBorMore > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameNumberofWinTelegrafMetricsWithTagsSize64KBorMore, winTelegrafMetricsCountWithTagsSize64KBorMore, nil))
+	}
+	if ContainerLogRecordCountWithEmptyTimeStamp > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameContainerLogRecordCountWithEmptyTimeStamp, containerLogRecordCountWithEmptyTimeStamp, nil))
+	}
+	if hostLogsFlushedCount > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameHostLogsFlushedCount, hostLogsFlushedCount, nil))
+	}
+	if hostLogsClientCreateErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountHostLogsClientCreateError, hostLogsClientCreateErrors, nil))
+	}
+	if hostLogsSendErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountHostLogsSendError, hostLogsSendErrors, nil))
+	}
+	if configSnapshotClientCreateErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountConfigSnapshotClientCreateError, configSnapshotClientCreateErrors, nil))
+	}
+	if configSnapshotSendErrors > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameErrorCountConfigSnapshotSendError, configSnapshotSendErrors, nil))
+	}
+	if deadLetterRecordCount > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameDeadLetterRecordCount, deadLetterRecordCount, nil))
+	}
+	if circuitBreakerOpenCount > 0.0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameCircuitBreakerOpenCount, circuitBreakerOpenCount, nil))
+	}
+	for priority, lane := range PriorityLanes {
+		rejected, timedOut := lane.takeRejectedCounts()
+		if rejected > 0 {
+			rejectedMetric := telemetry.Metric(metricNamePriorityLaneRejectedCount, float64(rejected), nil)
+			rejectedMetric.Properties["Lane"] = priority.String()
+			TelemetryClient.Track(rejectedMetric)
 		}
-		if kubeMonEventsWindowsAMAClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountKubeMonEventsWindowsAMAClientCreateError, kubeMonEventsWindowsAMAClientCreateErrors))
+		if timedOut > 0 {
+			timeoutMetric := telemetry.Metric(metricNamePriorityLaneTimeoutCount, float64(timedOut), nil)
+			timeoutMetric.Properties["Lane"] = priority.String()
+			TelemetryClient.Track(timeoutMetric)
 		}
-		if winTelegrafMetricsCountWithTagsSize64KBorMore > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameNumberofWinTelegrafMetricsWithTagsSize64KBorMore, winTelegrafMetricsCountWithTagsSize64KBorMore))
+	}
+	for key, count := range takeDroppedRecordCounts() {
+		droppedMetric := telemetry.Metric(metricNameDroppedRecordCount, count, nil)
+		droppedMetric.Properties["Reason"] = string(key.Reason)
+		droppedMetric.Properties["Namespace"] = key.Namespace
+		TelemetryClient.Track(droppedMetric)
+	}
+	for key, count := range takeSchemaViolationCounts() {
+		violationMetric := telemetry.Metric(metricNameSchemaViolationCount, count, nil)
+		violationMetric.Properties["Schema"] = key.Schema
+		violationMetric.Properties["Field"] = key.Field
+		violationMetric.Properties["Violation"] = string(key.Violation)
+		TelemetryClient.Track(violationMetric)
+	}
+	if level, usage := ResourceThrottling.takeMaxLevel(); level > ThrottleNone {
+		throttlingMetric := telemetry.Metric(metricNameResourceThrottlingMaxLevel, float64(level), nil)
+		throttlingMetric.Properties["MemoryPercent"] = strconv.FormatFloat(usage.MemoryPercent(), 'f', 1, 64)
+		throttlingMetric.Properties["CpuPercent"] = strconv.FormatFloat(usage.CPUPercent(), 'f', 1, 64)
+		throttlingMetric.Properties["ProcessRssBytes"] = strconv.FormatUint(usage.ProcessRSSBytes, 10)
+		throttlingMetric.Properties["GoHeapBytes"] = strconv.FormatUint(usage.GoHeapBytes, 10)
+		TelemetryClient.Track(throttlingMetric)
+	}
+	if duplicates := ResourceThrottling.takeDuplicates(); duplicates > 0 {
+		TelemetryClient.Track(telemetry.Metric(metricNameResourceThrottlingDuplicateRecordCount, float64(duplicates), nil))
+	}
+	for key, h := range TelemetryDeliveryLatency.take() {
+		latencies := map[string]float64{
+			metricNameDeliveryLatencyP50Ms: h.Percentile(0.50),
+			metricNameDeliveryLatencyP95Ms: h.Percentile(0.95),
+			metricNameDeliveryLatencyP99Ms: h.Percentile(0.99),
+			metricNameDeliveryLatencyMaxMs: h.MaxMs,
 		}
-		if ContainerLogRecordCountWithEmptyTimeStamp > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogRecordCountWithEmptyTimeStamp, containerLogRecordCountWithEmptyTimeStamp))
+		for metricName, latencyMs := range latencies {
+			latencyMetric := telemetry.Metric(metricName, latencyMs, nil)
+			latencyMetric.Properties["DataType"] = key.DataType
+			latencyMetric.Properties["Sink"] = key.Sink
+			latencyMetric.Properties["RecordCount"] = strconv.FormatUint(h.Count, 10)
+			TelemetryClient.Track(latencyMetric)
 		}
-
-		start = time.Now()
 	}
 }
 
@@ -388,97 +518,85 @@ func SendTracesAsMetrics(telemetryPushIntervalProperty string) {
 
 	TracesErrorMetricsTicker = time.NewTicker(time.Second * time.Duration(telemetryPushInterval))
 
-	for ; true; <-TracesErrorMetricsTicker.C {
-		TracesErrorMetricsMutex.Lock()
-		for metricName, metricValue := range TracesErrorMetrics {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricName, metricValue))
-		}
-		TracesErrorMetrics = map[string]float64{}
-		TracesErrorMetricsMutex.Unlock()
+	for running := true; running; running = waitForTick(TracesErrorMetricsTicker) {
+		flushTracesErrorMetrics()
 	}
+	flushTracesErrorMetrics()
+}
+
+// flushTracesErrorMetrics sends and resets the mdsd trace error counts
+func flushTracesErrorMetrics() {
+	TracesErrorMetricsMutex.Lock()
+	defer TracesErrorMetricsMutex.Unlock()
+	for metricName, metricValue := range TracesErrorMetrics {
+		TelemetryClient.Track(telemetry.Metric(metricName, metricValue, nil))
+		TracesErrorMetricTotals[metricName] += metricValue
+	}
+	TracesErrorMetrics = map[string]float64{}
 }
 
 // SendEvent sends an event to App Insights
 func SendEvent(eventName string, dimensions map[string]string) {
 	Log("Sending Event : %s\n", eventName)
-	event := appinsights.NewEventTelemetry(eventName)
-
-	// add any extra Properties
-	for k, v := range dimensions {
-		event.Properties[k] = v
-	}
-
-	TelemetryClient.Track(event)
+	TelemetryClient.Track(telemetry.Event(eventName, dimensions))
 }
 
 // SendMetric sends a metric to App Insights
 func SendMetric(metricName string, metricValue float64, dimensions map[string]string) {
 	Log("Sending Metric : %s\n", metricName)
-	metric := appinsights.NewMetricTelemetry(metricName, metricValue)
-
-	// add any extra Properties
-	for k, v := range dimensions {
-		metric.Properties[k] = v
-	}
-
-	TelemetryClient.Track(metric)
+	TelemetryClient.Track(telemetry.Metric(metricName, metricValue, dimensions))
 }
 
 // SendException  send an event to the configured app insights instance
 func SendException(err interface{}) {
-	if TelemetryClient != nil {
-		TelemetryClient.TrackException(err)
-	}
+	TelemetryClient.Track(telemetry.Exception(err, nil))
 }
 
-// InitializeTelemetryClient sets up the telemetry client to send telemetry to the App Insights instance
-func InitializeTelemetryClient(agentVersion string) (int, error) {
-	encodedIkey := os.Getenv(envAppInsightsAuth)
-	if encodedIkey == "" {
-		Log("Environment Variable Missing \n")
-		return -1, errors.New("Missing Environment Variable")
+// newTelemetryClient creates the client of the configured telemetry backend
+func newTelemetryClient(settings *PluginConfig) (telemetry.Client, error) {
+	config := telemetry.Config{
+		Backend:          settings.TelemetryBackend,
+		Disabled:         settings.TelemetryDisabled,
+		CommonProperties: CommonProperties,
+		ServiceName:      "out_oms",
+		ProxyURL:         ProxyEndpoint,
+		OTLPEndpoint:     settings.TelemetryOTLPEndpoint,
+		OTLPHeaders:      telemetry.ParseHeaders(settings.TelemetryOTLPHeaders),
+		FilePath:         paths.Resolve(settings.TelemetryFilePath),
+		Logger:           FLBLogger,
 	}
-
-	decIkey, err := base64.StdEncoding.DecodeString(encodedIkey)
-	if err != nil {
-		Log("Decoding Error %s", err.Error())
-		return -1, err
+	if config.Disabled {
+		Log("Telemetry is disabled \n")
+		return telemetry.New(config)
 	}
-
-	appInsightsEndpoint := os.Getenv(envAppInsightsEndpoint)
-	telemetryClientConfig := appinsights.NewTelemetryConfiguration(string(decIkey))
-	// endpoint override required only for sovereign clouds
-	if appInsightsEndpoint != "" {
-		Log("Overriding the default AppInsights EndpointUrl with %s", appInsightsEndpoint)
-		telemetryClientConfig.EndpointUrl = appInsightsEndpoint
-	}
-	// if the proxy configured set the customized httpclient with proxy
-	isProxyConfigured := false
-	if ProxyEndpoint != "" {
-		Log("Using proxy endpoint for telemetry client since proxy configured")
-		proxyEndpointUrl, err := url.Parse(ProxyEndpoint)
-		if err != nil {
-			Log("Failed Parsing of Proxy endpoint %s", err.Error())
-			return -1, err
+	if config.Backend == telemetry.BackendAppInsights {
+		encodedIkey := os.Getenv(envAppInsightsAuth)
+		if encodedIkey == "" {
+			Log("Environment Variable Missing \n")
+			return nil, errors.New("Missing Environment Variable")
 		}
-		//adding the proxy settings to the Transport object
-		transport := &http.Transport{
-			Proxy: http.ProxyURL(proxyEndpointUrl),
+		decIkey, err := base64.StdEncoding.DecodeString(encodedIkey)
+		if err != nil {
+			Log("Decoding Error %s", err.Error())
+			return nil, err
 		}
-		httpClient := &http.Client{
-			Transport: transport,
+		config.AppInsightsKey = string(decIkey)
+		config.AppInsightsEndpoint = os.Getenv(envAppInsightsEndpoint)
+		// endpoint override required only for sovereign clouds
+		if config.AppInsightsEndpoint != "" {
+			Log("Overriding the default AppInsights EndpointUrl with %s", config.AppInsightsEndpoint)
 		}
-		telemetryClientConfig.Client = httpClient
-		isProxyConfigured = true
 	}
-	TelemetryClient = appinsights.NewTelemetryClientFromConfig(telemetryClientConfig)
-
-	telemetryOffSwitch := os.Getenv("DISABLE_TELEMETRY")
-	if strings.Compare(strings.ToLower(telemetryOffSwitch), "true") == 0 {
-		Log("Appinsights telemetry is disabled \n")
-		TelemetryClient.SetIsEnabled(false)
+	if ProxyEndpoint != "" {
+		Log("Using proxy endpoint for telemetry client since proxy configured")
 	}
+	Log("Using the %s telemetry backend", config.Backend)
+	return telemetry.New(config)
+}
 
+// InitializeTelemetryClient sets up the telemetry client of the configured backend, the telemetry is dropped until it succeeds
+func InitializeTelemetryClient(agentVersion string, settings *PluginConfig) (int, error) {
+	var err error
 	CommonProperties = make(map[string]string)
 	CommonProperties["Computer"] = Computer
 	CommonProperties["WSID"] = WorkspaceID
@@ -496,7 +614,7 @@ func InitializeTelemetryClient(agentVersion string) (int, error) {
 		CommonProperties["Region"] = region
 	}
 
-	if isProxyConfigured == true {
+	if ProxyEndpoint != "" {
 		CommonProperties["Proxy"] = "true"
 	} else {
 		CommonProperties["Proxy"] = "false"
@@ -534,7 +652,12 @@ func InitializeTelemetryClient(agentVersion string) (int, error) {
 		}
 	}
 
-	TelemetryClient.Context().CommonProperties = CommonProperties
+	client, err := newTelemetryClient(settings)
+	if err != nil {
+		Log("Error::telemetry::Unable to create the telemetry client %s", err.Error())
+		return -1, err
+	}
+	TelemetryClient = client
 
 	// Getting the namespace count, monitor kubernetes pods values and namespace count once at start because it wont change unless the configmap is applied and the container is restarted
 
@@ -590,7 +713,7 @@ func UpdateTracesErrorMetrics(key string) {
 }
 
 // PushToAppInsightsTraces sends the log lines as trace messages to the configured App Insights Instance
-func PushToAppInsightsTraces(records []map[interface{}]interface{}, severityLevel contracts.SeverityLevel, tag string) int {
+func PushToAppInsightsTraces(records []map[interface{}]interface{}, severityLevel telemetry.Severity, tag string) int {
 	var logLines []string
 	for _, record := range records {
 		// If record contains config error or prometheus scraping errors send it to KubeMonAgentEvents table
@@ -633,8 +756,6 @@ func PushToAppInsightsTraces(records []map[interface{}]interface{}, severityLeve
 	}
 
 	traceEntry := strings.Join(logLines, "\n")
-	traceTelemetryItem := appinsights.NewTraceTelemetry(traceEntry, severityLevel)
-	traceTelemetryItem.Properties["tag"] = tag
-	TelemetryClient.Track(traceTelemetryItem)
+	TelemetryClient.Track(telemetry.Trace(traceEntry, severityLevel, map[string]string{"tag": tag}))
 	return output.FLB_OK
 }
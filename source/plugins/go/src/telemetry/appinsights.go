@@ -0,0 +1,82 @@
+package telemetry
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// time Close waits for App Insights to send the buffered items
+const appInsightsCloseTimeout = 10 * time.Second
+
+type appInsightsClient struct {
+	client appinsights.TelemetryClient
+}
+
+// NewAppInsightsClient returns a client that sends the items to App Insights, through the proxy if one is configured
+func NewAppInsightsClient(config Config) (Client, error) {
+	if config.AppInsightsKey == "" {
+		return nil, fmt.Errorf("missing App Insights instrumentation key")
+	}
+	telemetryConfig := appinsights.NewTelemetryConfiguration(config.AppInsightsKey)
+	// endpoint override required only for sovereign clouds
+	if config.AppInsightsEndpoint != "" {
+		telemetryConfig.EndpointUrl = config.AppInsightsEndpoint
+	}
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy endpoint: %w", err)
+		}
+		telemetryConfig.Client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	}
+	client := appinsights.NewTelemetryClientFromConfig(telemetryConfig)
+	if config.CommonProperties != nil {
+		client.Context().CommonProperties = config.CommonProperties
+	}
+	return &appInsightsClient{client: client}, nil
+}
+
+func (c *appInsightsClient) Track(item Item) {
+	// the common properties are added to the properties of the item
+	if item.Properties == nil {
+		item.Properties = make(map[string]string)
+	}
+	var telemetry appinsights.Telemetry
+	switch item.Kind {
+	case KindEvent:
+		event := appinsights.NewEventTelemetry(item.Name)
+		event.Properties = item.Properties
+		event.Timestamp = item.Time
+		telemetry = event
+	case KindMetric:
+		metric := appinsights.NewMetricTelemetry(item.Name, item.Value)
+		metric.Properties = item.Properties
+		metric.Timestamp = item.Time
+		telemetry = metric
+	case KindTrace:
+		trace := appinsights.NewTraceTelemetry(item.Name, contracts.SeverityLevel(item.Severity))
+		trace.Properties = item.Properties
+		trace.Timestamp = item.Time
+		telemetry = trace
+	case KindException:
+		exception := appinsights.NewExceptionTelemetry(item.Name)
+		exception.Properties = item.Properties
+		exception.Timestamp = item.Time
+		telemetry = exception
+	default:
+		return
+	}
+	c.client.Track(telemetry)
+}
+
+func (c *appInsightsClient) Close() {
+	select {
+	case <-c.client.Channel().Close(appInsightsCloseTimeout):
+	case <-time.After(appInsightsCloseTimeout):
+	}
+}
@@ -0,0 +1,56 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// fileClient writes the items as JSON lines to a local file, rotated like the plugin log files
+type fileClient struct {
+	mutex            sync.Mutex
+	writer           *lumberjack.Logger
+	commonProperties map[string]string
+	logger           *log.Logger
+}
+
+// NewFileClient returns a client that writes the items to config.FilePath
+func NewFileClient(config Config) (Client, error) {
+	if config.FilePath == "" {
+		return nil, fmt.Errorf("missing telemetry file path")
+	}
+	return &fileClient{
+		writer: &lumberjack.Logger{
+			Filename:   config.FilePath,
+			MaxSize:    10, //megabytes
+			MaxBackups: 1,
+			MaxAge:     28, //days
+			Compress:   true,
+		},
+		commonProperties: config.CommonProperties,
+		logger:           config.Logger,
+	}, nil
+}
+
+func (c *fileClient) Track(item Item) {
+	item.Properties = mergeProperties(c.commonProperties, item.Properties)
+	line, err := json.Marshal(item)
+	if err != nil {
+		c.logger.Printf("Error::telemetry::Unable to encode the telemetry item %s", err.Error())
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, err := c.writer.Write(append(line, '\n')); err != nil {
+		c.logger.Printf("Error::telemetry::Unable to write the telemetry item %s", err.Error())
+	}
+}
+
+func (c *fileClient) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writer.Close()
+}
@@ -0,0 +1,62 @@
+package telemetry
+
+import "sync"
+
+// MemoryClient keeps the items in memory, so tests can assert on the emitted telemetry
+type MemoryClient struct {
+	mutex  sync.Mutex
+	items  []Item
+	closed bool
+}
+
+// NewMemoryClient returns an empty MemoryClient
+func NewMemoryClient() *MemoryClient {
+	return &MemoryClient{}
+}
+
+func (c *MemoryClient) Track(item Item) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.items = append(c.items, item)
+}
+
+func (c *MemoryClient) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+}
+
+// Closed returns whether Close was called
+func (c *MemoryClient) Closed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// Items returns a copy of the tracked items
+func (c *MemoryClient) Items() []Item {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]Item(nil), c.items...)
+}
+
+// Find returns the tracked items of a kind and name
+func (c *MemoryClient) Find(kind Kind, name string) []Item {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var found []Item
+	for _, item := range c.items {
+		if item.Kind == kind && item.Name == name {
+			found = append(found, item)
+		}
+	}
+	return found
+}
+
+// Reset drops the tracked items
+func (c *MemoryClient) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.items = nil
+	c.closed = false
+}
@@ -0,0 +1,338 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+const otlpExportInterval = 10 * time.Second
+
+// items buffered between exports, an export starts at otlpBatchSize and items above otlpMaxBufferedItems are dropped
+const otlpBatchSize = 512
+const otlpMaxBufferedItems = 10000
+
+const otlpScopeName = "Docker-Provider/telemetry"
+
+// otlpClient exports the metrics to /v1/metrics and the events, traces and exceptions to /v1/logs of an OTLP/HTTP
+// collector, JSON encoded
+type otlpClient struct {
+	endpoint   string
+	headers    map[string]string
+	httpClient *http.Client
+	resource   otlpResource
+	logger     *log.Logger
+
+	mutex   sync.Mutex
+	items   []Item
+	dropped int
+	export  chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// NewOTLPClient returns a client that exports the items to an OTLP/HTTP collector in the background
+func NewOTLPClient(config Config) (Client, error) {
+	endpoint := strings.TrimRight(config.OTLPEndpoint, "/")
+	if endpoint == "" {
+		endpoint = DefaultOTLPEndpoint
+	}
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %s", endpoint)
+	}
+	transport := &http.Transport{}
+	if config.ProxyURL != "" {
+		if _, err := url.Parse(config.ProxyURL); err != nil {
+			return nil, fmt.Errorf("invalid proxy endpoint: %w", err)
+		}
+		// a collector on localhost or a loopback address, e.g. the default endpoint, and the NO_PROXY hosts aren't
+		// reached through the proxy
+		proxyConfig := &httpproxy.Config{HTTPProxy: config.ProxyURL, HTTPSProxy: config.ProxyURL, NoProxy: httpproxy.FromEnvironment().NoProxy}
+		proxyFunc := proxyConfig.ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "ama-logs"
+	}
+	c := &otlpClient{
+		endpoint:   endpoint,
+		headers:    config.OTLPHeaders,
+		httpClient: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		resource:   otlpResource{Attributes: append([]otlpKeyValue{otlpAttribute("service.name", serviceName)}, otlpAttributes(config.CommonProperties)...)},
+		logger:     config.Logger,
+		export:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if c.logger == nil {
+		c.logger = log.New(io.Discard, "", 0)
+	}
+	c.wg.Add(1)
+	go c.run()
+	return c, nil
+}
+
+func (c *otlpClient) Track(item Item) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.items) >= otlpMaxBufferedItems {
+		c.dropped++
+		return
+	}
+	c.items = append(c.items, item)
+	if len(c.items) >= otlpBatchSize {
+		select {
+		case c.export <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close stops the background export and exports the buffered items
+func (c *otlpClient) Close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+		c.flush()
+	})
+}
+
+func (c *otlpClient) run() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(otlpExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		case <-c.export:
+		}
+		c.flush()
+	}
+}
+
+// flush exports the buffered items, the items of a failed export are dropped
+func (c *otlpClient) flush() {
+	c.mutex.Lock()
+	items, dropped := c.items, c.dropped
+	c.items, c.dropped = nil, 0
+	c.mutex.Unlock()
+	if dropped > 0 {
+		c.logger.Printf("Error::telemetry::Dropped %d telemetry items above the OTLP buffer limit", dropped)
+	}
+
+	var metrics, logs []Item
+	for _, item := range items {
+		if item.Kind == KindMetric {
+			metrics = append(metrics, item)
+		} else {
+			logs = append(logs, item)
+		}
+	}
+	if len(metrics) > 0 {
+		c.post("/v1/metrics", c.metricsRequest(metrics))
+	}
+	if len(logs) > 0 {
+		c.post("/v1/logs", c.logsRequest(logs))
+	}
+}
+
+func (c *otlpClient) post(path string, request interface{}) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		c.logger.Printf("Error::telemetry::Unable to encode the OTLP request %s", err.Error())
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		c.logger.Printf("Error::telemetry::Unable to create the OTLP request %s", err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		c.logger.Printf("Error::telemetry::OTLP export to %s failed %s", path, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		c.logger.Printf("Error::telemetry::OTLP export to %s failed with status %s", path, resp.Status)
+	}
+}
+
+// OTLP/HTTP JSON encoding of the protobuf messages
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano string         `json:"timeUnixNano"`
+	AsDouble     float64        `json:"asDouble"`
+}
+
+type otlpMetric struct {
+	Name  string `json:"name"`
+	Gauge struct {
+		DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+	} `json:"gauge"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []struct {
+		Resource     otlpResource `json:"resource"`
+		ScopeMetrics []struct {
+			Scope   otlpScope    `json:"scope"`
+			Metrics []otlpMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []struct {
+		Resource  otlpResource `json:"resource"`
+		ScopeLogs []struct {
+			Scope      otlpScope       `json:"scope"`
+			LogRecords []otlpLogRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+func (c *otlpClient) metricsRequest(items []Item) *otlpMetricsRequest {
+	request := &otlpMetricsRequest{}
+	request.ResourceMetrics = make([]struct {
+		Resource     otlpResource `json:"resource"`
+		ScopeMetrics []struct {
+			Scope   otlpScope    `json:"scope"`
+			Metrics []otlpMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	}, 1)
+	resourceMetrics := &request.ResourceMetrics[0]
+	resourceMetrics.Resource = c.resource
+	resourceMetrics.ScopeMetrics = make([]struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}, 1)
+	scopeMetrics := &resourceMetrics.ScopeMetrics[0]
+	scopeMetrics.Scope = otlpScope{Name: otlpScopeName}
+	for _, item := range items {
+		var metric otlpMetric
+		metric.Name = item.Name
+		metric.Gauge.DataPoints = []otlpNumberDataPoint{{
+			Attributes:   otlpAttributes(item.Properties),
+			TimeUnixNano: strconv.FormatInt(item.Time.UnixNano(), 10),
+			AsDouble:     item.Value,
+		}}
+		scopeMetrics.Metrics = append(scopeMetrics.Metrics, metric)
+	}
+	return request
+}
+
+func (c *otlpClient) logsRequest(items []Item) *otlpLogsRequest {
+	request := &otlpLogsRequest{}
+	request.ResourceLogs = make([]struct {
+		Resource  otlpResource `json:"resource"`
+		ScopeLogs []struct {
+			Scope      otlpScope       `json:"scope"`
+			LogRecords []otlpLogRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	}, 1)
+	resourceLogs := &request.ResourceLogs[0]
+	resourceLogs.Resource = c.resource
+	resourceLogs.ScopeLogs = make([]struct {
+		Scope      otlpScope       `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}, 1)
+	scopeLogs := &resourceLogs.ScopeLogs[0]
+	scopeLogs.Scope = otlpScope{Name: otlpScopeName}
+	for _, item := range items {
+		severityNumber, severityText := otlpSeverity(item)
+		scopeLogs.LogRecords = append(scopeLogs.LogRecords, otlpLogRecord{
+			TimeUnixNano:   strconv.FormatInt(item.Time.UnixNano(), 10),
+			SeverityNumber: severityNumber,
+			SeverityText:   severityText,
+			Body:           otlpAnyValue{StringValue: item.Name},
+			Attributes:     append([]otlpKeyValue{otlpAttribute("telemetry.kind", string(item.Kind))}, otlpAttributes(item.Properties)...),
+		})
+	}
+	return request
+}
+
+// otlpSeverity maps the severity of traces to the OTLP severity numbers, events are INFO and exceptions ERROR
+func otlpSeverity(item Item) (int, string) {
+	switch {
+	case item.Kind == KindEvent:
+		return 9, "INFO"
+	case item.Kind == KindException:
+		return 17, "ERROR"
+	}
+	switch item.Severity {
+	case SeverityVerbose:
+		return 5, "DEBUG"
+	case SeverityWarning:
+		return 13, "WARN"
+	case SeverityError:
+		return 17, "ERROR"
+	case SeverityCritical:
+		return 21, "FATAL"
+	}
+	return 9, "INFO"
+}
+
+func otlpAttribute(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// otlpAttributes returns the properties sorted by key
+func otlpAttributes(properties map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attributes := make([]otlpKeyValue, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, otlpAttribute(key, properties[key]))
+	}
+	return attributes
+}
@@ -0,0 +1,179 @@
+// Package telemetry sends the agent telemetry to App Insights, an OTLP/HTTP collector, a local JSON file or nowhere.
+// It's shared by the out_oms output plugin and the input plugins
+package telemetry
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// env variables selecting and configuring the telemetry backend
+const (
+	BackendEnv      = "AZMON_TELEMETRY_BACKEND"
+	OTLPEndpointEnv = "AZMON_TELEMETRY_OTLP_ENDPOINT"
+	OTLPHeadersEnv  = "AZMON_TELEMETRY_OTLP_HEADERS"
+	FilePathEnv     = "AZMON_TELEMETRY_FILE_PATH"
+)
+
+// Backends of the telemetry
+const (
+	BackendAppInsights = "appinsights"
+	BackendOTLP        = "otlp"
+	BackendFile        = "file"
+	BackendNoop        = "noop"
+)
+
+// DefaultOTLPEndpoint is the OTLP/HTTP endpoint of a collector running on the node
+const DefaultOTLPEndpoint = "http://localhost:4318"
+
+// Kind of a telemetry item
+type Kind string
+
+const (
+	KindEvent     Kind = "event"
+	KindMetric    Kind = "metric"
+	KindTrace     Kind = "trace"
+	KindException Kind = "exception"
+)
+
+// Severity of a trace, the values match the App Insights severity levels
+type Severity int
+
+const (
+	SeverityVerbose Severity = iota
+	SeverityInformation
+	SeverityWarning
+	SeverityError
+	SeverityCritical
+)
+
+// Item is an event, metric, trace or exception
+type Item struct {
+	Kind Kind `json:"kind"`
+	// Name of the event or metric, message of the trace or exception
+	Name       string            `json:"name"`
+	Value      float64           `json:"value,omitempty"`
+	Severity   Severity          `json:"severity,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// Client sends telemetry items. Implementations are safe for concurrent use
+type Client interface {
+	Track(item Item)
+	// Close sends the buffered items
+	Close()
+}
+
+// Config of the telemetry backend
+type Config struct {
+	Backend string
+	// Disabled uses the noop backend whatever the backend is
+	Disabled bool
+	// CommonProperties are sent with every item
+	CommonProperties map[string]string
+	// ServiceName identifies the plugin in the OTLP resource
+	ServiceName string
+	// AppInsightsKey is the decoded instrumentation key
+	AppInsightsKey      string
+	AppInsightsEndpoint string
+	ProxyURL            string
+	OTLPEndpoint        string
+	OTLPHeaders         map[string]string
+	FilePath            string
+	// Logger for export errors, nil discards them
+	Logger *log.Logger
+}
+
+// New creates the client of the configured backend
+func New(config Config) (Client, error) {
+	if config.Logger == nil {
+		config.Logger = log.New(io.Discard, "", 0)
+	}
+	if config.Disabled {
+		return NewNoopClient(), nil
+	}
+	switch strings.ToLower(config.Backend) {
+	case "", BackendAppInsights:
+		return NewAppInsightsClient(config)
+	case BackendOTLP:
+		return NewOTLPClient(config)
+	case BackendFile:
+		return NewFileClient(config)
+	case BackendNoop:
+		return NewNoopClient(), nil
+	}
+	return nil, fmt.Errorf("unknown telemetry backend %s", config.Backend)
+}
+
+// ParseHeaders parses comma separated key=value headers
+func ParseHeaders(value string) map[string]string {
+	headers := make(map[string]string)
+	for _, header := range strings.Split(value, ",") {
+		if key, val, ok := strings.Cut(header, "="); ok && strings.TrimSpace(key) != "" {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(val)
+		}
+	}
+	return headers
+}
+
+// Event returns an event item
+func Event(name string, properties map[string]string) Item {
+	return newItem(KindEvent, name, properties)
+}
+
+// Metric returns a metric item
+func Metric(name string, value float64, properties map[string]string) Item {
+	item := newItem(KindMetric, name, properties)
+	item.Value = value
+	return item
+}
+
+// Trace returns a trace item
+func Trace(message string, severity Severity, properties map[string]string) Item {
+	item := newItem(KindTrace, message, properties)
+	item.Severity = severity
+	return item
+}
+
+// Exception returns an exception item of an error or a message
+func Exception(err interface{}, properties map[string]string) Item {
+	item := newItem(KindException, fmt.Sprint(err), properties)
+	item.Severity = SeverityError
+	return item
+}
+
+// newItem copies the properties, so the caller can add properties to the item
+func newItem(kind Kind, name string, properties map[string]string) Item {
+	copied := make(map[string]string, len(properties))
+	for k, v := range properties {
+		copied[k] = v
+	}
+	return Item{Kind: kind, Name: name, Properties: copied, Time: time.Now()}
+}
+
+// mergeProperties returns the common properties overridden by the properties of the item
+func mergeProperties(common map[string]string, properties map[string]string) map[string]string {
+	merged := make(map[string]string, len(common)+len(properties))
+	for k, v := range common {
+		merged[k] = v
+	}
+	for k, v := range properties {
+		merged[k] = v
+	}
+	return merged
+}
+
+type noopClient struct{}
+
+// NewNoopClient returns a client that drops the items
+func NewNoopClient() Client {
+	return noopClient{}
+}
+
+func (noopClient) Track(item Item) {}
+
+func (noopClient) Close() {}
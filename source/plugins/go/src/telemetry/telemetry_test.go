@@ -0,0 +1,161 @@
+package telemetry
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewSelectsBackend(t *testing.T) {
+	if client, err := New(Config{Backend: BackendNoop}); err != nil || client != NewNoopClient() {
+		t.Errorf("expected the noop client, got %v %v", client, err)
+	}
+	if client, err := New(Config{Backend: BackendOTLP, Disabled: true}); err != nil || client != NewNoopClient() {
+		t.Errorf("expected the noop client when disabled, got %v %v", client, err)
+	}
+	if _, err := New(Config{Backend: "statsd"}); err == nil {
+		t.Errorf("expected an error for an unknown backend")
+	}
+	if _, err := New(Config{Backend: BackendAppInsights}); err == nil {
+		t.Errorf("expected an error for a missing instrumentation key")
+	}
+	if _, err := New(Config{Backend: BackendFile}); err == nil {
+		t.Errorf("expected an error for a missing file path")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers := ParseHeaders("Authorization=Bearer a=b, x-tenant = team ,invalid,")
+	if len(headers) != 2 || headers["Authorization"] != "Bearer a=b" || headers["x-tenant"] != "team" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
+
+func TestItemsCopyProperties(t *testing.T) {
+	properties := map[string]string{"a": "1"}
+	item := Event("event", properties)
+	item.Properties["b"] = "2"
+	if len(properties) != 1 {
+		t.Errorf("expected the caller properties to be unchanged, got %v", properties)
+	}
+	if item := Metric("metric", 1, nil); item.Properties == nil {
+		t.Errorf("expected non nil properties")
+	}
+}
+
+func TestFileClientWritesJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "telemetry.json")
+	client, err := New(Config{Backend: BackendFile, FilePath: path, CommonProperties: map[string]string{"Computer": "node", "a": "common"}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	client.Track(Event("event", map[string]string{"a": "item"}))
+	client.Track(Trace("trace", SeverityWarning, nil))
+	client.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open the telemetry file: %v", err)
+	}
+	defer file.Close()
+	var items []Item
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var item Item
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			t.Fatalf("invalid line %s: %v", scanner.Text(), err)
+		}
+		items = append(items, item)
+	}
+	if len(items) != 2 || items[0].Properties["a"] != "item" || items[0].Properties["Computer"] != "node" || items[1].Severity != SeverityWarning {
+		t.Errorf("unexpected items %+v", items)
+	}
+}
+
+func TestOTLPClientExportsOnClose(t *testing.T) {
+	var mutex sync.Mutex
+	bodies := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Header.Get("x-tenant") != "team" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		bodies[r.URL.Path] = string(body)
+	}))
+	defer server.Close()
+
+	client, err := New(Config{Backend: BackendOTLP, OTLPEndpoint: server.URL + "/", OTLPHeaders: map[string]string{"x-tenant": "team"}, ServiceName: "out_oms"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	client.Track(Metric("FlushedRecordsCount", 42, map[string]string{"DataType": "ContainerLog"}))
+	client.Track(Trace("flush failed", SeverityError, nil))
+	client.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for path, expected := range map[string][]string{
+		"/v1/metrics": {`"name":"FlushedRecordsCount"`, `"asDouble":42`, `{"key":"DataType","value":{"stringValue":"ContainerLog"}}`, `{"key":"service.name","value":{"stringValue":"out_oms"}}`},
+		"/v1/logs":    {`"severityNumber":17`, `"body":{"stringValue":"flush failed"}`, `{"key":"telemetry.kind","value":{"stringValue":"trace"}}`},
+	} {
+		for _, s := range expected {
+			if !strings.Contains(bodies[path], s) {
+				t.Errorf("expected %s in the %s export %s", s, path, bodies[path])
+			}
+		}
+	}
+}
+
+func TestOTLPClientBypassesProxyForLoopback(t *testing.T) {
+	client, err := NewOTLPClient(Config{OTLPEndpoint: DefaultOTLPEndpoint, ProxyURL: "http://proxy:8080"})
+	if err != nil {
+		t.Fatalf("NewOTLPClient failed: %v", err)
+	}
+	defer client.Close()
+	transport := client.(*otlpClient).httpClient.Transport.(*http.Transport)
+	for endpoint, expected := range map[string]string{
+		"http://localhost:4318/v1/metrics":      "",
+		"http://127.0.0.1:4318/v1/metrics":      "",
+		"http://[::1]:4318/v1/metrics":          "",
+		"https://collector.contoso.com/v1/logs": "http://proxy:8080",
+	} {
+		req, _ := http.NewRequest(http.MethodPost, endpoint, nil)
+		proxyURL, err := transport.Proxy(req)
+		if err != nil {
+			t.Fatalf("Proxy(%s) failed: %v", endpoint, err)
+		}
+		got := ""
+		if proxyURL != nil {
+			got = proxyURL.String()
+		}
+		if got != expected {
+			t.Errorf("Proxy(%s) = %q, want %q", endpoint, got, expected)
+		}
+	}
+}
+
+func TestMemoryClient(t *testing.T) {
+	client := NewMemoryClient()
+	client.Track(Event("a", nil))
+	client.Track(Metric("a", 1, nil))
+	if found := client.Find(KindEvent, "a"); len(found) != 1 {
+		t.Errorf("expected a single event, got %v", found)
+	}
+	client.Close()
+	if !client.Closed() || len(client.Items()) != 2 {
+		t.Errorf("unexpected client state")
+	}
+	client.Reset()
+	if len(client.Items()) != 0 {
+		t.Errorf("expected no items after reset")
+	}
+}
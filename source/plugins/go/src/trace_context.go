@@ -0,0 +1,155 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// env variable to enable W3C trace context extraction from ContainerLogV2 LogMessage
+const TraceContextExtractionEnabledEnv = "AZMON_TRACE_CONTEXT_EXTRACTION_ENABLED"
+
+// env variable with additional extraction patterns (separated by ;;). Patterns use the named groups trace_id, span_id and trace_flags
+const TraceContextPatternsEnv = "AZMON_TRACE_CONTEXT_PATTERNS"
+
+const traceContextPatternSeparator = ";;"
+
+const traceIdLength = 32
+const spanIdLength = 16
+const traceFlagsLength = 2
+
+// traceparent: 00-<32 hex trace-id>-<16 hex parent-id>-<2 hex flags>
+const traceParentLength = 2 + 1 + traceIdLength + 1 + spanIdLength + 1 + traceFlagsLength
+
+var (
+	// TraceContextExtractionEnabled enables populating TraceId, SpanId and TraceFlags of ContainerLogV2
+	TraceContextExtractionEnabled bool
+	// TraceContextPatterns additional configured patterns with trace_id, span_id and trace_flags named groups
+	TraceContextPatterns []*regexp.Regexp
+	// matches "trace_id":"..." style keys used by OpenTelemetry log exporters and common logging libraries
+	traceIdKeyRegex    = regexp.MustCompile(`"(?:trace_id|traceId|traceid|TraceId|trace\.id)"\s*:\s*"([0-9a-fA-F]{32})"`)
+	spanIdKeyRegex     = regexp.MustCompile(`"(?:span_id|spanId|spanid|SpanId|span\.id)"\s*:\s*"([0-9a-fA-F]{16})"`)
+	traceFlagsKeyRegex = regexp.MustCompile(`"(?:trace_flags|traceFlags|traceflags|TraceFlags)"\s*:\s*"?([0-9a-fA-F]{1,2})"?`)
+)
+
+// TraceContext holds the W3C trace context extracted from a log line
+type TraceContext struct {
+	TraceId    string
+	SpanId     string
+	TraceFlags string
+}
+
+func populateTraceContextSettings(config *PluginConfig) {
+	TraceContextExtractionEnabled = config.TraceContextExtractionEnabled
+	TraceContextPatterns = nil
+	if !TraceContextExtractionEnabled {
+		return
+	}
+	Log("Trace context extraction enabled")
+	for _, pattern := range config.TraceContextPatterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			Log("Error::traceContext::Ignoring invalid trace context pattern %s: %s", pattern, err.Error())
+			continue
+		}
+		if compiled.SubexpIndex("trace_id") == -1 {
+			Log("Error::traceContext::Ignoring trace context pattern %s without trace_id named group", pattern)
+			continue
+		}
+		TraceContextPatterns = append(TraceContextPatterns, compiled)
+	}
+}
+
+// extractTraceContext returns the trace context found in the log message. Cheap substring checks are done before
+// falling back to the regular expressions, so lines without any trace context only pay for a few strings.Index calls
+func extractTraceContext(logMessage string) (TraceContext, bool) {
+	if tc, ok := extractTraceParent(logMessage); ok {
+		return tc, true
+	}
+	if tc, ok := extractTraceContextFromKeys(logMessage); ok {
+		return tc, true
+	}
+	for _, pattern := range TraceContextPatterns {
+		match := pattern.FindStringSubmatch(logMessage)
+		if match == nil {
+			continue
+		}
+		tc := TraceContext{TraceId: strings.ToLower(match[pattern.SubexpIndex("trace_id")])}
+		if i := pattern.SubexpIndex("span_id"); i != -1 {
+			tc.SpanId = strings.ToLower(match[i])
+		}
+		if i := pattern.SubexpIndex("trace_flags"); i != -1 {
+			tc.TraceFlags = strings.ToLower(match[i])
+		}
+		if isValidTraceId(tc.TraceId) {
+			return tc, true
+		}
+	}
+	return TraceContext{}, false
+}
+
+// extractTraceParent parses the W3C traceparent header value that follows a traceparent key
+func extractTraceParent(logMessage string) (TraceContext, bool) {
+	idx := strings.Index(logMessage, "traceparent")
+	for idx != -1 {
+		rest := logMessage[idx+len("traceparent"):]
+		// skip separators between key and value e.g. "traceparent": "00-..." or traceparent=00-...
+		start := strings.Index(rest, "00-")
+		if start != -1 && start <= 4 && len(rest)-start >= traceParentLength {
+			value := strings.ToLower(rest[start : start+traceParentLength])
+			traceId := value[3 : 3+traceIdLength]
+			spanId := value[3+traceIdLength+1 : 3+traceIdLength+1+spanIdLength]
+			flags := value[traceParentLength-traceFlagsLength:]
+			if value[3+traceIdLength] == '-' && value[traceParentLength-traceFlagsLength-1] == '-' &&
+				isValidTraceId(traceId) && isValidSpanId(spanId) && isHex(flags) {
+				return TraceContext{TraceId: traceId, SpanId: spanId, TraceFlags: flags}, true
+			}
+		}
+		next := strings.Index(rest, "traceparent")
+		if next == -1 {
+			break
+		}
+		idx = idx + len("traceparent") + next
+	}
+	return TraceContext{}, false
+}
+
+// extractTraceContextFromKeys looks for trace_id/span_id style json keys
+func extractTraceContextFromKeys(logMessage string) (TraceContext, bool) {
+	if !strings.Contains(logMessage, "race_id") && !strings.Contains(logMessage, "raceId") && !strings.Contains(logMessage, "raceid") && !strings.Contains(logMessage, "trace.id") {
+		return TraceContext{}, false
+	}
+	match := traceIdKeyRegex.FindStringSubmatch(logMessage)
+	if match == nil || !isValidTraceId(strings.ToLower(match[1])) {
+		return TraceContext{}, false
+	}
+	tc := TraceContext{TraceId: strings.ToLower(match[1])}
+	if spanMatch := spanIdKeyRegex.FindStringSubmatch(logMessage); spanMatch != nil && isValidSpanId(strings.ToLower(spanMatch[1])) {
+		tc.SpanId = strings.ToLower(spanMatch[1])
+	}
+	if flagsMatch := traceFlagsKeyRegex.FindStringSubmatch(logMessage); flagsMatch != nil {
+		tc.TraceFlags = strings.ToLower(flagsMatch[1])
+		if len(tc.TraceFlags) == 1 {
+			tc.TraceFlags = "0" + tc.TraceFlags
+		}
+	}
+	return tc, true
+}
+
+func isHex(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
+			return false
+		}
+	}
+	return len(value) > 0
+}
+
+// all zero trace and span ids are invalid as per the W3C spec
+func isValidTraceId(traceId string) bool {
+	return len(traceId) == traceIdLength && isHex(traceId) && traceId != strings.Repeat("0", traceIdLength)
+}
+
+func isValidSpanId(spanId string) bool {
+	return len(spanId) == spanIdLength && isHex(spanId) && spanId != strings.Repeat("0", spanIdLength)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"testing"
+)
+
+type traceContextFixture struct {
+	Name       string `json:"name"`
+	Log        string `json:"log"`
+	TraceId    string `json:"traceId"`
+	SpanId     string `json:"spanId"`
+	TraceFlags string `json:"traceFlags"`
+}
+
+func TestExtractTraceContextFixtures(t *testing.T) {
+	content, err := os.ReadFile("testdata/trace_context_fixtures.json")
+	if err != nil {
+		t.Fatalf("Unable to read fixtures: %v", err)
+	}
+	var fixtures []traceContextFixture
+	if err := json.Unmarshal(content, &fixtures); err != nil {
+		t.Fatalf("Unable to parse fixtures: %v", err)
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(fixture.Name, func(t *testing.T) {
+			tc, ok := extractTraceContext(fixture.Log)
+			if ok != (fixture.TraceId != "") {
+				t.Fatalf("extractTraceContext() found = %t, want %t", ok, fixture.TraceId != "")
+			}
+			if tc.TraceId != fixture.TraceId || tc.SpanId != fixture.SpanId || tc.TraceFlags != fixture.TraceFlags {
+				t.Errorf("extractTraceContext() = %+v, want %+v", tc, fixture)
+			}
+		})
+	}
+}
+
+func TestExtractTraceContextConfiguredPattern(t *testing.T) {
+	TraceContextPatterns = []*regexp.Regexp{regexp.MustCompile(`dd\.trace_id=(?P<trace_id>[0-9a-f]{32}) dd\.span_id=(?P<span_id>[0-9a-f]{16})`)}
+	defer func() { TraceContextPatterns = nil }()
+
+	tc, ok := extractTraceContext("INFO handled request dd.trace_id=4bf92f3577b34da6a3ce929d0e0e4736 dd.span_id=00f067aa0ba902b7")
+	if !ok || tc.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || tc.SpanId != "00f067aa0ba902b7" {
+		t.Errorf("extractTraceContext() = %+v, %t", tc, ok)
+	}
+}
+
+func BenchmarkExtractTraceContextNoMatch(b *testing.B) {
+	logLine := "2024-05-01 10:00:00 INFO Listening on port 8080 with 4 workers and a reasonably long log message body"
+	for i := 0; i < b.N; i++ {
+		extractTraceContext(logLine)
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"Docker-Provider/source/plugins/go/src/extension"
+	"Docker-Provider/source/plugins/go/src/paths"
 	"bufio"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -20,22 +22,47 @@ import (
 
 // ReadConfiguration reads a property file
 func ReadConfiguration(filename string) (map[string]string, error) {
-	config := map[string]string{}
-
 	if len(filename) == 0 {
-		return config, nil
+		return map[string]string{}, nil
 	}
 
-	file, err := os.Open(filename)
+	file, err := os.Open(paths.Resolve(filename))
 	if err != nil {
 		SendException(err)
 		time.Sleep(30 * time.Second)
-		fmt.Printf("%s", err.Error())
+		Log("Error::config::Unable to open %s %s", filename, err.Error())
 		return nil, err
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	config, err := parseConfiguration(file)
+	if err != nil {
+		SendException(err)
+		time.Sleep(30 * time.Second)
+		log.Fatalf("%s", err.Error())
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// readConfigurationFile reads the key=value properties of the file without reporting errors, for the lint command
+func readConfigurationFile(filename string) (map[string]string, error) {
+	if len(filename) == 0 {
+		return map[string]string{}, nil
+	}
+	file, err := os.Open(paths.Resolve(filename))
+	if err != nil {
+		return map[string]string{}, err
+	}
+	defer file.Close()
+	return parseConfiguration(file)
+}
+
+// parseConfiguration parses the key=value lines of the reader
+func parseConfiguration(reader io.Reader) (map[string]string, error) {
+	config := map[string]string{}
+	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		currentLine := scanner.Text()
 		if equalIndex := strings.Index(currentLine, "="); equalIndex >= 0 {
@@ -48,36 +75,52 @@ func ReadConfiguration(filename string) (map[string]string, error) {
 			}
 		}
 	}
-
 	if err := scanner.Err(); err != nil {
-		SendException(err)
-		time.Sleep(30 * time.Second)
-		log.Fatalf("%s", err.Error())
-		return nil, err
+		return map[string]string{}, err
 	}
-
 	return config, nil
 }
 
 // CreateHTTPClient used to create the client for sending post requests to OMSEndpoint
 func CreateHTTPClient() {
+	certFilePath, keyFilePath := getODSCertFilePaths(PluginConfiguration, WorkspaceID, IsWindows)
+	transport, err := newODSTransport(IsAADMSIAuthMode, certFilePath, keyFilePath, ProxyEndpoint)
+	if err != nil {
+		message := fmt.Sprintf("Error when loading cert %s", err.Error())
+		SendException(message)
+		time.Sleep(30 * time.Second)
+		Log(message)
+		log.Fatalf("Error when loading cert %s", err.Error())
+	}
+
+	HTTPClient = http.Client{
+		Transport: transport,
+		Timeout:   30 * time.Second,
+	}
+
+	Log("Successfully created HTTP Client")
+}
+
+// getODSCertFilePaths returns the workspace cert and key files of the out_oms.conf properties
+func getODSCertFilePaths(pluginConfig map[string]string, workspaceID string, isWindows bool) (string, string) {
+	certFilePath := pluginConfig["cert_file_path"]
+	keyFilePath := pluginConfig["key_file_path"]
+	if isWindows == false {
+		certFilePath = fmt.Sprintf(certFilePath, workspaceID)
+		keyFilePath = fmt.Sprintf(keyFilePath, workspaceID)
+	}
+	return certFilePath, keyFilePath
+}
+
+// newODSTransport returns the transport of the ODS requests, with the workspace cert outside of the AAD MSI auth mode
+func newODSTransport(aadMSIAuthMode bool, certFilePath string, keyFilePath string, proxyEndpoint string) (*http.Transport, error) {
 	var transport *http.Transport
-	if IsAADMSIAuthMode {
+	if aadMSIAuthMode {
 		transport = &http.Transport{}
 	} else {
-		certFilePath := PluginConfiguration["cert_file_path"]
-		keyFilePath := PluginConfiguration["key_file_path"]
-		if IsWindows == false {
-			certFilePath = fmt.Sprintf(certFilePath, WorkspaceID)
-			keyFilePath = fmt.Sprintf(keyFilePath, WorkspaceID)
-		}
 		cert, err := tls.LoadX509KeyPair(certFilePath, keyFilePath)
 		if err != nil {
-			message := fmt.Sprintf("Error when loading cert %s", err.Error())
-			SendException(message)
-			time.Sleep(30 * time.Second)
-			Log(message)
-			log.Fatalf("Error when loading cert %s", err.Error())
+			return nil, err
 		}
 
 		tlsConfig := &tls.Config{
@@ -88,8 +131,8 @@ func CreateHTTPClient() {
 		transport = &http.Transport{TLSClientConfig: tlsConfig}
 	}
 	// set the proxy if the proxy configured
-	if ProxyEndpoint != "" {
-		proxyEndpointUrl, err := url.Parse(ProxyEndpoint)
+	if proxyEndpoint != "" {
+		proxyEndpointUrl, err := url.Parse(proxyEndpoint)
 		if err != nil {
 			message := fmt.Sprintf("Error parsing Proxy endpoint %s", err.Error())
 			SendException(message)
@@ -99,13 +142,7 @@ func CreateHTTPClient() {
 			transport.Proxy = http.ProxyURL(proxyEndpointUrl)
 		}
 	}
-
-	HTTPClient = http.Client{
-		Transport: transport,
-		Timeout:   30 * time.Second,
-	}
-
-	Log("Successfully created HTTP Client")
+	return transport, nil
 }
 
 // ToString converts an interface into a string
@@ -119,89 +156,64 @@ func ToString(s interface{}) string {
 	}
 }
 
-// mdsdSocketClient to write msgp messages
-func CreateMDSDClient(dataType DataType, containerType string) {
+// getMdsdSocketPath returns the mdsd fluent socket for the data type
+func getMdsdSocketPath(dataType DataType, containerType string) string {
 	mdsdfluentSocket := "/var/run/mdsd-ci/default_fluent.socket"
 	if containerType != "" && strings.Compare(strings.ToLower(containerType), "prometheussidecar") == 0 {
 		mdsdfluentSocket = fmt.Sprintf("/var/run/mdsd-%s/default_fluent.socket", containerType)
 	}
 	switch dataType {
-	case ContainerLogV2:
-		if MdsdMsgpUnixSocketClient != nil {
-			MdsdMsgpUnixSocketClient.Close()
-			MdsdMsgpUnixSocketClient = nil
-		}
-		/*conn, err := fluent.New(fluent.Config{FluentNetwork:"unix",
-		FluentSocketPath:"/var/run/mdsd-ci/default_fluent.socket",
-		WriteTimeout: 5 * time.Second,
-		RequestAck: true}) */
-		conn, err := net.DialTimeout("unix",
-			mdsdfluentSocket, 10*time.Second)
-		if err != nil {
-			Log("Error::mdsd::Unable to open MDSD msgp socket connection for ContainerLogV2 %s", err.Error())
-			//log.Fatalf("Unable to open MDSD msgp socket connection %s", err.Error())
-		} else {
-			Log("Successfully created MDSD msgp socket connection for ContainerLogV2: %s", mdsdfluentSocket)
-			MdsdMsgpUnixSocketClient = conn
-		}
-	case KubeMonAgentEvents:
-		// incase of geneva logs integration mode, KubeMonAgentEvents ingested via sidecar container socket
+	case KubeMonAgentEvents, InsightsMetrics, InputPluginRecords, ConfigSnapshot:
+		// incase of geneva logs integration mode, KubeMonAgentEvents, InsightsMetrics, input plugin records and config snapshots ingested via sidecar container socket
 		if IsGenevaLogsIntegrationEnabled {
 			mdsdfluentSocket = "/var/run/mdsd-PrometheusSidecar/default_fluent.socket"
 		}
-		if MdsdKubeMonMsgpUnixSocketClient != nil {
-			MdsdKubeMonMsgpUnixSocketClient.Close()
-			MdsdKubeMonMsgpUnixSocketClient = nil
-		}
-		conn, err := net.DialTimeout("unix",
-			mdsdfluentSocket, 10*time.Second)
-		if err != nil {
-			Log("Error::mdsd::Unable to open MDSD msgp socket connection for KubeMon events %s", err.Error())
-			//log.Fatalf("Unable to open MDSD msgp socket connection %s", err.Error())
-		} else {
-			Log("Successfully created MDSD msgp socket connection for KubeMon events:%s", mdsdfluentSocket)
-			MdsdKubeMonMsgpUnixSocketClient = conn
-		}
-	case InsightsMetrics:
-		// incase of geneva logs integration mode, InsightsMetrics ingested via sidecar container socket
-		if IsGenevaLogsIntegrationEnabled {
-			mdsdfluentSocket = "/var/run/mdsd-PrometheusSidecar/default_fluent.socket"
-		}
-		if MdsdInsightsMetricsMsgpUnixSocketClient != nil {
-			MdsdInsightsMetricsMsgpUnixSocketClient.Close()
-			MdsdInsightsMetricsMsgpUnixSocketClient = nil
-		}
-		conn, err := net.DialTimeout("unix",
-			mdsdfluentSocket, 10*time.Second)
-		if err != nil {
-			Log("Error::mdsd::Unable to open MDSD msgp socket connection for insights metrics %s", err.Error())
-			//log.Fatalf("Unable to open MDSD msgp socket connection %s", err.Error())
-		} else {
-			Log("Successfully created MDSD msgp socket connection for Insights metrics %s", mdsdfluentSocket)
-			MdsdInsightsMetricsMsgpUnixSocketClient = conn
-		}
-	case InputPluginRecords:
-		// incase of geneva logs integration mode, InsightsMetrics ingested via sidecar container socket
-		if IsGenevaLogsIntegrationEnabled {
-			mdsdfluentSocket = "/var/run/mdsd-PrometheusSidecar/default_fluent.socket"
-		}
-		if MdsdInputPluginRecordsMsgpUnixSocketClient != nil {
-			MdsdInputPluginRecordsMsgpUnixSocketClient.Close()
-			MdsdInputPluginRecordsMsgpUnixSocketClient = nil
-		}
-		conn, err := net.DialTimeout("unix",
-			mdsdfluentSocket, 10*time.Second)
-		if err != nil {
-			Log("Error::mdsd::Unable to open MDSD msgp socket connection for input plugin records %s", err.Error())
-		} else {
-			Log("Successfully created MDSD msgp socket connection for input plugin records %s", mdsdfluentSocket)
-			MdsdInputPluginRecordsMsgpUnixSocketClient = conn
-		}
 	}
+	return paths.Resolve(mdsdfluentSocket)
+}
+
+// mdsdSocketClient to write msgp messages
+func CreateMDSDClient(client *net.Conn, dataType DataType, containerType string) {
+	mdsdfluentSocket := getMdsdSocketPath(dataType, containerType)
+	// skip the connect while mdsd is known to be down, callers retry the flush through fluent-bit
+	cb := getMdsdCircuitBreaker(dataType)
+	if !cb.Allow() {
+		return
+	}
+	if *client != nil {
+		(*client).Close()
+		*client = nil
+	}
+	// with priority lanes the lane owns the mdsd connection and the data type client writes through it
+	if lane := getPriorityLane(dataType); lane != nil {
+		*client = &laneConn{lane: lane}
+		return
+	}
+	/*conn, err := fluent.New(fluent.Config{FluentNetwork:"unix",
+	FluentSocketPath:"/var/run/mdsd-ci/default_fluent.socket",
+	WriteTimeout: 5 * time.Second,
+	RequestAck: true}) */
+	conn, err := dialMdsdSocket(cb, mdsdfluentSocket)
+	if err != nil {
+		Log("Error::mdsd::Unable to open MDSD msgp socket connection for %s %s", dataType, err.Error())
+		//log.Fatalf("Unable to open MDSD msgp socket connection %s", err.Error())
+	} else {
+		Log("Successfully created MDSD msgp socket connection for %s: %s", dataType, mdsdfluentSocket)
+		*client = conn
+	}
+}
+
+const mdsdDialTimeout = 10 * time.Second
+
+// dialMdsdSocket connects to the mdsd fluent socket and records the result on the circuit breaker of the data type
+func dialMdsdSocket(cb *CircuitBreaker, mdsdfluentSocket string) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", mdsdfluentSocket, mdsdDialTimeout)
+	recordConnectionResult(cb, err)
+	return conn, err
 }
 
 func ReadFileContents(fullPathToFileName string) (string, error) {
-	return ReadFileContentsImpl(fullPathToFileName, ioutil.ReadFile)
+	return ReadFileContentsImpl(paths.Resolve(fullPathToFileName), ioutil.ReadFile)
 }
 
 func ReadFileContentsImpl(fullPathToFileName string, readfilefunc func(string) ([]byte, error)) (string, error) {
@@ -2,7 +2,11 @@ package main
 
 import (
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"Docker-Provider/source/plugins/go/src/paths"
 )
 
 func Test_isValidUrl(t *testing.T) {
@@ -77,3 +81,30 @@ func Test_ReadFileContents(t *testing.T) {
 		})
 	}
 }
+
+func TestRelocatedPathsAndLocalMode(t *testing.T) {
+	original := paths.Current()
+	defer paths.Configure(original)
+	root := t.TempDir()
+	settings, _ := paths.Load(func(name string) string {
+		return map[string]string{paths.RootDirEnv: root, paths.LocalModeEnv: "true", paths.APIServerURLEnv: "http://127.0.0.1:18001"}[name]
+	})
+	paths.Configure(settings)
+
+	if socket := getMdsdSocketPath(ContainerLogV2, ""); socket != filepath.Join(root, "var/run/mdsd-ci/default_fluent.socket") {
+		t.Errorf("expected the mdsd socket under the root dir, got %s", socket)
+	}
+	confPath := filepath.Join(root, "etc/opt/microsoft/docker-cimprov/out_oms.conf")
+	if err := os.MkdirAll(filepath.Dir(confPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(confPath, []byte("amalogsproxy_secret_path=/etc/ama-logs-secret/PROXY\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if conf, err := ReadConfiguration(DaemonSetContainerLogPluginConfFilePath); err != nil || conf["amalogsproxy_secret_path"] != "/etc/ama-logs-secret/PROXY" {
+		t.Errorf("expected the conf file under the root dir, got %v %v", conf, err)
+	}
+	if config, err := kubeRestConfig(); err != nil || config.Host != "http://127.0.0.1:18001" {
+		t.Errorf("expected the API server of the local mode, got %+v %v", config, err)
+	}
+}
@@ -37,6 +37,11 @@ func CreateWindowsNamedPipeClient(namedPipe string, namedPipeConnection *net.Con
 
 func EnsureGenevaOr3PNamedPipeExists(namedPipeConnection *net.Conn, datatype string, errorCount *float64, isGenevaLogsIntegrationEnabled bool, refreshTracker *time.Time) bool {
 	if *namedPipeConnection == nil {
+		// skip the connect while ama is known to be down, callers retry the flush through fluent-bit
+		cb := getAMACircuitBreaker(datatype)
+		if !cb.Allow() {
+			return false
+		}
 		Log("Error::AMA:: The connection to named pipe was nil. re-connecting...")
 		var err error
 		if isGenevaLogsIntegrationEnabled {
@@ -44,6 +49,7 @@ func EnsureGenevaOr3PNamedPipeExists(namedPipeConnection *net.Conn, datatype str
 		} else {
 			err = CreateWindowsNamedPipeClient(GetOutputNamedPipe(datatype, refreshTracker), namedPipeConnection)
 		}
+		recordConnectionResult(cb, err)
 
 		if err != nil || namedPipeConnection == nil {
 			Log("Error::AMA::Cannot create the named pipe connection for %s.", datatype)
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pod annotation with an RFC3339 expiry timestamp that turns on verbose collection for the pod until then e.g.
+// azmon.container.insights/verbose-collection-until: "2024-05-01T18:00:00Z"
+const VerboseCollectionAnnotation = "azmon.container.insights/verbose-collection-until"
+
+// env variable to enable verbose collection overrides. excluded namespaces need to be tailed for the override to apply to them
+const VerboseCollectionOverrideEnabledEnv = "AZMON_VERBOSE_COLLECTION_OVERRIDE_ENABLED"
+
+const VerboseCollectionEventCategory = "container.azm.ms/verbosecollection"
+
+// overrides are time-boxed, expiries further out than this are capped
+const verboseCollectionMaxDuration = 24 * time.Hour
+
+const verboseCollectionRefreshIntervalSeconds = 60
+
+// verboseCollectionOverride is an active override, Value is the annotation value the expiry was derived from
+type verboseCollectionOverride struct {
+	Value  string
+	Expiry time.Time
+}
+
+var (
+	// VerboseCollectionOverrideEnabled enables the verbose collection pod annotation
+	VerboseCollectionOverrideEnabled bool
+	// VerboseCollectionOverrides caches namespace/podname to the active override for the pods on this node
+	VerboseCollectionOverrides = make(map[string]verboseCollectionOverride)
+	// VerboseCollectionOverridesMutex read and write mutex access to VerboseCollectionOverrides
+	VerboseCollectionOverridesMutex = &sync.RWMutex{}
+	// VerboseCollectionEvent hash of override activations sent as KubeMonAgentEvents
+	VerboseCollectionEvent = make(map[string]KubeMonAgentEventTags)
+	// VerboseCollectionRefreshTicker refreshes the overrides from the pods on this node
+	VerboseCollectionRefreshTicker *time.Ticker
+)
+
+func populateVerboseCollectionSettings(config *PluginConfig) {
+	VerboseCollectionOverrideEnabled = config.VerboseCollectionOverrideEnabled
+	Log("VerboseCollectionOverrideEnabled: %v", VerboseCollectionOverrideEnabled)
+}
+
+// parseVerboseCollectionExpiry returns the expiry of an annotation value. Invalid and expired values are ignored
+func parseVerboseCollectionExpiry(value string, now time.Time) (time.Time, bool) {
+	expiry, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+	if err != nil || !now.Before(expiry) {
+		return time.Time{}, false
+	}
+	if maxExpiry := now.Add(verboseCollectionMaxDuration); expiry.After(maxExpiry) {
+		expiry = maxExpiry
+	}
+	return expiry, true
+}
+
+// buildVerboseCollectionOverrides returns the active overrides of the pods. The expiry of an unchanged annotation is kept
+// from the previous refresh, so that the 24 hour cap is counted from the first time the annotation was seen
+func buildVerboseCollectionOverrides(pods []corev1.Pod, previous map[string]verboseCollectionOverride, now time.Time) map[string]verboseCollectionOverride {
+	overrides := make(map[string]verboseCollectionOverride)
+	for _, pod := range pods {
+		value, ok := pod.Annotations[VerboseCollectionAnnotation]
+		if !ok {
+			continue
+		}
+		key := pod.Namespace + "/" + pod.Name
+		if override, ok := previous[key]; ok && override.Value == value {
+			if now.Before(override.Expiry) {
+				overrides[key] = override
+			} else {
+				Log("Info::verboseCollection::Verbose collection override for pod %s expired at %s", key, override.Expiry.Format(time.RFC3339))
+			}
+			continue
+		}
+		if expiry, ok := parseVerboseCollectionExpiry(value, now); ok {
+			overrides[key] = verboseCollectionOverride{Value: value, Expiry: expiry}
+		}
+	}
+	return overrides
+}
+
+// setVerboseCollectionOverrides swaps the cached overrides and records a KubeMonAgentEvent for each new activation
+func setVerboseCollectionOverrides(overrides map[string]verboseCollectionOverride, now time.Time) {
+	VerboseCollectionOverridesMutex.Lock()
+	previous := VerboseCollectionOverrides
+	VerboseCollectionOverrides = overrides
+	VerboseCollectionOverridesMutex.Unlock()
+
+	for key, override := range overrides {
+		if previousOverride, ok := previous[key]; ok && previousOverride.Value == override.Value {
+			continue
+		}
+		message := fmt.Sprintf("Verbose collection override activated for pod %s until %s", key, override.Expiry.Format(time.RFC3339))
+		Log("Info::verboseCollection::%s", message)
+		EventHashUpdateMutex.Lock()
+		VerboseCollectionEvent[message] = KubeMonAgentEventTags{
+			PodName:         key,
+			FirstOccurrence: now.Format(time.RFC3339),
+			LastOccurrence:  override.Expiry.Format(time.RFC3339),
+			Count:           1,
+		}
+		EventHashUpdateMutex.Unlock()
+	}
+}
+
+// getVerboseCollectionOverrides returns the current overrides
+func getVerboseCollectionOverrides() map[string]verboseCollectionOverride {
+	VerboseCollectionOverridesMutex.RLock()
+	defer VerboseCollectionOverridesMutex.RUnlock()
+	return VerboseCollectionOverrides
+}
+
+// hasVerboseCollectionOverride returns true if the pod has an unexpired override
+func hasVerboseCollectionOverride(namespace string, podName string) bool {
+	if !VerboseCollectionOverrideEnabled {
+		return false
+	}
+	VerboseCollectionOverridesMutex.RLock()
+	override, ok := VerboseCollectionOverrides[namespace+"/"+podName]
+	VerboseCollectionOverridesMutex.RUnlock()
+	return ok && time.Now().Before(override.Expiry)
+}
+
+func updateVerboseCollectionOverrides() {
+	for running := true; running; running = waitForTick(VerboseCollectionRefreshTicker) {
+		listOptions := metav1.ListOptions{}
+		listOptions.FieldSelector = fmt.Sprintf("spec.nodeName=%s", Computer)
+		pods, err := ClientSet.CoreV1().Pods("").List(context.TODO(), listOptions)
+		if err != nil {
+			Log("Error::verboseCollection::Error getting pods %s. Keeping the current overrides", err.Error())
+			continue
+		}
+		now := time.Now()
+		setVerboseCollectionOverrides(buildVerboseCollectionOverrides(pods.Items, getVerboseCollectionOverrides(), now), now)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newVerboseCollectionPod(namespace string, name string, annotation string) corev1.Pod {
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	if annotation != "" {
+		pod.Annotations = map[string]string{VerboseCollectionAnnotation: annotation}
+	}
+	return pod
+}
+
+func resetVerboseCollectionOverrides(t *testing.T) {
+	origEnabled := VerboseCollectionOverrideEnabled
+	t.Cleanup(func() {
+		VerboseCollectionOverrideEnabled = origEnabled
+		VerboseCollectionOverrides = make(map[string]verboseCollectionOverride)
+		for k := range VerboseCollectionEvent {
+			delete(VerboseCollectionEvent, k)
+		}
+	})
+}
+
+func TestParseVerboseCollectionExpiry(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Time
+		ok       bool
+	}{
+		{"2024-05-01T18:00:00Z", time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC), true},
+		{" 2024-05-01T18:00:00Z ", time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC), true},
+		{"2024-05-03T00:00:00Z", now.Add(verboseCollectionMaxDuration), true},
+		{"2024-05-01T11:00:00Z", time.Time{}, false},
+		{"2024-05-01T12:00:00Z", time.Time{}, false},
+		{"tomorrow", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		expiry, ok := parseVerboseCollectionExpiry(tt.value, now)
+		if ok != tt.ok || !expiry.Equal(tt.expected) {
+			t.Errorf("parseVerboseCollectionExpiry(%q) = %s, %v, want %s, %v", tt.value, expiry, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
+func TestBuildVerboseCollectionOverrides(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	pods := []corev1.Pod{
+		newVerboseCollectionPod("kube-system", "coredns", "2024-05-01T18:00:00Z"),
+		newVerboseCollectionPod("default", "expired", "2024-05-01T11:00:00Z"),
+		newVerboseCollectionPod("default", "invalid", "soon"),
+		newVerboseCollectionPod("default", "unannotated", ""),
+	}
+	overrides := buildVerboseCollectionOverrides(pods, nil, now)
+	if len(overrides) != 1 {
+		t.Fatalf("expected one override, got %v", overrides)
+	}
+	if override := overrides["kube-system/coredns"]; !override.Expiry.Equal(time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected override %v", override)
+	}
+}
+
+func TestBuildVerboseCollectionOverridesKeepsTheCap(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	pods := []corev1.Pod{newVerboseCollectionPod("default", "app", "2030-01-01T00:00:00Z")}
+
+	overrides := buildVerboseCollectionOverrides(pods, nil, now)
+	capped := now.Add(verboseCollectionMaxDuration)
+	if !overrides["default/app"].Expiry.Equal(capped) {
+		t.Fatalf("expected the expiry to be capped at %s, got %s", capped, overrides["default/app"].Expiry)
+	}
+
+	// the cap doesn't move forward on later refreshes of the same annotation
+	overrides = buildVerboseCollectionOverrides(pods, overrides, now.Add(time.Hour))
+	if !overrides["default/app"].Expiry.Equal(capped) {
+		t.Errorf("expected the capped expiry to stay at %s, got %s", capped, overrides["default/app"].Expiry)
+	}
+	if overrides = buildVerboseCollectionOverrides(pods, overrides, capped); len(overrides) != 0 {
+		t.Errorf("expected the override to expire at the cap, got %v", overrides)
+	}
+
+	// a new annotation value starts a new override
+	pods[0].Annotations[VerboseCollectionAnnotation] = "2024-05-02T14:00:00Z"
+	if overrides = buildVerboseCollectionOverrides(pods, overrides, capped); len(overrides) != 1 {
+		t.Errorf("expected a changed annotation to start a new override, got %v", overrides)
+	}
+}
+
+func TestSetVerboseCollectionOverridesRecordsActivations(t *testing.T) {
+	resetVerboseCollectionOverrides(t)
+	now := time.Now()
+	pods := []corev1.Pod{newVerboseCollectionPod("default", "app", now.Add(time.Hour).Format(time.RFC3339))}
+
+	setVerboseCollectionOverrides(buildVerboseCollectionOverrides(pods, getVerboseCollectionOverrides(), now), now)
+	if len(VerboseCollectionEvent) != 1 {
+		t.Fatalf("expected one activation event, got %v", VerboseCollectionEvent)
+	}
+	for k := range VerboseCollectionEvent {
+		delete(VerboseCollectionEvent, k)
+	}
+
+	setVerboseCollectionOverrides(buildVerboseCollectionOverrides(pods, getVerboseCollectionOverrides(), now.Add(time.Minute)), now.Add(time.Minute))
+	if len(VerboseCollectionEvent) != 0 {
+		t.Errorf("expected no event for an unchanged override, got %v", VerboseCollectionEvent)
+	}
+}
+
+func TestHasVerboseCollectionOverride(t *testing.T) {
+	resetVerboseCollectionOverrides(t)
+	now := time.Now()
+	setVerboseCollectionOverrides(map[string]verboseCollectionOverride{
+		"default/active":  {Value: "active", Expiry: now.Add(time.Hour)},
+		"default/expired": {Value: "expired", Expiry: now.Add(-time.Minute)},
+	}, now)
+
+	VerboseCollectionOverrideEnabled = false
+	if hasVerboseCollectionOverride("default", "active") {
+		t.Errorf("expected no override while the setting is disabled")
+	}
+	VerboseCollectionOverrideEnabled = true
+	if !hasVerboseCollectionOverride("default", "active") {
+		t.Errorf("expected an override for the annotated pod")
+	}
+	if hasVerboseCollectionOverride("default", "expired") {
+		t.Errorf("expected no override once the expiry passed")
+	}
+	if hasVerboseCollectionOverride("default", "other") {
+		t.Errorf("expected no override for a pod without the annotation")
+	}
+}